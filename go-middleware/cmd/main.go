@@ -1,21 +1,41 @@
 package main
 
 import (
+    "context"
     "database/sql"
+    "errors"
     // "encoding/json" 
+    "fmt"
     "log"
+    "log/slog"
     "net/http"
     "os"
+    "os/signal"
+    "strconv"
+    "sync"
+    "syscall"
+    "time"
     
     // "github.com/golang-jwt/jwt/v5"
     "github.com/joho/godotenv"
     _ "github.com/lib/pq"
 
+    "urpaint/internal/collab"
+    "urpaint/internal/database"
     "urpaint/internal/handlers"
+    "urpaint/internal/jobs"
+    "urpaint/internal/mailer"
+    "urpaint/internal/metrics"
     "urpaint/internal/middleware"
+    "urpaint/internal/storage"
+    "urpaint/internal/uploads"
 )
 
 func main() {
+	// JSON logs; the standard logger goes through the same handler
+	logger := slog.New(middleware.LogHandler(slog.NewJSONHandler(os.Stdout, nil)))
+	slog.SetDefault(logger)
+
 	if err := godotenv.Load(); err != nil {
 		log.Fatal("Error loading .env file")
 	}
@@ -26,9 +46,6 @@ func main() {
 	dbHost := os.Getenv("DB_HOST")
 	dbPort := os.Getenv("DB_PORT")
 	jwtSecret := os.Getenv("JWT_SECRET")
-	if jwtSecret == "" {
-		log.Fatal("JWT_SECRET not set")
-	}
 
 	// PostGresQL
 	connStr := "postgres://" + dbUser + ":" + dbPassword + "@" + dbHost + ":" + dbPort + "/" + dbName + "?sslmode=disable"
@@ -40,86 +57,459 @@ func main() {
 		log.Fatal("DB ping error:", err)
 	}
 	defer db.Close()
-	log.Println("Connected to PostgreSQL")
+	metrics.RegisterDB(db, dbName)
+	slog.Info("connected to PostgreSQL", "host", dbHost, "database", dbName)
+
+	// Schema: `main migrate ...` manages it by hand, otherwise migrate on boot
+	if len(os.Args) > 1 && os.Args[1] == "migrate" {
+		if err := runMigrate(db, os.Args[2:]); err != nil {
+			log.Fatal("Migration error: ", err)
+		}
+		return
+	}
+	if os.Getenv("DB_AUTO_MIGRATE") != "false" {
+		applied, err := database.MigrateUp(context.Background(), db)
+		if err != nil {
+			log.Fatal("Migration error: ", err)
+		}
+		if applied > 0 {
+			slog.Info("applied migrations", "count", applied)
+		}
+	}
 
-	// Cloudinary
-	cloudinaryURL := os.Getenv("CLOUDINARY_URL")
-	if cloudinaryURL == "" {
-		log.Fatal("CLOUDINARY_URL not set")
+	if jwtSecret == "" {
+		log.Fatal("JWT_SECRET not set")
 	}
+
+	// Image storage
+	store, err := newStorage()
+	if err != nil {
+		log.Fatal("Storage init error:", err)
+	}
+	local, _ := store.(*storage.Local)
+	storageBackend := "cloudinary"
+	if local != nil {
+		storageBackend = "local"
+	}
+	store = metrics.Storage(store, storageBackend)
+
+	// Storage quotas, overridden per user by users.storage_quota
+	quotas := &handlers.Quotas{
+		DB:           db,
+		DefaultBytes: int64(intEnv("STORAGE_QUOTA_BYTES", 1<<30)),
+	}
+
 	avatarHandler := &handlers.AvatarHandler{
-		DB:            db,
-		CloudinaryURL: cloudinaryURL,
+		DB:      db,
+		Storage: store,
+		Uploads: uploadLimits("AVATAR", uploads.Limits{MaxBytes: 5 << 20, MaxWidth: 4096, MaxHeight: 4096, MaxPixels: 16_000_000}),
+		Quotas:  quotas,
+	}
+
+	// Background work runs until the server has drained on shutdown
+	workCtx, stopWork := context.WithCancel(context.Background())
+	var workers sync.WaitGroup
+	background := func(run func(ctx context.Context)) {
+		workers.Add(1)
+		go func() {
+			defer workers.Done()
+			run(workCtx)
+		}()
+	}
+	// Closed when shutdown starts
+	stopping := make(chan struct{})
+
+	// Background jobs
+	jobQueue := &jobs.Queue{
+		DB:          db,
+		Workers:     intEnv("JOB_WORKERS", 4),
+		PerUser:     intEnv("JOB_PER_USER", 2),
+		MaxQueued:   intEnv("JOB_MAX_QUEUED", 20),
+		MaxAttempts: intEnv("JOB_MAX_ATTEMPTS", 3),
 	}
 
 	// Gallery
 	galleryHandler := &handlers.GalleryHandler{
-		DB:            db,
-		CloudinaryURL: cloudinaryURL,
+		DB:             db,
+		Storage:        store,
+		ShareBaseURL:   os.Getenv("SHARE_BASE_URL"),
+		RevisionLimit:  intEnv("REVISION_LIMIT", 20),
+		TrashRetention: durationEnv("TRASH_RETENTION", 30*24*time.Hour),
+		Queue:          jobQueue,
+		Uploads:        uploadLimits("UPLOAD", uploads.DefaultLimits),
+		Quotas:         quotas,
 	}
+	background(func(ctx context.Context) {
+		galleryHandler.RunTrashSweeper(ctx, durationEnv("TRASH_SWEEP_INTERVAL", time.Hour))
+	})
+	background(func(ctx context.Context) {
+		galleryHandler.RunRenditionBackfill(ctx, durationEnv("RENDITION_BACKFILL_INTERVAL", time.Hour))
+	})
 
 	// Handlers
 	authHandler := &handlers.AuthHandler{
-		DB:        db,
-		JWTSecret: []byte(jwtSecret),
+		DB:         db,
+		JWTSecret:  []byte(jwtSecret),
+		AccessTTL:  durationEnv("ACCESS_TOKEN_TTL", 15*time.Minute),
+		RefreshTTL: durationEnv("REFRESH_TOKEN_TTL", 30*24*time.Hour),
+		Mailer:     newMailer(),
+		AppURL:     os.Getenv("APP_URL"),
 	}
 
-	profileHandler := &handlers.ProfileHandler{
+	albumHandler := &handlers.AlbumHandler{
 		DB: db,
 	}
 
+	profileHandler := &handlers.ProfileHandler{
+		DB:     db,
+		Quotas: quotas,
+	}
+
+	jobHandler := &handlers.JobHandler{
+		Queue: jobQueue,
+		Done:  stopping,
+	}
+
+	convertHandler := &handlers.ConvertHandler{
+		MaxBytes:      int64(intEnv("CONVERT_MAX_BYTES", 5<<20)),
+		AsyncMaxBytes: int64(intEnv("CONVERT_ASYNC_MAX_BYTES", 25<<20)),
+		MaxPixels:     intEnv("CONVERT_MAX_PIXELS", 16_000_000),
+		DB:            db,
+		Storage:       store,
+		Queue:         jobQueue,
+		Quotas:        quotas,
+		// Background results are downloaded, not kept like drawings
+		OutputRetention: durationEnv("CONVERT_OUTPUT_RETENTION", 7*24*time.Hour),
+	}
+	background(func(ctx context.Context) {
+		convertHandler.RunOutputSweeper(ctx, durationEnv("CONVERT_SWEEP_INTERVAL", time.Hour))
+	})
+	jobQueue.Register(handlers.ConvertJob, convertHandler)
+	jobQueue.Register(handlers.RenditionsJob, galleryHandler.RenditionTask())
+	background(jobQueue.Run)
+
+	// Live collaborative editing
+	collabHub := &collab.Hub{
+		Store: galleryHandler,
+		Authenticate: func(ctx context.Context, token string) (int, error) {
+			claims, err := middleware.Authenticate(ctx, []byte(jwtSecret), authHandler, token)
+			if err != nil {
+				return 0, err
+			}
+			id, ok := claims["id"].(float64)
+			if !ok {
+				return 0, middleware.ErrInvalidToken
+			}
+			return int(id), nil
+		},
+		AllowedOrigins: []string{allowedOrigin},
+		SaveInterval:   durationEnv("COLLAB_SAVE_INTERVAL", 30*time.Second),
+		FlushTimeout:   durationEnv("COLLAB_FLUSH_TIMEOUT", 15*time.Second),
+	}
+
+	// Routes name their method, so the mux answers 405 for the rest
 	mux := http.NewServeMux()
 
+	// Probes, no auth
+	healthHandler := &handlers.HealthHandler{DB: db, Storage: store, Done: stopping}
+	mux.HandleFunc("GET /healthz", healthHandler.Live)
+	mux.HandleFunc("GET /readyz", healthHandler.Ready)
+
+	// Serve images ourselves when they are stored on disk
+	if local != nil {
+		mux.Handle(local.Prefix(), local)
+	}
+
 	// Login and Signup
-	mux.HandleFunc("/signup", authHandler.Signup)
-	mux.HandleFunc("/login", authHandler.Login)
+	mux.HandleFunc("POST /signup", authHandler.Signup)
+	mux.HandleFunc("POST /login", authHandler.Login)
+
+	// Sessions
+	mux.HandleFunc("POST /auth/refresh", authHandler.Refresh)
+	mux.Handle("POST /auth/logout", middleware.JWTAuth([]byte(jwtSecret), authHandler, http.HandlerFunc(authHandler.Logout)))
+	mux.Handle("POST /auth/logout-all", middleware.JWTAuth([]byte(jwtSecret), authHandler, http.HandlerFunc(authHandler.LogoutAll)))
+
+	// Email verification and password reset
+	mux.Handle("POST /auth/verify-email/request", middleware.JWTAuth([]byte(jwtSecret), authHandler, http.HandlerFunc(authHandler.RequestEmailVerification)))
+	mux.HandleFunc("POST /auth/verify-email", authHandler.VerifyEmail)
+	mux.HandleFunc("POST /auth/password/forgot", authHandler.ForgotPassword)
+	mux.HandleFunc("POST /auth/password/reset", authHandler.ResetPassword)
 
 	// Return and Update Profile Information
-	mux.Handle("/profile", middleware.JWTAuth([]byte(jwtSecret), http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-		switch r.Method {
-		case http.MethodGet:
-			profileHandler.GetProfile(w, r)
-		case http.MethodPatch:
-			profileHandler.UpdateProfile(w, r)
-		default:
-			http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
-		}
-	})))
+	mux.Handle("GET /profile", middleware.JWTAuth([]byte(jwtSecret), authHandler, http.HandlerFunc(profileHandler.GetProfile)))
+	mux.Handle("PATCH /profile", middleware.JWTAuth([]byte(jwtSecret), authHandler, http.HandlerFunc(profileHandler.UpdateProfile)))
 
 	// Upload Profile Avatar 
-	mux.Handle("/profile/avatar", middleware.JWTAuth([]byte(jwtSecret), http.HandlerFunc(avatarHandler.UploadAvatar)))
+	mux.Handle("POST /profile/avatar", middleware.JWTAuth([]byte(jwtSecret), authHandler, http.HandlerFunc(avatarHandler.UploadAvatar)))
+
+	// Storage used against the quota
+	mux.Handle("GET /profile/usage", middleware.JWTAuth([]byte(jwtSecret), authHandler, http.HandlerFunc(profileHandler.GetUsage)))
 
-	// Upload Drawing
-	mux.Handle("/gallery/upload", middleware.JWTAuth([]byte(jwtSecret), http.HandlerFunc(galleryHandler.UploadDrawing)))
+	// Photo to coloring page
+	mux.Handle("POST /convert", middleware.JWTAuth([]byte(jwtSecret), authHandler, http.HandlerFunc(convertHandler.Convert)))
 
-	// Get Drawing
-	mux.Handle("/gallery", middleware.JWTAuth([]byte(jwtSecret), http.HandlerFunc(galleryHandler.GetGallery)))
+	// Background jobs
+	mux.Handle("POST /jobs/convert", middleware.JWTAuth([]byte(jwtSecret), authHandler, http.HandlerFunc(convertHandler.SubmitConvert)))
+	mux.Handle("GET /jobs", middleware.JWTAuth([]byte(jwtSecret), authHandler, http.HandlerFunc(jobHandler.ListJobs)))
+	mux.Handle("GET /jobs/{id}", middleware.JWTAuth([]byte(jwtSecret), authHandler, http.HandlerFunc(jobHandler.GetJob)))
+	mux.Handle("GET /jobs/{id}/events", middleware.JWTAuth([]byte(jwtSecret), authHandler, http.HandlerFunc(jobHandler.JobEvents)))
+	mux.Handle("DELETE /jobs/{id}", middleware.JWTAuth([]byte(jwtSecret), authHandler, http.HandlerFunc(jobHandler.CancelJob)))
 
-	// Rename Drawing
-	mux.Handle("/gallery/rename", middleware.JWTAuth([]byte(jwtSecret), http.HandlerFunc(galleryHandler.RenameDrawing)))
+	// Drawings
+	mux.Handle("GET /drawings", middleware.JWTAuth([]byte(jwtSecret), authHandler, http.HandlerFunc(galleryHandler.GetGallery)))
+	mux.Handle("POST /drawings", middleware.JWTAuth([]byte(jwtSecret), authHandler, http.HandlerFunc(galleryHandler.UploadDrawing)))
+	mux.Handle("PUT /drawings/order", middleware.JWTAuth([]byte(jwtSecret), authHandler, http.HandlerFunc(galleryHandler.ReorderGallery)))
+	mux.Handle("GET /drawings/{id}", middleware.JWTAuth([]byte(jwtSecret), authHandler, http.HandlerFunc(galleryHandler.GetDrawing)))
+	mux.Handle("PATCH /drawings/{id}", middleware.JWTAuth([]byte(jwtSecret), authHandler, http.HandlerFunc(galleryHandler.RenameDrawing)))
+	mux.Handle("PUT /drawings/{id}", middleware.JWTAuth([]byte(jwtSecret), authHandler, http.HandlerFunc(galleryHandler.UpdateDrawing)))
+	mux.Handle("DELETE /drawings/{id}", middleware.JWTAuth([]byte(jwtSecret), authHandler, http.HandlerFunc(galleryHandler.DeleteDrawing)))
 
-	// Delete Drawing
-	mux.Handle("/gallery/delete", middleware.JWTAuth([]byte(jwtSecret), http.HandlerFunc(galleryHandler.DeleteDrawing)))
+	// Deprecated: the query-string routes the drawings API replaced
+	mux.Handle("POST /gallery/upload", middleware.Deprecated("/drawings", middleware.JWTAuth([]byte(jwtSecret), authHandler, http.HandlerFunc(galleryHandler.UploadDrawing))))
+	mux.Handle("GET /gallery", middleware.Deprecated("/drawings", middleware.JWTAuth([]byte(jwtSecret), authHandler, http.HandlerFunc(galleryHandler.GetGallery))))
+	mux.Handle("PATCH /gallery/rename", middleware.Deprecated("/drawings/{id}", middleware.JWTAuth([]byte(jwtSecret), authHandler, http.HandlerFunc(galleryHandler.RenameDrawing))))
+	mux.Handle("DELETE /gallery/delete", middleware.Deprecated("/drawings/{id}", middleware.JWTAuth([]byte(jwtSecret), authHandler, http.HandlerFunc(galleryHandler.DeleteDrawing))))
+	mux.Handle("PATCH /gallery/reorder", middleware.Deprecated("/drawings/order", middleware.JWTAuth([]byte(jwtSecret), authHandler, http.HandlerFunc(galleryHandler.ReorderGallery))))
+	mux.Handle("PUT /gallery/update", middleware.Deprecated("/drawings/{id}", middleware.JWTAuth([]byte(jwtSecret), authHandler, http.HandlerFunc(galleryHandler.UpdateDrawing))))
+	mux.Handle("POST /gallery/update", middleware.Deprecated("/drawings/{id}", middleware.JWTAuth([]byte(jwtSecret), authHandler, http.HandlerFunc(galleryHandler.UpdateDrawing))))
 
-	// Rearrange Drawing
-	mux.Handle("/gallery/reorder", middleware.JWTAuth([]byte(jwtSecret), http.HandlerFunc(galleryHandler.ReorderGallery)))
+	// Download the gallery, or one album of it, as a ZIP
+	mux.Handle("GET /gallery/export", middleware.JWTAuth([]byte(jwtSecret), authHandler, http.HandlerFunc(galleryHandler.ExportGallery)))
 
-	// Edit Drawing
-	mux.Handle("/gallery/update", middleware.JWTAuth([]byte(jwtSecret), http.HandlerFunc(galleryHandler.UpdateDrawing)))
+	// Trash
+	mux.Handle("GET /gallery/trash", middleware.JWTAuth([]byte(jwtSecret), authHandler, http.HandlerFunc(galleryHandler.ListTrash)))
+	mux.Handle("DELETE /gallery/trash", middleware.JWTAuth([]byte(jwtSecret), authHandler, http.HandlerFunc(galleryHandler.PurgeTrash)))
+	mux.Handle("POST /gallery/trash/restore", middleware.JWTAuth([]byte(jwtSecret), authHandler, http.HandlerFunc(galleryHandler.RestoreFromTrash)))
 
-	handler := withCORS(mux)
+	// Tags and Search
+	mux.Handle("POST /gallery/tags", middleware.JWTAuth([]byte(jwtSecret), authHandler, http.HandlerFunc(galleryHandler.AddTags)))
+	mux.Handle("DELETE /gallery/tags", middleware.JWTAuth([]byte(jwtSecret), authHandler, http.HandlerFunc(galleryHandler.RemoveTag)))
+	mux.Handle("GET /tags", middleware.JWTAuth([]byte(jwtSecret), authHandler, http.HandlerFunc(galleryHandler.ListTags)))
+	mux.Handle("GET /gallery/search", middleware.JWTAuth([]byte(jwtSecret), authHandler, http.HandlerFunc(galleryHandler.SearchGallery)))
 
-	log.Println("Server running on port 8080")
-	http.ListenAndServe(":8080", handler)
+	// Albums
+	mux.Handle("GET /albums", middleware.JWTAuth([]byte(jwtSecret), authHandler, http.HandlerFunc(albumHandler.ListAlbums)))
+	mux.Handle("POST /albums", middleware.JWTAuth([]byte(jwtSecret), authHandler, http.HandlerFunc(albumHandler.CreateAlbum)))
+	mux.Handle("PATCH /albums", middleware.JWTAuth([]byte(jwtSecret), authHandler, http.HandlerFunc(albumHandler.RenameAlbum)))
+	mux.Handle("DELETE /albums", middleware.JWTAuth([]byte(jwtSecret), authHandler, http.HandlerFunc(albumHandler.DeleteAlbum)))
+	mux.Handle("POST /albums/items", middleware.JWTAuth([]byte(jwtSecret), authHandler, http.HandlerFunc(albumHandler.AddAlbumItem)))
+	mux.Handle("DELETE /albums/items", middleware.JWTAuth([]byte(jwtSecret), authHandler, http.HandlerFunc(albumHandler.RemoveAlbumItem)))
+	mux.Handle("PATCH /albums/reorder", middleware.JWTAuth([]byte(jwtSecret), authHandler, http.HandlerFunc(albumHandler.ReorderAlbum)))
+
+	// Drawing History
+	mux.Handle("GET /gallery/revisions", middleware.JWTAuth([]byte(jwtSecret), authHandler, http.HandlerFunc(galleryHandler.GetRevisions)))
+	mux.Handle("POST /gallery/revisions/restore", middleware.JWTAuth([]byte(jwtSecret), authHandler, http.HandlerFunc(galleryHandler.RestoreRevision)))
+
+	// Share Drawing
+	mux.Handle("GET /gallery/share", middleware.JWTAuth([]byte(jwtSecret), authHandler, http.HandlerFunc(galleryHandler.ListShares)))
+	mux.Handle("POST /gallery/share", middleware.JWTAuth([]byte(jwtSecret), authHandler, http.HandlerFunc(galleryHandler.CreateShare)))
+	mux.Handle("DELETE /gallery/share", middleware.JWTAuth([]byte(jwtSecret), authHandler, http.HandlerFunc(galleryHandler.RevokeShare)))
+
+	// Stroke document of a drawing
+	mux.Handle("GET /gallery/document", middleware.JWTAuth([]byte(jwtSecret), authHandler, http.HandlerFunc(galleryHandler.GetDocument)))
+	mux.Handle("PUT /gallery/document", middleware.JWTAuth([]byte(jwtSecret), authHandler, http.HandlerFunc(galleryHandler.PutDocument)))
+
+	// Collaborators and the live editing socket. The socket authenticates
+	// itself since browsers can't send headers on the handshake.
+	mux.Handle("GET /gallery/collaborators", middleware.JWTAuth([]byte(jwtSecret), authHandler, http.HandlerFunc(galleryHandler.ListCollaborators)))
+	mux.Handle("POST /gallery/collaborators", middleware.JWTAuth([]byte(jwtSecret), authHandler, http.HandlerFunc(galleryHandler.AddCollaborator)))
+	mux.Handle("DELETE /gallery/collaborators", middleware.JWTAuth([]byte(jwtSecret), authHandler, http.HandlerFunc(galleryHandler.RemoveCollaborator)))
+	mux.HandleFunc("GET /collab", collabHub.ServeWS)
+
+	// Public shared drawing, no auth
+	mux.HandleFunc("GET /s/{slug}", galleryHandler.ViewShare)
+
+	// Prometheus metrics, on their own port when METRICS_ADDR is set so
+	// they stay off the public listener
+	var adminServer *http.Server
+	if metricsAddr := os.Getenv("METRICS_ADDR"); metricsAddr != "" {
+		adminMux := http.NewServeMux()
+		adminMux.Handle("GET /metrics", metrics.Handler())
+		adminServer = &http.Server{Addr: metricsAddr, Handler: adminMux, ReadHeaderTimeout: 10 * time.Second}
+		go func() {
+			slog.Info("metrics listening", "addr", metricsAddr)
+			if err := adminServer.ListenAndServe(); err != nil && err != http.ErrServerClosed {
+				log.Fatal("Metrics server error: ", err)
+			}
+		}()
+	} else {
+		mux.Handle("GET /metrics", metrics.Handler())
+	}
+
+	// Outermost first: request ID, request log, metrics, panic recovery,
+	// CORS, then JSON errors for unmatched routes
+	handler := middleware.RequestID(middleware.Logger(logger, middleware.Metrics(middleware.Recover(logger, withCORS(middleware.Routes(mux))))))
+
+	// Read covers the whole request body, so it has to fit the largest
+	// upload on a slow connection. Event streams and exports lift the
+	// write deadline themselves.
+	server := &http.Server{
+		Addr:              envOr("HTTP_ADDR", ":8080"),
+		Handler:           handler,
+		ReadHeaderTimeout: durationEnv("HTTP_READ_HEADER_TIMEOUT", 10*time.Second),
+		ReadTimeout:       durationEnv("HTTP_READ_TIMEOUT", 2*time.Minute),
+		WriteTimeout:      durationEnv("HTTP_WRITE_TIMEOUT", 2*time.Minute),
+		IdleTimeout:       durationEnv("HTTP_IDLE_TIMEOUT", 2*time.Minute),
+		ErrorLog:          slog.NewLogLogger(logger.Handler(), slog.LevelWarn),
+	}
+	signals, stopSignals := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stopSignals()
+
+	serveErr := make(chan error, 1)
+	go func() {
+		slog.Info("server running", "addr", server.Addr)
+		serveErr <- server.ListenAndServe()
+	}()
+
+	select {
+	case err := <-serveErr:
+		log.Fatal("Server error: ", err)
+	case <-signals.Done():
+	}
+	// A second signal kills the process instead of waiting
+	stopSignals()
+
+	// Stop accepting, let in-flight requests finish, then stop background
+	// work. Running jobs are handed back to the queue.
+	timeout := durationEnv("SHUTDOWN_TIMEOUT", 30*time.Second)
+	slog.Info("shutting down", "timeout", timeout.String())
+	close(stopping)
+
+	shutdownCtx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+	if err := server.Shutdown(shutdownCtx); err != nil {
+		slog.Warn("requests still running at shutdown timeout, closing them", "err", err)
+		server.Close()
+	}
+	if adminServer != nil {
+		adminServer.Shutdown(shutdownCtx)
+	}
+	// Shutdown doesn't track hijacked connections, so the collab sockets
+	// are closed here once their rooms have had a last chance to save
+	collabHub.Close()
+
+	stopWork()
+	workers.Wait()
+	slog.Info("server stopped")
+}
+
+// Storage backend picked by STORAGE_BACKEND (cloudinary or local)
+func newStorage() (storage.Storage, error) {
+	switch backend := os.Getenv("STORAGE_BACKEND"); backend {
+	case "", "cloudinary":
+		cloudinaryURL := os.Getenv("CLOUDINARY_URL")
+		if cloudinaryURL == "" {
+			return nil, errors.New("CLOUDINARY_URL not set")
+		}
+		slog.Info("using Cloudinary storage")
+		return storage.NewCloudinary(cloudinaryURL)
+	case "local":
+		dir := os.Getenv("LOCAL_STORAGE_DIR")
+		if dir == "" {
+			dir = "./uploads"
+		}
+		baseURL := os.Getenv("LOCAL_STORAGE_URL")
+		if baseURL == "" {
+			baseURL = "http://localhost:8080/files"
+		}
+		slog.Info("using local storage", "dir", dir)
+		return storage.NewLocal(dir, baseURL)
+	default:
+		return nil, fmt.Errorf("unknown STORAGE_BACKEND %q", backend)
+	}
+}
+
+// Mailer picked by MAIL_BACKEND (log or smtp). Only development,
+// APP_ENV=development, may leave it unset and get the log mailer.
+func newMailer() mailer.Mailer {
+	switch backend := os.Getenv("MAIL_BACKEND"); backend {
+	case "":
+		if os.Getenv("APP_ENV") != "development" {
+			log.Fatal("MAIL_BACKEND must be set to log or smtp unless APP_ENV=development")
+		}
+		slog.Warn("MAIL_BACKEND not set, logging mail instead of sending it")
+		return &mailer.Log{Dir: os.Getenv("MAIL_LOG_DIR")}
+	case "log":
+		return &mailer.Log{Dir: os.Getenv("MAIL_LOG_DIR")}
+	case "smtp":
+		host := os.Getenv("SMTP_HOST")
+		from := os.Getenv("MAIL_FROM")
+		if host == "" || from == "" {
+			log.Fatal("SMTP_HOST and MAIL_FROM must be set for smtp mail")
+		}
+		port := os.Getenv("SMTP_PORT")
+		if port == "" {
+			port = "587"
+		}
+		return &mailer.SMTP{
+			Host:     host,
+			Port:     port,
+			Username: os.Getenv("SMTP_USERNAME"),
+			Password: os.Getenv("SMTP_PASSWORD"),
+			From:     from,
+		}
+	default:
+		log.Fatalf("Unknown MAIL_BACKEND %q", backend)
+		return nil
+	}
+}
+
+// Duration from env such as "15m", falling back to def
+func durationEnv(name string, def time.Duration) time.Duration {
+	value := os.Getenv(name)
+	if value == "" {
+		return def
+	}
+	d, err := time.ParseDuration(value)
+	if err != nil || d <= 0 {
+		log.Fatalf("Invalid %s: %q", name, value)
+	}
+	return d
 }
 
+// Positive integer from env, falling back to def
+func intEnv(name string, def int) int {
+	value := os.Getenv(name)
+	if value == "" {
+		return def
+	}
+	n, err := strconv.Atoi(value)
+	if err != nil || n <= 0 {
+		log.Fatalf("Invalid %s: %q", name, value)
+	}
+	return n
+}
+
+// String from env, falling back to def when unset
+func envOr(name, def string) string {
+	if value := os.Getenv(name); value != "" {
+		return value
+	}
+	return def
+}
+
+// uploadLimits reads <PREFIX>_MAX_BYTES, _MAX_WIDTH, _MAX_HEIGHT and
+// _MAX_PIXELS, falling back to def
+func uploadLimits(prefix string, def uploads.Limits) uploads.Limits {
+	return uploads.Limits{
+		MaxBytes:  int64(intEnv(prefix+"_MAX_BYTES", int(def.MaxBytes))),
+		MaxWidth:  intEnv(prefix+"_MAX_WIDTH", def.MaxWidth),
+		MaxHeight: intEnv(prefix+"_MAX_HEIGHT", def.MaxHeight),
+		MaxPixels: intEnv(prefix+"_MAX_PIXELS", def.MaxPixels),
+	}
+}
+
+// Frontend origin allowed to call the API and open sockets
+const allowedOrigin = "http://localhost:5173"
+
 // CORS wrapper
 func withCORS(h http.Handler) http.Handler {
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-		w.Header().Set("Access-Control-Allow-Origin", "http://localhost:5173")
-		w.Header().Set("Access-Control-Allow-Headers", "Authorization, Content-Type")
+		w.Header().Set("Access-Control-Allow-Origin", allowedOrigin)
+		w.Header().Set("Access-Control-Allow-Headers", "Authorization, Content-Type, X-Request-ID")
 		w.Header().Set("Access-Control-Allow-Methods", "GET, POST, PATCH, PUT, DELETE, OPTIONS")
 		w.Header().Set("Access-Control-Allow-Credentials", "true")
+		w.Header().Set("Access-Control-Expose-Headers", "Deprecation, Link, Location, X-Request-ID")
 
 		if r.Method == http.MethodOptions {
 			w.WriteHeader(http.StatusOK)
@@ -0,0 +1,55 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"log"
+	"strconv"
+
+	"urpaint/internal/database"
+)
+
+// migrate up | migrate down [N] | migrate version
+func runMigrate(db *sql.DB, args []string) error {
+	ctx := context.Background()
+
+	command := "up"
+	if len(args) > 0 {
+		command = args[0]
+	}
+
+	switch command {
+	case "up":
+		applied, err := database.MigrateUp(ctx, db)
+		if err != nil {
+			return err
+		}
+		log.Println("Applied", applied, "migration(s)")
+	case "down":
+		steps := 1
+		if len(args) > 1 {
+			n, err := strconv.Atoi(args[1])
+			if err != nil || n < 1 {
+				return fmt.Errorf("invalid step count %q", args[1])
+			}
+			steps = n
+		}
+		reverted, err := database.MigrateDown(ctx, db, steps)
+		if err != nil {
+			return err
+		}
+		log.Println("Reverted", reverted, "migration(s)")
+	case "version":
+		// handled below
+	default:
+		return fmt.Errorf("unknown migrate command %q (use up, down [N] or version)", command)
+	}
+
+	version, err := database.SchemaVersion(ctx, db)
+	if err != nil {
+		return err
+	}
+	log.Println("Schema version:", version)
+	return nil
+}
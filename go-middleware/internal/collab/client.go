@@ -0,0 +1,97 @@
+package collab
+
+import (
+	"encoding/json"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+const (
+	writeWait  = 10 * time.Second
+	pongWait   = 60 * time.Second
+	pingPeriod = pongWait * 9 / 10
+
+	// Snapshots carry two base64 PNGs, everything else is small
+	maxMessageSize = 24 << 20
+	maxEventSize   = 64 << 10
+
+	sendBuffer = 256
+)
+
+type client struct {
+	conn   *websocket.Conn
+	userID int
+	send   chan Message
+}
+
+func newClient(conn *websocket.Conn, userID int) *client {
+	return &client{conn: conn, userID: userID, send: make(chan Message, sendBuffer)}
+}
+
+// readPump forwards everything the client sends to the room until the
+// connection drops
+func (c *client) readPump(rm *room) {
+	defer func() {
+		rm.leave(c)
+		c.conn.Close()
+	}()
+
+	c.conn.SetReadLimit(maxMessageSize)
+	c.conn.SetReadDeadline(time.Now().Add(pongWait))
+	c.conn.SetPongHandler(func(string) error {
+		return c.conn.SetReadDeadline(time.Now().Add(pongWait))
+	})
+
+	for {
+		_, data, err := c.conn.ReadMessage()
+		if err != nil {
+			return
+		}
+
+		var msg Message
+		if err := json.Unmarshal(data, &msg); err != nil {
+			c.trySend(Message{Type: TypeError, Message: "invalid message"})
+			continue
+		}
+		rm.handle(c, msg)
+	}
+}
+
+// writePump owns all writes to the connection
+func (c *client) writePump() {
+	ticker := time.NewTicker(pingPeriod)
+	defer func() {
+		ticker.Stop()
+		c.conn.Close()
+	}()
+
+	for {
+		select {
+		case msg, ok := <-c.send:
+			c.conn.SetWriteDeadline(time.Now().Add(writeWait))
+			if !ok {
+				c.conn.WriteMessage(websocket.CloseMessage, []byte{})
+				return
+			}
+			if err := c.conn.WriteJSON(msg); err != nil {
+				return
+			}
+		case <-ticker.C:
+			c.conn.SetWriteDeadline(time.Now().Add(writeWait))
+			if err := c.conn.WriteMessage(websocket.PingMessage, nil); err != nil {
+				return
+			}
+		}
+	}
+}
+
+// trySend queues a message, reporting false if the client can't keep up
+func (c *client) trySend(msg Message) bool {
+	select {
+	case c.send <- msg:
+		return true
+	default:
+		return false
+	}
+}
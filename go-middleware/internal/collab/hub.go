@@ -0,0 +1,216 @@
+package collab
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gorilla/websocket"
+
+	"urpaint/internal/httperr"
+)
+
+var (
+	ErrNotFound  = errors.New("drawing not found")
+	ErrForbidden = errors.New("not a collaborator on this drawing")
+)
+
+// SnapshotError is a save the Store refused for a reason the participant
+// who uploaded the snapshot should see, such as an image that isn't valid
+type SnapshotError struct {
+	Message string
+}
+
+func (e *SnapshotError) Error() string {
+	return e.Message
+}
+
+// Store is what the hub needs from the gallery.
+type Store interface {
+	// OpenDrawing checks the user may edit the drawing and returns the URL
+	// of its current edit image.
+	OpenDrawing(ctx context.Context, drawingID, userID int) (string, error)
+	// SaveDrawing stores a merged snapshot as the drawing's new state and
+	// returns the new edit image URL. A *SnapshotError is passed on to the
+	// client that uploaded it.
+	SaveDrawing(ctx context.Context, drawingID int, editImage, galleryImage []byte) (string, error)
+}
+
+// Hub hosts one room per drawing being edited.
+type Hub struct {
+	Store Store
+	// Authenticate turns a JWT into a user ID, with the same checks as JWTAuth
+	Authenticate func(ctx context.Context, token string) (int, error)
+	// AllowedOrigins lists the browser origins allowed to connect
+	AllowedOrigins []string
+	// SaveInterval is how often a dirty room asks for a snapshot
+	SaveInterval time.Duration
+	// IdleTimeout keeps an empty room's unsaved events around for rejoiners
+	IdleTimeout time.Duration
+	// FlushTimeout bounds the last save when the final participant leaves
+	// or the hub closes
+	FlushTimeout time.Duration
+
+	upgrader websocket.Upgrader
+	once     sync.Once
+
+	mu     sync.Mutex
+	rooms  map[int]*room
+	closed bool
+}
+
+func (h *Hub) init() {
+	h.once.Do(func() {
+		h.rooms = map[int]*room{}
+		if h.SaveInterval <= 0 {
+			h.SaveInterval = 30 * time.Second
+		}
+		if h.IdleTimeout <= 0 {
+			h.IdleTimeout = 10 * time.Minute
+		}
+		if h.FlushTimeout <= 0 {
+			h.FlushTimeout = 15 * time.Second
+		}
+		h.upgrader = websocket.Upgrader{
+			ReadBufferSize:  4096,
+			WriteBufferSize: 4096,
+			CheckOrigin:     h.checkOrigin,
+		}
+	})
+}
+
+func (h *Hub) checkOrigin(r *http.Request) bool {
+	origin := r.Header.Get("Origin")
+	if origin == "" {
+		return true
+	}
+	for _, allowed := range h.AllowedOrigins {
+		if origin == allowed {
+			return true
+		}
+	}
+	return false
+}
+
+// ServeWS handles GET /collab?id=<drawing>&token=<jwt>. Browsers can't set
+// headers on a WebSocket handshake, so the token may come in the query.
+func (h *Hub) ServeWS(w http.ResponseWriter, r *http.Request) {
+	h.init()
+
+	drawingID, err := strconv.Atoi(r.URL.Query().Get("id"))
+	if err != nil {
+		httperr.Write(w, r, httperr.New(http.StatusBadRequest, "Invalid drawing ID"))
+		return
+	}
+
+	token := r.URL.Query().Get("token")
+	if token == "" {
+		token = strings.TrimSpace(strings.TrimPrefix(r.Header.Get("Authorization"), "Bearer "))
+	}
+	if token == "" {
+		httperr.Write(w, r, httperr.New(http.StatusUnauthorized, "Missing token"))
+		return
+	}
+
+	userID, err := h.Authenticate(r.Context(), token)
+	if err != nil {
+		httperr.Write(w, r, httperr.New(http.StatusUnauthorized, "Invalid token"))
+		return
+	}
+
+	snapshotURL, err := h.Store.OpenDrawing(r.Context(), drawingID, userID)
+	switch {
+	case errors.Is(err, ErrNotFound):
+		httperr.Write(w, r, httperr.New(http.StatusNotFound, "Drawing not found"))
+		return
+	case errors.Is(err, ErrForbidden):
+		httperr.Write(w, r, httperr.New(http.StatusForbidden, "Forbidden"))
+		return
+	case err != nil:
+		httperr.Write(w, r, httperr.Internal("Could not open drawing", err))
+		return
+	}
+
+	conn, err := h.upgrader.Upgrade(w, r, nil)
+	if err != nil {
+		// Upgrade already wrote the error response
+		return
+	}
+
+	rm := h.room(drawingID, snapshotURL)
+	if rm == nil {
+		conn.WriteMessage(websocket.CloseMessage,
+			websocket.FormatCloseMessage(websocket.CloseGoingAway, "server shutting down"))
+		conn.Close()
+		return
+	}
+
+	c := newClient(conn, userID)
+	rm.join(c)
+	go c.writePump()
+	c.readPump(rm)
+}
+
+// room returns the live room for a drawing, creating it on first join
+func (h *Hub) room(drawingID int, snapshotURL string) *room {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	if h.closed {
+		return nil
+	}
+	if rm, ok := h.rooms[drawingID]; ok {
+		return rm
+	}
+
+	rm := newRoom(h, drawingID, snapshotURL)
+	h.rooms[drawingID] = rm
+	go rm.run()
+	return rm
+}
+
+// remove forgets a room once it has shut itself down
+func (h *Hub) remove(rm *room) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if h.rooms[rm.drawingID] == rm {
+		delete(h.rooms, rm.drawingID)
+	}
+}
+
+// Close asks every room for a last snapshot and waits up to FlushTimeout
+// for them to save before disconnecting every client. Rooms don't outlive
+// the process, so anything still unsaved after that is lost.
+func (h *Hub) Close() {
+	h.init()
+
+	h.mu.Lock()
+	h.closed = true
+	rooms := make([]*room, 0, len(h.rooms))
+	for _, rm := range h.rooms {
+		rooms = append(rooms, rm)
+	}
+	h.mu.Unlock()
+
+	for _, rm := range rooms {
+		rm.flush()
+	}
+	deadline := time.NewTimer(h.FlushTimeout)
+	defer deadline.Stop()
+wait:
+	for _, rm := range rooms {
+		select {
+		case <-rm.stopped:
+		case <-deadline.C:
+			break wait
+		}
+	}
+
+	for _, rm := range rooms {
+		rm.close()
+	}
+}
@@ -0,0 +1,60 @@
+package collab
+
+import (
+	"encoding/json"
+	"time"
+)
+
+// Message is the JSON frame exchanged with clients in both directions.
+//
+// Client to server:
+//
+//	{"type":"stroke"|"fill"|"erase", "data":{...}}
+//	{"type":"snapshot", "seq":N, "editImage":"<base64 PNG>", "galleryImage":"<base64 PNG>"}
+//	{"type":"leave"}  before disconnecting; the last one out may be asked for a snapshot first
+//
+// Server to client:
+//
+//	sync             on join: snapshotUrl, seq and the events since that snapshot
+//	event            a stroke/fill/erase from a participant, with action and seq
+//	join, leave      presence changes
+//	snapshot_request asks this client to upload the merged canvas up to seq
+//	saved            a snapshot was stored, events up to seq are folded into it
+//	error            something the client sent was rejected
+type Message struct {
+	Type string `json:"type"`
+	// Action is the drawing event type (stroke, fill, erase) on "event" frames
+	Action string `json:"action,omitempty"`
+
+	Seq    int64           `json:"seq,omitempty"`
+	UserID int             `json:"userId,omitempty"`
+	Data   json.RawMessage `json:"data,omitempty"`
+	At     *time.Time      `json:"at,omitempty"`
+
+	SnapshotURL  string    `json:"snapshotUrl,omitempty"`
+	Events       []Message `json:"events,omitempty"`
+	Participants []int     `json:"participants,omitempty"`
+
+	EditImage    string `json:"editImage,omitempty"`
+	GalleryImage string `json:"galleryImage,omitempty"`
+
+	Message string `json:"message,omitempty"`
+}
+
+const (
+	TypeStroke          = "stroke"
+	TypeFill            = "fill"
+	TypeErase           = "erase"
+	TypeSnapshot        = "snapshot"
+	TypeSync            = "sync"
+	TypeEvent           = "event"
+	TypeJoin            = "join"
+	TypeLeave           = "leave"
+	TypeSnapshotRequest = "snapshot_request"
+	TypeSaved           = "saved"
+	TypeError           = "error"
+)
+
+func isDrawingEvent(t string) bool {
+	return t == TypeStroke || t == TypeFill || t == TypeErase
+}
@@ -0,0 +1,426 @@
+package collab
+
+import (
+	"context"
+	"encoding/base64"
+	"errors"
+	"log/slog"
+	"time"
+)
+
+// A room's unsaved event log is capped. Past snapshotEvents a snapshot is
+// asked for right away rather than on the next tick; at maxEvents new
+// events are refused until one is saved. 64KB events put the worst case
+// at 128MB a room.
+const (
+	snapshotEvents = 500
+	maxEvents      = 2000
+)
+
+type inbound struct {
+	from *client
+	msg  Message
+}
+
+// room serialises everything that happens to one drawing. The server never
+// renders the canvas itself: it keeps the last saved snapshot plus the log of
+// events since, which is exactly what a late joiner needs to catch up, and
+// periodically asks a participant to upload the merged result.
+type room struct {
+	hub       *Hub
+	drawingID int
+
+	joins    chan *client
+	leaves   chan *client
+	messages chan inbound
+	saves    chan saveResult
+	flushes  chan struct{}
+	done     chan struct{}
+	// Closed once run has returned
+	stopped chan struct{}
+
+	clients map[*client]bool
+	// The same clients, longest-connected first
+	order       []*client
+	snapshotURL string
+	events      []Message
+	seq         int64
+	savedSeq    int64
+
+	// The snapshot we asked for and who we asked, zero when none is pending
+	pendingSeq int64
+	pendingBy  *client
+	saving     bool
+
+	// Runs only while the room is empty
+	idle      <-chan time.Time
+	idleTimer *time.Timer
+
+	// The last participant, staying to upload the canvas before it goes
+	leaving    *client
+	leaveWait  <-chan time.Time
+	leaveTimer *time.Timer
+
+	// Set when the hub closes: save once more, then stop
+	flushing bool
+}
+
+type saveResult struct {
+	by  *client
+	seq int64
+	url string
+	err error
+}
+
+func newRoom(h *Hub, drawingID int, snapshotURL string) *room {
+	return &room{
+		hub:         h,
+		drawingID:   drawingID,
+		joins:       make(chan *client),
+		leaves:      make(chan *client),
+		messages:    make(chan inbound, 64),
+		saves:       make(chan saveResult, 1),
+		flushes:     make(chan struct{}),
+		done:        make(chan struct{}),
+		stopped:     make(chan struct{}),
+		clients:     map[*client]bool{},
+		snapshotURL: snapshotURL,
+	}
+}
+
+func (rm *room) join(c *client) {
+	select {
+	case rm.joins <- c:
+	case <-rm.done:
+		close(c.send)
+	}
+}
+
+func (rm *room) leave(c *client) {
+	select {
+	case rm.leaves <- c:
+	case <-rm.done:
+	}
+}
+
+func (rm *room) handle(c *client, msg Message) {
+	select {
+	case rm.messages <- inbound{from: c, msg: msg}:
+	case <-rm.done:
+	}
+}
+
+// flush asks the room for a last save, after which it stops. stopped is
+// closed once it has.
+func (rm *room) flush() {
+	select {
+	case rm.flushes <- struct{}{}:
+	case <-rm.done:
+	}
+}
+
+func (rm *room) close() {
+	select {
+	case <-rm.done:
+	default:
+		close(rm.done)
+	}
+}
+
+func (rm *room) run() {
+	saveTicker := time.NewTicker(rm.hub.SaveInterval)
+	defer saveTicker.Stop()
+
+	defer func() {
+		rm.close()
+		rm.hub.remove(rm)
+		for c := range rm.clients {
+			close(c.send)
+		}
+		close(rm.stopped)
+	}()
+
+	for {
+		select {
+		case c := <-rm.joins:
+			if rm.idleTimer != nil {
+				rm.idleTimer.Stop()
+				rm.idleTimer, rm.idle = nil, nil
+			}
+			rm.clients[c] = true
+			rm.order = append(rm.order, c)
+			c.trySend(Message{
+				Type:         TypeSync,
+				SnapshotURL:  rm.snapshotURL,
+				Seq:          rm.seq,
+				Events:       rm.events,
+				Participants: rm.participants(),
+			})
+			rm.broadcast(Message{Type: TypeJoin, UserID: c.userID}, c)
+
+		case c := <-rm.leaves:
+			rm.remove(c)
+
+		case in := <-rm.messages:
+			rm.receive(in.from, in.msg)
+
+		case res := <-rm.saves:
+			rm.saving = false
+			if res.err != nil {
+				rm.saveFailed(res)
+			} else {
+				rm.snapshotURL = res.url
+				rm.savedSeq = res.seq
+				rm.trim(res.seq)
+				rm.broadcast(Message{Type: TypeSaved, SnapshotURL: res.url, Seq: res.seq}, nil)
+			}
+			if !rm.flushing && rm.leaving == nil {
+				continue
+			}
+			// Go again for anything drawn while that saved. A failed save
+			// won't do better a second time.
+			if res.err == nil && rm.seq != rm.savedSeq {
+				rm.requestSnapshot()
+			}
+			if rm.pendingBy != nil {
+				continue
+			}
+			if rm.flushing {
+				rm.warnUnsaved()
+				return
+			}
+			rm.remove(rm.leaving)
+
+		case <-rm.leaveWait:
+			slog.Warn("collab participant left before saving", "drawing_id", rm.drawingID)
+			rm.remove(rm.leaving)
+
+		case <-rm.flushes:
+			rm.flushing = true
+			if rm.saving {
+				// Its result decides whether another is needed
+				continue
+			}
+			rm.requestSnapshot()
+			if rm.pendingBy == nil {
+				rm.warnUnsaved()
+				return
+			}
+
+		case <-saveTicker.C:
+			rm.requestSnapshot()
+
+		case <-rm.idle:
+			rm.warnUnsaved()
+			return
+
+		case <-rm.done:
+			return
+		}
+	}
+}
+
+func (rm *room) receive(c *client, msg Message) {
+	if !rm.clients[c] {
+		return
+	}
+
+	switch {
+	case isDrawingEvent(msg.Type):
+		if rm.flushing {
+			c.trySend(Message{Type: TypeError, Message: "the server is restarting, changes can't be kept"})
+			return
+		}
+		if len(msg.Data) == 0 || len(msg.Data) > maxEventSize {
+			c.trySend(Message{Type: TypeError, Message: "event data missing or too large"})
+			return
+		}
+		if len(rm.events) >= maxEvents {
+			c.trySend(Message{Type: TypeError, Message: "too many unsaved changes, wait for the drawing to save"})
+			if rm.pendingBy == nil {
+				rm.requestSnapshot()
+			}
+			return
+		}
+		rm.seq++
+		now := time.Now().UTC()
+		event := Message{
+			Type:   TypeEvent,
+			Action: msg.Type,
+			Seq:    rm.seq,
+			UserID: c.userID,
+			Data:   msg.Data,
+			At:     &now,
+		}
+		rm.events = append(rm.events, event)
+		rm.broadcast(event, nil)
+		if len(rm.events) >= snapshotEvents && rm.pendingBy == nil {
+			rm.requestSnapshot()
+		}
+
+	case msg.Type == TypeSnapshot:
+		if c != rm.pendingBy || msg.Seq != rm.pendingSeq {
+			c.trySend(Message{Type: TypeError, Message: "snapshot was not requested"})
+			return
+		}
+		rm.pendingSeq, rm.pendingBy = 0, nil
+
+		edit, err := base64.StdEncoding.DecodeString(msg.EditImage)
+		if err != nil || len(edit) == 0 {
+			c.trySend(Message{Type: TypeError, Message: "invalid editImage"})
+			return
+		}
+		gallery, err := base64.StdEncoding.DecodeString(msg.GalleryImage)
+		if err != nil || len(gallery) == 0 {
+			c.trySend(Message{Type: TypeError, Message: "invalid galleryImage"})
+			return
+		}
+
+		rm.saving = true
+		go rm.save(c, msg.Seq, edit, gallery)
+
+	case msg.Type == TypeLeave:
+		// Whoever leaves last uploads the canvas first, and is let go once
+		// it's saved or FlushTimeout runs out
+		if len(rm.clients) > 1 || rm.seq == rm.savedSeq || rm.flushing {
+			rm.remove(c)
+			return
+		}
+		if rm.leaving == nil {
+			rm.leaving = c
+			rm.leaveTimer = time.NewTimer(rm.hub.FlushTimeout)
+			rm.leaveWait = rm.leaveTimer.C
+			rm.requestSnapshot()
+		}
+
+	default:
+		c.trySend(Message{Type: TypeError, Message: "unknown message type"})
+	}
+}
+
+// requestSnapshot asks the longest-connected participant for the merged
+// canvas when there's something new to save
+func (rm *room) requestSnapshot() {
+	if rm.saving || rm.seq == rm.savedSeq || len(rm.clients) == 0 {
+		return
+	}
+
+	// A client that never answered loses its turn
+	var target *client
+	for _, c := range rm.order {
+		if c != rm.pendingBy {
+			target = c
+			break
+		}
+	}
+	if target == nil {
+		target = rm.pendingBy
+	}
+
+	rm.pendingSeq, rm.pendingBy = rm.seq, target
+	target.trySend(Message{Type: TypeSnapshotRequest, Seq: rm.seq})
+}
+
+func (rm *room) save(by *client, seq int64, edit, gallery []byte) {
+	ctx, cancel := context.WithTimeout(context.Background(), time.Minute)
+	defer cancel()
+
+	url, err := rm.hub.Store.SaveDrawing(ctx, rm.drawingID, edit, gallery)
+	select {
+	case rm.saves <- saveResult{by: by, seq: seq, url: url, err: err}:
+	case <-rm.done:
+	}
+}
+
+// saveFailed tells the uploader why their snapshot wasn't stored. The
+// events stay in the log, so the next tick asks again.
+func (rm *room) saveFailed(res saveResult) {
+	message := "could not save the drawing"
+	var rejected *SnapshotError
+	if errors.As(res.err, &rejected) {
+		slog.Warn("collab snapshot rejected", "drawing_id", rm.drawingID, "err", res.err)
+		message = rejected.Message
+	} else {
+		slog.Error("collab save failed", "drawing_id", rm.drawingID, "err", res.err)
+	}
+	if rm.clients[res.by] {
+		res.by.trySend(Message{Type: TypeError, Message: message})
+	}
+}
+
+// trim drops events already folded into the saved snapshot
+func (rm *room) trim(seq int64) {
+	i := 0
+	for i < len(rm.events) && rm.events[i].Seq <= seq {
+		i++
+	}
+	rm.events = append([]Message(nil), rm.events[i:]...)
+}
+
+// remove takes a client out of the room, whether it left or was dropped,
+// and starts the idle timer once the room is empty
+func (rm *room) remove(c *client) {
+	if !rm.clients[c] {
+		return
+	}
+	delete(rm.clients, c)
+	for i, o := range rm.order {
+		if o == c {
+			rm.order = append(rm.order[:i], rm.order[i+1:]...)
+			break
+		}
+	}
+	close(c.send)
+	if rm.pendingBy == c {
+		rm.pendingSeq, rm.pendingBy = 0, nil
+	}
+	if rm.leaving == c {
+		rm.leaveTimer.Stop()
+		rm.leaving, rm.leaveTimer, rm.leaveWait = nil, nil, nil
+	}
+	rm.broadcast(Message{Type: TypeLeave, UserID: c.userID}, nil)
+	// The one left may close the tab without saying goodbye, so don't
+	// wait for the next tick
+	if len(rm.clients) == 1 && rm.pendingBy == nil {
+		rm.requestSnapshot()
+	}
+	if len(rm.clients) == 0 && rm.idleTimer == nil {
+		rm.idleTimer = time.NewTimer(rm.hub.IdleTimeout)
+		rm.idle = rm.idleTimer.C
+	}
+}
+
+func (rm *room) warnUnsaved() {
+	if len(rm.events) > 0 {
+		slog.Warn("collab room closed with unsaved events", "drawing_id", rm.drawingID, "events", len(rm.events))
+	}
+}
+
+// broadcast sends to everyone except skip. Clients too slow to keep up are
+// dropped; they can rejoin and resync.
+func (rm *room) broadcast(msg Message, skip *client) {
+	var slow []*client
+	for c := range rm.clients {
+		if c == skip {
+			continue
+		}
+		if !c.trySend(msg) {
+			slow = append(slow, c)
+		}
+	}
+	for _, c := range slow {
+		rm.remove(c)
+	}
+}
+
+func (rm *room) participants() []int {
+	seen := map[int]bool{}
+	ids := []int{}
+	for _, c := range rm.order {
+		if !seen[c.userID] {
+			seen[c.userID] = true
+			ids = append(ids, c.userID)
+		}
+	}
+	return ids
+}
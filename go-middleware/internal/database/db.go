@@ -3,6 +3,8 @@ package database
 import (
 	"database/sql"
 	"fmt"
+	"log/slog"
+
 	_ "github.com/lib/pq"
 )
 
@@ -18,6 +20,6 @@ func ConnectDB(user, password, dbName, host, port string) (*sql.DB, error) {
 		return nil, err	
 	}
 
-	fmt.Println("Connected to database")
+	slog.Info("connected to database", "host", host, "database", dbName)
 	return db, nil
 }
@@ -0,0 +1,2 @@
+DROP TABLE IF EXISTS gallery;
+DROP TABLE IF EXISTS users;
@@ -0,0 +1,30 @@
+-- Base schema. IF NOT EXISTS lets databases that were set up by hand adopt it.
+CREATE TABLE IF NOT EXISTS users (
+    id         SERIAL PRIMARY KEY,
+    email      TEXT NOT NULL UNIQUE,
+    password   TEXT NOT NULL,
+    bio        TEXT,
+    avatar_url TEXT,
+    created_at TIMESTAMPTZ NOT NULL DEFAULT now()
+);
+
+ALTER TABLE users ADD COLUMN IF NOT EXISTS bio TEXT;
+ALTER TABLE users ADD COLUMN IF NOT EXISTS avatar_url TEXT;
+ALTER TABLE users ADD COLUMN IF NOT EXISTS created_at TIMESTAMPTZ NOT NULL DEFAULT now();
+
+CREATE TABLE IF NOT EXISTS gallery (
+    id          SERIAL PRIMARY KEY,
+    user_id     INTEGER NOT NULL REFERENCES users(id) ON DELETE CASCADE,
+    image_url   TEXT,
+    edit_url    TEXT,
+    title       TEXT,
+    order_index INTEGER NOT NULL DEFAULT 0,
+    uploaded_at TIMESTAMPTZ NOT NULL DEFAULT now()
+);
+
+ALTER TABLE gallery ADD COLUMN IF NOT EXISTS edit_url TEXT;
+ALTER TABLE gallery ADD COLUMN IF NOT EXISTS title TEXT;
+ALTER TABLE gallery ADD COLUMN IF NOT EXISTS order_index INTEGER NOT NULL DEFAULT 0;
+ALTER TABLE gallery ADD COLUMN IF NOT EXISTS uploaded_at TIMESTAMPTZ NOT NULL DEFAULT now();
+
+CREATE INDEX IF NOT EXISTS gallery_user_order_idx ON gallery (user_id, order_index);
@@ -0,0 +1 @@
+DROP TABLE IF EXISTS gallery_shares;
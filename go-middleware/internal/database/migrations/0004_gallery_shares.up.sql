@@ -0,0 +1,12 @@
+-- Public, unguessable links to a single drawing
+CREATE TABLE gallery_shares (
+    id         BIGSERIAL PRIMARY KEY,
+    gallery_id INTEGER NOT NULL REFERENCES gallery(id) ON DELETE CASCADE,
+    slug       TEXT NOT NULL UNIQUE,
+    expires_at TIMESTAMPTZ,
+    view_count BIGINT NOT NULL DEFAULT 0,
+    created_at TIMESTAMPTZ NOT NULL DEFAULT now(),
+    revoked_at TIMESTAMPTZ
+);
+
+CREATE INDEX gallery_shares_gallery_idx ON gallery_shares (gallery_id);
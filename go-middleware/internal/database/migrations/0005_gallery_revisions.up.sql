@@ -0,0 +1,15 @@
+-- One row per save of a drawing
+CREATE TABLE gallery_revisions (
+    id         BIGSERIAL PRIMARY KEY,
+    gallery_id INTEGER NOT NULL REFERENCES gallery(id) ON DELETE CASCADE,
+    image_url  TEXT,
+    edit_url   TEXT,
+    byte_size  BIGINT NOT NULL DEFAULT 0,
+    created_at TIMESTAMPTZ NOT NULL DEFAULT now()
+);
+
+CREATE INDEX gallery_revisions_gallery_idx ON gallery_revisions (gallery_id, created_at DESC);
+
+-- Existing drawings start their history at their current state
+INSERT INTO gallery_revisions (gallery_id, image_url, edit_url, created_at)
+SELECT id, image_url, edit_url, uploaded_at FROM gallery;
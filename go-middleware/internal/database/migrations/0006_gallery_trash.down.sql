@@ -0,0 +1,2 @@
+DROP INDEX IF EXISTS gallery_deleted_idx;
+ALTER TABLE gallery DROP COLUMN IF EXISTS deleted_at;
@@ -0,0 +1,4 @@
+-- Soft delete: trashed drawings keep their row until purged
+ALTER TABLE gallery ADD COLUMN deleted_at TIMESTAMPTZ;
+
+CREATE INDEX gallery_deleted_idx ON gallery (deleted_at) WHERE deleted_at IS NOT NULL;
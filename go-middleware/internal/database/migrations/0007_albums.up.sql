@@ -0,0 +1,18 @@
+CREATE TABLE albums (
+    id         SERIAL PRIMARY KEY,
+    user_id    INTEGER NOT NULL REFERENCES users(id) ON DELETE CASCADE,
+    name       TEXT NOT NULL,
+    created_at TIMESTAMPTZ NOT NULL DEFAULT now(),
+    UNIQUE (user_id, name)
+);
+
+-- A drawing can sit in any number of albums, each with its own order
+CREATE TABLE album_items (
+    album_id    INTEGER NOT NULL REFERENCES albums(id) ON DELETE CASCADE,
+    gallery_id  INTEGER NOT NULL REFERENCES gallery(id) ON DELETE CASCADE,
+    order_index INTEGER NOT NULL DEFAULT 0,
+    added_at    TIMESTAMPTZ NOT NULL DEFAULT now(),
+    PRIMARY KEY (album_id, gallery_id)
+);
+
+CREATE INDEX album_items_gallery_idx ON album_items (gallery_id);
@@ -0,0 +1,2 @@
+DROP TABLE IF EXISTS gallery_tags;
+ALTER TABLE gallery DROP COLUMN IF EXISTS description;
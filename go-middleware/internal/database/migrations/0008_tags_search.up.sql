@@ -0,0 +1,10 @@
+ALTER TABLE gallery ADD COLUMN description TEXT;
+
+CREATE TABLE gallery_tags (
+    gallery_id INTEGER NOT NULL REFERENCES gallery(id) ON DELETE CASCADE,
+    tag        TEXT NOT NULL,
+    created_at TIMESTAMPTZ NOT NULL DEFAULT now(),
+    PRIMARY KEY (gallery_id, tag)
+);
+
+CREATE INDEX gallery_tags_tag_idx ON gallery_tags (tag);
@@ -0,0 +1,9 @@
+-- Users the owner has invited to edit a drawing live
+CREATE TABLE drawing_collaborators (
+    gallery_id INTEGER NOT NULL REFERENCES gallery(id) ON DELETE CASCADE,
+    user_id    INTEGER NOT NULL REFERENCES users(id) ON DELETE CASCADE,
+    added_at   TIMESTAMPTZ NOT NULL DEFAULT now(),
+    PRIMARY KEY (gallery_id, user_id)
+);
+
+CREATE INDEX drawing_collaborators_user_idx ON drawing_collaborators (user_id);
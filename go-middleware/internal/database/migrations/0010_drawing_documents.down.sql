@@ -0,0 +1,3 @@
+ALTER TABLE gallery_revisions DROP COLUMN IF EXISTS document_id;
+ALTER TABLE gallery DROP COLUMN IF EXISTS document_id;
+DROP TABLE IF EXISTS drawing_documents;
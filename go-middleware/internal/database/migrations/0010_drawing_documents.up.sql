@@ -0,0 +1,15 @@
+-- Stroke documents: the vector source of a drawing, one row per saved version
+CREATE TABLE drawing_documents (
+    id             BIGSERIAL PRIMARY KEY,
+    gallery_id     INTEGER NOT NULL REFERENCES gallery(id) ON DELETE CASCADE,
+    format_version INTEGER NOT NULL,
+    document       JSONB NOT NULL,
+    byte_size      BIGINT NOT NULL DEFAULT 0,
+    created_at     TIMESTAMPTZ NOT NULL DEFAULT now()
+);
+
+CREATE INDEX drawing_documents_gallery_idx ON drawing_documents (gallery_id);
+
+-- Current document of a drawing, and the one each revision was saved with
+ALTER TABLE gallery ADD COLUMN document_id BIGINT REFERENCES drawing_documents(id) ON DELETE SET NULL;
+ALTER TABLE gallery_revisions ADD COLUMN document_id BIGINT REFERENCES drawing_documents(id) ON DELETE SET NULL;
@@ -0,0 +1,25 @@
+-- Background processing. Workers claim queued rows with SKIP LOCKED and
+-- hold them with a lease they keep extending while the job runs.
+CREATE TABLE jobs (
+    id               BIGSERIAL PRIMARY KEY,
+    user_id          INTEGER NOT NULL REFERENCES users(id) ON DELETE CASCADE,
+    kind             TEXT NOT NULL,
+    status           TEXT NOT NULL DEFAULT 'queued'
+                     CHECK (status IN ('queued', 'running', 'succeeded', 'failed', 'cancelled')),
+    payload          JSONB NOT NULL DEFAULT '{}',
+    result           JSONB,
+    error            TEXT,
+    attempts         INTEGER NOT NULL DEFAULT 0,
+    max_attempts     INTEGER NOT NULL DEFAULT 3,
+    run_after        TIMESTAMPTZ NOT NULL DEFAULT now(),
+    locked_until     TIMESTAMPTZ,
+    cancel_requested BOOLEAN NOT NULL DEFAULT false,
+    created_at       TIMESTAMPTZ NOT NULL DEFAULT now(),
+    started_at       TIMESTAMPTZ,
+    finished_at      TIMESTAMPTZ,
+    updated_at       TIMESTAMPTZ NOT NULL DEFAULT now()
+);
+
+CREATE INDEX jobs_queue_idx ON jobs (run_after, id) WHERE status = 'queued';
+CREATE INDEX jobs_running_idx ON jobs (user_id) WHERE status = 'running';
+CREATE INDEX jobs_user_idx ON jobs (user_id, created_at DESC);
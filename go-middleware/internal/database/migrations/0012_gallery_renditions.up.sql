@@ -0,0 +1,14 @@
+-- Downscaled copies of a drawing's gallery image. source_url is the
+-- image_url they were made from, so renditions of an older save are ignored.
+-- url is NULL when the original is already within the size.
+CREATE TABLE gallery_renditions (
+    gallery_id INTEGER NOT NULL REFERENCES gallery(id) ON DELETE CASCADE,
+    size       TEXT NOT NULL CHECK (size IN ('small', 'medium', 'large')),
+    source_url TEXT NOT NULL,
+    url        TEXT,
+    width      INTEGER NOT NULL,
+    height     INTEGER NOT NULL,
+    byte_size  BIGINT NOT NULL DEFAULT 0,
+    created_at TIMESTAMPTZ NOT NULL DEFAULT now(),
+    PRIMARY KEY (gallery_id, size)
+);
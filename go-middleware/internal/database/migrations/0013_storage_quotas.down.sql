@@ -0,0 +1,2 @@
+ALTER TABLE users DROP COLUMN IF EXISTS storage_quota;
+DROP TABLE IF EXISTS stored_assets;
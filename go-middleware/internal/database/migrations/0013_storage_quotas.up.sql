@@ -0,0 +1,13 @@
+-- Every object we store for a user, by storage key, so usage is a SUM.
+-- Objects stored before this migration aren't listed and don't count.
+CREATE TABLE stored_assets (
+    storage_key TEXT PRIMARY KEY,
+    user_id     INTEGER NOT NULL REFERENCES users(id) ON DELETE CASCADE,
+    byte_size   BIGINT NOT NULL,
+    created_at  TIMESTAMPTZ NOT NULL DEFAULT now()
+);
+
+CREATE INDEX stored_assets_user_idx ON stored_assets (user_id);
+
+-- Per-user override of the default quota, in bytes. NULL uses the default.
+ALTER TABLE users ADD COLUMN storage_quota BIGINT CHECK (storage_quota >= 0);
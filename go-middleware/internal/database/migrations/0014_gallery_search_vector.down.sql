@@ -0,0 +1,7 @@
+DROP TRIGGER IF EXISTS gallery_search_vector_tags ON gallery_tags;
+DROP FUNCTION IF EXISTS gallery_search_vector_tags();
+DROP TRIGGER IF EXISTS gallery_search_vector_row ON gallery;
+DROP FUNCTION IF EXISTS gallery_search_vector_row();
+DROP INDEX IF EXISTS gallery_search_vector_idx;
+ALTER TABLE gallery DROP COLUMN IF EXISTS search_vector;
+DROP FUNCTION IF EXISTS gallery_search_vector(TEXT, TEXT, INTEGER);
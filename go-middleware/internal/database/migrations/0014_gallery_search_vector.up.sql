@@ -0,0 +1,46 @@
+-- Search reads a stored, indexed tsvector instead of building one per row.
+-- Tags live in their own table, so it can't be a generated column; the
+-- triggers below keep it current. Weights: title A, tags B, description C.
+CREATE FUNCTION gallery_search_vector(title TEXT, description TEXT, gid INTEGER) RETURNS tsvector
+LANGUAGE sql STABLE AS $$
+    SELECT setweight(to_tsvector('english', COALESCE(title, '')), 'A') ||
+        setweight(to_tsvector('english', COALESCE((SELECT string_agg(t.tag, ' ') FROM gallery_tags t WHERE t.gallery_id = gid), '')), 'B') ||
+        setweight(to_tsvector('english', COALESCE(description, '')), 'C')
+$$;
+
+ALTER TABLE gallery ADD COLUMN search_vector tsvector;
+UPDATE gallery SET search_vector = gallery_search_vector(title, description, id);
+ALTER TABLE gallery ALTER COLUMN search_vector SET NOT NULL;
+
+CREATE INDEX gallery_search_vector_idx ON gallery USING GIN (search_vector);
+
+CREATE FUNCTION gallery_search_vector_row() RETURNS trigger
+LANGUAGE plpgsql AS $$
+BEGIN
+    NEW.search_vector := gallery_search_vector(NEW.title, NEW.description, NEW.id);
+    RETURN NEW;
+END
+$$;
+
+CREATE TRIGGER gallery_search_vector_row
+    BEFORE INSERT OR UPDATE OF title, description ON gallery
+    FOR EACH ROW EXECUTE FUNCTION gallery_search_vector_row();
+
+CREATE FUNCTION gallery_search_vector_tags() RETURNS trigger
+LANGUAGE plpgsql AS $$
+BEGIN
+    IF TG_OP <> 'INSERT' THEN
+        UPDATE gallery SET search_vector = gallery_search_vector(title, description, id)
+        WHERE id = OLD.gallery_id;
+    END IF;
+    IF TG_OP <> 'DELETE' AND (TG_OP = 'INSERT' OR NEW.gallery_id <> OLD.gallery_id) THEN
+        UPDATE gallery SET search_vector = gallery_search_vector(title, description, id)
+        WHERE id = NEW.gallery_id;
+    END IF;
+    RETURN NULL;
+END
+$$;
+
+CREATE TRIGGER gallery_search_vector_tags
+    AFTER INSERT OR UPDATE OR DELETE ON gallery_tags
+    FOR EACH ROW EXECUTE FUNCTION gallery_search_vector_tags();
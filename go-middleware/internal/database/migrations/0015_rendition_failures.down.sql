@@ -0,0 +1 @@
+ALTER TABLE gallery DROP COLUMN IF EXISTS renditions_failed_url;
@@ -0,0 +1,3 @@
+-- The image_url renditions couldn't be made from, because the image is
+-- gone or unreadable. The backfill skips the drawing until its image changes.
+ALTER TABLE gallery ADD COLUMN renditions_failed_url TEXT;
@@ -0,0 +1,294 @@
+package handlers
+
+import (
+    "context"
+    "database/sql"
+    "encoding/json"
+    "log/slog"
+    "net/http"
+    "net/mail"
+    "net/url"
+    "strings"
+    "time"
+
+    "golang.org/x/crypto/bcrypt"
+
+    "urpaint/internal/httperr"
+    "urpaint/internal/mailer"
+)
+
+const (
+    purposeVerifyEmail   = "verify_email"
+    purposeResetPassword = "reset_password"
+
+    verifyEmailTTL   = 48 * time.Hour
+    resetPasswordTTL = time.Hour
+
+    minPasswordLength = 8
+)
+
+// validEmail accepts a bare address such as "name@example.com"
+func validEmail(email string) bool {
+    addr, err := mail.ParseAddress(email)
+    return err == nil && addr.Address == email
+}
+
+// createUserToken stores a new single-use token, retiring older unused ones
+func (h *AuthHandler) createUserToken(ctx context.Context, userID int, purpose string, ttl time.Duration) (string, error) {
+    token, err := randomToken(32)
+    if err != nil {
+        return "", err
+    }
+
+    tx, err := h.DB.BeginTx(ctx, nil)
+    if err != nil {
+        return "", err
+    }
+    defer tx.Rollback()
+
+    if _, err := tx.ExecContext(ctx,
+        "UPDATE user_tokens SET used_at = now() WHERE user_id = $1 AND purpose = $2 AND used_at IS NULL",
+        userID, purpose,
+    ); err != nil {
+        return "", err
+    }
+
+    if _, err := tx.ExecContext(ctx,
+        "INSERT INTO user_tokens (user_id, purpose, token_hash, expires_at) VALUES ($1, $2, $3, $4)",
+        userID, purpose, hashToken(token), time.Now().Add(ttl),
+    ); err != nil {
+        return "", err
+    }
+
+    return token, tx.Commit()
+}
+
+// consumeUserToken marks a live token as used and returns its owner.
+// sql.ErrNoRows means the token is unknown, expired or already used.
+func consumeUserToken(ctx context.Context, q queryer, token, purpose string) (int, error) {
+    var userID int
+    err := q.QueryRowContext(ctx,
+        `UPDATE user_tokens SET used_at = now()
+         WHERE token_hash = $1 AND purpose = $2 AND used_at IS NULL AND expires_at > now()
+         RETURNING user_id`,
+        hashToken(token), purpose,
+    ).Scan(&userID)
+    return userID, err
+}
+
+func (h *AuthHandler) link(path, token string) string {
+    base := strings.TrimSuffix(h.AppURL, "/")
+    if base == "" {
+        base = "http://localhost:5173"
+    }
+    return base + path + "?token=" + url.QueryEscape(token)
+}
+
+// Mail is sent in the background so response timing never reveals
+// whether an address has an account
+func (h *AuthHandler) sendMail(msg mailer.Message) {
+    if h.Mailer == nil {
+        slog.Warn("no mailer configured, dropping mail", "to", msg.To, "subject", msg.Subject)
+        return
+    }
+    go func() {
+        ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+        defer cancel()
+        if err := h.Mailer.Send(ctx, msg); err != nil {
+            slog.ErrorContext(ctx, "mail delivery failed", "subject", msg.Subject, "err", err)
+        }
+    }()
+}
+
+func (h *AuthHandler) sendVerificationEmail(ctx context.Context, userID int, email string) error {
+    token, err := h.createUserToken(ctx, userID, purposeVerifyEmail, verifyEmailTTL)
+    if err != nil {
+        return err
+    }
+
+    h.sendMail(mailer.Message{
+        To:      email,
+        Subject: "Confirm your URPaint email",
+        Body: "Welcome to URPaint!\n\n" +
+            "Confirm your email address by opening this link:\n" +
+            h.link("/verify-email", token) + "\n\n" +
+            "The link expires in 48 hours.",
+    })
+    return nil
+}
+
+// POST /auth/verify-email/request
+func (h *AuthHandler) RequestEmailVerification(w http.ResponseWriter, r *http.Request) {
+    userID, ok := userIDFromContext(r)
+    if !ok {
+        httperr.Write(w, r, httperr.New(http.StatusUnauthorized, "Unauthorized"))
+        return
+    }
+
+    var email string
+    var verifiedAt sql.NullTime
+    err := h.DB.QueryRow(
+        "SELECT email, email_verified_at FROM users WHERE id = $1", userID,
+    ).Scan(&email, &verifiedAt)
+    if err != nil {
+        httperr.Write(w, r, httperr.New(http.StatusNotFound, "User not found"))
+        return
+    }
+
+    if verifiedAt.Valid {
+        httperr.Write(w, r, httperr.New(http.StatusConflict, "Email already verified"))
+        return
+    }
+
+    if err := h.sendVerificationEmail(r.Context(), userID, email); err != nil {
+        httperr.Write(w, r, httperr.Internal("Failed to create verification token", err))
+        return
+    }
+
+    w.WriteHeader(http.StatusAccepted)
+}
+
+// POST /auth/verify-email
+func (h *AuthHandler) VerifyEmail(w http.ResponseWriter, r *http.Request) {
+    var input struct {
+        Token string `json:"token"`
+    }
+    if err := json.NewDecoder(r.Body).Decode(&input); err != nil || input.Token == "" {
+        httperr.Write(w, r, httperr.New(http.StatusBadRequest, "Invalid input"))
+        return
+    }
+
+    tx, err := h.DB.BeginTx(r.Context(), nil)
+    if err != nil {
+        httperr.Write(w, r, httperr.Internal("Database error", err))
+        return
+    }
+    defer tx.Rollback()
+
+    userID, err := consumeUserToken(r.Context(), tx, input.Token, purposeVerifyEmail)
+    if err == sql.ErrNoRows {
+        httperr.Write(w, r, httperr.New(http.StatusBadRequest, "Invalid or expired token").WithCode("invalid_token"))
+        return
+    }
+    if err != nil {
+        httperr.Write(w, r, httperr.Internal("Database error", err))
+        return
+    }
+
+    if _, err := tx.ExecContext(r.Context(),
+        "UPDATE users SET email_verified_at = COALESCE(email_verified_at, now()) WHERE id = $1", userID,
+    ); err != nil {
+        httperr.Write(w, r, httperr.Internal("Failed to verify email", err))
+        return
+    }
+
+    if err := tx.Commit(); err != nil {
+        httperr.Write(w, r, httperr.Internal("Failed to verify email", err))
+        return
+    }
+
+    w.WriteHeader(http.StatusNoContent)
+}
+
+// POST /auth/password/forgot
+// Always answers 202 so callers can't probe which emails are registered
+func (h *AuthHandler) ForgotPassword(w http.ResponseWriter, r *http.Request) {
+    var input struct {
+        Email string `json:"email"`
+    }
+    if err := json.NewDecoder(r.Body).Decode(&input); err != nil || input.Email == "" {
+        httperr.Write(w, r, httperr.New(http.StatusBadRequest, "Invalid input"))
+        return
+    }
+
+    var userID int
+    err := h.DB.QueryRow("SELECT id FROM users WHERE email = $1", input.Email).Scan(&userID)
+    if err != nil {
+        if err != sql.ErrNoRows {
+            slog.ErrorContext(r.Context(), "password reset lookup failed", "err", err)
+        }
+        w.WriteHeader(http.StatusAccepted)
+        return
+    }
+
+    token, err := h.createUserToken(r.Context(), userID, purposeResetPassword, resetPasswordTTL)
+    if err != nil {
+        slog.ErrorContext(r.Context(), "password reset token failed", "err", err)
+        w.WriteHeader(http.StatusAccepted)
+        return
+    }
+
+    h.sendMail(mailer.Message{
+        To:      input.Email,
+        Subject: "Reset your URPaint password",
+        Body: "Someone asked to reset the password for this URPaint account.\n\n" +
+            "Choose a new password here:\n" +
+            h.link("/reset-password", token) + "\n\n" +
+            "The link expires in one hour. If this wasn't you, ignore this email.",
+    })
+
+    w.WriteHeader(http.StatusAccepted)
+}
+
+// POST /auth/password/reset
+// Sets a new password and signs the user out everywhere
+func (h *AuthHandler) ResetPassword(w http.ResponseWriter, r *http.Request) {
+    var input struct {
+        Token    string `json:"token"`
+        Password string `json:"password"`
+    }
+    if err := json.NewDecoder(r.Body).Decode(&input); err != nil || input.Token == "" {
+        httperr.Write(w, r, httperr.New(http.StatusBadRequest, "Invalid input"))
+        return
+    }
+
+    if len(input.Password) < minPasswordLength {
+        httperr.Write(w, r, httperr.New(http.StatusBadRequest, "Password must be at least 8 characters"))
+        return
+    }
+
+    hashed, err := bcrypt.GenerateFromPassword([]byte(input.Password), bcrypt.DefaultCost)
+    if err != nil {
+        httperr.Write(w, r, httperr.Internal("Error hashing password", err))
+        return
+    }
+
+    ctx := r.Context()
+    tx, err := h.DB.BeginTx(ctx, nil)
+    if err != nil {
+        httperr.Write(w, r, httperr.Internal("Database error", err))
+        return
+    }
+    defer tx.Rollback()
+
+    userID, err := consumeUserToken(ctx, tx, input.Token, purposeResetPassword)
+    if err == sql.ErrNoRows {
+        httperr.Write(w, r, httperr.New(http.StatusBadRequest, "Invalid or expired token").WithCode("invalid_token"))
+        return
+    }
+    if err != nil {
+        httperr.Write(w, r, httperr.Internal("Database error", err))
+        return
+    }
+
+    // Receiving the link proves the user controls the address
+    if _, err := tx.ExecContext(ctx,
+        "UPDATE users SET password = $1, email_verified_at = COALESCE(email_verified_at, now()) WHERE id = $2",
+        string(hashed), userID,
+    ); err != nil {
+        httperr.Write(w, r, httperr.Internal("Failed to reset password", err))
+        return
+    }
+
+    if err := h.revokeAllTokens(ctx, tx, userID); err != nil {
+        httperr.Write(w, r, httperr.Internal("Failed to reset password", err))
+        return
+    }
+
+    if err := tx.Commit(); err != nil {
+        httperr.Write(w, r, httperr.Internal("Failed to reset password", err))
+        return
+    }
+
+    w.WriteHeader(http.StatusNoContent)
+}
@@ -0,0 +1,327 @@
+package handlers
+
+import (
+    "database/sql"
+    "encoding/json"
+    "net/http"
+    "strings"
+    "time"
+
+    "github.com/lib/pq"
+
+    "urpaint/internal/httperr"
+)
+
+type AlbumHandler struct {
+    DB *sql.DB
+}
+
+type Album struct {
+    ID        int       `json:"id"`
+    Name      string    `json:"name"`
+    ItemCount int       `json:"itemCount"`
+    CoverURL  string    `json:"coverUrl"`
+    CreatedAt time.Time `json:"createdAt"`
+}
+
+func isUniqueViolation(err error) bool {
+    pqErr, ok := err.(*pq.Error)
+    return ok && pqErr.Code == "23505"
+}
+
+func decodeAlbumName(w http.ResponseWriter, r *http.Request) (string, bool) {
+    var input struct {
+        Name string `json:"name"`
+    }
+    if err := json.NewDecoder(r.Body).Decode(&input); err != nil {
+        httperr.Write(w, r, httperr.New(http.StatusBadRequest, "Invalid input"))
+        return "", false
+    }
+
+    name := strings.TrimSpace(input.Name)
+    if name == "" || len(name) > 100 {
+        httperr.Write(w, r, httperr.New(http.StatusBadRequest, "Album name must be 1-100 characters"))
+        return "", false
+    }
+    return name, true
+}
+
+// GET /albums
+func (h *AlbumHandler) ListAlbums(w http.ResponseWriter, r *http.Request) {
+    userID, ok := userIDFromContext(r)
+    if !ok {
+        httperr.Write(w, r, httperr.New(http.StatusUnauthorized, "Unauthorized"))
+        return
+    }
+
+    // Trashed drawings neither count nor act as the cover
+    rows, err := h.DB.Query(
+        `SELECT a.id, a.name, a.created_at,
+                COUNT(g.id),
+                (ARRAY_AGG(g.image_url ORDER BY ai.order_index, g.id) FILTER (WHERE g.id IS NOT NULL))[1]
+         FROM albums a
+         LEFT JOIN album_items ai ON ai.album_id = a.id
+         LEFT JOIN gallery g ON g.id = ai.gallery_id AND g.deleted_at IS NULL
+         WHERE a.user_id = $1
+         GROUP BY a.id
+         ORDER BY a.name`,
+        userID,
+    )
+    if err != nil {
+        httperr.Write(w, r, httperr.Internal("Database error", err))
+        return
+    }
+    defer rows.Close()
+
+    albums := []Album{}
+    for rows.Next() {
+        var album Album
+        var cover sql.NullString
+        if err := rows.Scan(&album.ID, &album.Name, &album.CreatedAt, &album.ItemCount, &cover); err != nil {
+            httperr.Write(w, r, httperr.Internal("Database error", err))
+            return
+        }
+        album.CoverURL = cover.String
+        albums = append(albums, album)
+    }
+    if err := rows.Err(); err != nil {
+        httperr.Write(w, r, httperr.Internal("Database error", err))
+        return
+    }
+
+    w.Header().Set("Content-Type", "application/json")
+    json.NewEncoder(w).Encode(albums)
+}
+
+// POST /albums
+func (h *AlbumHandler) CreateAlbum(w http.ResponseWriter, r *http.Request) {
+    userID, ok := userIDFromContext(r)
+    if !ok {
+        httperr.Write(w, r, httperr.New(http.StatusUnauthorized, "Unauthorized"))
+        return
+    }
+
+    name, ok := decodeAlbumName(w, r)
+    if !ok {
+        return
+    }
+
+    album := Album{Name: name}
+    err := h.DB.QueryRow(
+        "INSERT INTO albums (user_id, name) VALUES ($1, $2) RETURNING id, created_at",
+        userID, name,
+    ).Scan(&album.ID, &album.CreatedAt)
+    if isUniqueViolation(err) {
+        httperr.Write(w, r, httperr.New(http.StatusConflict, "Album already exists"))
+        return
+    }
+    if err != nil {
+        httperr.Write(w, r, httperr.Internal("Failed to create album", err))
+        return
+    }
+
+    w.Header().Set("Content-Type", "application/json")
+    w.WriteHeader(http.StatusCreated)
+    json.NewEncoder(w).Encode(album)
+}
+
+// PATCH /albums?id=
+func (h *AlbumHandler) RenameAlbum(w http.ResponseWriter, r *http.Request) {
+    userID, ok := userIDFromContext(r)
+    if !ok {
+        httperr.Write(w, r, httperr.New(http.StatusUnauthorized, "Unauthorized"))
+        return
+    }
+
+    albumID, ok := intParam(w, r, "id", "album ID")
+    if !ok {
+        return
+    }
+
+    name, ok := decodeAlbumName(w, r)
+    if !ok {
+        return
+    }
+
+    res, err := h.DB.Exec(
+        "UPDATE albums SET name = $1 WHERE id = $2 AND user_id = $3",
+        name, albumID, userID,
+    )
+    if isUniqueViolation(err) {
+        httperr.Write(w, r, httperr.New(http.StatusConflict, "Album already exists"))
+        return
+    }
+    if err != nil {
+        httperr.Write(w, r, httperr.Internal("Failed to rename album", err))
+        return
+    }
+    if n, _ := res.RowsAffected(); n == 0 {
+        httperr.Write(w, r, httperr.New(http.StatusNotFound, "Album not found"))
+        return
+    }
+
+    w.WriteHeader(http.StatusNoContent)
+}
+
+// DELETE /albums?id=
+// Only the album goes away, its drawings stay in the gallery
+func (h *AlbumHandler) DeleteAlbum(w http.ResponseWriter, r *http.Request) {
+    userID, ok := userIDFromContext(r)
+    if !ok {
+        httperr.Write(w, r, httperr.New(http.StatusUnauthorized, "Unauthorized"))
+        return
+    }
+
+    albumID, ok := intParam(w, r, "id", "album ID")
+    if !ok {
+        return
+    }
+
+    res, err := h.DB.Exec("DELETE FROM albums WHERE id = $1 AND user_id = $2", albumID, userID)
+    if err != nil {
+        httperr.Write(w, r, httperr.Internal("Failed to delete album", err))
+        return
+    }
+    if n, _ := res.RowsAffected(); n == 0 {
+        httperr.Write(w, r, httperr.New(http.StatusNotFound, "Album not found"))
+        return
+    }
+
+    w.WriteHeader(http.StatusNoContent)
+}
+
+// POST /albums/items?id=&drawing=
+// Adds a drawing to the end of the album
+func (h *AlbumHandler) AddAlbumItem(w http.ResponseWriter, r *http.Request) {
+    userID, ok := userIDFromContext(r)
+    if !ok {
+        httperr.Write(w, r, httperr.New(http.StatusUnauthorized, "Unauthorized"))
+        return
+    }
+
+    albumID, ok := intParam(w, r, "id", "album ID")
+    if !ok {
+        return
+    }
+    drawingID, ok := intParam(w, r, "drawing", "drawing ID")
+    if !ok {
+        return
+    }
+
+    res, err := h.DB.Exec(
+        `INSERT INTO album_items (album_id, gallery_id, order_index)
+         SELECT a.id, g.id,
+                COALESCE((SELECT MAX(order_index) + 1 FROM album_items WHERE album_id = a.id), 0)
+         FROM albums a, gallery g
+         WHERE a.id = $1 AND a.user_id = $3 AND g.id = $2 AND g.user_id = $3 AND g.deleted_at IS NULL
+         ON CONFLICT (album_id, gallery_id) DO NOTHING`,
+        albumID, drawingID, userID,
+    )
+    if err != nil {
+        httperr.Write(w, r, httperr.Internal("Failed to add drawing to album", err))
+        return
+    }
+
+    if n, _ := res.RowsAffected(); n == 0 {
+        // Either it was already there, or the album or drawing isn't the user's
+        var member bool
+        err := h.DB.QueryRow(
+            `SELECT EXISTS (SELECT 1 FROM album_items ai JOIN albums a ON a.id = ai.album_id
+             WHERE ai.album_id = $1 AND ai.gallery_id = $2 AND a.user_id = $3)`,
+            albumID, drawingID, userID,
+        ).Scan(&member)
+        if err != nil {
+            httperr.Write(w, r, httperr.Internal("Database error", err))
+            return
+        }
+        if !member {
+            httperr.Write(w, r, httperr.New(http.StatusNotFound, "Album or drawing not found"))
+            return
+        }
+    }
+
+    w.WriteHeader(http.StatusNoContent)
+}
+
+// DELETE /albums/items?id=&drawing=
+func (h *AlbumHandler) RemoveAlbumItem(w http.ResponseWriter, r *http.Request) {
+    userID, ok := userIDFromContext(r)
+    if !ok {
+        httperr.Write(w, r, httperr.New(http.StatusUnauthorized, "Unauthorized"))
+        return
+    }
+
+    albumID, ok := intParam(w, r, "id", "album ID")
+    if !ok {
+        return
+    }
+    drawingID, ok := intParam(w, r, "drawing", "drawing ID")
+    if !ok {
+        return
+    }
+
+    res, err := h.DB.Exec(
+        `DELETE FROM album_items ai USING albums a
+         WHERE ai.album_id = a.id AND ai.album_id = $1 AND ai.gallery_id = $2 AND a.user_id = $3`,
+        albumID, drawingID, userID,
+    )
+    if err != nil {
+        httperr.Write(w, r, httperr.Internal("Failed to remove drawing from album", err))
+        return
+    }
+    if n, _ := res.RowsAffected(); n == 0 {
+        httperr.Write(w, r, httperr.New(http.StatusNotFound, "Drawing not in album"))
+        return
+    }
+
+    w.WriteHeader(http.StatusNoContent)
+}
+
+// PATCH /albums/reorder?id=
+// Same body as /gallery/reorder: {"order": [drawingID, ...]}
+func (h *AlbumHandler) ReorderAlbum(w http.ResponseWriter, r *http.Request) {
+    userID, ok := userIDFromContext(r)
+    if !ok {
+        httperr.Write(w, r, httperr.New(http.StatusUnauthorized, "Unauthorized"))
+        return
+    }
+
+    albumID, ok := intParam(w, r, "id", "album ID")
+    if !ok {
+        return
+    }
+
+    var input struct {
+        Order []int `json:"order"`
+    }
+    if err := json.NewDecoder(r.Body).Decode(&input); err != nil {
+        httperr.Write(w, r, httperr.New(http.StatusBadRequest, "Invalid input"))
+        return
+    }
+
+    var owned bool
+    err := h.DB.QueryRow(
+        "SELECT EXISTS (SELECT 1 FROM albums WHERE id = $1 AND user_id = $2)", albumID, userID,
+    ).Scan(&owned)
+    if err != nil {
+        httperr.Write(w, r, httperr.Internal("Database error", err))
+        return
+    }
+    if !owned {
+        httperr.Write(w, r, httperr.New(http.StatusNotFound, "Album not found"))
+        return
+    }
+
+    for index, id := range input.Order {
+        _, err := h.DB.Exec(
+            "UPDATE album_items SET order_index = $1 WHERE album_id = $2 AND gallery_id = $3",
+            index, albumID, id,
+        )
+        if err != nil {
+            httperr.Write(w, r, httperr.Internal("Failed to update order", err))
+            return
+        }
+    }
+
+    w.WriteHeader(http.StatusNoContent)
+}
@@ -1,23 +1,31 @@
 package handlers
 
 import (
+    "bytes"
     "database/sql"
 	"encoding/json"
+    "log/slog"
     "net/http"
     "time"
     "strings"
-    "os"
+    "strconv"
 
-    "github.com/cloudinary/cloudinary-go/v2"
-    "github.com/cloudinary/cloudinary-go/v2/api/uploader"
-    "github.com/golang-jwt/jwt/v5"
     "golang.org/x/crypto/bcrypt"
     "github.com/lib/pq"
+
+    "urpaint/internal/httperr"
+    "urpaint/internal/mailer"
+    "urpaint/internal/storage"
+    "urpaint/internal/uploads"
 )
 
 type AuthHandler struct {
     DB *sql.DB
 	JWTSecret []byte
+	AccessTTL time.Duration
+	RefreshTTL time.Duration
+	Mailer mailer.Mailer
+	AppURL string
 }
 
 type Credentials struct {
@@ -33,28 +41,24 @@ type User struct {
 
 type ProfileHandler struct {
     DB *sql.DB
+    Quotas *Quotas
 }
 
 type AvatarHandler struct {
     DB *sql.DB
-    CloudinaryURL string
+    Storage storage.Storage
+    Uploads uploads.Limits
+    Quotas *Quotas
 }
 
 // GET /profile
 
 func (h *ProfileHandler) GetProfile(w http.ResponseWriter, r *http.Request) {
-    claims, ok := r.Context().Value("claims").(jwt.MapClaims)
-    if !ok {
-        http.Error(w, "Claims not found", http.StatusUnauthorized)
-        return
-    }
-
-    userIDFloat, ok := claims["id"].(float64)
+    userID, ok := userIDFromContext(r)
     if !ok {
-        http.Error(w, "Invalid user ID in claims", http.StatusUnauthorized)
+        httperr.Write(w, r, httperr.New(http.StatusUnauthorized, "Unauthorized"))
         return
     }
-    userID := int(userIDFloat)
 
     var profile struct {
         ID       int    `json:"id"`
@@ -62,24 +66,26 @@ func (h *ProfileHandler) GetProfile(w http.ResponseWriter, r *http.Request) {
         Bio      string `json:"bio"`
         JoinedAt string `json:"joinedAt"`
         AvatarURL string `json:"avatarUrl"`
+        EmailVerified bool `json:"emailVerified"`
     }
 
     var bio sql.NullString
     var createdAt sql.NullTime
     var avatar sql.NullString
+    var verifiedAt sql.NullTime
 
     err := h.DB.QueryRow(
-        "SELECT id, email, bio, created_at, avatar_url FROM users WHERE id = $1",
+        "SELECT id, email, bio, created_at, avatar_url, email_verified_at FROM users WHERE id = $1",
         userID,
-    ).Scan(&profile.ID, &profile.Email, &bio, &createdAt, &avatar)
+    ).Scan(&profile.ID, &profile.Email, &bio, &createdAt, &avatar, &verifiedAt)
     
     if err != nil {
         if err == sql.ErrNoRows {
-            http.Error(w, "User not found", http.StatusNotFound)
+            httperr.Write(w, r, httperr.New(http.StatusNotFound, "User not found"))
             return
         }
 
-        http.Error(w, "Database error: "+err.Error(), http.StatusInternalServerError)
+        httperr.Write(w, r, httperr.Internal("Database error", err))
         return
     }
 
@@ -102,36 +108,25 @@ func (h *ProfileHandler) GetProfile(w http.ResponseWriter, r *http.Request) {
         profile.AvatarURL = ""
     }
 
+    profile.EmailVerified = verifiedAt.Valid
+
     w.Header().Set("Content-Type", "application/json")
     json.NewEncoder(w).Encode(profile)
 }
 
 // PATCH /profile
 func(h *ProfileHandler) UpdateProfile(w http.ResponseWriter, r *http.Request) {
-    if r.Method != http.MethodPatch {
-        http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
-        return
-    }
-
-    claims, ok := r.Context().Value("claims").(jwt.MapClaims)
-    if !ok {
-        http.Error(w, "Claims not found", http.StatusUnauthorized)
-        return
-    }
-
-    userIDFloat, ok := claims["id"].(float64)
+    userID, ok := userIDFromContext(r)
     if !ok {
-        http.Error(w, "Invalid user ID in claims", http.StatusUnauthorized)
+        httperr.Write(w, r, httperr.New(http.StatusUnauthorized, "Unauthorized"))
         return
     }
 
-    userID := int(userIDFloat)
-
     var input struct {
         Bio string `json:"bio"`
     }
     if err := json.NewDecoder(r.Body).Decode(&input); err != nil {
-        http.Error(w, "Invalid input", http.StatusBadRequest)
+        httperr.Write(w, r, httperr.New(http.StatusBadRequest, "Invalid input"))
         return
     }
 
@@ -140,7 +135,7 @@ func(h *ProfileHandler) UpdateProfile(w http.ResponseWriter, r *http.Request) {
         input.Bio, userID,
     )
     if err != nil {
-        http.Error(w, "Failed to update profile: "+err.Error(), http.StatusInternalServerError)
+        httperr.Write(w, r, httperr.Internal("Failed to update profile", err))
         return
     }
 
@@ -150,50 +145,62 @@ func(h *ProfileHandler) UpdateProfile(w http.ResponseWriter, r *http.Request) {
 // signup
 
 func (h *AuthHandler) Signup(w http.ResponseWriter, r *http.Request) {
-    if r.Method != http.MethodPost {
-        http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
-        return
-    }
-
     var creds Credentials
     if err := json.NewDecoder(r.Body).Decode(&creds); err != nil {
-        http.Error(w, "Invalid input", http.StatusBadRequest)
+        httperr.Write(w, r, httperr.New(http.StatusBadRequest, "Invalid input"))
         return
     }
 
     if creds.Email == "" || creds.Password == "" {
-        http.Error(w, "Email and password required", http.StatusBadRequest)
+        httperr.Write(w, r, httperr.New(http.StatusBadRequest, "Email and password required"))
+        return
+    }
+
+    if !validEmail(creds.Email) {
+        httperr.Write(w, r, httperr.New(http.StatusBadRequest, "Invalid email address"))
+        return
+    }
+
+    if len(creds.Password) < minPasswordLength {
+        httperr.Write(w, r, httperr.New(http.StatusBadRequest, "Password must be at least 8 characters").
+            WithDetails(httperr.Field("password")))
         return
     }
 
     hashed, err := bcrypt.GenerateFromPassword([]byte(creds.Password), bcrypt.DefaultCost)
     if err != nil {
-        http.Error(w, "Error hashing password", http.StatusInternalServerError)
+        httperr.Write(w, r, httperr.Internal("Error hashing password", err))
         return
     }
 
-    _, err = h.DB.Exec(
-        "INSERT INTO users (email, password) Values ($1, $2)",
+    var userID int
+    err = h.DB.QueryRow(
+        "INSERT INTO users (email, password) Values ($1, $2) RETURNING id",
         creds.Email, string(hashed),
-    )
+    ).Scan(&userID)
 
     if err != nil {
         
         if pqErr, ok := err.(*pq.Error); ok && pqErr.Code == "23505" {
-            http.Error(w, "Email already exists", http.StatusConflict)
+            httperr.Write(w, r, httperr.New(http.StatusConflict, "Email already exists").WithCode("email_taken").WithDetails(httperr.Field("email")))
             return
         }
 
         
         if strings.Contains(err.Error(), "duplicate key") || strings.Contains(err.Error(), "unique constraint") {
-            http.Error(w, "Email already exists", http.StatusConflict)
+            httperr.Write(w, r, httperr.New(http.StatusConflict, "Email already exists").WithCode("email_taken").WithDetails(httperr.Field("email")))
             return
         }
 
-        http.Error(w, "Failed to create user: "+err.Error(), http.StatusInternalServerError)
+        httperr.Write(w, r, httperr.Internal("Failed to create user", err))
         return
     }
 
+    // The account works right away, verification only confirms the address
+    if err := h.sendVerificationEmail(r.Context(), userID, creds.Email); err != nil {
+        slog.ErrorContext(r.Context(), "verification email failed", "user_id", userID, "err", err)
+    }
+
     w.Header().Set("Content-Type", "application/json")
     w.WriteHeader(http.StatusCreated)
     json.NewEncoder(w).Encode(map[string]string{"message": "User created"})
@@ -202,108 +209,100 @@ func (h *AuthHandler) Signup(w http.ResponseWriter, r *http.Request) {
 // login
 
 func (h *AuthHandler) Login(w http.ResponseWriter, r *http.Request) {
-    if r.Method != http.MethodPost {
-        http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
-        return
-    }
-
     var creds Credentials
     if err := json.NewDecoder(r.Body).Decode(&creds); err != nil {
-        http.Error(w, "Invalid input", http.StatusBadRequest)
+        httperr.Write(w, r, httperr.New(http.StatusBadRequest, "Invalid input"))
         return
     }
 
     var user User
     var storedHash string
-    err := h.DB.QueryRow("SELECT id, email, password FROM users WHERE email = $1", creds.Email).
-        Scan(&user.ID, &user.Email, &storedHash)
+    var tokenVersion int
+    err := h.DB.QueryRow("SELECT id, email, password, token_version FROM users WHERE email = $1", creds.Email).
+        Scan(&user.ID, &user.Email, &storedHash, &tokenVersion)
     if err != nil {
-        http.Error(w, "Invalid credentials", http.StatusUnauthorized)
+        httperr.Write(w, r, httperr.New(http.StatusUnauthorized, "Invalid credentials").WithCode("invalid_credentials"))
         return
     }
 
     if err := bcrypt.CompareHashAndPassword([]byte(storedHash), []byte(creds.Password)); err != nil {
-        http.Error(w, "Invalid credentials", http.StatusUnauthorized)
+        httperr.Write(w, r, httperr.New(http.StatusUnauthorized, "Invalid credentials").WithCode("invalid_credentials"))
         return
     }
 
-    // Create JWT
-    claims := jwt.MapClaims{
-        "id":    user.ID,
-        "email": user.Email,
-        "exp":   time.Now().Add(24 * time.Hour).Unix(),
+    // Short-lived JWT plus a refresh token that starts a new family
+    family, err := randomToken(16)
+    if err != nil {
+        httperr.Write(w, r, httperr.Internal("Could not generate token", err))
+        return
     }
 
-    token := jwt.NewWithClaims(jwt.SigningMethodHS256, claims)
-    signed, err := token.SignedString(h.JWTSecret)
+    pair, _, err := h.issueTokens(r.Context(), h.DB, user.ID, user.Email, tokenVersion, family)
     if err != nil {
-        http.Error(w, "Could not generate token", http.StatusInternalServerError)
+        httperr.Write(w, r, httperr.Internal("Could not generate token", err))
         return
     }
 
     w.Header().Set("Content-Type", "application/json")
-    json.NewEncoder(w).Encode(map[string]string{"token": signed})
+    json.NewEncoder(w).Encode(pair)
 }
 
 // Upload Avatar
 func (h *AvatarHandler) UploadAvatar(w http.ResponseWriter, r *http.Request) {
-    if r.Method != http.MethodPost {
-        http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+    userID, ok := userIDFromContext(r)
+    if !ok {
+        httperr.Write(w, r, httperr.New(http.StatusUnauthorized, "Unauthorized"))
         return
     }
 
-    claims, ok := r.Context().Value("claims").(jwt.MapClaims)
+    if !parseUpload(w, r, h.Uploads.Bytes()) {
+        return
+    }
+    avatar, ok := readImage(w, r, "avatar", h.Uploads, false)
     if !ok {
-        http.Error(w, "Claims not found", http.StatusUnauthorized)
         return
     }
-
-    userIDFloat, ok := claims["id"].(float64)
+    release, ok := h.Quotas.allow(w, r, userID, int64(len(avatar.Data)))
     if !ok {
-        http.Error(w, "Invalid user ID in claims", http.StatusUnauthorized)
         return
     }
-    userID := int(userIDFloat)
+    defer release()
+    file := bytes.NewReader(avatar.Data)
 
-    file, _, err := r.FormFile("avatar")
+    var existing sql.NullString
+    err := h.DB.QueryRow("SELECT avatar_url FROM users WHERE id=$1", userID).Scan(&existing)
     if err != nil {
-        http.Error(w, "Failed to read file: "+err.Error(), http.StatusBadRequest)
+        httperr.Write(w, r, httperr.New(http.StatusNotFound, "User not found"))
         return
     }
-    defer file.Close()
-    
-    overwrite := true
 
-    uploadParams := uploader.UploadParams{
-        Folder: "URPaint Avatars",
-        PublicID: "avatar",
-        Overwrite: &overwrite,
-        ResourceType: "image",
+    // Replace the user's previous avatar in place when it lives in their folder
+    folder := "URPaint Avatars/user_" + strconv.Itoa(userID)
+    var obj storage.Object
+    if key := h.Storage.KeyFromURL(existing.String); strings.HasPrefix(key, folder+"/") {
+        obj, err = h.Storage.Overwrite(r.Context(), key, file)
+    } else {
+        obj, err = h.Storage.Put(r.Context(), folder, file)
     }
-
-    // Cloudinary
-    cld, err := cloudinary.NewFromURL(os.Getenv("CLOUDINARY_URL"))
     if err != nil {
-        http.Error(w, "Cloudinary init error: "+err.Error(), http.StatusInternalServerError)
+        httperr.Write(w, r, httperr.Internal("Upload error", err))
         return
     }
-
-    uploadResult, err := cld.Upload.Upload(r.Context(), file, uploadParams)
-    if err != nil {
-        http.Error(w, "Upload error: "+err.Error(), http.StatusInternalServerError)
+    if err := trackAsset(r.Context(), h.DB, userID, obj); err != nil {
+        httperr.Write(w, r, httperr.Internal("Failed to save avatar", err))
         return
     }
 
     // Url in DB
-    _, err = h.DB.Exec("UPDATE users SET avatar_url=$1 WHERE id=$2", uploadResult.SecureURL, userID)
+    _, err = h.DB.Exec("UPDATE users SET avatar_url=$1 WHERE id=$2", obj.URL, userID)
     if err != nil {
-        http.Error(w, "Failed to save avatar URL: "+err.Error(), http.StatusInternalServerError)
+        httperr.Write(w, r, httperr.Internal("Failed to save avatar URL", err))
         return
     }
 
     w.Header().Set("Content-Type", "application/json")
     json.NewEncoder(w).Encode(map[string]string{
-        "avatarUrl": uploadResult.SecureURL,
+        "avatarUrl": obj.URL,
     })
 }
 
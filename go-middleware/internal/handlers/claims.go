@@ -0,0 +1,28 @@
+package handlers
+
+import (
+    "net/http"
+
+    "github.com/golang-jwt/jwt/v5"
+)
+
+// claimsFromContext reads the claims JWTAuth stored on the request
+func claimsFromContext(r *http.Request) (jwt.MapClaims, bool) {
+    claims, ok := r.Context().Value("claims").(jwt.MapClaims)
+    return claims, ok
+}
+
+// userIDFromContext reads the user ID that JWTAuth stored on the request.
+// Every handler answers 401 Unauthorized when it's missing.
+func userIDFromContext(r *http.Request) (int, bool) {
+    claims, ok := claimsFromContext(r)
+    if !ok {
+        return 0, false
+    }
+
+    userIDFloat, ok := claims["id"].(float64)
+    if !ok {
+        return 0, false
+    }
+    return int(userIDFloat), true
+}
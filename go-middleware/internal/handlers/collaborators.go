@@ -0,0 +1,322 @@
+package handlers
+
+import (
+    "context"
+    "database/sql"
+    "encoding/json"
+    "errors"
+    "net/http"
+    "strings"
+    "time"
+
+    "urpaint/internal/httperr"
+    "urpaint/internal/collab"
+    "urpaint/internal/metrics"
+    "urpaint/internal/uploads"
+)
+
+type Collaborator struct {
+    UserID  int       `json:"userId"`
+    Email   string    `json:"email"`
+    AddedAt time.Time `json:"addedAt"`
+}
+
+// ownsDrawing reports whether a live drawing belongs to the user
+func (h *GalleryHandler) ownsDrawing(ctx context.Context, drawingID, userID int) (bool, error) {
+    var owned bool
+    err := h.DB.QueryRowContext(ctx,
+        "SELECT EXISTS (SELECT 1 FROM gallery WHERE id = $1 AND user_id = $2 AND deleted_at IS NULL)",
+        drawingID, userID,
+    ).Scan(&owned)
+    return owned, err
+}
+
+// GET /gallery/collaborators?id=
+func (h *GalleryHandler) ListCollaborators(w http.ResponseWriter, r *http.Request) {
+    userID, ok := userIDFromContext(r)
+    if !ok {
+        httperr.Write(w, r, httperr.New(http.StatusUnauthorized, "Unauthorized"))
+        return
+    }
+
+    drawingID, ok := drawingIDParam(w, r)
+    if !ok {
+        return
+    }
+
+    owned, err := h.ownsDrawing(r.Context(), drawingID, userID)
+    if err != nil {
+        httperr.Write(w, r, httperr.Internal("Database error", err))
+        return
+    }
+    if !owned {
+        httperr.Write(w, r, httperr.New(http.StatusNotFound, "Drawing not found"))
+        return
+    }
+
+    rows, err := h.DB.Query(
+        `SELECT u.id, u.email, c.added_at
+         FROM drawing_collaborators c JOIN users u ON u.id = c.user_id
+         WHERE c.gallery_id = $1
+         ORDER BY c.added_at`,
+        drawingID,
+    )
+    if err != nil {
+        httperr.Write(w, r, httperr.Internal("Database error", err))
+        return
+    }
+    defer rows.Close()
+
+    collaborators := []Collaborator{}
+    for rows.Next() {
+        var c Collaborator
+        if err := rows.Scan(&c.UserID, &c.Email, &c.AddedAt); err != nil {
+            httperr.Write(w, r, httperr.Internal("Database error", err))
+            return
+        }
+        collaborators = append(collaborators, c)
+    }
+    if err := rows.Err(); err != nil {
+        httperr.Write(w, r, httperr.Internal("Database error", err))
+        return
+    }
+
+    w.Header().Set("Content-Type", "application/json")
+    json.NewEncoder(w).Encode(collaborators)
+}
+
+// POST /gallery/collaborators?id=
+// Body: {"email": "..."}
+func (h *GalleryHandler) AddCollaborator(w http.ResponseWriter, r *http.Request) {
+    userID, ok := userIDFromContext(r)
+    if !ok {
+        httperr.Write(w, r, httperr.New(http.StatusUnauthorized, "Unauthorized"))
+        return
+    }
+
+    drawingID, ok := drawingIDParam(w, r)
+    if !ok {
+        return
+    }
+
+    var input struct {
+        Email string `json:"email"`
+    }
+    if err := json.NewDecoder(r.Body).Decode(&input); err != nil {
+        httperr.Write(w, r, httperr.New(http.StatusBadRequest, "Invalid input"))
+        return
+    }
+    email := strings.TrimSpace(input.Email)
+    if email == "" {
+        httperr.Write(w, r, httperr.New(http.StatusBadRequest, "Email is required"))
+        return
+    }
+
+    owned, err := h.ownsDrawing(r.Context(), drawingID, userID)
+    if err != nil {
+        httperr.Write(w, r, httperr.Internal("Database error", err))
+        return
+    }
+    if !owned {
+        httperr.Write(w, r, httperr.New(http.StatusNotFound, "Drawing not found"))
+        return
+    }
+
+    var c Collaborator
+    err = h.DB.QueryRow("SELECT id, email FROM users WHERE email = $1", email).Scan(&c.UserID, &c.Email)
+    if err == sql.ErrNoRows {
+        httperr.Write(w, r, httperr.New(http.StatusNotFound, "User not found"))
+        return
+    }
+    if err != nil {
+        httperr.Write(w, r, httperr.Internal("Database error", err))
+        return
+    }
+
+    if c.UserID == userID {
+        httperr.Write(w, r, httperr.New(http.StatusBadRequest, "You already own this drawing"))
+        return
+    }
+
+    err = h.DB.QueryRow(
+        `INSERT INTO drawing_collaborators (gallery_id, user_id) VALUES ($1, $2)
+         ON CONFLICT (gallery_id, user_id) DO UPDATE SET added_at = drawing_collaborators.added_at
+         RETURNING added_at`,
+        drawingID, c.UserID,
+    ).Scan(&c.AddedAt)
+    if err != nil {
+        httperr.Write(w, r, httperr.Internal("Failed to add collaborator", err))
+        return
+    }
+
+    w.Header().Set("Content-Type", "application/json")
+    w.WriteHeader(http.StatusCreated)
+    json.NewEncoder(w).Encode(c)
+}
+
+// DELETE /gallery/collaborators?id=&user=
+func (h *GalleryHandler) RemoveCollaborator(w http.ResponseWriter, r *http.Request) {
+    userID, ok := userIDFromContext(r)
+    if !ok {
+        httperr.Write(w, r, httperr.New(http.StatusUnauthorized, "Unauthorized"))
+        return
+    }
+
+    drawingID, ok := drawingIDParam(w, r)
+    if !ok {
+        return
+    }
+    collaboratorID, ok := intParam(w, r, "user", "user ID")
+    if !ok {
+        return
+    }
+
+    res, err := h.DB.Exec(
+        `DELETE FROM drawing_collaborators c USING gallery g
+         WHERE g.id = c.gallery_id AND c.gallery_id = $1 AND g.user_id = $2 AND c.user_id = $3`,
+        drawingID, userID, collaboratorID,
+    )
+    if err != nil {
+        httperr.Write(w, r, httperr.Internal("Failed to remove collaborator", err))
+        return
+    }
+    if n, _ := res.RowsAffected(); n == 0 {
+        httperr.Write(w, r, httperr.New(http.StatusNotFound, "Collaborator not found"))
+        return
+    }
+
+    w.WriteHeader(http.StatusNoContent)
+}
+
+// OpenDrawing lets the owner and invited collaborators into a drawing's
+// live room and returns the image late joiners start from
+func (h *GalleryHandler) OpenDrawing(ctx context.Context, drawingID, userID int) (string, error) {
+    var ownerID int
+    var editURL, imageURL sql.NullString
+    err := h.DB.QueryRowContext(ctx,
+        "SELECT user_id, edit_url, image_url FROM gallery WHERE id = $1 AND deleted_at IS NULL",
+        drawingID,
+    ).Scan(&ownerID, &editURL, &imageURL)
+    if err == sql.ErrNoRows {
+        return "", collab.ErrNotFound
+    }
+    if err != nil {
+        return "", err
+    }
+
+    if ownerID != userID {
+        var invited bool
+        err := h.DB.QueryRowContext(ctx,
+            "SELECT EXISTS (SELECT 1 FROM drawing_collaborators WHERE gallery_id = $1 AND user_id = $2)",
+            drawingID, userID,
+        ).Scan(&invited)
+        if err != nil {
+            return "", err
+        }
+        if !invited {
+            // Don't reveal that someone else's drawing exists
+            return "", collab.ErrNotFound
+        }
+    }
+
+    if editURL.String != "" {
+        return editURL.String, nil
+    }
+    return imageURL.String, nil
+}
+
+// SaveDrawing stores a room's merged canvas as a new revision of the
+// drawing, in the owner's folder whoever happened to upload it
+func (h *GalleryHandler) SaveDrawing(ctx context.Context, drawingID int, editImage, galleryImage []byte) (string, error) {
+    edit, err := h.snapshotImage("editImage", editImage)
+    if err != nil {
+        return "", err
+    }
+    gallery, err := h.snapshotImage("galleryImage", galleryImage)
+    if err != nil {
+        return "", err
+    }
+
+    var ownerID int
+    err = h.DB.QueryRowContext(ctx,
+        "SELECT user_id FROM gallery WHERE id = $1 AND deleted_at IS NULL",
+        drawingID,
+    ).Scan(&ownerID)
+    if err == sql.ErrNoRows {
+        return "", collab.ErrNotFound
+    }
+    if err != nil {
+        return "", err
+    }
+
+    // Held until the new images are tracked, like any other upload
+    release, err := h.Quotas.reserve(ctx, ownerID, imageBytes(edit)+imageBytes(gallery))
+    var exceeded *quotaError
+    if errors.As(err, &exceeded) {
+        return "", &collab.SnapshotError{Message: "the drawing's owner is out of storage. " + exceeded.Error()}
+    }
+    if err != nil {
+        return "", err
+    }
+    defer release()
+
+    editObj, err := h.putAsset(ctx, ownerID, edit.Data)
+    if err != nil {
+        return "", err
+    }
+    imageObj, err := h.putAsset(ctx, ownerID, gallery.Data)
+    if err != nil {
+        h.deleteAsset(ctx, editObj.URL)
+        return "", err
+    }
+
+    // Nothing points at the new objects until the commit
+    cleanup := func() {
+        h.deleteAsset(ctx, editObj.URL)
+        h.deleteAsset(ctx, imageObj.URL)
+    }
+
+    tx, err := h.DB.BeginTx(ctx, nil)
+    if err != nil {
+        cleanup()
+        return "", err
+    }
+    defer tx.Rollback()
+
+    _, err = tx.ExecContext(ctx,
+        "UPDATE gallery SET edit_url = $1, image_url = $2, document_id = NULL WHERE id = $3 AND deleted_at IS NULL",
+        editObj.URL, imageObj.URL, drawingID,
+    )
+    if err != nil {
+        cleanup()
+        return "", err
+    }
+    if _, err := recordRevision(ctx, tx, drawingID, editObj.Bytes+imageObj.Bytes); err != nil {
+        cleanup()
+        return "", err
+    }
+    if err := tx.Commit(); err != nil {
+        cleanup()
+        return "", err
+    }
+
+    h.pruneRevisions(ctx, drawingID)
+    h.queueRenditions(ctx, ownerID, drawingID)
+    return editObj.URL, nil
+}
+
+// snapshotImage puts a snapshot image through the same checks as an
+// upload, so a participant can't store what UploadDrawing would refuse
+func (h *GalleryHandler) snapshotImage(field string, data []byte) (*uploads.Image, error) {
+    img, err := uploads.Check(data, h.Uploads)
+    var rejected *uploads.Error
+    if errors.As(err, &rejected) {
+        metrics.UploadsRejected.WithLabelValues(field, rejected.Code).Inc()
+        return nil, &collab.SnapshotError{Message: field + ": " + rejected.Message}
+    }
+    if err != nil {
+        return nil, err
+    }
+    metrics.UploadBytes.WithLabelValues(field).Add(float64(len(img.Data)))
+    return &img, nil
+}
@@ -0,0 +1,435 @@
+package handlers
+
+import (
+    "bytes"
+    "context"
+    "database/sql"
+    "encoding/json"
+    "errors"
+    "image"
+    _ "image/jpeg"
+    "image/png"
+    "io"
+    "log/slog"
+    "net/http"
+    "strconv"
+    "time"
+
+    "urpaint/internal/httperr"
+    "urpaint/internal/imaging"
+    "urpaint/internal/jobs"
+    "urpaint/internal/storage"
+)
+
+const (
+    defaultConvertMaxBytes      = 5 << 20
+    defaultConvertAsyncMaxBytes = 25 << 20
+    defaultConvertMaxPixels     = 16_000_000
+    defaultConvertRetention     = 7 * 24 * time.Hour
+
+    // ConvertJob is the job kind for background conversions
+    ConvertJob = "convert"
+)
+
+// ConvertHandler turns uploaded photos into coloring pages, either in the
+// request or as a background job
+type ConvertHandler struct {
+    MaxBytes      int64
+    AsyncMaxBytes int64
+    MaxPixels     int
+    DB            *sql.DB
+    Storage       storage.Storage
+    Queue         *jobs.Queue
+    Quotas        *Quotas
+    // OutputRetention is how long a background conversion's image is kept
+    // before SweepOutputs deletes it
+    OutputRetention time.Duration
+}
+
+func (h *ConvertHandler) outputRetention() time.Duration {
+    if h.OutputRetention > 0 {
+        return h.OutputRetention
+    }
+    return defaultConvertRetention
+}
+
+// convertOptions reads the style and its parameters from the form or query
+func convertOptions(r *http.Request) (imaging.Options, error) {
+    opts := imaging.Options{Style: r.FormValue("style")}
+
+    intValue := func(name string, dst **int) error {
+        value := r.FormValue(name)
+        if value == "" {
+            return nil
+        }
+        n, err := strconv.Atoi(value)
+        if err != nil {
+            return &imaging.OptionError{Param: name, Message: "must be a whole number"}
+        }
+        *dst = &n
+        return nil
+    }
+
+    if err := intValue("blockSize", &opts.BlockSize); err != nil {
+        return opts, err
+    }
+    if err := intValue("blurRadius", &opts.BlurRadius); err != nil {
+        return opts, err
+    }
+    if err := intValue("levels", &opts.Levels); err != nil {
+        return opts, err
+    }
+    if value := r.FormValue("c"); value != "" {
+        c, err := strconv.ParseFloat(value, 64)
+        if err != nil {
+            return opts, &imaging.OptionError{Param: "c", Message: "must be a number"}
+        }
+        opts.C = &c
+    }
+    return opts, nil
+}
+
+func (h *ConvertHandler) maxPixels() int {
+    if h.MaxPixels > 0 {
+        return h.MaxPixels
+    }
+    return defaultConvertMaxPixels
+}
+
+// checkImage makes sure data is a PNG or JPEG small enough to decode
+func (h *ConvertHandler) checkImage(data []byte) (int, string) {
+    // Check dimensions before decoding so a tiny file can't claim a huge image
+    cfg, format, err := image.DecodeConfig(bytes.NewReader(data))
+    if err != nil || (format != "png" && format != "jpeg") {
+        return http.StatusBadRequest, "Invalid file type. Only JPEG and PNG are allowed."
+    }
+    if cfg.Width*cfg.Height > h.maxPixels() {
+        return http.StatusRequestEntityTooLarge, "Image has too many pixels"
+    }
+    return 0, ""
+}
+
+// readConvertUpload reads the "file" part and conversion options, answering
+// 4xx itself when either is unusable
+func (h *ConvertHandler) readConvertUpload(w http.ResponseWriter, r *http.Request, maxBytes int64) ([]byte, imaging.Options, bool) {
+    // Leave room for the multipart framing around the file
+    r.Body = http.MaxBytesReader(w, r.Body, maxBytes+1<<20)
+    file, _, err := r.FormFile("file")
+    var tooLarge *http.MaxBytesError
+    if errors.As(err, &tooLarge) {
+        httperr.Write(w, r, httperr.New(http.StatusRequestEntityTooLarge, "File too large").WithDetails(httperr.Field("file")))
+        return nil, imaging.Options{}, false
+    }
+    if err == http.ErrMissingFile {
+        httperr.Write(w, r, httperr.New(http.StatusBadRequest, "No file uploaded").WithDetails(httperr.Field("file")))
+        return nil, imaging.Options{}, false
+    }
+    if err != nil {
+        httperr.Write(w, r, httperr.New(http.StatusBadRequest, "Failed to read upload").WithDetails(httperr.Field("file")))
+        return nil, imaging.Options{}, false
+    }
+    defer file.Close()
+
+    data, err := io.ReadAll(io.LimitReader(file, maxBytes+1))
+    if err != nil {
+        httperr.Write(w, r, httperr.New(http.StatusBadRequest, "Failed to read upload").WithDetails(httperr.Field("file")))
+        return nil, imaging.Options{}, false
+    }
+    if len(data) == 0 {
+        httperr.Write(w, r, httperr.New(http.StatusBadRequest, "Uploaded file is empty").WithDetails(httperr.Field("file")))
+        return nil, imaging.Options{}, false
+    }
+    if int64(len(data)) > maxBytes {
+        httperr.Write(w, r, httperr.New(http.StatusRequestEntityTooLarge, "File too large").WithDetails(httperr.Field("file")))
+        return nil, imaging.Options{}, false
+    }
+
+    opts, err := convertOptions(r)
+    if err == nil {
+        err = opts.Validate()
+    }
+    var invalid *imaging.OptionError
+    if errors.As(err, &invalid) {
+        httperr.Write(w, r, httperr.New(http.StatusBadRequest, "Invalid "+invalid.Error()).WithDetails(httperr.Field(invalid.Param)))
+        return nil, imaging.Options{}, false
+    }
+    if err != nil {
+        httperr.Write(w, r, httperr.New(http.StatusBadRequest, "Invalid options"))
+        return nil, imaging.Options{}, false
+    }
+
+    if status, msg := h.checkImage(data); status != 0 {
+        httperr.Write(w, r, httperr.New(status, msg).WithDetails(httperr.Field("file")))
+        return nil, imaging.Options{}, false
+    }
+    return data, opts, true
+}
+
+// convert decodes a checked image and encodes the result as PNG
+func convert(data []byte, opts imaging.Options) ([]byte, error) {
+    img, _, err := image.Decode(bytes.NewReader(data))
+    if err != nil {
+        return nil, err
+    }
+    page, err := imaging.Convert(img, opts)
+    if err != nil {
+        return nil, err
+    }
+
+    var out bytes.Buffer
+    if err := png.Encode(&out, page); err != nil {
+        return nil, err
+    }
+    return out.Bytes(), nil
+}
+
+// POST /convert
+// Multipart "file" (PNG or JPEG), responds with the converted page as PNG.
+// Optional fields: style (cartoon, sketch, lineart, posterize) and the
+// style's parameters blockSize, c, blurRadius, levels.
+func (h *ConvertHandler) Convert(w http.ResponseWriter, r *http.Request) {
+    maxBytes := h.MaxBytes
+    if maxBytes <= 0 {
+        maxBytes = defaultConvertMaxBytes
+    }
+    data, opts, ok := h.readConvertUpload(w, r, maxBytes)
+    if !ok {
+        return
+    }
+
+    out, err := convert(data, opts)
+    if err != nil {
+        httperr.Write(w, r, httperr.Internal("Error processing image", err))
+        return
+    }
+
+    w.Header().Set("Content-Type", "image/png")
+    w.Write(out)
+}
+
+// convertJob is the stored payload of a background conversion
+type convertJob struct {
+    InputURL string          `json:"inputUrl"`
+    Options  imaging.Options `json:"options"`
+}
+
+// POST /jobs/convert
+// Same form as /convert with a larger size limit. Responds 202 with the job
+// to poll at GET /jobs/{id}; its result is {"url": "<converted PNG>"} until
+// the image expires after OutputRetention.
+func (h *ConvertHandler) SubmitConvert(w http.ResponseWriter, r *http.Request) {
+    userID, ok := userIDFromContext(r)
+    if !ok {
+        httperr.Write(w, r, httperr.New(http.StatusUnauthorized, "Unauthorized"))
+        return
+    }
+
+    maxBytes := h.AsyncMaxBytes
+    if maxBytes <= 0 {
+        maxBytes = defaultConvertAsyncMaxBytes
+    }
+    data, opts, ok := h.readConvertUpload(w, r, maxBytes)
+    if !ok {
+        return
+    }
+
+    // The staged upload counts towards the quota until the job finishes
+    release, ok := h.Quotas.allow(w, r, userID, int64(len(data)))
+    if !ok {
+        return
+    }
+    defer release()
+
+    input, err := h.Storage.Put(r.Context(), "URPaint_Jobs/user_"+strconv.Itoa(userID), bytes.NewReader(data))
+    if err != nil {
+        httperr.Write(w, r, httperr.Internal("Failed to store upload", err))
+        return
+    }
+    if err := trackAsset(r.Context(), h.DB, userID, input); err != nil {
+        h.deleteInput(r.Context(), input.URL)
+        httperr.Write(w, r, httperr.Internal("Failed to store upload", err))
+        return
+    }
+
+    job, err := h.Queue.Submit(r.Context(), userID, ConvertJob, convertJob{InputURL: input.URL, Options: opts})
+    if err != nil {
+        h.deleteInput(r.Context(), input.URL)
+        if errors.Is(err, jobs.ErrTooManyQueued) {
+            httperr.Write(w, r, httperr.New(http.StatusTooManyRequests, "Too many jobs in progress, try again later").WithCode("too_many_jobs"))
+            return
+        }
+        httperr.Write(w, r, httperr.Internal("Failed to queue job", err))
+        return
+    }
+
+    w.Header().Set("Content-Type", "application/json")
+    w.Header().Set("Location", "/jobs/"+strconv.FormatInt(job.ID, 10))
+    w.WriteHeader(http.StatusAccepted)
+    json.NewEncoder(w).Encode(job)
+}
+
+// Run converts a queued upload and stores the result against the user's
+// quota
+func (h *ConvertHandler) Run(ctx context.Context, job *jobs.Job) (interface{}, error) {
+    var payload convertJob
+    if err := json.Unmarshal(job.Payload, &payload); err != nil {
+        return nil, jobs.Permanent(err)
+    }
+
+    key := h.Storage.KeyFromURL(payload.InputURL)
+    if key == "" {
+        return nil, jobs.Permanent(jobs.Fail("The upload is no longer available", errors.New("upload is not in storage")))
+    }
+    rc, err := h.Storage.Open(ctx, key)
+    if errors.Is(err, storage.ErrNotFound) {
+        return nil, jobs.Permanent(jobs.Fail("The upload is no longer available", err))
+    }
+    if err != nil {
+        return nil, err
+    }
+    data, err := io.ReadAll(rc)
+    rc.Close()
+    if err != nil {
+        return nil, err
+    }
+
+    out, err := convert(data, payload.Options)
+    if err != nil {
+        return nil, jobs.Permanent(jobs.Fail("The image could not be converted", err))
+    }
+    if err := ctx.Err(); err != nil {
+        return nil, err
+    }
+
+    // The input is still counted but goes when the job finishes, so only
+    // the difference has to fit
+    release, err := h.Quotas.reserve(ctx, job.UserID, int64(len(out))-int64(len(data)))
+    var exceeded *quotaError
+    if errors.As(err, &exceeded) {
+        return nil, jobs.Permanent(jobs.Fail(exceeded.Error(), err))
+    }
+    if err != nil {
+        return nil, err
+    }
+    defer release()
+
+    obj, err := h.Storage.Put(ctx, "URPaint_Converted/user_"+strconv.Itoa(job.UserID), bytes.NewReader(out))
+    if err != nil {
+        return nil, err
+    }
+    if err := trackAsset(ctx, h.DB, job.UserID, obj); err != nil {
+        h.deleteOutput(context.WithoutCancel(ctx), obj.URL)
+        return nil, err
+    }
+    // Cancelled or shutting down: no result will be recorded to point at it
+    if err := ctx.Err(); err != nil {
+        h.deleteOutput(context.WithoutCancel(ctx), obj.URL)
+        return nil, err
+    }
+    return map[string]string{"url": obj.URL}, nil
+}
+
+// Finish drops the uploaded original once the job is over
+func (h *ConvertHandler) Finish(ctx context.Context, job *jobs.Job) {
+    var payload convertJob
+    if err := json.Unmarshal(job.Payload, &payload); err != nil {
+        return
+    }
+    h.deleteInput(ctx, payload.InputURL)
+}
+
+// deleteInput removes a staged upload and drops it from its owner's usage
+func (h *ConvertHandler) deleteInput(ctx context.Context, url string) {
+    key := h.Storage.KeyFromURL(url)
+    if key == "" {
+        return
+    }
+    if err := h.Storage.Delete(ctx, key); err != nil && !errors.Is(err, storage.ErrNotFound) {
+        slog.WarnContext(ctx, "storage delete failed", "key", key, "err", err)
+        return
+    }
+    if err := untrackAsset(ctx, h.DB, key); err != nil {
+        slog.WarnContext(ctx, "storage usage update failed", "key", key, "err", err)
+    }
+}
+
+// deleteOutput removes a converted image and drops it from its owner's usage
+func (h *ConvertHandler) deleteOutput(ctx context.Context, url string) {
+    key := h.Storage.KeyFromURL(url)
+    if key == "" {
+        return
+    }
+    if err := h.Storage.Delete(ctx, key); err != nil && !errors.Is(err, storage.ErrNotFound) {
+        slog.WarnContext(ctx, "storage delete failed", "key", key, "err", err)
+        return
+    }
+    if err := untrackAsset(ctx, h.DB, key); err != nil {
+        slog.WarnContext(ctx, "storage usage update failed", "key", key, "err", err)
+    }
+}
+
+// SweepOutputs deletes the images of conversions that finished more than
+// the retention period ago and clears them from their jobs' results
+func (h *ConvertHandler) SweepOutputs(ctx context.Context) (int, error) {
+    cutoff := time.Now().Add(-h.outputRetention())
+
+    // Result first so no job ever points at a deleted image
+    rows, err := h.DB.QueryContext(ctx,
+        `WITH expired AS (
+             SELECT id, result->>'url' AS url FROM jobs
+             WHERE kind = $1 AND status = 'succeeded' AND result IS NOT NULL AND finished_at < $2
+             ORDER BY finished_at
+             LIMIT 500
+             FOR UPDATE SKIP LOCKED
+         )
+         UPDATE jobs j SET result = NULL, updated_at = now()
+         FROM expired e WHERE j.id = e.id
+         RETURNING e.url`,
+        ConvertJob, cutoff,
+    )
+    if err != nil {
+        return 0, err
+    }
+
+    var urls []string
+    for rows.Next() {
+        var url sql.NullString
+        if err := rows.Scan(&url); err != nil {
+            rows.Close()
+            return 0, err
+        }
+        if url.Valid {
+            urls = append(urls, url.String)
+        }
+    }
+    rows.Close()
+    if err := rows.Err(); err != nil {
+        return 0, err
+    }
+
+    for _, url := range urls {
+        h.deleteOutput(ctx, url)
+    }
+    return len(urls), nil
+}
+
+// RunOutputSweeper calls SweepOutputs every interval until ctx is cancelled
+func (h *ConvertHandler) RunOutputSweeper(ctx context.Context, interval time.Duration) {
+    ticker := time.NewTicker(interval)
+    defer ticker.Stop()
+
+    for {
+        deleted, err := h.SweepOutputs(ctx)
+        if err != nil {
+            slog.ErrorContext(ctx, "converted image sweep failed", "err", err)
+        } else if deleted > 0 {
+            slog.InfoContext(ctx, "deleted expired converted images", "images", deleted)
+        }
+
+        select {
+        case <-ctx.Done():
+            return
+        case <-ticker.C:
+        }
+    }
+}
@@ -0,0 +1,261 @@
+package handlers
+
+import (
+    "context"
+    "database/sql"
+    "encoding/json"
+    "errors"
+    "io"
+    "net/http"
+    "strconv"
+    "strings"
+
+    "urpaint/internal/httperr"
+    "urpaint/internal/strokes"
+)
+
+// Stroke documents are mostly coordinates; a long session is a few MB
+const maxDocumentBytes = 16 << 20
+
+// readDocument parses a stroke document body, answering 400/413 itself.
+// Validation errors name the offending path in the details.
+func readDocument(w http.ResponseWriter, r *http.Request, body io.Reader) ([]byte, bool) {
+    data, err := io.ReadAll(io.LimitReader(body, maxDocumentBytes+1))
+    if err != nil {
+        httperr.Write(w, r, httperr.New(http.StatusBadRequest, "Failed to read document").WithDetails(httperr.Field("document")))
+        return nil, false
+    }
+    if len(data) > maxDocumentBytes {
+        httperr.Write(w, r, httperr.New(http.StatusRequestEntityTooLarge, "Document too large").WithDetails(httperr.Field("document")))
+        return nil, false
+    }
+
+    doc, err := strokes.Parse(data)
+    var invalid *strokes.ValidationError
+    if errors.As(err, &invalid) {
+        field := "document"
+        if invalid.Field != "" {
+            field += "." + invalid.Field
+        }
+        httperr.Write(w, r, httperr.New(http.StatusBadRequest, "Invalid document: "+invalid.Message).
+            WithCode("invalid_document").WithDetails(httperr.Field(field)))
+        return nil, false
+    }
+    if err != nil {
+        httperr.Write(w, r, httperr.New(http.StatusBadRequest, "Invalid document").WithCode("invalid_document"))
+        return nil, false
+    }
+
+    // Stored re-encoded so every copy has the same shape
+    canonical, err := json.Marshal(doc)
+    if err != nil {
+        httperr.Write(w, r, httperr.Internal("Failed to encode document", err))
+        return nil, false
+    }
+    return canonical, true
+}
+
+// documentFromForm reads the optional "document" part of a multipart
+// upload, sent either as a file or a plain field. nil when absent.
+func documentFromForm(w http.ResponseWriter, r *http.Request) ([]byte, bool) {
+    file, _, err := r.FormFile("document")
+    if err == nil {
+        defer file.Close()
+        return readDocument(w, r, file)
+    }
+    if err != http.ErrMissingFile {
+        httperr.Write(w, r, httperr.New(http.StatusBadRequest, "Failed to read document").WithDetails(httperr.Field("document")))
+        return nil, false
+    }
+
+    if value := r.FormValue("document"); value != "" {
+        return readDocument(w, r, strings.NewReader(value))
+    }
+    return nil, true
+}
+
+// saveDocument stores a validated document and makes it the drawing's
+// current one. Callers record the revision afterwards.
+func saveDocument(ctx context.Context, q queryer, drawingID int, doc []byte) (int64, error) {
+    var id int64
+    err := q.QueryRowContext(ctx,
+        `INSERT INTO drawing_documents (gallery_id, format_version, document, byte_size)
+         VALUES ($1, $2, $3, $4) RETURNING id`,
+        drawingID, strokes.Version, string(doc), len(doc),
+    ).Scan(&id)
+    if err != nil {
+        return 0, err
+    }
+
+    _, err = q.ExecContext(ctx, "UPDATE gallery SET document_id = $1 WHERE id = $2", id, drawingID)
+    return id, err
+}
+
+// pruneDocuments drops documents neither the drawing nor any revision
+// points at anymore
+func pruneDocuments(ctx context.Context, q queryer, drawingID int) error {
+    _, err := q.ExecContext(ctx,
+        `DELETE FROM drawing_documents d
+         WHERE d.gallery_id = $1
+           AND NOT EXISTS (SELECT 1 FROM gallery g WHERE g.document_id = d.id)
+           AND NOT EXISTS (SELECT 1 FROM gallery_revisions r WHERE r.document_id = d.id)`,
+        drawingID,
+    )
+    return err
+}
+
+// GET /gallery/document?id=[&revision=]
+// Serves the drawing's stroke document, or the one saved with a revision
+func (h *GalleryHandler) GetDocument(w http.ResponseWriter, r *http.Request) {
+    userID, ok := userIDFromContext(r)
+    if !ok {
+        httperr.Write(w, r, httperr.New(http.StatusUnauthorized, "Unauthorized"))
+        return
+    }
+
+    drawingID, ok := drawingIDParam(w, r)
+    if !ok {
+        return
+    }
+
+    var revisionID int64
+    if param := r.URL.Query().Get("revision"); param != "" {
+        id, err := strconv.ParseInt(param, 10, 64)
+        if err != nil {
+            httperr.Write(w, r, httperr.New(http.StatusBadRequest, "Invalid revision ID"))
+            return
+        }
+        revisionID = id
+    }
+
+    var doc string
+    var err error
+    if revisionID == 0 {
+        err = h.DB.QueryRow(
+            `SELECT d.document FROM gallery g JOIN drawing_documents d ON d.id = g.document_id
+             WHERE g.id = $1 AND g.user_id = $2 AND g.deleted_at IS NULL`,
+            drawingID, userID,
+        ).Scan(&doc)
+    } else {
+        err = h.DB.QueryRow(
+            `SELECT d.document FROM gallery_revisions r
+             JOIN gallery g ON g.id = r.gallery_id
+             JOIN drawing_documents d ON d.id = r.document_id
+             WHERE r.id = $1 AND g.id = $2 AND g.user_id = $3`,
+            revisionID, drawingID, userID,
+        ).Scan(&doc)
+    }
+    if errors.Is(err, sql.ErrNoRows) {
+        httperr.Write(w, r, httperr.New(http.StatusNotFound, "Document not found"))
+        return
+    }
+    if err != nil {
+        httperr.Write(w, r, httperr.Internal("Database error", err))
+        return
+    }
+
+    w.Header().Set("Content-Type", "application/json")
+    io.WriteString(w, doc)
+}
+
+// PUT /gallery/document?id=
+// Body is a stroke document. The drawing's images are re-rendered from it
+// and saving it is a new revision of the drawing.
+func (h *GalleryHandler) PutDocument(w http.ResponseWriter, r *http.Request) {
+    userID, ok := userIDFromContext(r)
+    if !ok {
+        httperr.Write(w, r, httperr.New(http.StatusUnauthorized, "Unauthorized"))
+        return
+    }
+
+    drawingID, ok := drawingIDParam(w, r)
+    if !ok {
+        return
+    }
+
+    doc, ok := readDocument(w, r, r.Body)
+    if !ok {
+        return
+    }
+
+    owned, err := h.ownsDrawing(r.Context(), drawingID, userID)
+    if err != nil {
+        httperr.Write(w, r, httperr.Internal("Database error", err))
+        return
+    }
+    if !owned {
+        httperr.Write(w, r, httperr.New(http.StatusNotFound, "Drawing not found"))
+        return
+    }
+    release, ok := h.Quotas.allow(w, r, userID, int64(len(doc)))
+    if !ok {
+        return
+    }
+    defer release()
+
+    rendered, err := h.putRender(r.Context(), userID, doc)
+    if errors.Is(err, errBadBaseImage) {
+        httperr.Write(w, r, httperr.New(http.StatusBadRequest, "Invalid document: "+errBadBaseImage.Error()).
+            WithCode("invalid_document").WithDetails(httperr.Field("document.baseImage")))
+        return
+    }
+    if err != nil {
+        httperr.Write(w, r, httperr.Internal("Failed to render document", err))
+        return
+    }
+
+    tx, err := h.DB.BeginTx(r.Context(), nil)
+    if err != nil {
+        httperr.Write(w, r, httperr.Internal("Database error", err))
+        return
+    }
+    defer tx.Rollback()
+
+    var locked int
+    err = tx.QueryRow(
+        "SELECT id FROM gallery WHERE id = $1 AND user_id = $2 AND deleted_at IS NULL FOR UPDATE",
+        drawingID, userID,
+    ).Scan(&locked)
+    if errors.Is(err, sql.ErrNoRows) {
+        httperr.Write(w, r, httperr.New(http.StatusNotFound, "Drawing not found"))
+        return
+    }
+    if err != nil {
+        httperr.Write(w, r, httperr.Internal("Database error", err))
+        return
+    }
+
+    _, err = tx.Exec("UPDATE gallery SET image_url = $1, edit_url = $1 WHERE id = $2", rendered.URL, drawingID)
+    if err != nil {
+        httperr.Write(w, r, httperr.Internal("Failed to update drawing", err))
+        return
+    }
+
+    documentID, err := saveDocument(r.Context(), tx, drawingID, doc)
+    if err != nil {
+        httperr.Write(w, r, httperr.Internal("Failed to save document", err))
+        return
+    }
+
+    revisionID, err := recordRevision(r.Context(), tx, drawingID, rendered.Bytes+int64(len(doc)))
+    if err != nil {
+        httperr.Write(w, r, httperr.Internal("Failed to save revision", err))
+        return
+    }
+
+    if err := tx.Commit(); err != nil {
+        httperr.Write(w, r, httperr.Internal("Failed to save document", err))
+        return
+    }
+
+    h.pruneRevisions(r.Context(), drawingID)
+    h.queueRenditions(r.Context(), userID, drawingID)
+
+    w.Header().Set("Content-Type", "application/json")
+    json.NewEncoder(w).Encode(map[string]interface{}{
+        "documentId": documentID,
+        "revisionId": revisionID,
+        "imageUrl":   rendered.URL,
+        "editUrl":    rendered.URL,
+    })
+}
@@ -0,0 +1,314 @@
+package handlers
+
+import (
+    "archive/zip"
+    "bufio"
+    "context"
+    "database/sql"
+    "encoding/json"
+    "fmt"
+    "io"
+    "log/slog"
+    "mime"
+    "net/http"
+    "strconv"
+    "strings"
+    "time"
+    "unicode"
+
+    "github.com/lib/pq"
+
+    "urpaint/internal/httperr"
+)
+
+// ExportAlbum names an album drawings in the export refer to by ID
+type ExportAlbum struct {
+    ID   int    `json:"id"`
+    Name string `json:"name"`
+}
+
+// ExportDrawing is a drawing's entry in manifest.json. The image fields
+// are paths inside the archive, left out when the file couldn't be read.
+type ExportDrawing struct {
+    ID           int       `json:"id"`
+    Title        string    `json:"title"`
+    Description  string    `json:"description"`
+    Order        int       `json:"order"`
+    UploadedAt   time.Time `json:"uploadedAt"`
+    Tags         []string  `json:"tags"`
+    Albums       []int64   `json:"albums"`
+    GalleryImage string    `json:"galleryImage,omitempty"`
+    EditImage    string    `json:"editImage,omitempty"`
+
+    imageURL string
+    editURL  string
+}
+
+// ExportManifest is written last as manifest.json, once every image has
+// been tried
+type ExportManifest struct {
+    ExportedAt time.Time       `json:"exportedAt"`
+    Album      *ExportAlbum    `json:"album,omitempty"`
+    Unfiled    bool            `json:"unfiled,omitempty"`
+    Albums     []ExportAlbum   `json:"albums"`
+    Drawings   []ExportDrawing `json:"drawings"`
+    // Paths of images that were skipped because they couldn't be read
+    Missing []string `json:"missing,omitempty"`
+}
+
+// exportName makes a title safe to use as a file name in the archive
+func exportName(title string, id int) string {
+    var b strings.Builder
+    for _, r := range strings.TrimSpace(title) {
+        switch {
+        case unicode.IsLetter(r), unicode.IsDigit(r), r == '-', r == '_':
+            b.WriteRune(r)
+        case unicode.IsSpace(r):
+            b.WriteRune('_')
+        }
+        if b.Len() >= 60 {
+            break
+        }
+    }
+    name := b.String()
+    if name == "" {
+        name = "untitled"
+    }
+    return name + "-" + strconv.Itoa(id)
+}
+
+// attachment is a Content-Disposition for downloading as name. Album
+// names can make it non-ASCII, so older clients get a filename with those
+// characters replaced and the rest get the full name in filename*.
+func attachment(name string) string {
+    ascii := strings.Map(func(r rune) rune {
+        if r > unicode.MaxASCII {
+            return '_'
+        }
+        return r
+    }, name)
+
+    disposition := mime.FormatMediaType("attachment", map[string]string{"filename": ascii})
+    if ascii != name {
+        // FormatMediaType encodes a non-ASCII value as filename*
+        disposition += strings.TrimPrefix(mime.FormatMediaType("attachment", map[string]string{"filename": name}), "attachment")
+    }
+    return disposition
+}
+
+// imageExtension picks a file extension from the first bytes of an image
+func imageExtension(head []byte) string {
+    switch http.DetectContentType(head) {
+    case "image/png":
+        return ".png"
+    case "image/jpeg":
+        return ".jpg"
+    case "image/gif":
+        return ".gif"
+    case "image/webp":
+        return ".webp"
+    }
+    return ".bin"
+}
+
+// exportDrawings loads the metadata for an export. Only the images are
+// streamed; this is a few hundred bytes a drawing.
+func (h *GalleryHandler) exportDrawings(ctx context.Context, userID, albumID int, unfiled bool) ([]ExportDrawing, error) {
+    args := []interface{}{userID}
+    from := "gallery g"
+    orderIndex := "g.order_index"
+    where := "g.user_id = $1 AND g.deleted_at IS NULL"
+
+    switch {
+    case albumID != 0:
+        args = append(args, albumID)
+        from += " JOIN album_items ai ON ai.gallery_id = g.id AND ai.album_id = $2"
+        orderIndex = "ai.order_index"
+    case unfiled:
+        where += " AND NOT EXISTS (SELECT 1 FROM album_items ai WHERE ai.gallery_id = g.id)"
+    }
+
+    rows, err := h.DB.QueryContext(ctx, fmt.Sprintf(
+        `SELECT g.id, g.image_url, g.edit_url, g.title, g.description, g.uploaded_at, %s,
+             ARRAY(SELECT t.tag FROM gallery_tags t WHERE t.gallery_id = g.id ORDER BY t.tag),
+             ARRAY(SELECT ai2.album_id FROM album_items ai2 WHERE ai2.gallery_id = g.id ORDER BY ai2.album_id)
+         FROM %s
+         WHERE %s
+         ORDER BY %s, g.id`,
+        orderIndex, from, where, orderIndex,
+    ), args...)
+    if err != nil {
+        return nil, err
+    }
+    defer rows.Close()
+
+    drawings := []ExportDrawing{}
+    for rows.Next() {
+        var d ExportDrawing
+        var imageURL, editURL, title, description sql.NullString
+        err := rows.Scan(&d.ID, &imageURL, &editURL, &title, &description, &d.UploadedAt, &d.Order,
+            pq.Array(&d.Tags), pq.Array(&d.Albums))
+        if err != nil {
+            return nil, err
+        }
+        d.imageURL = imageURL.String
+        d.editURL = editURL.String
+        d.Title = title.String
+        d.Description = description.String
+        if d.Tags == nil {
+            d.Tags = []string{}
+        }
+        if d.Albums == nil {
+            d.Albums = []int64{}
+        }
+        drawings = append(drawings, d)
+    }
+    return drawings, rows.Err()
+}
+
+// exportImage copies one stored image into the archive as dir/name.ext,
+// returning its path. Images are stored rather than deflated; they're
+// compressed already.
+func (h *GalleryHandler) exportImage(ctx context.Context, zw *zip.Writer, url, dir, name string, modified time.Time) (string, error) {
+    key := h.Storage.KeyFromURL(url)
+    if key == "" {
+        return "", fmt.Errorf("%s is not in storage", url)
+    }
+    rc, err := h.Storage.Open(ctx, key)
+    if err != nil {
+        return "", err
+    }
+    defer rc.Close()
+
+    br := bufio.NewReaderSize(rc, 512)
+    head, err := br.Peek(512)
+    if err != nil && err != io.EOF && err != bufio.ErrBufferFull {
+        return "", err
+    }
+
+    path := dir + "/" + name + imageExtension(head)
+    f, err := zw.CreateHeader(&zip.FileHeader{Name: path, Method: zip.Store, Modified: modified})
+    if err != nil {
+        return "", err
+    }
+    if _, err := io.Copy(f, br); err != nil {
+        return "", err
+    }
+    return path, nil
+}
+
+// GET /gallery/export[?album=ID|none]
+// Streams the gallery as a ZIP of gallery/ and edit/ images plus
+// manifest.json. Large galleries can be fetched an album at a time;
+// album=none is everything not in an album.
+func (h *GalleryHandler) ExportGallery(w http.ResponseWriter, r *http.Request) {
+    userID, ok := userIDFromContext(r)
+    if !ok {
+        httperr.Write(w, r, httperr.New(http.StatusUnauthorized, "Unauthorized"))
+        return
+    }
+
+    manifest := ExportManifest{ExportedAt: time.Now().UTC(), Albums: []ExportAlbum{}}
+    filename := "urpaint-gallery"
+
+    var albumID int
+    switch param := r.URL.Query().Get("album"); param {
+    case "":
+    case "none":
+        manifest.Unfiled = true
+        filename += "-unfiled"
+    default:
+        id, err := strconv.Atoi(param)
+        if err != nil {
+            httperr.Write(w, r, httperr.New(http.StatusBadRequest, "Invalid album ID"))
+            return
+        }
+        albumID = id
+    }
+
+    rows, err := h.DB.QueryContext(r.Context(), "SELECT id, name FROM albums WHERE user_id = $1 ORDER BY name", userID)
+    if err != nil {
+        httperr.Write(w, r, httperr.Internal("Database error", err))
+        return
+    }
+    for rows.Next() {
+        var a ExportAlbum
+        if err := rows.Scan(&a.ID, &a.Name); err != nil {
+            rows.Close()
+            httperr.Write(w, r, httperr.Internal("Database error", err))
+            return
+        }
+        manifest.Albums = append(manifest.Albums, a)
+        if a.ID == albumID {
+            album := a
+            manifest.Album = &album
+        }
+    }
+    rows.Close()
+    if err := rows.Err(); err != nil {
+        httperr.Write(w, r, httperr.Internal("Database error", err))
+        return
+    }
+
+    if albumID != 0 {
+        if manifest.Album == nil {
+            httperr.Write(w, r, httperr.New(http.StatusNotFound, "Album not found"))
+            return
+        }
+        filename += "-" + exportName(manifest.Album.Name, albumID)
+    }
+
+    manifest.Drawings, err = h.exportDrawings(r.Context(), userID, albumID, manifest.Unfiled)
+    if err != nil {
+        httperr.Write(w, r, httperr.Internal("Database error", err))
+        return
+    }
+
+    // A big gallery can take longer than the server's write timeout
+    http.NewResponseController(w).SetWriteDeadline(time.Time{})
+
+    w.Header().Set("Content-Type", "application/zip")
+    w.Header().Set("Content-Disposition", attachment(filename+".zip"))
+
+    // From here on the status is sent; a failure can only cut the archive short
+    zw := zip.NewWriter(w)
+    for i := range manifest.Drawings {
+        d := &manifest.Drawings[i]
+        name := exportName(d.Title, d.ID)
+
+        for _, image := range []struct {
+            url, dir string
+            path     *string
+        }{
+            {d.imageURL, "gallery", &d.GalleryImage},
+            {d.editURL, "edit", &d.EditImage},
+        } {
+            if image.url == "" {
+                continue
+            }
+            path, err := h.exportImage(r.Context(), zw, image.url, image.dir, name, d.UploadedAt)
+            if r.Context().Err() != nil {
+                return
+            }
+            if err != nil {
+                slog.WarnContext(r.Context(), "export skipped image", "drawing_id", d.ID, "dir", image.dir, "err", err)
+                manifest.Missing = append(manifest.Missing, image.dir+"/"+name)
+                continue
+            }
+            *image.path = path
+        }
+    }
+
+    f, err := zw.CreateHeader(&zip.FileHeader{Name: "manifest.json", Method: zip.Deflate, Modified: manifest.ExportedAt})
+    if err == nil {
+        enc := json.NewEncoder(f)
+        enc.SetIndent("", "  ")
+        err = enc.Encode(manifest)
+    }
+    if err == nil {
+        err = zw.Close()
+    }
+    if err != nil {
+        slog.ErrorContext(r.Context(), "export failed", "err", err)
+    }
+}
@@ -0,0 +1,49 @@
+package handlers
+
+import (
+    "mime"
+    "testing"
+)
+
+func TestAttachment(t *testing.T) {
+    tests := []struct {
+        name string
+        want string
+    }{
+        {"urpaint-gallery.zip", "attachment; filename=urpaint-gallery.zip"},
+        {"urpaint-gallery-Été_2024-3.zip", "attachment; filename=urpaint-gallery-_t__2024-3.zip; filename*=utf-8''urpaint-gallery-%C3%89t%C3%A9_2024-3.zip"},
+        {"urpaint-gallery-猫-4.zip", "attachment; filename=urpaint-gallery-_-4.zip; filename*=utf-8''urpaint-gallery-%E7%8C%AB-4.zip"},
+    }
+    for _, tt := range tests {
+        got := attachment(tt.name)
+        if got != tt.want {
+            t.Errorf("attachment(%q) = %q, want %q", tt.name, got, tt.want)
+        }
+
+        // Clients that understand filename* get the original name back
+        _, params, err := mime.ParseMediaType(got)
+        if err != nil {
+            t.Fatalf("ParseMediaType(%q): %v", got, err)
+        }
+        if params["filename"] != tt.name {
+            t.Errorf("parsed filename = %q, want %q", params["filename"], tt.name)
+        }
+    }
+}
+
+func TestExportName(t *testing.T) {
+    tests := []struct {
+        title string
+        want  string
+    }{
+        {"Sunset over the bay", "Sunset_over_the_bay-1"},
+        {"  ../../etc/passwd  ", "etcpasswd-1"},
+        {"", "untitled-1"},
+        {"Été", "Été-1"},
+    }
+    for _, tt := range tests {
+        if got := exportName(tt.title, 1); got != tt.want {
+            t.Errorf("exportName(%q) = %q, want %q", tt.title, got, tt.want)
+        }
+    }
+}
@@ -1,206 +1,288 @@
 package handlers
 
 import (
+    "bytes"
+	"context"
 	"database/sql"
     "encoding/json"
-    "mime/multipart"
+    "errors"
+    "log/slog"
     "net/http"
     "strconv"
-	"strings"
     "fmt"
+    "time"
 
-    "github.com/cloudinary/cloudinary-go/v2"
-    "github.com/cloudinary/cloudinary-go/v2/api/uploader"
-    "github.com/golang-jwt/jwt/v5"
-
+    "urpaint/internal/httperr"
+    "urpaint/internal/jobs"
+    "urpaint/internal/storage"
+    "urpaint/internal/uploads"
 )
 
 type GalleryHandler struct {
 	DB *sql.DB
-	CloudinaryURL string
+	Storage storage.Storage
+	ShareBaseURL string
+	RevisionLimit int
+	TrashRetention time.Duration
+	Queue *jobs.Queue
+	Uploads uploads.Limits
+	Quotas *Quotas
 }
 
 // POST Upload 
 func (h *GalleryHandler) UploadDrawing(w http.ResponseWriter, r *http.Request) {
-	if r.Method != http.MethodPost {
-		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
-        return
-	}
-
-	claims, ok := r.Context().Value("claims").(jwt.MapClaims)
+	userID, ok := userIDFromContext(r)
 	if !ok {
-		http.Error(w, "Unauthorized", http.StatusUnauthorized)
-        return
-	}
-
-	userIDFloat, ok := claims["id"].(float64)
-	if !ok {
-		http.Error(w, "Invalid user ID in claims", http.StatusUnauthorized)
-        return
-	}
-	userID := int(userIDFloat)
-
-    err := r.ParseMultipartForm(10 << 20) // 10MB
-	if err != nil {
-		http.Error(w, "Failed to parse form: "+err.Error(), http.StatusBadRequest)
+		httperr.Write(w, r, httperr.New(http.StatusUnauthorized, "Unauthorized"))
 		return
 	}
 
-	cld, err := cloudinary.NewFromURL(h.CloudinaryURL)
-	if err != nil {
-        http.Error(w, "Cloudinary init error: "+err.Error(), http.StatusInternalServerError)
+    if !parseUpload(w, r, 2*h.Uploads.Bytes()+maxDocumentBytes) {
         return
     }
 
-	folderName := "URPaint_Gallery/user_" + strconv.Itoa(userID)
-
-    uploadFile := func(fieldName string) (string, error) {
-        file, _, err := r.FormFile(fieldName)
-        if err != nil {
-			if err == http.ErrMissingFile {
-				return "", nil
-			}
-			return "", fmt.Errorf("failed to read %s: %w", fieldName, err)
-		}
-        defer file.Close()
+    // Everything is checked before anything is uploaded
+    document, ok := documentFromForm(w, r)
+    if !ok {
+        return
+    }
+    galleryImage, ok := readImage(w, r, "galleryImage", h.Uploads, true)
+    if !ok {
+        return
+    }
+    editImage, ok := readImage(w, r, "editImage", h.Uploads, true)
+    if !ok {
+        return
+    }
+    release, ok := h.Quotas.allow(w, r, userID, imageBytes(galleryImage)+imageBytes(editImage)+int64(len(document)))
+    if !ok {
+        return
+    }
+    defer release()
 
-        uploadParams := uploader.UploadParams{
-            Folder:       folderName,
-            ResourceType: "image",
+    uploadFile := func(fieldName string, img *uploads.Image) (storage.Object, error) {
+        if img == nil {
+            return storage.Object{}, nil
         }
 
-        result, err := cld.Upload.Upload(r.Context(), file, uploadParams)
+        obj, err := h.putAsset(r.Context(), userID, img.Data)
 		if err != nil {
-			return "", fmt.Errorf("upload error (%s): %w", fieldName, err)
+			return storage.Object{}, fmt.Errorf("upload error (%s): %w", fieldName, err)
 		}
 
-		return result.SecureURL, nil
+		return obj, nil
     }
 
-    galleryURL, err := uploadFile("galleryImage")
+    galleryObj, err := uploadFile("galleryImage", galleryImage)
 	if err != nil {
-		http.Error(w, err.Error(), http.StatusInternalServerError)
+		httperr.Write(w, r, httperr.Internal("Failed to upload image", err))
 		return
 	}
 
-    editURL, err := uploadFile("editImage")
+    editObj, err := uploadFile("editImage", editImage)
 	if err != nil {
-		http.Error(w, err.Error(), http.StatusInternalServerError)
+		httperr.Write(w, r, httperr.Internal("Failed to upload image", err))
 		return
 	}
 
-    _, err = h.DB.Exec(
-		`INSERT INTO gallery (user_id, image_url, edit_url) VALUES ($1, $2, $3)`,
-		userID, galleryURL, editURL,
-	)
+    // API clients can send only strokes and let us draw the images
+    if document != nil && (galleryObj.URL == "" || editObj.URL == "") {
+        rendered, err := h.putRender(r.Context(), userID, document)
+        if errors.Is(err, errBadBaseImage) {
+            httperr.Write(w, r, httperr.New(http.StatusBadRequest, "Invalid document: "+errBadBaseImage.Error()).
+                WithCode("invalid_document").WithDetails(httperr.Field("document.baseImage")))
+            return
+        }
+        if err != nil {
+            httperr.Write(w, r, httperr.Internal("Failed to render document", err))
+            return
+        }
+        if galleryObj.URL == "" {
+            galleryObj = rendered
+        }
+        if editObj.URL == "" {
+            editObj = rendered
+            editObj.Bytes = 0
+        }
+    }
+
+    // The first revision is the drawing as uploaded
+    tx, err := h.DB.BeginTx(r.Context(), nil)
+    if err != nil {
+        httperr.Write(w, r, httperr.Internal("Failed to save image reference", err))
+        return
+    }
+    defer tx.Rollback()
+
+    var drawingID int
+    err = tx.QueryRow(
+		`INSERT INTO gallery (user_id, image_url, edit_url) VALUES ($1, $2, $3) RETURNING id`,
+		userID, galleryObj.URL, editObj.URL,
+	).Scan(&drawingID)
 	if err != nil {
-		http.Error(w, "Failed to save image reference: "+err.Error(), http.StatusInternalServerError)
+		httperr.Write(w, r, httperr.Internal("Failed to save image reference", err))
 		return
 	}
 
+    if document != nil {
+        if _, err := saveDocument(r.Context(), tx, drawingID, document); err != nil {
+            httperr.Write(w, r, httperr.Internal("Failed to save document", err))
+            return
+        }
+    }
+
+    if _, err := recordRevision(r.Context(), tx, drawingID, galleryObj.Bytes+editObj.Bytes+int64(len(document))); err != nil {
+        httperr.Write(w, r, httperr.Internal("Failed to save revision", err))
+        return
+    }
+
+    if err := tx.Commit(); err != nil {
+        httperr.Write(w, r, httperr.Internal("Failed to save image reference", err))
+        return
+    }
+
+    h.queueRenditions(r.Context(), userID, drawingID)
+
 	w.Header().Set("Content-Type", "application/json")
-	json.NewEncoder(w).Encode(map[string]string{
-		"galleryUrl": galleryURL,
-		"editUrl":    editURL,
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"id":          drawingID,
+		"galleryUrl":  galleryObj.URL,
+		"editUrl":     editObj.URL,
+		"hasDocument": document != nil,
 	})
 }
 
 // GET Display
 func (h *GalleryHandler) GetGallery(w http.ResponseWriter, r *http.Request) {
-	if r.Method != http.MethodGet {
-        http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
-        return
-    }
-
-	claims, ok := r.Context().Value("claims").(jwt.MapClaims)
+	userID, ok := userIDFromContext(r)
 	if !ok {
-        http.Error(w, "Unauthorized", http.StatusUnauthorized)
-        return
-    }
+		httperr.Write(w, r, httperr.New(http.StatusUnauthorized, "Unauthorized"))
+		return
+	}
 
-	userIDFloat, ok := claims["id"].(float64)
-    if !ok {
-        http.Error(w, "Invalid user ID", http.StatusUnauthorized)
-        return
-    }
-    userID := int(userIDFloat)
+	query, err := parseGalleryQuery(r.URL.Query(), userID)
+	var invalid *httperr.Error
+	if errors.As(err, &invalid) {
+		httperr.Write(w, r, invalid)
+		return
+	}
+	if err != nil {
+		httperr.Write(w, r, httperr.New(http.StatusBadRequest, err.Error()))
+		return
+	}
 
-	rows, err := h.DB.Query(
-		"SELECT id, image_url, edit_url, title, uploaded_at FROM gallery WHERE user_id = $1 ORDER BY order_index ASC",
-        userID,
-	)
+	sqlQuery, args := query.sql()
+	rows, err := h.DB.Query(sqlQuery, args...)
 	if err != nil {
-		http.Error(w, "Database error: "+err.Error(), http.StatusInternalServerError)
+		httperr.Write(w, r, httperr.Internal("Database error", err))
         return
 	}
 	defer rows.Close()
 
-	var gallery []map[string]interface{}
+	page := GalleryPage{Items: []GalleryItem{}}
 	for rows.Next() {
-        var id int
-        var imageUrl sql.NullString
-        var editUrl sql.NullString
-        var uploadedAt string
-        var title sql.NullString
-
-        if err := rows.Scan(&id, &imageUrl, &editUrl, &title, &uploadedAt); err != nil {
-            continue
+        item, err := scanGalleryItem(rows)
+        if err != nil {
+            httperr.Write(w, r, httperr.Internal("Database error", err))
+            return
         }
 
-        gallery = append(gallery, map[string]interface{}{
-            "id": id,
-            "image_url": imageUrl.String,
-            "edit_url": editUrl.String,
-            "title": title.String,
-            "uploadedAt": uploadedAt,
-        })
+        if len(page.Items) == query.Limit {
+            // The extra row only tells us there is another page
+            page.NextCursor = query.cursorFor(page.Items[len(page.Items)-1])
+            break
+        }
+        page.Items = append(page.Items, item)
     }
+	if err := rows.Err(); err != nil {
+		httperr.Write(w, r, httperr.Internal("Database error", err))
+		return
+	}
 
 	w.Header().Set("Content-Type", "application/json")
-	json.NewEncoder(w).Encode(gallery)
+	json.NewEncoder(w).Encode(page)
 }
 
-// PATCH Rename Image
-func (h *GalleryHandler) RenameDrawing(w http.ResponseWriter, r *http.Request) {
-	if r.Method != http.MethodPatch {
-        http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+// GET /drawings/{id}
+func (h *GalleryHandler) GetDrawing(w http.ResponseWriter, r *http.Request) {
+    userID, ok := userIDFromContext(r)
+    if !ok {
+        httperr.Write(w, r, httperr.New(http.StatusUnauthorized, "Unauthorized"))
         return
     }
 
-	claims, ok := r.Context().Value("claims").(jwt.MapClaims)
+    drawingID, ok := drawingIDParam(w, r)
     if !ok {
-        http.Error(w, "Unauthorized", http.StatusUnauthorized)
         return
     }
 
-	userIDFloat, ok := claims["id"].(float64)
-    if !ok {
-        http.Error(w, "Invalid user ID", http.StatusUnauthorized)
+    rows, err := h.DB.QueryContext(r.Context(),
+        `SELECT `+galleryItemColumns+`, g.order_index FROM gallery g
+         WHERE g.id = $1 AND g.user_id = $2 AND g.deleted_at IS NULL`,
+        drawingID, userID,
+    )
+    if err != nil {
+        httperr.Write(w, r, httperr.Internal("Database error", err))
         return
     }
-    userID := int(userIDFloat)
+    defer rows.Close()
 
-	idParam := r.URL.Query().Get("id")
-	if idParam == "" {
-        http.Error(w, "Missing drawing ID", http.StatusBadRequest)
+    if !rows.Next() {
+        if err := rows.Err(); err != nil {
+            httperr.Write(w, r, httperr.Internal("Database error", err))
+            return
+        }
+        httperr.Write(w, r, httperr.New(http.StatusNotFound, "Drawing not found"))
         return
     }
-	drawingID, _ := strconv.Atoi(idParam)
+    item, err := scanGalleryItem(rows)
+    if err != nil {
+        httperr.Write(w, r, httperr.Internal("Database error", err))
+        return
+    }
+
+    w.Header().Set("Content-Type", "application/json")
+    json.NewEncoder(w).Encode(item)
+}
 
+// PATCH Rename Image (title and description)
+func (h *GalleryHandler) RenameDrawing(w http.ResponseWriter, r *http.Request) {
+	userID, ok := userIDFromContext(r)
+	if !ok {
+		httperr.Write(w, r, httperr.New(http.StatusUnauthorized, "Unauthorized"))
+		return
+	}
+
+	drawingID, ok := drawingIDParam(w, r)
+	if !ok {
+        return
+    }
+
+	// Either field may be left out to keep its current value
 	var input struct {
-		Title string `json:"title"`
+		Title       *string `json:"title"`
+		Description *string `json:"description"`
 	}
 	if err := json.NewDecoder(r.Body).Decode(&input); err != nil {
-        http.Error(w, "Invalid input", http.StatusBadRequest)
+        httperr.Write(w, r, httperr.New(http.StatusBadRequest, "Invalid input"))
+        return
+    }
+	if input.Title == nil && input.Description == nil {
+        httperr.Write(w, r, httperr.New(http.StatusBadRequest, "Title or description required"))
         return
     }
 
-	_, err := h.DB.Exec(
-		"UPDATE gallery SET title = $1 WHERE id = $2 AND user_id = $3",
-        input.Title, drawingID, userID,
+	res, err := h.DB.Exec(
+		`UPDATE gallery SET title = COALESCE($1, title), description = COALESCE($2, description)
+		 WHERE id = $3 AND user_id = $4 AND deleted_at IS NULL`,
+        input.Title, input.Description, drawingID, userID,
 	)
 	if err != nil {
-        http.Error(w, "Failed to rename drawing: "+err.Error(), http.StatusInternalServerError)
+        httperr.Write(w, r, httperr.Internal("Failed to rename drawing", err))
+        return
+    }
+    if n, _ := res.RowsAffected(); n == 0 {
+        httperr.Write(w, r, httperr.New(http.StatusNotFound, "Drawing not found"))
         return
     }
 
@@ -209,80 +291,28 @@ func (h *GalleryHandler) RenameDrawing(w http.ResponseWriter, r *http.Request) {
 
 // DELETE Delete Image
 func (h *GalleryHandler) DeleteDrawing(w http.ResponseWriter, r *http.Request) {
-	if r.Method != http.MethodDelete {
-        http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
-        return
-    }
-
-    claims, ok := r.Context().Value("claims").(jwt.MapClaims)
+    userID, ok := userIDFromContext(r)
     if !ok {
-        http.Error(w, "Unauthorized", http.StatusUnauthorized)
+        httperr.Write(w, r, httperr.New(http.StatusUnauthorized, "Unauthorized"))
         return
     }
 
-    userIDFloat, ok := claims["id"].(float64)
+	drawingID, ok := drawingIDParam(w, r)
     if !ok {
-        http.Error(w, "Invalid user ID", http.StatusUnauthorized)
         return
     }
-    userID := int(userIDFloat)
 
-	idParam := r.URL.Query().Get("id")
-    if idParam == "" {
-        http.Error(w, "Missing drawing ID", http.StatusBadRequest)
-        return
-    }
-    drawingID, _ := strconv.Atoi(idParam)
-
-	var imageURL, editURL string
-	err := h.DB.QueryRow(
-        "SELECT image_url, edit_url FROM gallery WHERE id = $1 AND user_id = $2",
+	// Moves to the trash, the sweeper or a purge removes it for good
+	res, err := h.DB.Exec(
+        "UPDATE gallery SET deleted_at = now() WHERE id = $1 AND user_id = $2 AND deleted_at IS NULL",
         drawingID, userID,
-    ).Scan(&imageURL, &editURL)
+    )
     if err != nil {
-        http.Error(w, "Drawing not found", http.StatusNotFound)
-        return
-    }
-
-	cld, err := cloudinary.NewFromURL(h.CloudinaryURL)
-    if err == nil {
-        urls := []string{imageURL, editURL}
-        for _, url := range urls {
-            if url == "" {
-                continue
-            }
-
-            uploadIndex := strings.Index(url, "/upload/")
-            if uploadIndex == -1 {
-                continue
-            }
-
-            publicIDWithVersion := url[uploadIndex+len("/upload/"):]
-            slashIndex := strings.Index(publicIDWithVersion, "/")
-            if slashIndex != -1 {
-                publicIDWithVersion = publicIDWithVersion[slashIndex+1:]
-            }
-
-            dotIndex := strings.LastIndex(publicIDWithVersion, ".")
-            if dotIndex != -1 {
-                publicIDWithVersion = publicIDWithVersion[:dotIndex]
-            }
-
-            _, destroyErr := cld.Upload.Destroy(r.Context(), uploader.DestroyParams{
-                PublicID:     publicIDWithVersion,
-                ResourceType: "image",
-            })
-            if destroyErr != nil {
-                println("⚠️ Cloudinary delete failed:", destroyErr.Error())
-            } else {
-                println("✅ Cloudinary image deleted:", publicIDWithVersion)
-            }
-        }
+        httperr.Write(w, r, httperr.Internal("Failed to delete drawing", err))
+        return
     }
-
-	_, err = h.DB.Exec("DELETE FROM gallery WHERE id = $1 AND user_id = $2", drawingID, userID)
-    if err != nil {
-        http.Error(w, "Failed to delete drawing: "+err.Error(), http.StatusInternalServerError)
+    if n, _ := res.RowsAffected(); n == 0 {
+        httperr.Write(w, r, httperr.New(http.StatusNotFound, "Drawing not found"))
         return
     }
 
@@ -291,40 +321,28 @@ func (h *GalleryHandler) DeleteDrawing(w http.ResponseWriter, r *http.Request) {
 
 // Patch Rearrange Image
 func (h *GalleryHandler) ReorderGallery(w http.ResponseWriter, r *http.Request) {
-    if r.Method != http.MethodPatch {
-        http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
-        return
-    }
-
-    claims, ok := r.Context().Value("claims").(jwt.MapClaims)
+    userID, ok := userIDFromContext(r)
     if !ok {
-        http.Error(w, "Unauthorized", http.StatusUnauthorized)
+        httperr.Write(w, r, httperr.New(http.StatusUnauthorized, "Unauthorized"))
         return
     }
 
-    userIDFloat, ok := claims["id"].(float64)
-    if !ok {
-        http.Error(w, "Invalid user ID", http.StatusUnauthorized)
-        return
-    }
-    userID := int(userIDFloat)
-
     var input struct {
         Order []int `json:"order"`
     }
 
     if err := json.NewDecoder(r.Body).Decode(&input); err != nil {
-        http.Error(w, "Invalid input", http.StatusBadRequest)
+        httperr.Write(w, r, httperr.New(http.StatusBadRequest, "Invalid input"))
         return
     }
 
     for index, id := range input.Order {
         _, err := h.DB.Exec(
-            "UPDATE gallery SET order_index = $1 WHERE id = $2 AND user_id = $3",
+            "UPDATE gallery SET order_index = $1 WHERE id = $2 AND user_id = $3 AND deleted_at IS NULL",
             index, id, userID,
         )
         if err != nil {
-            http.Error(w, "Failed to update order: "+err.Error(), http.StatusInternalServerError)
+            httperr.Write(w, r, httperr.Internal("Failed to update order", err))
             return
         }
     }
@@ -334,127 +352,172 @@ func (h *GalleryHandler) ReorderGallery(w http.ResponseWriter, r *http.Request)
 
 // Put Edit Image
 func (h *GalleryHandler) UpdateDrawing(w http.ResponseWriter, r *http.Request) {
-    if r.Method != http.MethodPut && r.Method != http.MethodPost {
-		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
-		return
-	}
-
-    claims, ok := r.Context().Value("claims").(jwt.MapClaims)
+    userID, ok := userIDFromContext(r)
     if !ok {
-		http.Error(w, "Unauthorized", http.StatusUnauthorized)
-		return
-	}
-    userIDFloat, ok := claims["id"].(float64)
-	if !ok {
-		http.Error(w, "Invalid user ID", http.StatusUnauthorized)
-		return
-	}
-	userID := int(userIDFloat)
+        httperr.Write(w, r, httperr.New(http.StatusUnauthorized, "Unauthorized"))
+        return
+    }
 
-    idParam := r.URL.Query().Get("id")
-	if idParam == "" {
-		http.Error(w, "Missing drawing ID", http.StatusBadRequest)
-		return
-	}
-	drawingID, err := strconv.Atoi(idParam)
-	if err != nil {
-		http.Error(w, "Invalid drawing ID", http.StatusBadRequest)
-		return
-	}
+    drawingID, ok := drawingIDParam(w, r)
+    if !ok {
+        return
+    }
 
-    var existingEditUrl, existingImageUrl sql.NullString
-    err = h.DB.QueryRow(
-		"SELECT edit_url, image_url FROM gallery WHERE id = $1 AND user_id = $2",
+    var exists bool
+    err := h.DB.QueryRow(
+		"SELECT EXISTS (SELECT 1 FROM gallery WHERE id = $1 AND user_id = $2 AND deleted_at IS NULL)",
 		drawingID, userID,
-	).Scan(&existingEditUrl, &existingImageUrl)
+	).Scan(&exists)
 	if err != nil {
-		http.Error(w, "Drawing not found", http.StatusNotFound)
+		httperr.Write(w, r, httperr.Internal("Database error", err))
 		return
 	}
-
-    if err := r.ParseMultipartForm(20 << 20); err != nil {
-		http.Error(w, "Failed to parse multipart form: "+err.Error(), http.StatusBadRequest)
+	if !exists {
+		httperr.Write(w, r, httperr.New(http.StatusNotFound, "Drawing not found"))
 		return
 	}
 
-    cld, err := cloudinary.NewFromURL(h.CloudinaryURL)
-    if err != nil {
-		http.Error(w, "Cloudinary init error: "+err.Error(), http.StatusInternalServerError)
-		return
-	}
+    if !parseUpload(w, r, 2*h.Uploads.Bytes()+maxDocumentBytes) {
+        return
+    }
+
+    document, ok := documentFromForm(w, r)
+    if !ok {
+        return
+    }
+    editImage, ok := readImage(w, r, "editImage", h.Uploads, true)
+    if !ok {
+        return
+    }
+    galleryImage, ok := readImage(w, r, "galleryImage", h.Uploads, true)
+    if !ok {
+        return
+    }
+    release, ok := h.Quotas.allow(w, r, userID, imageBytes(editImage)+imageBytes(galleryImage)+int64(len(document)))
+    if !ok {
+        return
+    }
+    defer release()
 
-    extractPublicID := func(url string) string {
-        uploadIndex := strings.Index(url, "/upload/")
-        if uploadIndex == -1 {
-            return ""
+    // Every save gets fresh assets so older revisions stay intact
+    uploadFile := func(img *uploads.Image) (storage.Object, error) {
+        if img == nil {
+            return storage.Object{}, nil
         }
-        publicIDWithVersion := url[uploadIndex+len("/upload/"):]
+        return h.putAsset(r.Context(), userID, img.Data)
+    }
 
-        slashIndex := strings.Index(publicIDWithVersion, "/")
-		if slashIndex != -1 {
-			publicIDWithVersion = publicIDWithVersion[slashIndex+1:]
-		}
+    editObj, err := uploadFile(editImage)
+    if err != nil {
+        httperr.Write(w, r, httperr.Internal("Failed to upload edit image", err))
+        return
+    }
 
-        dotIndex := strings.LastIndex(publicIDWithVersion, ".")
-        if dotIndex != -1 {
-            publicIDWithVersion = publicIDWithVersion[:dotIndex]
-        }
-        
-        return publicIDWithVersion
-    }
-
-    uploadFile := func(file multipart.File, existingURL sql.NullString) (string, error) {
-        defer file.Close()
-        params := uploader.UploadParams{ResourceType: "image"}
-        if existingURL.Valid && existingURL.String != "" {
-            publicID := extractPublicID(existingURL.String)
-            if publicID != "" {
-                params.PublicID = publicID
-                b := true
-                params.Overwrite = &b
-            }
-        }
-        res, err := cld.Upload.Upload(r.Context(), file, params)
-        if err != nil {
-            return "", err
-        }
-        return res.SecureURL, nil
+    imageObj, err := uploadFile(galleryImage)
+    if err != nil {
+        httperr.Write(w, r, httperr.Internal("Failed to upload gallery image", err))
+        return
     }
 
-    var editURL, imageURL string
+    if editObj.URL == "" && imageObj.URL == "" {
+        if document == nil {
+            httperr.Write(w, r, httperr.New(http.StatusBadRequest, "No image provided"))
+            return
+        }
 
-    editFile, _, err := r.FormFile("editImage")
-    if err == nil {
-        editURL, err = uploadFile(editFile, existingEditUrl)
-        if err != nil {
-            http.Error(w, "Failed to upload edit image: "+err.Error(), http.StatusInternalServerError)
+        // Strokes only: both images are drawn from the document
+        rendered, err := h.putRender(r.Context(), userID, document)
+        if errors.Is(err, errBadBaseImage) {
+            httperr.Write(w, r, httperr.New(http.StatusBadRequest, "Invalid document: "+errBadBaseImage.Error()).
+                WithCode("invalid_document").WithDetails(httperr.Field("document.baseImage")))
             return
         }
-        _, err = h.DB.Exec("UPDATE gallery SET edit_url=$1 WHERE id=$2 AND user_id=$3", editURL, drawingID, userID)
         if err != nil {
-            http.Error(w, "Failed to update edit URL: "+err.Error(), http.StatusInternalServerError)
+            httperr.Write(w, r, httperr.Internal("Failed to render document", err))
             return
         }
+        editObj, imageObj = rendered, rendered
+        imageObj.Bytes = 0
     }
 
-    imageFile, _, err := r.FormFile("galleryImage")
-    if err == nil {
-        imageURL, err = uploadFile(imageFile, existingImageUrl)
-        if err != nil {
-            http.Error(w, "Failed to upload gallery image: "+err.Error(), http.StatusInternalServerError)
-            return
-        }
-        _, err = h.DB.Exec("UPDATE gallery SET image_url=$1 WHERE id=$2 AND user_id=$3", imageURL, drawingID, userID)
-        if err != nil {
-            http.Error(w, "Failed to update image URL: "+err.Error(), http.StatusInternalServerError)
+    tx, err := h.DB.BeginTx(r.Context(), nil)
+    if err != nil {
+        httperr.Write(w, r, httperr.Internal("Database error", err))
+        return
+    }
+    defer tx.Rollback()
+
+    // A save without strokes leaves the old document stale, so it's dropped
+    _, err = tx.Exec(
+        `UPDATE gallery SET edit_url = COALESCE(NULLIF($1, ''), edit_url), image_url = COALESCE(NULLIF($2, ''), image_url),
+             document_id = NULL
+         WHERE id = $3 AND user_id = $4 AND deleted_at IS NULL`,
+        editObj.URL, imageObj.URL, drawingID, userID,
+    )
+    if err != nil {
+        httperr.Write(w, r, httperr.Internal("Failed to update drawing", err))
+        return
+    }
+
+    if document != nil {
+        if _, err := saveDocument(r.Context(), tx, drawingID, document); err != nil {
+            httperr.Write(w, r, httperr.Internal("Failed to save document", err))
             return
         }
     }
 
+    revisionID, err := recordRevision(r.Context(), tx, drawingID, editObj.Bytes+imageObj.Bytes+int64(len(document)))
+    if err != nil {
+        httperr.Write(w, r, httperr.Internal("Failed to save revision", err))
+        return
+    }
+
+    if err := tx.Commit(); err != nil {
+        httperr.Write(w, r, httperr.Internal("Failed to update drawing", err))
+        return
+    }
+
+    h.pruneRevisions(r.Context(), drawingID)
+    if imageObj.URL != "" {
+        h.queueRenditions(r.Context(), userID, drawingID)
+    }
+
     w.Header().Set("Content-Type", "application/json")
 
-    json.NewEncoder(w).Encode(map[string]string{
-        "editUrl":  editURL,
-        "imageUrl": imageURL,
+    json.NewEncoder(w).Encode(map[string]interface{}{
+        "editUrl":     editObj.URL,
+        "imageUrl":    imageObj.URL,
+        "revisionId":  revisionID,
+        "hasDocument": document != nil,
     })
-}
\ No newline at end of file
+}
+
+// putAsset stores an image in the user's gallery folder and counts it
+// towards their quota
+func (h *GalleryHandler) putAsset(ctx context.Context, userID int, data []byte) (storage.Object, error) {
+    obj, err := h.Storage.Put(ctx, "URPaint_Gallery/user_"+strconv.Itoa(userID), bytes.NewReader(data))
+    if err != nil {
+        return storage.Object{}, err
+    }
+    if err := trackAsset(ctx, h.DB, userID, obj); err != nil {
+        h.deleteAsset(ctx, obj.URL)
+        return storage.Object{}, err
+    }
+    return obj, nil
+}
+
+// deleteAsset removes a stored image, logging rather than failing
+func (h *GalleryHandler) deleteAsset(ctx context.Context, url string) {
+    key := h.Storage.KeyFromURL(url)
+    if key == "" {
+        return
+    }
+    if err := h.Storage.Delete(ctx, key); err != nil && !errors.Is(err, storage.ErrNotFound) {
+        slog.WarnContext(ctx, "storage delete failed", "key", key, "err", err)
+        return
+    }
+    if err := untrackAsset(ctx, h.DB, key); err != nil {
+        slog.WarnContext(ctx, "storage usage update failed", "key", key, "err", err)
+    }
+    slog.InfoContext(ctx, "storage image deleted", "key", key)
+}
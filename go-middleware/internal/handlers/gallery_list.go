@@ -0,0 +1,297 @@
+package handlers
+
+import (
+    "database/sql"
+    "encoding/base64"
+    "encoding/json"
+    "errors"
+    "fmt"
+    "net/http"
+    "net/url"
+    "strconv"
+    "strings"
+    "time"
+
+    "github.com/lib/pq"
+
+    "urpaint/internal/httperr"
+)
+
+const (
+    defaultPageSize = 50
+    maxPageSize     = 200
+)
+
+type GalleryItem struct {
+    ID          int       `json:"id"`
+    ImageURL    string    `json:"image_url"`
+    EditURL     string    `json:"edit_url"`
+    Title       string    `json:"title"`
+    Description string    `json:"description"`
+    Tags        []string  `json:"tags"`
+    UploadedAt  time.Time `json:"uploadedAt"`
+    OrderIndex  int       `json:"orderIndex"`
+    HasDocument bool      `json:"hasDocument"`
+    // Smaller copies of image_url by size (small, medium, large). Empty
+    // until they've been generated; clients fall back to image_url.
+    Renditions map[string]Rendition `json:"renditions"`
+}
+
+// Columns read by scanGalleryItem, for a query aliasing gallery as g.
+// The caller appends its order_index column after these.
+const galleryItemColumns = `g.id, g.image_url, g.edit_url, g.title, g.description, g.uploaded_at,
+    g.document_id IS NOT NULL, ARRAY(SELECT t.tag FROM gallery_tags t WHERE t.gallery_id = g.id ORDER BY t.tag),
+    ` + galleryRenditionsColumn
+
+func scanGalleryItem(rows *sql.Rows, extra ...interface{}) (GalleryItem, error) {
+    var item GalleryItem
+    var imageURL, editURL, title, description sql.NullString
+    var renditions []byte
+
+    dest := append([]interface{}{
+        &item.ID, &imageURL, &editURL, &title, &description, &item.UploadedAt,
+        &item.HasDocument, pq.Array(&item.Tags), &renditions, &item.OrderIndex,
+    }, extra...)
+    if err := rows.Scan(dest...); err != nil {
+        return item, err
+    }
+    if err := json.Unmarshal(renditions, &item.Renditions); err != nil {
+        return item, err
+    }
+
+    item.ImageURL = imageURL.String
+    item.EditURL = editURL.String
+    item.Title = title.String
+    item.Description = description.String
+    if item.Tags == nil {
+        item.Tags = []string{}
+    }
+    return item, nil
+}
+
+type GalleryPage struct {
+    Items      []GalleryItem `json:"items"`
+    NextCursor string        `json:"nextCursor,omitempty"`
+}
+
+// Sortable columns. Titles can be NULL, so they sort as ''.
+var gallerySortColumns = map[string]string{
+    "order_index": "g.order_index",
+    "uploaded_at": "g.uploaded_at",
+    "title":       "COALESCE(g.title, '')",
+}
+
+// galleryCursor is the last row of a page, encoded opaquely for clients
+type galleryCursor struct {
+    Sort  string `json:"s"`
+    Desc  bool   `json:"d"`
+    Value string `json:"v"`
+    ID    int    `json:"i"`
+    Album int    `json:"a,omitempty"`
+
+    // Value parsed for the sort column, set by decodeGalleryCursor
+    value interface{}
+}
+
+func (c galleryCursor) encode() string {
+    b, _ := json.Marshal(c)
+    return base64.RawURLEncoding.EncodeToString(b)
+}
+
+var errInvalidCursor = errors.New("invalid cursor")
+
+// decodeGalleryCursor reverses encode. A cursor that doesn't decode, or
+// whose value doesn't parse for its sort, is errInvalidCursor.
+func decodeGalleryCursor(s string) (galleryCursor, error) {
+    var c galleryCursor
+    b, err := base64.RawURLEncoding.DecodeString(s)
+    if err != nil {
+        return c, errInvalidCursor
+    }
+    if err := json.Unmarshal(b, &c); err != nil {
+        return c, errInvalidCursor
+    }
+
+    switch c.Sort {
+    case "order_index":
+        n, err := strconv.Atoi(c.Value)
+        if err != nil {
+            return c, errInvalidCursor
+        }
+        c.value = n
+    case "uploaded_at":
+        t, err := time.Parse(time.RFC3339Nano, c.Value)
+        if err != nil {
+            return c, errInvalidCursor
+        }
+        c.value = t
+    case "title":
+        c.value = c.Value
+    default:
+        return c, errInvalidCursor
+    }
+    return c, nil
+}
+
+type galleryQuery struct {
+    UserID int
+    Limit  int
+    Sort   string
+    Desc   bool
+    After  *galleryCursor
+    Title  string
+    From   *time.Time
+    To     *time.Time
+    Album  int
+    Tag    string
+}
+
+// parseGalleryQuery reads limit, after, sort, order, q, from, to, album and tag.
+// Errors are safe to show to the client; a bad cursor is an *httperr.Error
+// with code invalid_cursor.
+func parseGalleryQuery(values url.Values, userID int) (galleryQuery, error) {
+    q := galleryQuery{UserID: userID, Limit: defaultPageSize, Sort: "order_index"}
+
+    if v := values.Get("limit"); v != "" {
+        n, err := strconv.Atoi(v)
+        if err != nil || n < 1 {
+            return q, fmt.Errorf("invalid limit %q", v)
+        }
+        q.Limit = min(n, maxPageSize)
+    }
+
+    if v := values.Get("sort"); v != "" {
+        if _, ok := gallerySortColumns[v]; !ok {
+            return q, fmt.Errorf("invalid sort %q (use order_index, uploaded_at or title)", v)
+        }
+        q.Sort = v
+    }
+
+    switch v := values.Get("order"); v {
+    case "", "asc":
+    case "desc":
+        q.Desc = true
+    default:
+        return q, fmt.Errorf("invalid order %q (use asc or desc)", v)
+    }
+
+    if v := values.Get("album"); v != "" {
+        n, err := strconv.Atoi(v)
+        if err != nil || n < 1 {
+            return q, fmt.Errorf("invalid album %q", v)
+        }
+        q.Album = n
+    }
+
+    if v := values.Get("after"); v != "" {
+        c, err := decodeGalleryCursor(v)
+        if err != nil || c.Sort != q.Sort || c.Desc != q.Desc || c.Album != q.Album {
+            return q, httperr.New(http.StatusBadRequest, "Invalid cursor").
+                WithCode("invalid_cursor").WithDetails(httperr.Field("after"))
+        }
+        q.After = &c
+    }
+
+    q.Title = strings.TrimSpace(values.Get("q"))
+    q.Tag = normalizeTag(values.Get("tag"))
+
+    for name, dst := range map[string]**time.Time{"from": &q.From, "to": &q.To} {
+        v := values.Get(name)
+        if v == "" {
+            continue
+        }
+        t, err := parseDateParam(v)
+        if err != nil {
+            return q, fmt.Errorf("invalid %s %q (use RFC 3339 or YYYY-MM-DD)", name, v)
+        }
+        *dst = &t
+    }
+    // A bare end date covers that whole day
+    if v := values.Get("to"); q.To != nil && len(v) == len("2006-01-02") {
+        end := q.To.Add(24 * time.Hour)
+        q.To = &end
+    }
+
+    return q, nil
+}
+
+func parseDateParam(v string) (time.Time, error) {
+    if t, err := time.Parse(time.RFC3339, v); err == nil {
+        return t, nil
+    }
+    return time.Parse("2006-01-02", v)
+}
+
+// sql builds the page query. It fetches one extra row to detect a next page.
+// Inside an album, order_index is the album's own ordering.
+func (q galleryQuery) sql() (string, []interface{}) {
+    args := []interface{}{q.UserID}
+    arg := func(v interface{}) string {
+        args = append(args, v)
+        return "$" + strconv.Itoa(len(args))
+    }
+
+    from := "gallery g"
+    orderIndex := "g.order_index"
+    where := []string{"g.user_id = $1", "g.deleted_at IS NULL"}
+
+    if q.Album != 0 {
+        from += " JOIN album_items ai ON ai.gallery_id = g.id JOIN albums a ON a.id = ai.album_id"
+        orderIndex = "ai.order_index"
+        where = append(where, "a.user_id = $1", "ai.album_id = "+arg(q.Album))
+    }
+
+    if q.Title != "" {
+        where = append(where, "g.title ILIKE "+arg("%"+escapeLike(q.Title)+"%"))
+    }
+    if q.Tag != "" {
+        where = append(where, "EXISTS (SELECT 1 FROM gallery_tags t WHERE t.gallery_id = g.id AND t.tag = "+arg(q.Tag)+")")
+    }
+    if q.From != nil {
+        where = append(where, "g.uploaded_at >= "+arg(*q.From))
+    }
+    if q.To != nil {
+        where = append(where, "g.uploaded_at < "+arg(*q.To))
+    }
+
+    sortExpr := gallerySortColumns[q.Sort]
+    if q.Sort == "order_index" {
+        sortExpr = orderIndex
+    }
+    cmp, dir := ">", "ASC"
+    if q.Desc {
+        cmp, dir = "<", "DESC"
+    }
+
+    if q.After != nil {
+        where = append(where, fmt.Sprintf("(%s, g.id) %s (%s, %s)", sortExpr, cmp, arg(q.After.value), arg(q.After.ID)))
+    }
+
+    query := fmt.Sprintf(
+        `SELECT %s, %s
+         FROM %s
+         WHERE %s
+         ORDER BY %s %s, g.id %s
+         LIMIT %s`,
+        galleryItemColumns, orderIndex, from, strings.Join(where, " AND "), sortExpr, dir, dir, arg(q.Limit+1),
+    )
+    return query, args
+}
+
+// cursorFor encodes the position right after item
+func (q galleryQuery) cursorFor(item GalleryItem) string {
+    c := galleryCursor{Sort: q.Sort, Desc: q.Desc, ID: item.ID, Album: q.Album}
+    switch q.Sort {
+    case "order_index":
+        c.Value = strconv.Itoa(item.OrderIndex)
+    case "uploaded_at":
+        c.Value = item.UploadedAt.Format(time.RFC3339Nano)
+    case "title":
+        c.Value = item.Title
+    }
+    return c.encode()
+}
+
+func escapeLike(s string) string {
+    return strings.NewReplacer(`\`, `\\`, `%`, `\%`, `_`, `\_`).Replace(s)
+}
@@ -0,0 +1,160 @@
+package handlers
+
+import (
+    "encoding/base64"
+    "errors"
+    "net/url"
+    "strings"
+    "testing"
+    "time"
+
+    "urpaint/internal/httperr"
+)
+
+func TestGalleryCursorRoundTrip(t *testing.T) {
+    uploaded := time.Date(2024, 3, 1, 12, 30, 0, 123456789, time.UTC)
+    item := GalleryItem{ID: 42, OrderIndex: 7, UploadedAt: uploaded, Title: "Sunset"}
+
+    tests := []struct {
+        sort string
+        want interface{}
+    }{
+        {"order_index", 7},
+        {"uploaded_at", uploaded},
+        {"title", "Sunset"},
+    }
+    for _, tt := range tests {
+        t.Run(tt.sort, func(t *testing.T) {
+            q := galleryQuery{Sort: tt.sort, Desc: true, Album: 3}
+            c, err := decodeGalleryCursor(q.cursorFor(item))
+            if err != nil {
+                t.Fatalf("decode: %v", err)
+            }
+            if c.Sort != tt.sort || !c.Desc || c.Album != 3 || c.ID != 42 {
+                t.Errorf("cursor = %+v", c)
+            }
+            if got, ok := c.value.(time.Time); ok {
+                if !got.Equal(tt.want.(time.Time)) {
+                    t.Errorf("value = %v, want %v", got, tt.want)
+                }
+            } else if c.value != tt.want {
+                t.Errorf("value = %#v, want %#v", c.value, tt.want)
+            }
+        })
+    }
+}
+
+func TestDecodeGalleryCursorRejects(t *testing.T) {
+    encode := func(s string) string {
+        return base64.RawURLEncoding.EncodeToString([]byte(s))
+    }
+
+    tests := []struct {
+        name   string
+        cursor string
+    }{
+        {"not base64", "!!!"},
+        {"not json", encode("nope")},
+        {"unknown sort", encode(`{"s":"id","v":"1","i":1}`)},
+        {"bad order index", encode(`{"s":"order_index","v":"x","i":1}`)},
+        {"bad time", encode(`{"s":"uploaded_at","v":"yesterday","i":1}`)},
+    }
+    for _, tt := range tests {
+        t.Run(tt.name, func(t *testing.T) {
+            if _, err := decodeGalleryCursor(tt.cursor); !errors.Is(err, errInvalidCursor) {
+                t.Errorf("err = %v, want errInvalidCursor", err)
+            }
+        })
+    }
+}
+
+func TestParseGalleryQueryCursor(t *testing.T) {
+    valid := galleryQuery{Sort: "order_index"}.cursorFor(GalleryItem{ID: 5, OrderIndex: 2})
+
+    tests := []struct {
+        name    string
+        values  url.Values
+        invalid bool
+    }{
+        {"valid", url.Values{"after": {valid}}, false},
+        {"garbage", url.Values{"after": {"garbage"}}, true},
+        {"other sort", url.Values{"after": {valid}, "sort": {"title"}}, true},
+        {"other order", url.Values{"after": {valid}, "order": {"desc"}}, true},
+        {"other album", url.Values{"after": {valid}, "album": {"9"}}, true},
+    }
+    for _, tt := range tests {
+        t.Run(tt.name, func(t *testing.T) {
+            q, err := parseGalleryQuery(tt.values, 1)
+            if !tt.invalid {
+                if err != nil {
+                    t.Fatalf("err = %v", err)
+                }
+                if q.After == nil || q.After.ID != 5 {
+                    t.Errorf("After = %+v", q.After)
+                }
+                return
+            }
+
+            var e *httperr.Error
+            if !errors.As(err, &e) {
+                t.Fatalf("err = %v, want *httperr.Error", err)
+            }
+            if e.Status != 400 || e.Code != "invalid_cursor" {
+                t.Errorf("got %d %s, want 400 invalid_cursor", e.Status, e.Code)
+            }
+        })
+    }
+}
+
+func TestParseGalleryQueryErrors(t *testing.T) {
+    tests := []struct {
+        name   string
+        values url.Values
+    }{
+        {"limit", url.Values{"limit": {"0"}}},
+        {"sort", url.Values{"sort": {"id"}}},
+        {"order", url.Values{"order": {"up"}}},
+        {"album", url.Values{"album": {"-1"}}},
+        {"date", url.Values{"from": {"March"}}},
+    }
+    for _, tt := range tests {
+        t.Run(tt.name, func(t *testing.T) {
+            if _, err := parseGalleryQuery(tt.values, 1); err == nil {
+                t.Error("expected an error")
+            }
+        })
+    }
+}
+
+func TestGalleryQuerySQL(t *testing.T) {
+    q, err := parseGalleryQuery(url.Values{"limit": {"500"}, "to": {"2024-01-31"}}, 1)
+    if err != nil {
+        t.Fatal(err)
+    }
+    if q.Limit != maxPageSize {
+        t.Errorf("Limit = %d, want %d", q.Limit, maxPageSize)
+    }
+    // A bare end date covers the whole day
+    if want := time.Date(2024, 2, 1, 0, 0, 0, 0, time.UTC); !q.To.Equal(want) {
+        t.Errorf("To = %v, want %v", q.To, want)
+    }
+
+    after := galleryQuery{Sort: "order_index"}.cursorFor(GalleryItem{ID: 5, OrderIndex: 2})
+    q, err = parseGalleryQuery(url.Values{"after": {after}, "q": {"50%_off"}}, 1)
+    if err != nil {
+        t.Fatal(err)
+    }
+    sql, args := q.sql()
+    if !strings.Contains(sql, "(g.order_index, g.id) > ($3, $4)") {
+        t.Errorf("missing cursor condition:\n%s", sql)
+    }
+    want := []interface{}{1, `%50\%\_off%`, 2, 5, defaultPageSize + 1}
+    if len(args) != len(want) {
+        t.Fatalf("args = %#v, want %#v", args, want)
+    }
+    for i := range want {
+        if args[i] != want[i] {
+            t.Errorf("args[%d] = %#v, want %#v", i, args[i], want[i])
+        }
+    }
+}
@@ -0,0 +1,98 @@
+package handlers
+
+import (
+    "context"
+    "database/sql"
+    "encoding/json"
+    "net/http"
+    "sync"
+    "time"
+
+    "urpaint/internal/httperr"
+    "urpaint/internal/storage"
+)
+
+// How long a readiness check waits on each dependency
+const readyTimeout = 3 * time.Second
+
+// How long a storage ping's result is reused. Probes come every few
+// seconds from every instance, and the Cloudinary Admin API is rate-limited.
+const defaultStoragePingInterval = 30 * time.Second
+
+type HealthHandler struct {
+    DB      *sql.DB
+    Storage storage.Storage
+    // Done closes when the server starts shutting down, after which it
+    // reports not ready
+    Done <-chan struct{}
+    // StoragePingInterval is how often storage is actually pinged
+    StoragePingInterval time.Duration
+
+    mu       sync.Mutex
+    pingedAt time.Time
+    pingErr  error
+}
+
+// GET /healthz
+// Liveness: the process is up and serving. Dependencies aren't checked,
+// so a database outage doesn't get every instance restarted.
+func (h *HealthHandler) Live(w http.ResponseWriter, r *http.Request) {
+    w.Header().Set("Content-Type", "application/json")
+    json.NewEncoder(w).Encode(map[string]string{"status": "ok"})
+}
+
+// GET /readyz
+// Readiness: the database answers a ping and the storage backend is
+// reachable. Answers 503 with each check's result otherwise.
+func (h *HealthHandler) Ready(w http.ResponseWriter, r *http.Request) {
+    select {
+    case <-h.Done:
+        httperr.Write(w, r, httperr.New(http.StatusServiceUnavailable, "Shutting down").WithCode("shutting_down"))
+        return
+    default:
+    }
+
+    ctx, cancel := context.WithTimeout(r.Context(), readyTimeout)
+    defer cancel()
+
+    checks := map[string]string{"database": "ok", "storage": "ok"}
+    var failed error
+    if err := h.DB.PingContext(ctx); err != nil {
+        checks["database"] = "unreachable"
+        failed = err
+    }
+    if pinger, ok := h.Storage.(storage.Pinger); ok {
+        if err := h.pingStorage(ctx, pinger); err != nil {
+            checks["storage"] = "unreachable"
+            failed = err
+        }
+    }
+
+    if failed != nil {
+        e := httperr.New(http.StatusServiceUnavailable, "Not ready").WithCode("not_ready").WithDetails(checks)
+        e.Err = failed
+        httperr.Write(w, r, e)
+        return
+    }
+
+    w.Header().Set("Content-Type", "application/json")
+    json.NewEncoder(w).Encode(map[string]interface{}{"status": "ok", "checks": checks})
+}
+
+// pingStorage returns the last ping's result while it's fresh. Concurrent
+// checks wait for the one ping in flight rather than sending their own.
+func (h *HealthHandler) pingStorage(ctx context.Context, pinger storage.Pinger) error {
+    interval := h.StoragePingInterval
+    if interval <= 0 {
+        interval = defaultStoragePingInterval
+    }
+
+    h.mu.Lock()
+    defer h.mu.Unlock()
+    if !h.pingedAt.IsZero() && time.Since(h.pingedAt) < interval {
+        return h.pingErr
+    }
+    h.pingErr = pinger.Ping(ctx)
+    h.pingedAt = time.Now()
+    return h.pingErr
+}
@@ -0,0 +1,198 @@
+package handlers
+
+import (
+    "encoding/json"
+    "errors"
+    "fmt"
+    "net/http"
+    "strconv"
+    "time"
+
+    "urpaint/internal/httperr"
+    "urpaint/internal/jobs"
+)
+
+const (
+    jobPollInterval = time.Second
+    jobKeepAlive    = 15 * time.Second
+)
+
+// JobHandler lets users follow and cancel their background jobs
+type JobHandler struct {
+    Queue *jobs.Queue
+    // Done closes when the server starts shutting down. Open event streams
+    // end then, so the drain doesn't wait on them.
+    Done <-chan struct{}
+}
+
+// jobIDParam parses the {id} path segment
+func jobIDParam(w http.ResponseWriter, r *http.Request) (int64, bool) {
+    id, err := strconv.ParseInt(r.PathValue("id"), 10, 64)
+    if err != nil {
+        httperr.Write(w, r, httperr.New(http.StatusBadRequest, "Invalid job ID"))
+        return 0, false
+    }
+    return id, true
+}
+
+// GET /jobs
+// The user's 50 most recent jobs
+func (h *JobHandler) ListJobs(w http.ResponseWriter, r *http.Request) {
+    userID, ok := userIDFromContext(r)
+    if !ok {
+        httperr.Write(w, r, httperr.New(http.StatusUnauthorized, "Unauthorized"))
+        return
+    }
+
+    list, err := h.Queue.List(r.Context(), userID, 50)
+    if err != nil {
+        httperr.Write(w, r, httperr.Internal("Database error", err))
+        return
+    }
+
+    w.Header().Set("Content-Type", "application/json")
+    json.NewEncoder(w).Encode(list)
+}
+
+// GET /jobs/{id}
+func (h *JobHandler) GetJob(w http.ResponseWriter, r *http.Request) {
+    userID, ok := userIDFromContext(r)
+    if !ok {
+        httperr.Write(w, r, httperr.New(http.StatusUnauthorized, "Unauthorized"))
+        return
+    }
+
+    id, ok := jobIDParam(w, r)
+    if !ok {
+        return
+    }
+
+    job, err := h.Queue.Get(r.Context(), id, userID)
+    if errors.Is(err, jobs.ErrNotFound) {
+        httperr.Write(w, r, httperr.New(http.StatusNotFound, "Job not found"))
+        return
+    }
+    if err != nil {
+        httperr.Write(w, r, httperr.Internal("Database error", err))
+        return
+    }
+
+    w.Header().Set("Content-Type", "application/json")
+    json.NewEncoder(w).Encode(job)
+}
+
+// DELETE /jobs/{id}
+// Cancels the job and responds with its state
+func (h *JobHandler) CancelJob(w http.ResponseWriter, r *http.Request) {
+    userID, ok := userIDFromContext(r)
+    if !ok {
+        httperr.Write(w, r, httperr.New(http.StatusUnauthorized, "Unauthorized"))
+        return
+    }
+
+    id, ok := jobIDParam(w, r)
+    if !ok {
+        return
+    }
+
+    job, err := h.Queue.Cancel(r.Context(), id, userID)
+    if errors.Is(err, jobs.ErrNotFound) {
+        httperr.Write(w, r, httperr.New(http.StatusNotFound, "Job not found"))
+        return
+    }
+    if err != nil {
+        httperr.Write(w, r, httperr.Internal("Failed to cancel job", err))
+        return
+    }
+
+    w.Header().Set("Content-Type", "application/json")
+    json.NewEncoder(w).Encode(job)
+}
+
+// GET /jobs/{id}/events
+// Server-sent events: a "job" event with the job every time it changes,
+// ending once it is done. EventSource can't send an Authorization header,
+// so browsers should read this with fetch.
+func (h *JobHandler) JobEvents(w http.ResponseWriter, r *http.Request) {
+    userID, ok := userIDFromContext(r)
+    if !ok {
+        httperr.Write(w, r, httperr.New(http.StatusUnauthorized, "Unauthorized"))
+        return
+    }
+
+    id, ok := jobIDParam(w, r)
+    if !ok {
+        return
+    }
+
+    flusher, ok := w.(http.Flusher)
+    if !ok {
+        httperr.Write(w, r, httperr.Internal("Streaming unsupported", nil))
+        return
+    }
+
+    job, err := h.Queue.Get(r.Context(), id, userID)
+    if errors.Is(err, jobs.ErrNotFound) {
+        httperr.Write(w, r, httperr.New(http.StatusNotFound, "Job not found"))
+        return
+    }
+    if err != nil {
+        httperr.Write(w, r, httperr.Internal("Database error", err))
+        return
+    }
+
+    // The stream outlives the server's write timeout
+    http.NewResponseController(w).SetWriteDeadline(time.Time{})
+
+    w.Header().Set("Content-Type", "text/event-stream")
+    w.Header().Set("Cache-Control", "no-cache")
+    w.Header().Set("X-Accel-Buffering", "no")
+
+    send := func(job *jobs.Job) bool {
+        data, err := json.Marshal(job)
+        if err != nil {
+            return false
+        }
+        if _, err := fmt.Fprintf(w, "event: job\nid: %d\ndata: %s\n\n", job.UpdatedAt.UnixMilli(), data); err != nil {
+            return false
+        }
+        flusher.Flush()
+        return true
+    }
+
+    if !send(job) || job.Done() {
+        return
+    }
+    last := job.UpdatedAt
+
+    poll := time.NewTicker(jobPollInterval)
+    defer poll.Stop()
+    keepAlive := time.NewTicker(jobKeepAlive)
+    defer keepAlive.Stop()
+
+    for {
+        select {
+        case <-r.Context().Done():
+            return
+        case <-h.Done:
+            return
+        case <-keepAlive.C:
+            if _, err := fmt.Fprint(w, ": keep-alive\n\n"); err != nil {
+                return
+            }
+            flusher.Flush()
+        case <-poll.C:
+            job, err := h.Queue.Get(r.Context(), id, userID)
+            if err != nil {
+                return
+            }
+            if job.UpdatedAt.Equal(last) {
+                continue
+            }
+            last = job.UpdatedAt
+            if !send(job) || job.Done() {
+                return
+            }
+        }
+    }
+}
@@ -0,0 +1,52 @@
+package handlers
+
+import (
+    "net/http"
+    "strconv"
+    "strings"
+
+    "urpaint/internal/httperr"
+)
+
+// intParam parses a required integer query parameter and reports a 400
+// itself when it is missing or malformed. label names it in the error.
+func intParam(w http.ResponseWriter, r *http.Request, name, label string) (int, bool) {
+    param := r.URL.Query().Get(name)
+    if param == "" {
+        httperr.Write(w, r, httperr.New(http.StatusBadRequest, "Missing "+label))
+        return 0, false
+    }
+    value, err := strconv.Atoi(param)
+    if err != nil {
+        httperr.Write(w, r, httperr.New(http.StatusBadRequest, "Invalid "+label))
+        return 0, false
+    }
+    return value, true
+}
+
+// drawingIDParam reads the drawing ID from the {id} path segment, or
+// from ?id= on the older /gallery/* routes that have no {id}
+func drawingIDParam(w http.ResponseWriter, r *http.Request) (int, bool) {
+    if param := r.PathValue("id"); param != "" {
+        id, err := strconv.Atoi(param)
+        if err != nil || id <= 0 {
+            httperr.Write(w, r, httperr.New(http.StatusBadRequest, "Invalid drawing ID"))
+            return 0, false
+        }
+        return id, true
+    }
+    if !galleryRoute(r) {
+        httperr.Write(w, r, httperr.New(http.StatusBadRequest, "Missing drawing ID"))
+        return 0, false
+    }
+    return intParam(w, r, "id", "drawing ID")
+}
+
+// galleryRoute reports whether r matched one of the /gallery/* routes
+func galleryRoute(r *http.Request) bool {
+    path := r.Pattern
+    if _, p, ok := strings.Cut(path, " "); ok {
+        path = p
+    }
+    return strings.HasPrefix(path, "/gallery/")
+}
@@ -0,0 +1,48 @@
+package handlers
+
+import (
+    "net/http"
+    "net/http/httptest"
+    "strconv"
+    "testing"
+)
+
+func TestDrawingIDParam(t *testing.T) {
+    mux := http.NewServeMux()
+    handler := func(w http.ResponseWriter, r *http.Request) {
+        if id, ok := drawingIDParam(w, r); ok {
+            w.Write([]byte(strconv.Itoa(id)))
+        }
+    }
+    mux.HandleFunc("GET /drawings/{id}", handler)
+    mux.HandleFunc("PUT /drawings/order", handler)
+    mux.HandleFunc("PATCH /gallery/rename", handler)
+
+    tests := []struct {
+        name   string
+        method string
+        target string
+        status int
+        body   string
+    }{
+        {"path", http.MethodGet, "/drawings/12", http.StatusOK, "12"},
+        {"path wins over query", http.MethodGet, "/drawings/12?id=99", http.StatusOK, "12"},
+        {"bad path", http.MethodGet, "/drawings/abc", http.StatusBadRequest, ""},
+        {"zero path", http.MethodGet, "/drawings/0", http.StatusBadRequest, ""},
+        {"gallery alias", http.MethodPatch, "/gallery/rename?id=7", http.StatusOK, "7"},
+        {"gallery alias missing", http.MethodPatch, "/gallery/rename", http.StatusBadRequest, ""},
+        {"query on new route", http.MethodPut, "/drawings/order?id=7", http.StatusBadRequest, ""},
+    }
+    for _, tt := range tests {
+        t.Run(tt.name, func(t *testing.T) {
+            w := httptest.NewRecorder()
+            mux.ServeHTTP(w, httptest.NewRequest(tt.method, tt.target, nil))
+            if w.Code != tt.status {
+                t.Fatalf("status = %d, want %d (%s)", w.Code, tt.status, w.Body)
+            }
+            if tt.body != "" && w.Body.String() != tt.body {
+                t.Errorf("id = %q, want %q", w.Body, tt.body)
+            }
+        })
+    }
+}
@@ -0,0 +1,171 @@
+package handlers
+
+import (
+    "context"
+    "database/sql"
+    "database/sql/driver"
+    "encoding/json"
+    "errors"
+    "fmt"
+    "net/http"
+
+    "urpaint/internal/httperr"
+    "urpaint/internal/storage"
+)
+
+// Arbitrary class for pg_advisory_lock(class, user_id), so one user's
+// uploads check and track their usage one at a time
+const quotaLockClass = 72_617_003
+
+// Quotas caps the bytes each user keeps in storage. users.storage_quota
+// overrides DefaultBytes per user; a DefaultBytes of 0 means no limit.
+type Quotas struct {
+    DB           *sql.DB
+    DefaultBytes int64
+}
+
+// Usage is what a user has stored against their quota
+type Usage struct {
+    Drawings        int   `json:"drawings"`
+    TrashedDrawings int   `json:"trashedDrawings"`
+    BytesUsed       int64 `json:"bytesUsed"`
+    // null when the user has no limit
+    QuotaBytes *int64 `json:"quotaBytes"`
+}
+
+// Usage counts the user's drawings and stored bytes: tracked objects plus
+// the stroke documents kept in the database
+func (q *Quotas) Usage(ctx context.Context, userID int) (Usage, error) {
+    var usage Usage
+    var quota sql.NullInt64
+    err := q.DB.QueryRowContext(ctx,
+        `SELECT
+             (SELECT COUNT(*) FROM gallery WHERE user_id = $1 AND deleted_at IS NULL),
+             (SELECT COUNT(*) FROM gallery WHERE user_id = $1 AND deleted_at IS NOT NULL),
+             (SELECT COALESCE(SUM(byte_size), 0) FROM stored_assets WHERE user_id = $1)
+             + (SELECT COALESCE(SUM(d.byte_size), 0) FROM drawing_documents d
+                JOIN gallery g ON g.id = d.gallery_id WHERE g.user_id = $1),
+             u.storage_quota
+         FROM users u WHERE u.id = $1`,
+        userID,
+    ).Scan(&usage.Drawings, &usage.TrashedDrawings, &usage.BytesUsed, &quota)
+    if err != nil {
+        return Usage{}, err
+    }
+
+    switch {
+    case quota.Valid:
+        usage.QuotaBytes = &quota.Int64
+    case q.DefaultBytes > 0:
+        limit := q.DefaultBytes
+        usage.QuotaBytes = &limit
+    }
+    return usage, nil
+}
+
+// quotaError is an upload that would take the user over their quota
+type quotaError struct {
+    used, quota, incoming int64
+}
+
+func (e *quotaError) Error() string {
+    return fmt.Sprintf("Storage quota exceeded: %d of %d bytes used, this upload needs %d more", e.used, e.quota, e.incoming)
+}
+
+// reserve fails with a *quotaError when storing incoming more bytes would
+// take the user over quota. Otherwise it holds the user's quota lock until
+// release is called, which must be after what was stored is tracked, so
+// concurrent uploads can't all pass the check against the same usage.
+// A nil Quotas allows everything.
+func (q *Quotas) reserve(ctx context.Context, userID int, incoming int64) (release func(), err error) {
+    if q == nil {
+        return func() {}, nil
+    }
+
+    conn, err := q.DB.Conn(ctx)
+    if err != nil {
+        return nil, err
+    }
+    if _, err := conn.ExecContext(ctx, "SELECT pg_advisory_lock($1, $2)", quotaLockClass, userID); err != nil {
+        conn.Close()
+        return nil, err
+    }
+    release = func() {
+        // Unlock even if the request was cancelled. A connection that might
+        // still hold the lock is discarded rather than pooled.
+        if _, err := conn.ExecContext(context.Background(), "SELECT pg_advisory_unlock($1, $2)", quotaLockClass, userID); err != nil {
+            conn.Raw(func(interface{}) error { return driver.ErrBadConn })
+        }
+        conn.Close()
+    }
+
+    usage, err := q.Usage(ctx, userID)
+    if err != nil {
+        release()
+        return nil, err
+    }
+    if usage.QuotaBytes != nil && usage.BytesUsed+incoming > *usage.QuotaBytes {
+        release()
+        return nil, &quotaError{used: usage.BytesUsed, quota: *usage.QuotaBytes, incoming: incoming}
+    }
+    return release, nil
+}
+
+// allow is reserve for a request, answering 413 itself when the upload
+// doesn't fit
+func (q *Quotas) allow(w http.ResponseWriter, r *http.Request, userID int, incoming int64) (release func(), ok bool) {
+    release, err := q.reserve(r.Context(), userID, incoming)
+    var exceeded *quotaError
+    if errors.As(err, &exceeded) {
+        uploadError(w, r, http.StatusRequestEntityTooLarge, "", "quota_exceeded", exceeded.Error())
+        return nil, false
+    }
+    if err != nil {
+        httperr.Write(w, r, httperr.Internal("Database error", err))
+        return nil, false
+    }
+    return release, true
+}
+
+// trackAsset records a stored object against its owner's usage. Writing
+// the same key again, as an overwrite does, replaces its size.
+func trackAsset(ctx context.Context, q queryer, userID int, obj storage.Object) error {
+    _, err := q.ExecContext(ctx,
+        `INSERT INTO stored_assets (storage_key, user_id, byte_size) VALUES ($1, $2, $3)
+         ON CONFLICT (storage_key) DO UPDATE SET user_id = EXCLUDED.user_id, byte_size = EXCLUDED.byte_size`,
+        obj.Key, userID, obj.Bytes,
+    )
+    return err
+}
+
+// untrackAsset drops a deleted object from its owner's usage
+func untrackAsset(ctx context.Context, q queryer, key string) error {
+    _, err := q.ExecContext(ctx, "DELETE FROM stored_assets WHERE storage_key = $1", key)
+    return err
+}
+
+// GET /profile/usage
+func (h *ProfileHandler) GetUsage(w http.ResponseWriter, r *http.Request) {
+    userID, ok := userIDFromContext(r)
+    if !ok {
+        httperr.Write(w, r, httperr.New(http.StatusUnauthorized, "Unauthorized"))
+        return
+    }
+
+    quotas := h.Quotas
+    if quotas == nil {
+        quotas = &Quotas{DB: h.DB}
+    }
+    usage, err := quotas.Usage(r.Context(), userID)
+    if err == sql.ErrNoRows {
+        httperr.Write(w, r, httperr.New(http.StatusNotFound, "User not found"))
+        return
+    }
+    if err != nil {
+        httperr.Write(w, r, httperr.Internal("Database error", err))
+        return
+    }
+
+    w.Header().Set("Content-Type", "application/json")
+    json.NewEncoder(w).Encode(usage)
+}
@@ -0,0 +1,89 @@
+package handlers
+
+import (
+    "bytes"
+    "context"
+    "encoding/json"
+    "errors"
+    "fmt"
+    "image"
+    _ "image/gif"
+    _ "image/jpeg"
+    "image/png"
+    "io"
+
+    _ "golang.org/x/image/webp"
+
+    "urpaint/internal/storage"
+    "urpaint/internal/strokes"
+    "urpaint/internal/uploads"
+)
+
+// Base images are photos; anything bigger than this isn't one we stored
+const maxBaseImageBytes = 32 << 20
+
+// errBadBaseImage means the client pointed baseImage somewhere we won't load
+var errBadBaseImage = errors.New("baseImage must be an image stored by this server")
+
+// decodeStored decodes an image read back from storage. The header is
+// checked first, so a small file can't decode into something huge.
+func decodeStored(r io.Reader, maxBytes int64) (image.Image, error) {
+    data, err := io.ReadAll(io.LimitReader(r, maxBytes))
+    if err != nil {
+        return nil, err
+    }
+    cfg, _, err := image.DecodeConfig(bytes.NewReader(data))
+    if err != nil {
+        return nil, err
+    }
+    limits := uploads.DefaultLimits
+    if cfg.Width > limits.MaxWidth || cfg.Height > limits.MaxHeight || cfg.Width*cfg.Height > limits.MaxPixels {
+        return nil, fmt.Errorf("image is %dx%d, over the %d pixel limit", cfg.Width, cfg.Height, limits.MaxPixels)
+    }
+    img, _, err := image.Decode(bytes.NewReader(data))
+    return img, err
+}
+
+// renderDocument rasterizes a stored stroke document to PNG
+func (h *GalleryHandler) renderDocument(ctx context.Context, doc []byte) ([]byte, error) {
+    var parsed strokes.Document
+    if err := json.Unmarshal(doc, &parsed); err != nil {
+        return nil, err
+    }
+
+    var base image.Image
+    if parsed.BaseImage != "" {
+        // Only our own storage, so a document can't make us fetch arbitrary URLs
+        key := h.Storage.KeyFromURL(parsed.BaseImage)
+        if key == "" {
+            return nil, errBadBaseImage
+        }
+        rc, err := h.Storage.Open(ctx, key)
+        if errors.Is(err, storage.ErrNotFound) {
+            return nil, errBadBaseImage
+        }
+        if err != nil {
+            return nil, fmt.Errorf("loading base image: %w", err)
+        }
+        base, err = decodeStored(rc, maxBaseImageBytes)
+        rc.Close()
+        if err != nil {
+            return nil, errBadBaseImage
+        }
+    }
+
+    var buf bytes.Buffer
+    if err := png.Encode(&buf, strokes.Render(&parsed, base)); err != nil {
+        return nil, err
+    }
+    return buf.Bytes(), nil
+}
+
+// putRender renders a document into the owner's gallery folder
+func (h *GalleryHandler) putRender(ctx context.Context, userID int, doc []byte) (storage.Object, error) {
+    data, err := h.renderDocument(ctx, doc)
+    if err != nil {
+        return storage.Object{}, err
+    }
+    return h.putAsset(ctx, userID, data)
+}
@@ -0,0 +1,328 @@
+package handlers
+
+import (
+    "bytes"
+    "context"
+    "database/sql"
+    "encoding/json"
+    "errors"
+    "image"
+    "image/png"
+    "log/slog"
+    "time"
+
+    "golang.org/x/image/draw"
+
+    "urpaint/internal/jobs"
+    "urpaint/internal/storage"
+)
+
+// RenditionsJob is the job kind that (re)generates a drawing's renditions
+const RenditionsJob = "renditions"
+
+// Arbitrary key for pg_try_advisory_lock so only one instance backfills
+const renditionBackfillLockKey = 72_617_002
+
+// Drawings are canvas-sized; anything past this isn't one of ours
+const maxRenditionSourceBytes = 64 << 20
+
+type Rendition struct {
+    URL    string `json:"url"`
+    Width  int    `json:"width"`
+    Height int    `json:"height"`
+}
+
+// Longest side of each rendition. Originals already that small are served as is.
+var renditionSizes = []struct {
+    name string
+    max  int
+}{
+    {"small", 256},
+    {"medium", 640},
+    {"large", 1280},
+}
+
+// Renditions of the current image as a JSON object keyed by size, for a
+// query aliasing gallery as g
+const galleryRenditionsColumn = `COALESCE((
+    SELECT json_object_agg(r.size, json_build_object('url', COALESCE(r.url, g.image_url), 'width', r.width, 'height', r.height))
+    FROM gallery_renditions r WHERE r.gallery_id = g.id AND r.source_url = g.image_url
+), '{}')`
+
+// renditionsJob is the stored payload of a RenditionsJob
+type renditionsJob struct {
+    DrawingID int `json:"drawingId"`
+}
+
+// queueRenditions asks a worker to redo a drawing's renditions after its
+// image changed. Failing to queue only costs smaller downloads until the
+// backfill gets to it.
+func (h *GalleryHandler) queueRenditions(ctx context.Context, userID, drawingID int) {
+    if h.Queue == nil {
+        return
+    }
+    if _, err := h.Queue.Submit(ctx, userID, RenditionsJob, renditionsJob{DrawingID: drawingID}); err != nil {
+        slog.WarnContext(ctx, "could not queue renditions", "drawing_id", drawingID, "err", err)
+    }
+}
+
+// GenerateRenditions renders every size from the drawing's current image
+// and swaps them in, deleting the ones they replace
+func (h *GalleryHandler) GenerateRenditions(ctx context.Context, drawingID int) error {
+    var userID int
+    var sourceURL sql.NullString
+    err := h.DB.QueryRowContext(ctx,
+        "SELECT user_id, image_url FROM gallery WHERE id = $1 AND deleted_at IS NULL", drawingID,
+    ).Scan(&userID, &sourceURL)
+    if errors.Is(err, sql.ErrNoRows) || (err == nil && sourceURL.String == "") {
+        return nil
+    }
+    if err != nil {
+        return err
+    }
+
+    // Trying this image again won't help, so the backfill is told to skip
+    // it until the drawing gets a new one
+    unreadable := func(err error) error {
+        _, markErr := h.DB.ExecContext(ctx,
+            "UPDATE gallery SET renditions_failed_url = $2 WHERE id = $1 AND image_url = $2",
+            drawingID, sourceURL.String,
+        )
+        if markErr != nil {
+            slog.WarnContext(ctx, "could not record rendition failure", "drawing_id", drawingID, "err", markErr)
+        }
+        return jobs.Permanent(err)
+    }
+
+    key := h.Storage.KeyFromURL(sourceURL.String)
+    if key == "" {
+        return unreadable(errors.New("image is not in storage"))
+    }
+    rc, err := h.Storage.Open(ctx, key)
+    if errors.Is(err, storage.ErrNotFound) {
+        return unreadable(err)
+    }
+    if err != nil {
+        return err
+    }
+    src, err := decodeStored(rc, maxRenditionSourceBytes)
+    rc.Close()
+    if err != nil {
+        return unreadable(err)
+    }
+
+    type made struct {
+        size string
+        Rendition
+        bytes int64
+    }
+    var renditions []made
+    var uploaded []string
+    cleanup := func() {
+        for _, url := range uploaded {
+            h.deleteAsset(context.Background(), url)
+        }
+    }
+
+    bounds := src.Bounds()
+    for _, size := range renditionSizes {
+        w, hgt := fitWithin(bounds.Dx(), bounds.Dy(), size.max)
+        if w == bounds.Dx() && hgt == bounds.Dy() {
+            renditions = append(renditions, made{size: size.name, Rendition: Rendition{Width: w, Height: hgt}})
+            continue
+        }
+
+        dst := image.NewNRGBA(image.Rect(0, 0, w, hgt))
+        draw.CatmullRom.Scale(dst, dst.Bounds(), src, bounds, draw.Src, nil)
+
+        var buf bytes.Buffer
+        if err := png.Encode(&buf, dst); err != nil {
+            cleanup()
+            return err
+        }
+        obj, err := h.putAsset(ctx, userID, buf.Bytes())
+        if err != nil {
+            cleanup()
+            return err
+        }
+        uploaded = append(uploaded, obj.URL)
+        renditions = append(renditions, made{size: size.name, Rendition: Rendition{URL: obj.URL, Width: w, Height: hgt}, bytes: obj.Bytes})
+    }
+
+    tx, err := h.DB.BeginTx(ctx, nil)
+    if err != nil {
+        cleanup()
+        return err
+    }
+    defer tx.Rollback()
+
+    // The drawing may have been saved again while we worked; its own job
+    // will produce the right renditions
+    var current sql.NullString
+    err = tx.QueryRowContext(ctx, "SELECT image_url FROM gallery WHERE id = $1 FOR UPDATE", drawingID).Scan(&current)
+    if errors.Is(err, sql.ErrNoRows) || (err == nil && current.String != sourceURL.String) {
+        cleanup()
+        return nil
+    }
+    if err != nil {
+        cleanup()
+        return err
+    }
+
+    rows, err := tx.QueryContext(ctx, "DELETE FROM gallery_renditions WHERE gallery_id = $1 RETURNING url", drawingID)
+    if err != nil {
+        cleanup()
+        return err
+    }
+    var replaced []string
+    for rows.Next() {
+        var url sql.NullString
+        if err := rows.Scan(&url); err != nil {
+            rows.Close()
+            cleanup()
+            return err
+        }
+        if url.Valid {
+            replaced = append(replaced, url.String)
+        }
+    }
+    rows.Close()
+
+    for _, r := range renditions {
+        _, err := tx.ExecContext(ctx,
+            `INSERT INTO gallery_renditions (gallery_id, size, source_url, url, width, height, byte_size)
+             VALUES ($1, $2, $3, NULLIF($4, ''), $5, $6, $7)`,
+            drawingID, r.size, sourceURL.String, r.URL, r.Width, r.Height, r.bytes,
+        )
+        if err != nil {
+            cleanup()
+            return err
+        }
+    }
+
+    if err := tx.Commit(); err != nil {
+        cleanup()
+        return err
+    }
+
+    for _, url := range replaced {
+        h.deleteAsset(ctx, url)
+    }
+    return nil
+}
+
+// fitWithin scales w×h down so the longer side is at most max
+func fitWithin(w, h, max int) (int, int) {
+    if w <= max && h <= max {
+        return w, h
+    }
+    if w >= h {
+        return max, maxInt(1, h*max/w)
+    }
+    return maxInt(1, w*max/h), max
+}
+
+func maxInt(a, b int) int {
+    if a > b {
+        return a
+    }
+    return b
+}
+
+// renditionTask runs RenditionsJob for the queue
+type renditionTask struct {
+    h *GalleryHandler
+}
+
+// RenditionTask is the jobs.Task for RenditionsJob
+func (h *GalleryHandler) RenditionTask() jobs.Task {
+    return renditionTask{h}
+}
+
+func (t renditionTask) Run(ctx context.Context, job *jobs.Job) (interface{}, error) {
+    var payload renditionsJob
+    if err := json.Unmarshal(job.Payload, &payload); err != nil {
+        return nil, jobs.Permanent(err)
+    }
+    return nil, t.h.GenerateRenditions(ctx, payload.DrawingID)
+}
+
+// BackfillRenditions generates renditions for drawings whose current image
+// has none yet, a batch at a time. Images that couldn't be read before are
+// left out. Only one instance runs it at once.
+func (h *GalleryHandler) BackfillRenditions(ctx context.Context) (int, error) {
+    conn, err := h.DB.Conn(ctx)
+    if err != nil {
+        return 0, err
+    }
+    defer conn.Close()
+
+    var locked bool
+    if err := conn.QueryRowContext(ctx, "SELECT pg_try_advisory_lock($1)", renditionBackfillLockKey).Scan(&locked); err != nil {
+        return 0, err
+    }
+    if !locked {
+        return 0, nil
+    }
+    defer conn.ExecContext(context.Background(), "SELECT pg_advisory_unlock($1)", renditionBackfillLockKey)
+
+    rows, err := h.DB.QueryContext(ctx,
+        `SELECT g.id FROM gallery g
+         WHERE g.deleted_at IS NULL AND g.image_url IS NOT NULL AND g.image_url <> ''
+           AND g.renditions_failed_url IS DISTINCT FROM g.image_url
+           AND NOT EXISTS (SELECT 1 FROM gallery_renditions r WHERE r.gallery_id = g.id AND r.source_url = g.image_url)
+         ORDER BY g.id LIMIT 500`,
+    )
+    if err != nil {
+        return 0, err
+    }
+    var ids []int
+    for rows.Next() {
+        var id int
+        if err := rows.Scan(&id); err != nil {
+            rows.Close()
+            return 0, err
+        }
+        ids = append(ids, id)
+    }
+    rows.Close()
+    if err := rows.Err(); err != nil {
+        return 0, err
+    }
+
+    done := 0
+    for _, id := range ids {
+        if ctx.Err() != nil {
+            break
+        }
+        if err := h.GenerateRenditions(ctx, id); err != nil {
+            // Transient failures are retried next pass
+            slog.WarnContext(ctx, "rendition backfill failed", "drawing_id", id, "err", err)
+            continue
+        }
+        done++
+    }
+    return done, nil
+}
+
+// RunRenditionBackfill calls BackfillRenditions now and every interval
+// until ctx is cancelled
+func (h *GalleryHandler) RunRenditionBackfill(ctx context.Context, interval time.Duration) {
+    ticker := time.NewTicker(interval)
+    defer ticker.Stop()
+
+    for {
+        n, err := h.BackfillRenditions(ctx)
+        if err != nil && ctx.Err() == nil {
+            slog.ErrorContext(ctx, "rendition backfill failed", "err", err)
+        } else if n > 0 {
+            slog.InfoContext(ctx, "backfilled renditions", "drawings", n)
+        }
+
+        select {
+        case <-ctx.Done():
+            return
+        case <-ticker.C:
+        }
+    }
+}
@@ -0,0 +1,292 @@
+package handlers
+
+import (
+    "context"
+    "database/sql"
+    "encoding/json"
+    "log/slog"
+    "net/http"
+    "strconv"
+    "time"
+
+    "urpaint/internal/httperr"
+)
+
+const defaultRevisionLimit = 20
+
+type Revision struct {
+    ID          int64     `json:"id"`
+    ImageURL    string    `json:"image_url"`
+    EditURL     string    `json:"edit_url"`
+    ByteSize    int64     `json:"byteSize"`
+    CreatedAt   time.Time `json:"createdAt"`
+    Current     bool      `json:"current"`
+    HasDocument bool      `json:"hasDocument"`
+}
+
+func (h *GalleryHandler) revisionLimit() int {
+    if h.RevisionLimit > 0 {
+        return h.RevisionLimit
+    }
+    return defaultRevisionLimit
+}
+
+// recordRevision snapshots the drawing's current URLs as a new revision
+func recordRevision(ctx context.Context, q queryer, drawingID int, byteSize int64) (int64, error) {
+    var id int64
+    err := q.QueryRowContext(ctx,
+        `INSERT INTO gallery_revisions (gallery_id, image_url, edit_url, document_id, byte_size)
+         SELECT id, image_url, edit_url, document_id, $2 FROM gallery WHERE id = $1
+         RETURNING id`,
+        drawingID, byteSize,
+    ).Scan(&id)
+    return id, err
+}
+
+// pruneRevisions drops revisions past the retention limit along with any
+// stored image nothing else points at anymore
+func (h *GalleryHandler) pruneRevisions(ctx context.Context, drawingID int) {
+    rows, err := h.DB.QueryContext(ctx,
+        `DELETE FROM gallery_revisions
+         WHERE gallery_id = $1 AND id NOT IN (
+             SELECT id FROM gallery_revisions WHERE gallery_id = $1
+             ORDER BY created_at DESC, id DESC LIMIT $2
+         )
+         RETURNING image_url, edit_url`,
+        drawingID, h.revisionLimit(),
+    )
+    if err != nil {
+        slog.WarnContext(ctx, "revision prune failed", "drawing_id", drawingID, "err", err)
+        return
+    }
+
+    var urls []string
+    for rows.Next() {
+        var imageURL, editURL sql.NullString
+        if err := rows.Scan(&imageURL, &editURL); err != nil {
+            slog.WarnContext(ctx, "revision prune failed", "drawing_id", drawingID, "err", err)
+            break
+        }
+        urls = append(urls, imageURL.String, editURL.String)
+    }
+    rows.Close()
+
+    h.deleteUnreferenced(ctx, urls)
+
+    if err := pruneDocuments(ctx, h.DB, drawingID); err != nil {
+        slog.WarnContext(ctx, "document prune failed", "drawing_id", drawingID, "err", err)
+    }
+}
+
+// deleteUnreferenced removes stored images no drawing or revision still uses
+func (h *GalleryHandler) deleteUnreferenced(ctx context.Context, urls []string) {
+    seen := map[string]bool{}
+    for _, url := range urls {
+        if url == "" || seen[url] {
+            continue
+        }
+        seen[url] = true
+
+        var referenced bool
+        err := h.DB.QueryRowContext(ctx,
+            `SELECT EXISTS (SELECT 1 FROM gallery WHERE image_url = $1 OR edit_url = $1)
+                 OR EXISTS (SELECT 1 FROM gallery_revisions WHERE image_url = $1 OR edit_url = $1)`,
+            url,
+        ).Scan(&referenced)
+        if err != nil {
+            slog.WarnContext(ctx, "asset reference check failed", "url", url, "err", err)
+            continue
+        }
+        if !referenced {
+            h.deleteAsset(ctx, url)
+        }
+    }
+}
+
+// drawingAssetURLs lists every stored image belonging to a drawing,
+// current and historical. sql.ErrNoRows if the user doesn't own it.
+func (h *GalleryHandler) drawingAssetURLs(ctx context.Context, drawingID, userID int) ([]string, error) {
+    rows, err := h.DB.QueryContext(ctx,
+        `SELECT g.image_url, g.edit_url FROM gallery g WHERE g.id = $1 AND g.user_id = $2
+         UNION
+         SELECT r.image_url, r.edit_url FROM gallery_revisions r
+         JOIN gallery g ON g.id = r.gallery_id
+         WHERE r.gallery_id = $1 AND g.user_id = $2
+         UNION
+         SELECT r.url, NULL FROM gallery_renditions r
+         JOIN gallery g ON g.id = r.gallery_id
+         WHERE r.gallery_id = $1 AND g.user_id = $2 AND r.url IS NOT NULL`,
+        drawingID, userID,
+    )
+    if err != nil {
+        return nil, err
+    }
+    defer rows.Close()
+
+    seen := map[string]bool{}
+    var urls []string
+    for rows.Next() {
+        var imageURL, editURL sql.NullString
+        if err := rows.Scan(&imageURL, &editURL); err != nil {
+            return nil, err
+        }
+        for _, url := range []string{imageURL.String, editURL.String} {
+            if url != "" && !seen[url] {
+                seen[url] = true
+                urls = append(urls, url)
+            }
+        }
+    }
+    if err := rows.Err(); err != nil {
+        return nil, err
+    }
+    if urls == nil {
+        var exists bool
+        err := h.DB.QueryRowContext(ctx,
+            "SELECT EXISTS (SELECT 1 FROM gallery WHERE id = $1 AND user_id = $2)", drawingID, userID,
+        ).Scan(&exists)
+        if err != nil {
+            return nil, err
+        }
+        if !exists {
+            return nil, sql.ErrNoRows
+        }
+    }
+    return urls, nil
+}
+
+// GET /gallery/revisions?id=[&revision=]
+// Lists a drawing's history, newest first, or returns a single revision
+func (h *GalleryHandler) GetRevisions(w http.ResponseWriter, r *http.Request) {
+    userID, ok := userIDFromContext(r)
+    if !ok {
+        httperr.Write(w, r, httperr.New(http.StatusUnauthorized, "Unauthorized"))
+        return
+    }
+
+    drawingID, ok := drawingIDParam(w, r)
+    if !ok {
+        return
+    }
+
+    var revisionID int64
+    if param := r.URL.Query().Get("revision"); param != "" {
+        id, err := strconv.ParseInt(param, 10, 64)
+        if err != nil {
+            httperr.Write(w, r, httperr.New(http.StatusBadRequest, "Invalid revision ID"))
+            return
+        }
+        revisionID = id
+    }
+
+    rows, err := h.DB.Query(
+        `SELECT r.id, r.image_url, r.edit_url, r.byte_size, r.created_at,
+                r.image_url IS NOT DISTINCT FROM g.image_url AND r.edit_url IS NOT DISTINCT FROM g.edit_url
+                    AND r.document_id IS NOT DISTINCT FROM g.document_id,
+                r.document_id IS NOT NULL
+         FROM gallery_revisions r JOIN gallery g ON g.id = r.gallery_id
+         WHERE r.gallery_id = $1 AND g.user_id = $2 AND ($3 = 0 OR r.id = $3)
+         ORDER BY r.created_at DESC, r.id DESC`,
+        drawingID, userID, revisionID,
+    )
+    if err != nil {
+        httperr.Write(w, r, httperr.Internal("Database error", err))
+        return
+    }
+    defer rows.Close()
+
+    revisions := []Revision{}
+    for rows.Next() {
+        var rev Revision
+        var imageURL, editURL sql.NullString
+        if err := rows.Scan(&rev.ID, &imageURL, &editURL, &rev.ByteSize, &rev.CreatedAt, &rev.Current, &rev.HasDocument); err != nil {
+            httperr.Write(w, r, httperr.Internal("Database error", err))
+            return
+        }
+        rev.ImageURL = imageURL.String
+        rev.EditURL = editURL.String
+        revisions = append(revisions, rev)
+    }
+    if err := rows.Err(); err != nil {
+        httperr.Write(w, r, httperr.Internal("Database error", err))
+        return
+    }
+
+    w.Header().Set("Content-Type", "application/json")
+
+    if revisionID != 0 {
+        if len(revisions) == 0 {
+            httperr.Write(w, r, httperr.New(http.StatusNotFound, "Revision not found"))
+            return
+        }
+        json.NewEncoder(w).Encode(revisions[0])
+        return
+    }
+    json.NewEncoder(w).Encode(revisions)
+}
+
+// POST /gallery/revisions/restore?id=&revision=
+// Makes an old revision current again. The restore is itself a new revision.
+func (h *GalleryHandler) RestoreRevision(w http.ResponseWriter, r *http.Request) {
+    userID, ok := userIDFromContext(r)
+    if !ok {
+        httperr.Write(w, r, httperr.New(http.StatusUnauthorized, "Unauthorized"))
+        return
+    }
+
+    drawingID, ok := drawingIDParam(w, r)
+    if !ok {
+        return
+    }
+
+    revisionID, err := strconv.ParseInt(r.URL.Query().Get("revision"), 10, 64)
+    if err != nil {
+        httperr.Write(w, r, httperr.New(http.StatusBadRequest, "Invalid revision ID"))
+        return
+    }
+
+    tx, err := h.DB.BeginTx(r.Context(), nil)
+    if err != nil {
+        httperr.Write(w, r, httperr.Internal("Database error", err))
+        return
+    }
+    defer tx.Rollback()
+
+    var imageURL, editURL sql.NullString
+    err = tx.QueryRow(
+        `UPDATE gallery g SET image_url = r.image_url, edit_url = r.edit_url, document_id = r.document_id
+         FROM gallery_revisions r
+         WHERE r.id = $1 AND r.gallery_id = g.id AND g.id = $2 AND g.user_id = $3 AND g.deleted_at IS NULL
+         RETURNING g.image_url, g.edit_url`,
+        revisionID, drawingID, userID,
+    ).Scan(&imageURL, &editURL)
+    if err == sql.ErrNoRows {
+        httperr.Write(w, r, httperr.New(http.StatusNotFound, "Revision not found"))
+        return
+    }
+    if err != nil {
+        httperr.Write(w, r, httperr.Internal("Failed to restore revision", err))
+        return
+    }
+
+    newRevisionID, err := recordRevision(r.Context(), tx, drawingID, 0)
+    if err != nil {
+        httperr.Write(w, r, httperr.Internal("Failed to save revision", err))
+        return
+    }
+
+    if err := tx.Commit(); err != nil {
+        httperr.Write(w, r, httperr.Internal("Failed to restore revision", err))
+        return
+    }
+
+    h.pruneRevisions(r.Context(), drawingID)
+    h.queueRenditions(r.Context(), userID, drawingID)
+
+    w.Header().Set("Content-Type", "application/json")
+    json.NewEncoder(w).Encode(map[string]interface{}{
+        "editUrl":    editURL.String,
+        "imageUrl":   imageURL.String,
+        "revisionId": newRevisionID,
+    })
+}
@@ -0,0 +1,222 @@
+package handlers
+
+import (
+    "database/sql"
+    "encoding/json"
+    "net/http"
+    "strings"
+    "time"
+
+    "urpaint/internal/httperr"
+)
+
+type Share struct {
+    Slug      string     `json:"slug"`
+    URL       string     `json:"url"`
+    ExpiresAt *time.Time `json:"expiresAt,omitempty"`
+    ViewCount int64      `json:"viewCount"`
+    CreatedAt time.Time  `json:"createdAt"`
+}
+
+func (h *GalleryHandler) shareURL(slug string) string {
+    base := h.ShareBaseURL
+    if base == "" {
+        base = "/s/"
+    }
+    return strings.TrimSuffix(base, "/") + "/" + slug
+}
+
+// POST /gallery/share?id=
+func (h *GalleryHandler) CreateShare(w http.ResponseWriter, r *http.Request) {
+    userID, ok := userIDFromContext(r)
+    if !ok {
+        httperr.Write(w, r, httperr.New(http.StatusUnauthorized, "Unauthorized"))
+        return
+    }
+
+    drawingID, ok := drawingIDParam(w, r)
+    if !ok {
+        return
+    }
+
+    var input struct {
+        ExpiresAt *time.Time `json:"expiresAt"`
+    }
+    if r.ContentLength != 0 {
+        if err := json.NewDecoder(r.Body).Decode(&input); err != nil {
+            httperr.Write(w, r, httperr.New(http.StatusBadRequest, "Invalid input"))
+            return
+        }
+    }
+    if input.ExpiresAt != nil && !input.ExpiresAt.After(time.Now()) {
+        httperr.Write(w, r, httperr.New(http.StatusBadRequest, "expiresAt must be in the future"))
+        return
+    }
+
+    var owned bool
+    err := h.DB.QueryRow(
+        "SELECT EXISTS (SELECT 1 FROM gallery WHERE id = $1 AND user_id = $2 AND deleted_at IS NULL)",
+        drawingID, userID,
+    ).Scan(&owned)
+    if err != nil {
+        httperr.Write(w, r, httperr.Internal("Database error", err))
+        return
+    }
+    if !owned {
+        httperr.Write(w, r, httperr.New(http.StatusNotFound, "Drawing not found"))
+        return
+    }
+
+    slug, err := randomToken(16)
+    if err != nil {
+        httperr.Write(w, r, httperr.Internal("Could not generate share link", err))
+        return
+    }
+
+    share := Share{Slug: slug, URL: h.shareURL(slug), ExpiresAt: input.ExpiresAt}
+    err = h.DB.QueryRow(
+        "INSERT INTO gallery_shares (gallery_id, slug, expires_at) VALUES ($1, $2, $3) RETURNING created_at",
+        drawingID, slug, input.ExpiresAt,
+    ).Scan(&share.CreatedAt)
+    if err != nil {
+        httperr.Write(w, r, httperr.Internal("Failed to create share link", err))
+        return
+    }
+
+    w.Header().Set("Content-Type", "application/json")
+    w.WriteHeader(http.StatusCreated)
+    json.NewEncoder(w).Encode(share)
+}
+
+// GET /gallery/share?id=
+// Lists the drawing's links that still work
+func (h *GalleryHandler) ListShares(w http.ResponseWriter, r *http.Request) {
+    userID, ok := userIDFromContext(r)
+    if !ok {
+        httperr.Write(w, r, httperr.New(http.StatusUnauthorized, "Unauthorized"))
+        return
+    }
+
+    drawingID, ok := drawingIDParam(w, r)
+    if !ok {
+        return
+    }
+
+    rows, err := h.DB.Query(
+        `SELECT s.slug, s.expires_at, s.view_count, s.created_at
+         FROM gallery_shares s JOIN gallery g ON g.id = s.gallery_id
+         WHERE s.gallery_id = $1 AND g.user_id = $2 AND s.revoked_at IS NULL
+           AND (s.expires_at IS NULL OR s.expires_at > now())
+         ORDER BY s.created_at DESC`,
+        drawingID, userID,
+    )
+    if err != nil {
+        httperr.Write(w, r, httperr.Internal("Database error", err))
+        return
+    }
+    defer rows.Close()
+
+    shares := []Share{}
+    for rows.Next() {
+        var share Share
+        var expiresAt sql.NullTime
+        if err := rows.Scan(&share.Slug, &expiresAt, &share.ViewCount, &share.CreatedAt); err != nil {
+            httperr.Write(w, r, httperr.Internal("Database error", err))
+            return
+        }
+        if expiresAt.Valid {
+            share.ExpiresAt = &expiresAt.Time
+        }
+        share.URL = h.shareURL(share.Slug)
+        shares = append(shares, share)
+    }
+    if err := rows.Err(); err != nil {
+        httperr.Write(w, r, httperr.Internal("Database error", err))
+        return
+    }
+
+    w.Header().Set("Content-Type", "application/json")
+    json.NewEncoder(w).Encode(shares)
+}
+
+// DELETE /gallery/share?id=&slug=
+// Without a slug every link to the drawing is revoked
+func (h *GalleryHandler) RevokeShare(w http.ResponseWriter, r *http.Request) {
+    userID, ok := userIDFromContext(r)
+    if !ok {
+        httperr.Write(w, r, httperr.New(http.StatusUnauthorized, "Unauthorized"))
+        return
+    }
+
+    drawingID, ok := drawingIDParam(w, r)
+    if !ok {
+        return
+    }
+    slug := r.URL.Query().Get("slug")
+
+    res, err := h.DB.Exec(
+        `UPDATE gallery_shares s SET revoked_at = now()
+         FROM gallery g
+         WHERE g.id = s.gallery_id AND s.gallery_id = $1 AND g.user_id = $2
+           AND s.revoked_at IS NULL AND ($3 = '' OR s.slug = $3)`,
+        drawingID, userID, slug,
+    )
+    if err != nil {
+        httperr.Write(w, r, httperr.Internal("Failed to revoke share link", err))
+        return
+    }
+
+    if n, _ := res.RowsAffected(); n == 0 && slug != "" {
+        httperr.Write(w, r, httperr.New(http.StatusNotFound, "Share link not found"))
+        return
+    }
+
+    w.WriteHeader(http.StatusNoContent)
+}
+
+// GET /s/{slug}
+// Public view of a shared drawing. Never exposes edit_url.
+func (h *GalleryHandler) ViewShare(w http.ResponseWriter, r *http.Request) {
+    slug := r.PathValue("slug")
+    if slug == "" {
+        httperr.Write(w, r, httperr.New(http.StatusNotFound, "Share link not found"))
+        return
+    }
+
+    var shared struct {
+        Title      string     `json:"title"`
+        ImageURL   string     `json:"image_url"`
+        UploadedAt time.Time  `json:"uploadedAt"`
+        ViewCount  int64      `json:"viewCount"`
+        ExpiresAt  *time.Time `json:"expiresAt,omitempty"`
+    }
+    var title, imageURL sql.NullString
+    var expiresAt sql.NullTime
+
+    err := h.DB.QueryRow(
+        `UPDATE gallery_shares s SET view_count = s.view_count + 1
+         FROM gallery g
+         WHERE s.slug = $1 AND g.id = s.gallery_id AND g.deleted_at IS NULL AND s.revoked_at IS NULL
+           AND (s.expires_at IS NULL OR s.expires_at > now())
+         RETURNING g.title, g.image_url, g.uploaded_at, s.view_count, s.expires_at`,
+        slug,
+    ).Scan(&title, &imageURL, &shared.UploadedAt, &shared.ViewCount, &expiresAt)
+    if err == sql.ErrNoRows {
+        httperr.Write(w, r, httperr.New(http.StatusNotFound, "Share link not found"))
+        return
+    }
+    if err != nil {
+        httperr.Write(w, r, httperr.Internal("Database error", err))
+        return
+    }
+
+    shared.Title = title.String
+    shared.ImageURL = imageURL.String
+    if expiresAt.Valid {
+        shared.ExpiresAt = &expiresAt.Time
+    }
+
+    w.Header().Set("Cache-Control", "no-store")
+    w.Header().Set("Content-Type", "application/json")
+    json.NewEncoder(w).Encode(shared)
+}
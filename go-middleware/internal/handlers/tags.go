@@ -0,0 +1,260 @@
+package handlers
+
+import (
+    "encoding/json"
+    "net/http"
+    "strconv"
+    "strings"
+    "unicode/utf8"
+
+    "github.com/lib/pq"
+
+    "urpaint/internal/httperr"
+)
+
+const (
+    maxTagLength   = 50
+    maxTagsPerItem = 30
+)
+
+type TagCount struct {
+    Tag   string `json:"tag"`
+    Count int    `json:"count"`
+}
+
+type SearchResult struct {
+    GalleryItem
+    Rank float64 `json:"rank"`
+}
+
+// Tags are case-insensitive and compared trimmed
+func normalizeTag(tag string) string {
+    return strings.ToLower(strings.TrimSpace(tag))
+}
+
+// POST /gallery/tags?id=
+// Body {"tags": ["sketch", "cats"]}. Responds with the drawing's tags.
+func (h *GalleryHandler) AddTags(w http.ResponseWriter, r *http.Request) {
+    userID, ok := userIDFromContext(r)
+    if !ok {
+        httperr.Write(w, r, httperr.New(http.StatusUnauthorized, "Unauthorized"))
+        return
+    }
+
+    drawingID, ok := drawingIDParam(w, r)
+    if !ok {
+        return
+    }
+
+    var input struct {
+        Tags []string `json:"tags"`
+    }
+    if err := json.NewDecoder(r.Body).Decode(&input); err != nil {
+        httperr.Write(w, r, httperr.New(http.StatusBadRequest, "Invalid input"))
+        return
+    }
+
+    tags := make([]string, 0, len(input.Tags))
+    for _, tag := range input.Tags {
+        tag = normalizeTag(tag)
+        if tag == "" || utf8.RuneCountInString(tag) > maxTagLength {
+            httperr.Write(w, r, httperr.New(http.StatusBadRequest, "Tags must be 1-50 characters"))
+            return
+        }
+        tags = append(tags, tag)
+    }
+    if len(tags) == 0 {
+        httperr.Write(w, r, httperr.New(http.StatusBadRequest, "No tags given"))
+        return
+    }
+
+    var owned bool
+    err := h.DB.QueryRow(
+        "SELECT EXISTS (SELECT 1 FROM gallery WHERE id = $1 AND user_id = $2 AND deleted_at IS NULL)",
+        drawingID, userID,
+    ).Scan(&owned)
+    if err != nil {
+        httperr.Write(w, r, httperr.Internal("Database error", err))
+        return
+    }
+    if !owned {
+        httperr.Write(w, r, httperr.New(http.StatusNotFound, "Drawing not found"))
+        return
+    }
+
+    tx, err := h.DB.BeginTx(r.Context(), nil)
+    if err != nil {
+        httperr.Write(w, r, httperr.Internal("Database error", err))
+        return
+    }
+    defer tx.Rollback()
+
+    _, err = tx.Exec(
+        `INSERT INTO gallery_tags (gallery_id, tag)
+         SELECT $1, tag FROM unnest($2::text[]) AS tag
+         ON CONFLICT (gallery_id, tag) DO NOTHING`,
+        drawingID, pq.Array(tags),
+    )
+    if err != nil {
+        httperr.Write(w, r, httperr.Internal("Failed to add tags", err))
+        return
+    }
+
+    var current []string
+    err = tx.QueryRow(
+        "SELECT ARRAY(SELECT tag FROM gallery_tags WHERE gallery_id = $1 ORDER BY tag)", drawingID,
+    ).Scan(pq.Array(&current))
+    if err != nil {
+        httperr.Write(w, r, httperr.Internal("Database error", err))
+        return
+    }
+
+    if len(current) > maxTagsPerItem {
+        httperr.Write(w, r, httperr.New(http.StatusBadRequest, "A drawing can have at most "+strconv.Itoa(maxTagsPerItem)+" tags"))
+        return
+    }
+
+    if err := tx.Commit(); err != nil {
+        httperr.Write(w, r, httperr.Internal("Failed to add tags", err))
+        return
+    }
+
+    w.Header().Set("Content-Type", "application/json")
+    json.NewEncoder(w).Encode(map[string][]string{"tags": current})
+}
+
+// DELETE /gallery/tags?id=&tag=
+func (h *GalleryHandler) RemoveTag(w http.ResponseWriter, r *http.Request) {
+    userID, ok := userIDFromContext(r)
+    if !ok {
+        httperr.Write(w, r, httperr.New(http.StatusUnauthorized, "Unauthorized"))
+        return
+    }
+
+    drawingID, ok := drawingIDParam(w, r)
+    if !ok {
+        return
+    }
+
+    tag := normalizeTag(r.URL.Query().Get("tag"))
+    if tag == "" {
+        httperr.Write(w, r, httperr.New(http.StatusBadRequest, "Missing tag"))
+        return
+    }
+
+    res, err := h.DB.Exec(
+        `DELETE FROM gallery_tags t USING gallery g
+         WHERE g.id = t.gallery_id AND t.gallery_id = $1 AND g.user_id = $2 AND t.tag = $3`,
+        drawingID, userID, tag,
+    )
+    if err != nil {
+        httperr.Write(w, r, httperr.Internal("Failed to remove tag", err))
+        return
+    }
+    if n, _ := res.RowsAffected(); n == 0 {
+        httperr.Write(w, r, httperr.New(http.StatusNotFound, "Tag not found"))
+        return
+    }
+
+    w.WriteHeader(http.StatusNoContent)
+}
+
+// GET /tags
+// Every tag the user has used, with how many live drawings carry it
+func (h *GalleryHandler) ListTags(w http.ResponseWriter, r *http.Request) {
+    userID, ok := userIDFromContext(r)
+    if !ok {
+        httperr.Write(w, r, httperr.New(http.StatusUnauthorized, "Unauthorized"))
+        return
+    }
+
+    rows, err := h.DB.Query(
+        `SELECT t.tag, COUNT(*) FROM gallery_tags t
+         JOIN gallery g ON g.id = t.gallery_id
+         WHERE g.user_id = $1 AND g.deleted_at IS NULL
+         GROUP BY t.tag
+         ORDER BY COUNT(*) DESC, t.tag`,
+        userID,
+    )
+    if err != nil {
+        httperr.Write(w, r, httperr.Internal("Database error", err))
+        return
+    }
+    defer rows.Close()
+
+    tags := []TagCount{}
+    for rows.Next() {
+        var tc TagCount
+        if err := rows.Scan(&tc.Tag, &tc.Count); err != nil {
+            httperr.Write(w, r, httperr.Internal("Database error", err))
+            return
+        }
+        tags = append(tags, tc)
+    }
+    if err := rows.Err(); err != nil {
+        httperr.Write(w, r, httperr.Internal("Database error", err))
+        return
+    }
+
+    w.Header().Set("Content-Type", "application/json")
+    json.NewEncoder(w).Encode(tags)
+}
+
+// GET /gallery/search?q=[&limit=]
+// Full-text search over title, tags and description, best match first
+func (h *GalleryHandler) SearchGallery(w http.ResponseWriter, r *http.Request) {
+    userID, ok := userIDFromContext(r)
+    if !ok {
+        httperr.Write(w, r, httperr.New(http.StatusUnauthorized, "Unauthorized"))
+        return
+    }
+
+    q := strings.TrimSpace(r.URL.Query().Get("q"))
+    if q == "" {
+        httperr.Write(w, r, httperr.New(http.StatusBadRequest, "Missing search query"))
+        return
+    }
+
+    limit := defaultPageSize
+    if v := r.URL.Query().Get("limit"); v != "" {
+        n, err := strconv.Atoi(v)
+        if err != nil || n < 1 {
+            httperr.Write(w, r, httperr.New(http.StatusBadRequest, "Invalid limit"))
+            return
+        }
+        limit = min(n, maxPageSize)
+    }
+
+    rows, err := h.DB.Query(
+        `SELECT `+galleryItemColumns+`, g.order_index, ts_rank(g.search_vector, query) AS rank
+         FROM gallery g, websearch_to_tsquery('english', $2) AS query
+         WHERE g.user_id = $1 AND g.deleted_at IS NULL AND g.search_vector @@ query
+         ORDER BY rank DESC, g.uploaded_at DESC, g.id DESC
+         LIMIT $3`,
+        userID, q, limit,
+    )
+    if err != nil {
+        httperr.Write(w, r, httperr.Internal("Database error", err))
+        return
+    }
+    defer rows.Close()
+
+    results := []SearchResult{}
+    for rows.Next() {
+        var result SearchResult
+        item, err := scanGalleryItem(rows, &result.Rank)
+        if err != nil {
+            httperr.Write(w, r, httperr.Internal("Database error", err))
+            return
+        }
+        result.GalleryItem = item
+        results = append(results, result)
+    }
+    if err := rows.Err(); err != nil {
+        httperr.Write(w, r, httperr.Internal("Database error", err))
+        return
+    }
+
+    w.Header().Set("Content-Type", "application/json")
+    json.NewEncoder(w).Encode(results)
+}
@@ -0,0 +1,316 @@
+package handlers
+
+import (
+    "context"
+    "crypto/rand"
+    "crypto/sha256"
+    "database/sql"
+    "encoding/base64"
+    "encoding/hex"
+    "encoding/json"
+    "errors"
+    "net/http"
+    "time"
+
+    "github.com/golang-jwt/jwt/v5"
+
+    "urpaint/internal/httperr"
+)
+
+const (
+    defaultAccessTTL  = 15 * time.Minute
+    defaultRefreshTTL = 30 * 24 * time.Hour
+)
+
+var errInvalidRefreshToken = errors.New("invalid refresh token")
+
+// Satisfied by both *sql.DB and *sql.Tx
+type queryer interface {
+    ExecContext(ctx context.Context, query string, args ...interface{}) (sql.Result, error)
+    QueryRowContext(ctx context.Context, query string, args ...interface{}) *sql.Row
+}
+
+type tokenPair struct {
+    Token        string `json:"token"`
+    RefreshToken string `json:"refreshToken"`
+    ExpiresIn    int    `json:"expiresIn"`
+}
+
+func (h *AuthHandler) accessTTL() time.Duration {
+    if h.AccessTTL > 0 {
+        return h.AccessTTL
+    }
+    return defaultAccessTTL
+}
+
+func (h *AuthHandler) refreshTTL() time.Duration {
+    if h.RefreshTTL > 0 {
+        return h.RefreshTTL
+    }
+    return defaultRefreshTTL
+}
+
+// issueTokens signs an access token and stores a new refresh token in the given family
+func (h *AuthHandler) issueTokens(ctx context.Context, q queryer, userID int, email string, tokenVersion int, family string) (tokenPair, int64, error) {
+    jti, err := randomToken(16)
+    if err != nil {
+        return tokenPair{}, 0, err
+    }
+
+    now := time.Now()
+    claims := jwt.MapClaims{
+        "id":    userID,
+        "email": email,
+        "ver":   tokenVersion,
+        "jti":   jti,
+        "iat":   now.Unix(),
+        "exp":   now.Add(h.accessTTL()).Unix(),
+    }
+
+    signed, err := jwt.NewWithClaims(jwt.SigningMethodHS256, claims).SignedString(h.JWTSecret)
+    if err != nil {
+        return tokenPair{}, 0, err
+    }
+
+    refresh, err := randomToken(32)
+    if err != nil {
+        return tokenPair{}, 0, err
+    }
+
+    var refreshID int64
+    err = q.QueryRowContext(ctx,
+        `INSERT INTO refresh_tokens (user_id, family_id, token_hash, expires_at)
+         VALUES ($1, $2, $3, $4) RETURNING id`,
+        userID, family, hashToken(refresh), now.Add(h.refreshTTL()),
+    ).Scan(&refreshID)
+    if err != nil {
+        return tokenPair{}, 0, err
+    }
+
+    return tokenPair{
+        Token:        signed,
+        RefreshToken: refresh,
+        ExpiresIn:    int(h.accessTTL().Seconds()),
+    }, refreshID, nil
+}
+
+// Revoked implements middleware.Revoker. A token is dead once its jti is
+// denylisted or the user's token_version moved past the one it carries.
+func (h *AuthHandler) Revoked(ctx context.Context, claims jwt.MapClaims) (bool, error) {
+    userIDFloat, ok := claims["id"].(float64)
+    if !ok {
+        return true, nil
+    }
+    version, ok := claims["ver"].(float64)
+    if !ok {
+        return true, nil
+    }
+    jti, _ := claims["jti"].(string)
+
+    var currentVersion int
+    var denied bool
+    err := h.DB.QueryRowContext(ctx,
+        `SELECT token_version, EXISTS (SELECT 1 FROM revoked_tokens WHERE jti = $2)
+         FROM users WHERE id = $1`,
+        int(userIDFloat), jti,
+    ).Scan(&currentVersion, &denied)
+    if err == sql.ErrNoRows {
+        return true, nil
+    }
+    if err != nil {
+        return false, err
+    }
+
+    return denied || int(version) != currentVersion, nil
+}
+
+// POST /auth/refresh
+func (h *AuthHandler) Refresh(w http.ResponseWriter, r *http.Request) {
+    var input struct {
+        RefreshToken string `json:"refreshToken"`
+    }
+    if err := json.NewDecoder(r.Body).Decode(&input); err != nil || input.RefreshToken == "" {
+        httperr.Write(w, r, httperr.New(http.StatusBadRequest, "Invalid input"))
+        return
+    }
+
+    pair, err := h.rotateRefreshToken(r.Context(), input.RefreshToken)
+    if err == errInvalidRefreshToken {
+        httperr.Write(w, r, httperr.New(http.StatusUnauthorized, "Invalid refresh token"))
+        return
+    }
+    if err != nil {
+        httperr.Write(w, r, httperr.Internal("Could not refresh token", err))
+        return
+    }
+
+    w.Header().Set("Content-Type", "application/json")
+    json.NewEncoder(w).Encode(pair)
+}
+
+// rotateRefreshToken swaps a live refresh token for a new pair. Presenting a
+// token that was already rotated means it leaked, so the whole family dies.
+func (h *AuthHandler) rotateRefreshToken(ctx context.Context, refreshToken string) (tokenPair, error) {
+    tx, err := h.DB.BeginTx(ctx, nil)
+    if err != nil {
+        return tokenPair{}, err
+    }
+    defer tx.Rollback()
+
+    var tokenID int64
+    var userID int
+    var family string
+    var expiresAt time.Time
+    var revokedAt sql.NullTime
+    err = tx.QueryRowContext(ctx,
+        `SELECT id, user_id, family_id, expires_at, revoked_at
+         FROM refresh_tokens WHERE token_hash = $1 FOR UPDATE`,
+        hashToken(refreshToken),
+    ).Scan(&tokenID, &userID, &family, &expiresAt, &revokedAt)
+    if err == sql.ErrNoRows {
+        return tokenPair{}, errInvalidRefreshToken
+    }
+    if err != nil {
+        return tokenPair{}, err
+    }
+
+    if revokedAt.Valid {
+        if _, err := tx.ExecContext(ctx,
+            "UPDATE refresh_tokens SET revoked_at = now() WHERE family_id = $1 AND revoked_at IS NULL",
+            family,
+        ); err != nil {
+            return tokenPair{}, err
+        }
+        if err := tx.Commit(); err != nil {
+            return tokenPair{}, err
+        }
+        return tokenPair{}, errInvalidRefreshToken
+    }
+    if time.Now().After(expiresAt) {
+        return tokenPair{}, errInvalidRefreshToken
+    }
+
+    var email string
+    var tokenVersion int
+    err = tx.QueryRowContext(ctx,
+        "SELECT email, token_version FROM users WHERE id = $1", userID,
+    ).Scan(&email, &tokenVersion)
+    if err == sql.ErrNoRows {
+        return tokenPair{}, errInvalidRefreshToken
+    }
+    if err != nil {
+        return tokenPair{}, err
+    }
+
+    pair, newID, err := h.issueTokens(ctx, tx, userID, email, tokenVersion, family)
+    if err != nil {
+        return tokenPair{}, err
+    }
+
+    if _, err := tx.ExecContext(ctx,
+        "UPDATE refresh_tokens SET revoked_at = now(), replaced_by = $1 WHERE id = $2",
+        newID, tokenID,
+    ); err != nil {
+        return tokenPair{}, err
+    }
+
+    return pair, tx.Commit()
+}
+
+// POST /auth/logout
+// Revokes the calling access token and, if given, its refresh token family
+func (h *AuthHandler) Logout(w http.ResponseWriter, r *http.Request) {
+    userID, ok := userIDFromContext(r)
+    if !ok {
+        httperr.Write(w, r, httperr.New(http.StatusUnauthorized, "Unauthorized"))
+        return
+    }
+
+    var input struct {
+        RefreshToken string `json:"refreshToken"`
+    }
+    if r.ContentLength != 0 {
+        if err := json.NewDecoder(r.Body).Decode(&input); err != nil {
+            httperr.Write(w, r, httperr.New(http.StatusBadRequest, "Invalid input"))
+            return
+        }
+    }
+
+    ctx := r.Context()
+
+    claims, _ := claimsFromContext(r)
+    jti, _ := claims["jti"].(string)
+    exp, _ := claims["exp"].(float64)
+    if jti != "" {
+        _, err := h.DB.ExecContext(ctx,
+            "INSERT INTO revoked_tokens (jti, expires_at) VALUES ($1, $2) ON CONFLICT (jti) DO NOTHING",
+            jti, time.Unix(int64(exp), 0),
+        )
+        if err != nil {
+            httperr.Write(w, r, httperr.Internal("Failed to revoke token", err))
+            return
+        }
+    }
+
+    if input.RefreshToken != "" {
+        _, err := h.DB.ExecContext(ctx,
+            `UPDATE refresh_tokens SET revoked_at = now()
+             WHERE revoked_at IS NULL AND user_id = $1 AND family_id = (
+                 SELECT family_id FROM refresh_tokens WHERE token_hash = $2 AND user_id = $1
+             )`,
+            userID, hashToken(input.RefreshToken),
+        )
+        if err != nil {
+            httperr.Write(w, r, httperr.Internal("Failed to revoke refresh token", err))
+            return
+        }
+    }
+
+    // Denylist entries are useless once the token would have expired anyway
+    h.DB.ExecContext(ctx, "DELETE FROM revoked_tokens WHERE expires_at < now()")
+
+    w.WriteHeader(http.StatusNoContent)
+}
+
+// POST /auth/logout-all
+// Invalidates every access and refresh token the user holds
+func (h *AuthHandler) LogoutAll(w http.ResponseWriter, r *http.Request) {
+    userID, ok := userIDFromContext(r)
+    if !ok {
+        httperr.Write(w, r, httperr.New(http.StatusUnauthorized, "Unauthorized"))
+        return
+    }
+
+    if err := h.revokeAllTokens(r.Context(), h.DB, userID); err != nil {
+        httperr.Write(w, r, httperr.Internal("Failed to log out", err))
+        return
+    }
+
+    w.WriteHeader(http.StatusNoContent)
+}
+
+func (h *AuthHandler) revokeAllTokens(ctx context.Context, q queryer, userID int) error {
+    if _, err := q.ExecContext(ctx,
+        "UPDATE users SET token_version = token_version + 1 WHERE id = $1", userID,
+    ); err != nil {
+        return err
+    }
+    _, err := q.ExecContext(ctx,
+        "UPDATE refresh_tokens SET revoked_at = now() WHERE user_id = $1 AND revoked_at IS NULL", userID,
+    )
+    return err
+}
+
+func randomToken(size int) (string, error) {
+    b := make([]byte, size)
+    if _, err := rand.Read(b); err != nil {
+        return "", err
+    }
+    return base64.RawURLEncoding.EncodeToString(b), nil
+}
+
+// Refresh tokens are only ever stored hashed
+func hashToken(token string) string {
+    sum := sha256.Sum256([]byte(token))
+    return hex.EncodeToString(sum[:])
+}
@@ -0,0 +1,242 @@
+package handlers
+
+import (
+    "context"
+    "database/sql"
+    "encoding/json"
+    "log/slog"
+    "net/http"
+    "time"
+
+    "urpaint/internal/httperr"
+)
+
+const defaultTrashRetention = 30 * 24 * time.Hour
+
+type TrashedDrawing struct {
+    ID        int       `json:"id"`
+    ImageURL  string    `json:"image_url"`
+    Title     string    `json:"title"`
+    DeletedAt time.Time `json:"deletedAt"`
+    PurgeAt   time.Time `json:"purgeAt"`
+}
+
+func (h *GalleryHandler) trashRetention() time.Duration {
+    if h.TrashRetention > 0 {
+        return h.TrashRetention
+    }
+    return defaultTrashRetention
+}
+
+// GET /gallery/trash
+func (h *GalleryHandler) ListTrash(w http.ResponseWriter, r *http.Request) {
+    userID, ok := userIDFromContext(r)
+    if !ok {
+        httperr.Write(w, r, httperr.New(http.StatusUnauthorized, "Unauthorized"))
+        return
+    }
+
+    rows, err := h.DB.Query(
+        `SELECT id, image_url, title, deleted_at FROM gallery
+         WHERE user_id = $1 AND deleted_at IS NOT NULL
+         ORDER BY deleted_at DESC`,
+        userID,
+    )
+    if err != nil {
+        httperr.Write(w, r, httperr.Internal("Database error", err))
+        return
+    }
+    defer rows.Close()
+
+    trash := []TrashedDrawing{}
+    for rows.Next() {
+        var item TrashedDrawing
+        var imageURL, title sql.NullString
+        if err := rows.Scan(&item.ID, &imageURL, &title, &item.DeletedAt); err != nil {
+            httperr.Write(w, r, httperr.Internal("Database error", err))
+            return
+        }
+        item.ImageURL = imageURL.String
+        item.Title = title.String
+        item.PurgeAt = item.DeletedAt.Add(h.trashRetention())
+        trash = append(trash, item)
+    }
+    if err := rows.Err(); err != nil {
+        httperr.Write(w, r, httperr.Internal("Database error", err))
+        return
+    }
+
+    w.Header().Set("Content-Type", "application/json")
+    json.NewEncoder(w).Encode(trash)
+}
+
+// POST /gallery/trash/restore?id=
+func (h *GalleryHandler) RestoreFromTrash(w http.ResponseWriter, r *http.Request) {
+    userID, ok := userIDFromContext(r)
+    if !ok {
+        httperr.Write(w, r, httperr.New(http.StatusUnauthorized, "Unauthorized"))
+        return
+    }
+
+    drawingID, ok := drawingIDParam(w, r)
+    if !ok {
+        return
+    }
+
+    res, err := h.DB.Exec(
+        "UPDATE gallery SET deleted_at = NULL WHERE id = $1 AND user_id = $2 AND deleted_at IS NOT NULL",
+        drawingID, userID,
+    )
+    if err != nil {
+        httperr.Write(w, r, httperr.Internal("Failed to restore drawing", err))
+        return
+    }
+    if n, _ := res.RowsAffected(); n == 0 {
+        httperr.Write(w, r, httperr.New(http.StatusNotFound, "Drawing not found in trash"))
+        return
+    }
+
+    w.WriteHeader(http.StatusNoContent)
+}
+
+// DELETE /gallery/trash[?id=]
+// Purges one trashed drawing, or empties the whole trash without an id
+func (h *GalleryHandler) PurgeTrash(w http.ResponseWriter, r *http.Request) {
+    userID, ok := userIDFromContext(r)
+    if !ok {
+        httperr.Write(w, r, httperr.New(http.StatusUnauthorized, "Unauthorized"))
+        return
+    }
+
+    var drawingIDs []int
+    if r.URL.Query().Has("id") {
+        drawingID, ok := drawingIDParam(w, r)
+        if !ok {
+            return
+        }
+        drawingIDs = []int{drawingID}
+    } else {
+        rows, err := h.DB.Query(
+            "SELECT id FROM gallery WHERE user_id = $1 AND deleted_at IS NOT NULL", userID,
+        )
+        if err != nil {
+            httperr.Write(w, r, httperr.Internal("Database error", err))
+            return
+        }
+        for rows.Next() {
+            var id int
+            if err := rows.Scan(&id); err != nil {
+                rows.Close()
+                httperr.Write(w, r, httperr.Internal("Database error", err))
+                return
+            }
+            drawingIDs = append(drawingIDs, id)
+        }
+        rows.Close()
+        if err := rows.Err(); err != nil {
+            httperr.Write(w, r, httperr.Internal("Database error", err))
+            return
+        }
+    }
+
+    for _, drawingID := range drawingIDs {
+        err := h.purgeDrawing(r.Context(), drawingID, userID)
+        if err == sql.ErrNoRows && len(drawingIDs) == 1 {
+            httperr.Write(w, r, httperr.New(http.StatusNotFound, "Drawing not found in trash"))
+            return
+        }
+        if err != nil && err != sql.ErrNoRows {
+            httperr.Write(w, r, httperr.Internal("Failed to purge drawing", err))
+            return
+        }
+    }
+
+    w.WriteHeader(http.StatusNoContent)
+}
+
+// purgeDrawing permanently deletes a trashed drawing, its history and
+// every stored image. sql.ErrNoRows if it isn't in the user's trash.
+func (h *GalleryHandler) purgeDrawing(ctx context.Context, drawingID, userID int) error {
+    urls, err := h.drawingAssetURLs(ctx, drawingID, userID)
+    if err != nil {
+        return err
+    }
+
+    // Row first so nothing ever points at a deleted image
+    res, err := h.DB.ExecContext(ctx,
+        "DELETE FROM gallery WHERE id = $1 AND user_id = $2 AND deleted_at IS NOT NULL",
+        drawingID, userID,
+    )
+    if err != nil {
+        return err
+    }
+    if n, _ := res.RowsAffected(); n == 0 {
+        return sql.ErrNoRows
+    }
+
+    for _, url := range urls {
+        h.deleteAsset(ctx, url)
+    }
+    return nil
+}
+
+// SweepTrash purges drawings that sat in the trash past the retention period
+func (h *GalleryHandler) SweepTrash(ctx context.Context) (int, error) {
+    cutoff := time.Now().Add(-h.trashRetention())
+
+    rows, err := h.DB.QueryContext(ctx,
+        "SELECT id, user_id FROM gallery WHERE deleted_at < $1 ORDER BY deleted_at LIMIT 500",
+        cutoff,
+    )
+    if err != nil {
+        return 0, err
+    }
+
+    type expired struct{ drawingID, userID int }
+    var batch []expired
+    for rows.Next() {
+        var e expired
+        if err := rows.Scan(&e.drawingID, &e.userID); err != nil {
+            rows.Close()
+            return 0, err
+        }
+        batch = append(batch, e)
+    }
+    rows.Close()
+    if err := rows.Err(); err != nil {
+        return 0, err
+    }
+
+    purged := 0
+    for _, e := range batch {
+        if err := h.purgeDrawing(ctx, e.drawingID, e.userID); err != nil {
+            if err == sql.ErrNoRows {
+                continue
+            }
+            return purged, err
+        }
+        purged++
+    }
+    return purged, nil
+}
+
+// RunTrashSweeper calls SweepTrash every interval until ctx is cancelled
+func (h *GalleryHandler) RunTrashSweeper(ctx context.Context, interval time.Duration) {
+    ticker := time.NewTicker(interval)
+    defer ticker.Stop()
+
+    for {
+        purged, err := h.SweepTrash(ctx)
+        if err != nil {
+            slog.ErrorContext(ctx, "trash sweep failed", "err", err)
+        } else if purged > 0 {
+            slog.InfoContext(ctx, "purged expired drawings from trash", "drawings", purged)
+        }
+
+        select {
+        case <-ctx.Done():
+            return
+        case <-ticker.C:
+        }
+    }
+}
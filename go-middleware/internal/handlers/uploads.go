@@ -0,0 +1,89 @@
+package handlers
+
+import (
+    "errors"
+    "net/http"
+
+    "urpaint/internal/httperr"
+    "urpaint/internal/metrics"
+    "urpaint/internal/uploads"
+)
+
+// Room for the multipart framing and small fields around the files
+const multipartOverhead = 1 << 20
+
+// uploadError rejects an upload. field is the form field that failed,
+// empty when the request as a whole was refused.
+func uploadError(w http.ResponseWriter, r *http.Request, status int, field, code, message string) {
+    e := httperr.New(status, message).WithCode(code)
+    if field != "" {
+        e.WithDetails(httperr.Field(field))
+    }
+    httperr.Write(w, r, e)
+}
+
+// parseUpload parses a multipart body capped at maxBytes, answering
+// 413/400 itself when it can't
+func parseUpload(w http.ResponseWriter, r *http.Request, maxBytes int64) bool {
+    r.Body = http.MaxBytesReader(w, r.Body, maxBytes+multipartOverhead)
+    err := r.ParseMultipartForm(10 << 20)
+    var tooLarge *http.MaxBytesError
+    if errors.As(err, &tooLarge) {
+        uploadError(w, r, http.StatusRequestEntityTooLarge, "", uploads.CodeTooLarge, "Request body is too large")
+        return false
+    }
+    if err != nil {
+        uploadError(w, r, http.StatusBadRequest, "", "invalid_form", "Failed to parse form")
+        return false
+    }
+    return true
+}
+
+// readImage checks the image in a multipart field and returns it with its
+// metadata stripped. A missing field is nil when optional, otherwise the
+// handler has already answered whenever ok is false.
+func readImage(w http.ResponseWriter, r *http.Request, field string, limits uploads.Limits, optional bool) (*uploads.Image, bool) {
+    file, _, err := r.FormFile(field)
+    if err == http.ErrMissingFile {
+        if optional {
+            return nil, true
+        }
+        uploadError(w, r, http.StatusBadRequest, field, "missing", "No file uploaded")
+        return nil, false
+    }
+    if err != nil {
+        uploadError(w, r, http.StatusBadRequest, field, "invalid_form", "Failed to read file")
+        return nil, false
+    }
+    defer file.Close()
+
+    img, err := uploads.Read(file, limits)
+    var rejected *uploads.Error
+    if errors.As(err, &rejected) {
+        status := http.StatusBadRequest
+        switch rejected.Code {
+        case uploads.CodeTooLarge, uploads.CodeDimensions:
+            status = http.StatusRequestEntityTooLarge
+        case uploads.CodeUnsupportedType:
+            status = http.StatusUnsupportedMediaType
+        }
+        metrics.UploadsRejected.WithLabelValues(field, rejected.Code).Inc()
+        uploadError(w, r, status, field, rejected.Code, rejected.Message)
+        return nil, false
+    }
+    if err != nil {
+        httperr.Write(w, r, httperr.New(http.StatusBadRequest, "Failed to read file").
+            WithCode("invalid_form").WithDetails(httperr.Field(field)))
+        return nil, false
+    }
+    metrics.UploadBytes.WithLabelValues(field).Add(float64(len(img.Data)))
+    return &img, true
+}
+
+// imageBytes is the size of an optional image
+func imageBytes(img *uploads.Image) int64 {
+    if img == nil {
+        return 0
+    }
+    return int64(len(img.Data))
+}
@@ -0,0 +1,134 @@
+// Package httperr is how handlers answer with an error. Every error goes
+// out as the same JSON envelope:
+//
+//	{"error": {"code": "...", "message": "...", "details": ..., "requestId": "..."}}
+//
+// Message is always safe to show a user. The cause behind an internal
+// error is logged against the request and never sent.
+package httperr
+
+import (
+	"encoding/json"
+	"errors"
+	"log/slog"
+	"net/http"
+	"strings"
+)
+
+// Error is an error a handler answers with
+type Error struct {
+	// Code is a stable, machine-readable name such as "not_found"
+	Code    string
+	Status  int
+	Message string
+	// Details is optional structured data, e.g. the field that failed
+	Details interface{}
+	// Err is the underlying cause; it is logged, not sent
+	Err error
+}
+
+func (e *Error) Error() string {
+	if e.Err != nil {
+		return e.Message + ": " + e.Err.Error()
+	}
+	return e.Message
+}
+
+func (e *Error) Unwrap() error {
+	return e.Err
+}
+
+// New is an error with the code that goes with its status
+func New(status int, message string) *Error {
+	return &Error{Code: codeFor(status), Status: status, Message: message}
+}
+
+// Internal is a 500 whose cause stays in the logs. message says what
+// failed in terms a user understands.
+func Internal(message string, err error) *Error {
+	return &Error{Code: "internal", Status: http.StatusInternalServerError, Message: message, Err: err}
+}
+
+// WithCode replaces the generic code
+func (e *Error) WithCode(code string) *Error {
+	e.Code = code
+	return e
+}
+
+// WithDetails attaches structured details
+func (e *Error) WithDetails(details interface{}) *Error {
+	e.Details = details
+	return e
+}
+
+// Field is the usual details for a problem with one input
+func Field(name string) map[string]string {
+	return map[string]string{"field": name}
+}
+
+var codes = map[int]string{
+	http.StatusBadRequest:            "bad_request",
+	http.StatusUnauthorized:          "unauthorized",
+	http.StatusForbidden:             "forbidden",
+	http.StatusNotFound:              "not_found",
+	http.StatusMethodNotAllowed:      "method_not_allowed",
+	http.StatusConflict:              "conflict",
+	http.StatusGone:                  "gone",
+	http.StatusRequestEntityTooLarge: "too_large",
+	http.StatusUnsupportedMediaType:  "unsupported_media_type",
+	http.StatusTooManyRequests:       "too_many_requests",
+	http.StatusInternalServerError:   "internal",
+	http.StatusServiceUnavailable:    "unavailable",
+}
+
+func codeFor(status int) string {
+	if code, ok := codes[status]; ok {
+		return code
+	}
+	return strings.ReplaceAll(strings.ToLower(http.StatusText(status)), " ", "_")
+}
+
+type body struct {
+	Error detail `json:"error"`
+}
+
+type detail struct {
+	Code      string      `json:"code"`
+	Message   string      `json:"message"`
+	Details   interface{} `json:"details,omitempty"`
+	RequestID string      `json:"requestId,omitempty"`
+}
+
+// Write answers r with err. Anything that isn't an *Error is an internal
+// error. Server errors and any cause are logged.
+func Write(w http.ResponseWriter, r *http.Request, err error) {
+	var e *Error
+	if !errors.As(err, &e) {
+		e = Internal("Something went wrong", err)
+	}
+	requestID := r.Header.Get("X-Request-ID")
+
+	if e.Status >= 500 || e.Err != nil {
+		level := slog.LevelWarn
+		if e.Status >= 500 {
+			level = slog.LevelError
+		}
+		slog.Log(r.Context(), level, e.Message,
+			slog.String("method", r.Method),
+			slog.String("path", r.URL.Path),
+			slog.Int("status", e.Status),
+			slog.String("code", e.Code),
+			slog.Any("err", e.Err),
+		)
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("X-Content-Type-Options", "nosniff")
+	w.WriteHeader(e.Status)
+	json.NewEncoder(w).Encode(body{detail{
+		Code:      e.Code,
+		Message:   e.Message,
+		Details:   e.Details,
+		RequestID: requestID,
+	}})
+}
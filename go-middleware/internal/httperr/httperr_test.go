@@ -0,0 +1,148 @@
+package httperr
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+type envelope struct {
+	Error struct {
+		Code      string          `json:"code"`
+		Message   string          `json:"message"`
+		Details   json.RawMessage `json:"details"`
+		RequestID string          `json:"requestId"`
+	} `json:"error"`
+}
+
+// capture sends the default logger to a buffer for the rest of the test
+func capture(t *testing.T) *bytes.Buffer {
+	var buf bytes.Buffer
+	prev := slog.Default()
+	slog.SetDefault(slog.New(slog.NewTextHandler(&buf, nil)))
+	t.Cleanup(func() { slog.SetDefault(prev) })
+	return &buf
+}
+
+func write(t *testing.T, err error) (*httptest.ResponseRecorder, envelope) {
+	t.Helper()
+	r := httptest.NewRequest(http.MethodGet, "/drawings/7", nil)
+	r.Header.Set("X-Request-ID", "req-1")
+	w := httptest.NewRecorder()
+	Write(w, r, err)
+
+	var env envelope
+	if err := json.Unmarshal(w.Body.Bytes(), &env); err != nil {
+		t.Fatalf("body %q: %v", w.Body, err)
+	}
+	return w, env
+}
+
+func TestCodeFor(t *testing.T) {
+	tests := []struct {
+		status int
+		code   string
+	}{
+		{http.StatusBadRequest, "bad_request"},
+		{http.StatusNotFound, "not_found"},
+		{http.StatusRequestEntityTooLarge, "too_large"},
+		{http.StatusServiceUnavailable, "unavailable"},
+		// Not in the table: derived from the status text
+		{http.StatusTeapot, "i'm_a_teapot"},
+		{http.StatusPreconditionFailed, "precondition_failed"},
+	}
+	for _, tt := range tests {
+		if got := New(tt.status, "x").Code; got != tt.code {
+			t.Errorf("New(%d).Code = %q, want %q", tt.status, got, tt.code)
+		}
+	}
+}
+
+func TestWriteEnvelope(t *testing.T) {
+	logs := capture(t)
+	w, env := write(t, New(http.StatusBadRequest, "Title is required").WithCode("invalid_title").WithDetails(Field("title")))
+
+	if w.Code != http.StatusBadRequest {
+		t.Errorf("status = %d", w.Code)
+	}
+	if ct := w.Header().Get("Content-Type"); ct != "application/json" {
+		t.Errorf("Content-Type = %q", ct)
+	}
+	if env.Error.Code != "invalid_title" || env.Error.Message != "Title is required" || env.Error.RequestID != "req-1" {
+		t.Errorf("envelope = %+v", env.Error)
+	}
+	if string(env.Error.Details) != `{"field":"title"}` {
+		t.Errorf("details = %s", env.Error.Details)
+	}
+	if logs.Len() != 0 {
+		t.Errorf("a plain client error was logged: %s", logs)
+	}
+}
+
+func TestWriteHidesCause(t *testing.T) {
+	cause := errors.New(`pq: relation "drawings" does not exist`)
+
+	tests := []struct {
+		name    string
+		err     error
+		message string
+	}{
+		{"internal", Internal("Could not load the drawing", cause), "Could not load the drawing"},
+		{"plain error", cause, "Something went wrong"},
+		{"wrapped", fmt.Errorf("loading: %w", cause), "Something went wrong"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			logs := capture(t)
+			w, env := write(t, tt.err)
+
+			if w.Code != http.StatusInternalServerError || env.Error.Code != "internal" {
+				t.Errorf("got %d %s, want 500 internal", w.Code, env.Error.Code)
+			}
+			if env.Error.Message != tt.message {
+				t.Errorf("message = %q, want %q", env.Error.Message, tt.message)
+			}
+			if strings.Contains(w.Body.String(), "pq:") {
+				t.Errorf("cause leaked: %s", w.Body)
+			}
+			if !strings.Contains(logs.String(), "level=ERROR") || !strings.Contains(logs.String(), "pq: relation") {
+				t.Errorf("cause wasn't logged: %s", logs)
+			}
+		})
+	}
+}
+
+func TestWriteFindsWrappedError(t *testing.T) {
+	logs := capture(t)
+	e := New(http.StatusConflict, "Name taken")
+	e.Err = errors.New("unique violation")
+	w, env := write(t, fmt.Errorf("rename: %w", e))
+
+	if w.Code != http.StatusConflict || env.Error.Code != "conflict" || env.Error.Message != "Name taken" {
+		t.Errorf("got %d %+v", w.Code, env.Error)
+	}
+	// A client error with a cause is logged as a warning
+	if !strings.Contains(logs.String(), "level=WARN") {
+		t.Errorf("logs = %s", logs)
+	}
+}
+
+func TestErrorUnwrap(t *testing.T) {
+	cause := errors.New("disk full")
+	e := Internal("Could not save", cause)
+	if !errors.Is(e, cause) {
+		t.Error("errors.Is doesn't reach the cause")
+	}
+	if e.Error() != "Could not save: disk full" {
+		t.Errorf("Error() = %q", e.Error())
+	}
+	if New(http.StatusNotFound, "Not found").Error() != "Not found" {
+		t.Error("Error() without a cause should be the message")
+	}
+}
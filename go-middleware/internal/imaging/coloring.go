@@ -0,0 +1,233 @@
+// Package imaging turns photos into pages to color in. The cartoon style is
+// a Go port of convert_to_coloring_page from the old Python service
+// (python-imaging/image_utils/URPaint.py).
+package imaging
+
+import (
+	"fmt"
+	"image"
+	"math"
+	"strings"
+)
+
+// Styles
+const (
+	// Cartoon lays dark edges over smoothed color, the original pipeline
+	Cartoon = "cartoon"
+	// Sketch is the pencil look: grayscale dodge-blended with its blurred negative
+	Sketch = "sketch"
+	// LineArt is black outlines on white, for printing and coloring by hand
+	LineArt = "lineart"
+	// Posterize reduces the photo to a few flat tones per channel
+	Posterize = "posterize"
+)
+
+// Styles lists every style Convert accepts, default first
+var Styles = []string{Cartoon, Sketch, LineArt, Posterize}
+
+// Options picks a style and overrides its parameters. nil keeps the
+// style's default; setting a parameter the style doesn't use is an error.
+type Options struct {
+	Style string `json:"style,omitempty"`
+	// BlockSize is the odd neighbourhood size for adaptive thresholding
+	BlockSize *int `json:"blockSize,omitempty"`
+	// C is subtracted from the neighbourhood mean; higher keeps fewer edges
+	C *float64 `json:"c,omitempty"`
+	// BlurRadius sizes the blur applied first (the kernel is 2r+1 wide)
+	BlurRadius *int `json:"blurRadius,omitempty"`
+	// Levels is the number of tones per channel when posterizing
+	Levels *int `json:"levels,omitempty"`
+}
+
+// OptionError is a parameter the client got wrong.
+type OptionError struct {
+	Param   string
+	Message string
+}
+
+func (e *OptionError) Error() string {
+	return e.Param + ": " + e.Message
+}
+
+type settings struct {
+	blockSize  int
+	c          float64
+	blurRadius int
+	levels     int
+}
+
+type styleSpec struct {
+	defaults settings
+	params   []string
+	run      func(img *image.RGBA, s settings) *image.RGBA
+}
+
+var styleSpecs = map[string]styleSpec{
+	Cartoon: {
+		defaults: settings{blockSize: 9, c: 9, blurRadius: 3},
+		params:   []string{"blockSize", "c", "blurRadius"},
+		run:      cartoon,
+	},
+	Sketch: {
+		defaults: settings{blurRadius: 10},
+		params:   []string{"blurRadius"},
+		run:      sketch,
+	},
+	LineArt: {
+		defaults: settings{blockSize: 9, c: 9, blurRadius: 3},
+		params:   []string{"blockSize", "c", "blurRadius"},
+		run:      lineArt,
+	},
+	Posterize: {
+		defaults: settings{blurRadius: 2, levels: 6},
+		params:   []string{"blurRadius", "levels"},
+		run:      posterize,
+	},
+}
+
+// Convert renders src in the requested style. An empty style is Cartoon.
+func Convert(src image.Image, opts Options) (*image.RGBA, error) {
+	spec, s, err := opts.resolve()
+	if err != nil {
+		return nil, err
+	}
+	return spec.run(toRGBA(src), s), nil
+}
+
+// Validate reports the first bad option without converting anything
+func (opts Options) Validate() error {
+	_, _, err := opts.resolve()
+	return err
+}
+
+func (opts Options) resolve() (styleSpec, settings, error) {
+	style := opts.Style
+	if style == "" {
+		style = Cartoon
+	}
+	spec, ok := styleSpecs[style]
+	if !ok {
+		return spec, settings{}, &OptionError{Param: "style", Message: "must be one of " + strings.Join(Styles, ", ")}
+	}
+	s, err := opts.apply(style, spec)
+	return spec, s, err
+}
+
+func (opts Options) apply(style string, spec styleSpec) (settings, error) {
+	s := spec.defaults
+	uses := func(param string) error {
+		for _, p := range spec.params {
+			if p == param {
+				return nil
+			}
+		}
+		return &OptionError{Param: param, Message: fmt.Sprintf("not used by the %s style", style)}
+	}
+
+	if opts.BlockSize != nil {
+		if err := uses("blockSize"); err != nil {
+			return s, err
+		}
+		if v := *opts.BlockSize; v < 3 || v > 51 || v%2 == 0 {
+			return s, &OptionError{Param: "blockSize", Message: "must be an odd number between 3 and 51"}
+		}
+		s.blockSize = *opts.BlockSize
+	}
+	if opts.C != nil {
+		if err := uses("c"); err != nil {
+			return s, err
+		}
+		if v := *opts.C; math.IsNaN(v) || v < -50 || v > 50 {
+			return s, &OptionError{Param: "c", Message: "must be between -50 and 50"}
+		}
+		s.c = *opts.C
+	}
+	if opts.BlurRadius != nil {
+		if err := uses("blurRadius"); err != nil {
+			return s, err
+		}
+		if v := *opts.BlurRadius; v < 0 || v > 25 {
+			return s, &OptionError{Param: "blurRadius", Message: "must be between 0 and 25"}
+		}
+		s.blurRadius = *opts.BlurRadius
+	}
+	if opts.Levels != nil {
+		if err := uses("levels"); err != nil {
+			return s, err
+		}
+		if v := *opts.Levels; v < 2 || v > 32 {
+			return s, &OptionError{Param: "levels", Message: "must be between 2 and 32"}
+		}
+		s.levels = *opts.Levels
+	}
+	return s, nil
+}
+
+// edgeMask is white except for the dark edges of the photo
+func edgeMask(img *image.RGBA, s settings) *image.Gray {
+	gray := equalizeHist(grayscale(img))
+	if s.blurRadius > 0 {
+		gray = medianBlur(gray, 2*s.blurRadius+1)
+	}
+	return adaptiveThresholdMean(gray, s.blockSize, s.c)
+}
+
+// cartoon is convert_to_coloring_page: edges found on an equalized,
+// median-blurred grayscale copy are laid over a bilateral-smoothed color
+// copy, leaving flat color regions outlined in black
+func cartoon(img *image.RGBA, s settings) *image.RGBA {
+	edges := edgeMask(img, s)
+	smooth := bilateralFilter(img, 9, 200, 200)
+	return mask(smooth, edges)
+}
+
+// lineArt keeps only the edges: black on white
+func lineArt(img *image.RGBA, s settings) *image.RGBA {
+	return grayToRGBA(edgeMask(img, s))
+}
+
+// sketch is the mode commented out in the Python service:
+// divide(gray, 255 - GaussianBlur(255 - gray), scale=256)
+func sketch(img *image.RGBA, s settings) *image.RGBA {
+	gray := grayscale(img)
+
+	inv := image.NewGray(gray.Bounds())
+	for i, v := range gray.Pix {
+		inv.Pix[i] = 255 - v
+	}
+	blur := gaussianBlur(inv, s.blurRadius)
+
+	out := image.NewGray(gray.Bounds())
+	for i, v := range gray.Pix {
+		if d := 255 - int(blur.Pix[i]); d != 0 {
+			out.Pix[i] = saturate(float64(v) * 256 / float64(d))
+		}
+	}
+	return grayToRGBA(out)
+}
+
+// posterize blurs away noise then snaps each channel to evenly spaced levels
+func posterize(img *image.RGBA, s settings) *image.RGBA {
+	channels := splitChannels(img)
+	for i := range channels {
+		if s.blurRadius > 0 {
+			channels[i] = gaussianBlur(channels[i], s.blurRadius)
+		}
+	}
+
+	step := 255 / float64(s.levels-1)
+	var lut [256]uint8
+	for v := range lut {
+		lut[v] = saturate(math.Round(float64(v)/step) * step)
+	}
+
+	dst := image.NewRGBA(img.Bounds())
+	for j := range channels[0].Pix {
+		i := j * 4
+		dst.Pix[i] = lut[channels[0].Pix[j]]
+		dst.Pix[i+1] = lut[channels[1].Pix[j]]
+		dst.Pix[i+2] = lut[channels[2].Pix[j]]
+		dst.Pix[i+3] = 255
+	}
+	return dst
+}
@@ -0,0 +1,192 @@
+package imaging
+
+import (
+	"bytes"
+	"errors"
+	"flag"
+	"image"
+	"image/color"
+	"image/png"
+	"math"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+var update = flag.Bool("update", false, "rewrite the golden files in testdata")
+
+// testPhoto is a small deterministic stand-in for a photo: a diagonal
+// gradient with a dark disc and a bright bar, so every style has edges,
+// flat areas and tones to work with
+func testPhoto() *image.RGBA {
+	const w, h = 64, 48
+	img := image.NewRGBA(image.Rect(0, 0, w, h))
+	for y := 0; y < h; y++ {
+		for x := 0; x < w; x++ {
+			c := color.RGBA{uint8(x * 4), uint8(y * 5), uint8(128 + (x-y)/2), 255}
+			if dx, dy := x-20, y-24; dx*dx+dy*dy < 12*12 {
+				c = color.RGBA{40, 30, 90, 255}
+			}
+			if x >= 40 && x < 56 && y >= 8 && y < 40 {
+				c = color.RGBA{240, 220, 60, 255}
+			}
+			img.SetRGBA(x, y, c)
+		}
+	}
+	return img
+}
+
+func intp(v int) *int           { return &v }
+func floatp(v float64) *float64 { return &v }
+
+func TestConvertGolden(t *testing.T) {
+	tests := []struct {
+		name string
+		opts Options
+	}{
+		{Cartoon, Options{Style: Cartoon}},
+		{Sketch, Options{Style: Sketch}},
+		{LineArt, Options{Style: LineArt}},
+		{Posterize, Options{Style: Posterize}},
+		{"lineart-tuned", Options{Style: LineArt, BlockSize: intp(15), C: floatp(4), BlurRadius: intp(0)}},
+		{"posterize-levels", Options{Style: Posterize, Levels: intp(2)}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := Convert(testPhoto(), tt.opts)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got.Bounds() != testPhoto().Bounds() {
+				t.Fatalf("bounds = %v", got.Bounds())
+			}
+
+			golden := filepath.Join("testdata", tt.name+".png")
+			if *update {
+				var buf bytes.Buffer
+				if err := png.Encode(&buf, got); err != nil {
+					t.Fatal(err)
+				}
+				if err := os.WriteFile(golden, buf.Bytes(), 0o644); err != nil {
+					t.Fatal(err)
+				}
+				return
+			}
+
+			f, err := os.Open(golden)
+			if err != nil {
+				t.Fatalf("%v (run with -update to create it)", err)
+			}
+			defer f.Close()
+			want, err := png.Decode(f)
+			if err != nil {
+				t.Fatal(err)
+			}
+			wantRGBA := toRGBA(want)
+			if !bytes.Equal(got.Pix, wantRGBA.Pix) {
+				t.Errorf("output differs from %s", golden)
+			}
+		})
+	}
+}
+
+func TestConvertStyleInvariants(t *testing.T) {
+	isGray := func(img *image.RGBA) bool {
+		for i := 0; i < len(img.Pix); i += 4 {
+			if img.Pix[i] != img.Pix[i+1] || img.Pix[i] != img.Pix[i+2] {
+				return false
+			}
+		}
+		return true
+	}
+
+	// An empty style is Cartoon
+	def, err := Convert(testPhoto(), Options{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	cartoon, err := Convert(testPhoto(), Options{Style: Cartoon})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(def.Pix, cartoon.Pix) {
+		t.Error("the default style differs from cartoon")
+	}
+
+	lines, err := Convert(testPhoto(), Options{Style: LineArt})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !isGray(lines) {
+		t.Error("line art output isn't grayscale")
+	}
+	for i := 0; i < len(lines.Pix); i += 4 {
+		if v := lines.Pix[i]; v != 0 && v != 255 {
+			t.Fatalf("line art pixel %d = %v, want pure black or white", i/4, lines.Pix[i:i+4])
+		}
+	}
+
+	sk, err := Convert(testPhoto(), Options{Style: Sketch})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !isGray(sk) {
+		t.Error("sketch output isn't grayscale")
+	}
+
+	poster, err := Convert(testPhoto(), Options{Style: Posterize, Levels: intp(3)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i, v := range poster.Pix {
+		if i%4 != 3 && v != 0 && v != 128 && v != 255 {
+			t.Fatalf("posterized channel value %d at %d, want one of 3 levels", v, i)
+		}
+	}
+}
+
+func TestOptionsValidate(t *testing.T) {
+	tests := []struct {
+		name  string
+		opts  Options
+		param string
+	}{
+		{"default", Options{}, ""},
+		{"every style", Options{Style: Sketch, BlurRadius: intp(0)}, ""},
+		{"all cartoon params", Options{BlockSize: intp(51), C: floatp(-50), BlurRadius: intp(25)}, ""},
+		{"unknown style", Options{Style: "watercolor"}, "style"},
+		{"even block size", Options{BlockSize: intp(8)}, "blockSize"},
+		{"small block size", Options{BlockSize: intp(1)}, "blockSize"},
+		{"large block size", Options{BlockSize: intp(53)}, "blockSize"},
+		{"c too high", Options{C: floatp(50.5)}, "c"},
+		{"c nan", Options{C: floatp(math.NaN())}, "c"},
+		{"negative blur", Options{BlurRadius: intp(-1)}, "blurRadius"},
+		{"large blur", Options{Style: Posterize, BlurRadius: intp(26)}, "blurRadius"},
+		{"one level", Options{Style: Posterize, Levels: intp(1)}, "levels"},
+		{"many levels", Options{Style: Posterize, Levels: intp(33)}, "levels"},
+		{"levels on cartoon", Options{Levels: intp(4)}, "levels"},
+		{"block size on sketch", Options{Style: Sketch, BlockSize: intp(9)}, "blockSize"},
+		{"c on posterize", Options{Style: Posterize, C: floatp(1)}, "c"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := tt.opts.Validate()
+			if tt.param == "" {
+				if err != nil {
+					t.Errorf("err = %v", err)
+				}
+				return
+			}
+			var optErr *OptionError
+			if !errors.As(err, &optErr) {
+				t.Fatalf("err = %v, want *OptionError", err)
+			}
+			if optErr.Param != tt.param {
+				t.Errorf("param = %q, want %q", optErr.Param, tt.param)
+			}
+			if _, err := Convert(testPhoto(), tt.opts); err == nil {
+				t.Error("Convert accepted options Validate rejected")
+			}
+		})
+	}
+}
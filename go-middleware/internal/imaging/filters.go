@@ -0,0 +1,354 @@
+package imaging
+
+import (
+	"image"
+	"image/draw"
+	"math"
+)
+
+// The filters below follow OpenCV's 8-bit implementations closely,
+// including rounding and border handling, so results line up with what
+// the Python service produced.
+
+// toRGBA copies src into an opaque RGBA image. Like cv2.IMREAD_COLOR,
+// alpha is dropped rather than composited.
+func toRGBA(src image.Image) *image.RGBA {
+	b := src.Bounds()
+	dst := image.NewRGBA(image.Rect(0, 0, b.Dx(), b.Dy()))
+
+	if n, ok := src.(*image.NRGBA); ok {
+		for y := 0; y < b.Dy(); y++ {
+			copy(dst.Pix[y*dst.Stride:y*dst.Stride+b.Dx()*4], n.Pix[n.PixOffset(b.Min.X, b.Min.Y+y):])
+		}
+	} else {
+		draw.Draw(dst, dst.Bounds(), src, b.Min, draw.Src)
+	}
+
+	for i := 3; i < len(dst.Pix); i += 4 {
+		dst.Pix[i] = 255
+	}
+	return dst
+}
+
+// grayscale is cv2.cvtColor(..., COLOR_BGR2GRAY) with its fixed-point weights
+func grayscale(src *image.RGBA) *image.Gray {
+	b := src.Bounds()
+	dst := image.NewGray(b)
+	for i, j := 0, 0; i < len(src.Pix); i, j = i+4, j+1 {
+		r, g, bl := int(src.Pix[i]), int(src.Pix[i+1]), int(src.Pix[i+2])
+		dst.Pix[j] = uint8((r*4899 + g*9617 + bl*1868 + 8192) >> 14)
+	}
+	return dst
+}
+
+// equalizeHist is cv2.equalizeHist
+func equalizeHist(src *image.Gray) *image.Gray {
+	var hist [256]int
+	for _, v := range src.Pix {
+		hist[v]++
+	}
+
+	dst := image.NewGray(src.Bounds())
+	total := len(src.Pix)
+
+	i := 0
+	for i < 255 && hist[i] == 0 {
+		i++
+	}
+	if hist[i] == total {
+		for k := range dst.Pix {
+			dst.Pix[k] = uint8(i)
+		}
+		return dst
+	}
+
+	var lut [256]uint8
+	scale := float32(255) / float32(total-hist[i])
+	sum := 0
+	for i++; i < 256; i++ {
+		sum += hist[i]
+		lut[i] = saturate(float64(float32(sum) * scale))
+	}
+
+	for k, v := range src.Pix {
+		dst.Pix[k] = lut[v]
+	}
+	return dst
+}
+
+// medianBlur is cv2.medianBlur for an odd ksize, replicating edge pixels
+func medianBlur(src *image.Gray, ksize int) *image.Gray {
+	w, h := src.Bounds().Dx(), src.Bounds().Dy()
+	dst := image.NewGray(src.Bounds())
+	r := ksize / 2
+	half := ksize*ksize/2 + 1
+
+	at := func(x, y int) uint8 {
+		return src.Pix[clamp(y, 0, h-1)*src.Stride+clamp(x, 0, w-1)]
+	}
+
+	for y := 0; y < h; y++ {
+		var hist [256]int
+		for dy := -r; dy <= r; dy++ {
+			for dx := -r; dx <= r; dx++ {
+				hist[at(dx, y+dy)]++
+			}
+		}
+
+		for x := 0; x < w; x++ {
+			if x > 0 {
+				for dy := -r; dy <= r; dy++ {
+					hist[at(x-r-1, y+dy)]--
+					hist[at(x+r, y+dy)]++
+				}
+			}
+
+			count := 0
+			for v := 0; v < 256; v++ {
+				count += hist[v]
+				if count >= half {
+					dst.Pix[y*dst.Stride+x] = uint8(v)
+					break
+				}
+			}
+		}
+	}
+	return dst
+}
+
+// boxMean is cv2.blur with a normalized ksize×ksize box, replicating edges
+// and rounding back to 8 bits the way adaptiveThreshold's mean does
+func boxMean(src *image.Gray, ksize int) *image.Gray {
+	w, h := src.Bounds().Dx(), src.Bounds().Dy()
+	r := ksize / 2
+
+	// Horizontal sums, then vertical
+	rows := make([]int, w*h)
+	for y := 0; y < h; y++ {
+		line := src.Pix[y*src.Stride : y*src.Stride+w]
+		sum := 0
+		for dx := -r; dx <= r; dx++ {
+			sum += int(line[clamp(dx, 0, w-1)])
+		}
+		for x := 0; x < w; x++ {
+			rows[y*w+x] = sum
+			sum += int(line[clamp(x+r+1, 0, w-1)]) - int(line[clamp(x-r, 0, w-1)])
+		}
+	}
+
+	dst := image.NewGray(src.Bounds())
+	area := float64(ksize * ksize)
+	for x := 0; x < w; x++ {
+		sum := 0
+		for dy := -r; dy <= r; dy++ {
+			sum += rows[clamp(dy, 0, h-1)*w+x]
+		}
+		for y := 0; y < h; y++ {
+			dst.Pix[y*dst.Stride+x] = saturate(float64(sum) / area)
+			sum += rows[clamp(y+r+1, 0, h-1)*w+x] - rows[clamp(y-r, 0, h-1)*w+x]
+		}
+	}
+	return dst
+}
+
+// adaptiveThresholdMean is cv2.adaptiveThreshold with ADAPTIVE_THRESH_MEAN_C
+// and THRESH_BINARY: 255 where a pixel is brighter than its neighbourhood
+// mean minus c, 0 elsewhere
+func adaptiveThresholdMean(src *image.Gray, blockSize int, c float64) *image.Gray {
+	mean := boxMean(src, blockSize)
+	delta := int(math.Ceil(c))
+
+	dst := image.NewGray(src.Bounds())
+	for i, v := range src.Pix {
+		if int(v)-int(mean.Pix[i]) > -delta {
+			dst.Pix[i] = 255
+		}
+	}
+	return dst
+}
+
+// bilateralFilter is cv2.bilateralFilter on a color image: a smoothing that
+// keeps edges by weighting neighbours on both distance and color difference
+// (summed over channels). Borders reflect without repeating the edge.
+func bilateralFilter(src *image.RGBA, d int, sigmaColor, sigmaSpace float64) *image.RGBA {
+	w, h := src.Bounds().Dx(), src.Bounds().Dy()
+	radius := d / 2
+	if d <= 0 {
+		radius = int(math.Round(sigmaSpace * 1.5))
+	}
+
+	colorCoeff := -0.5 / (sigmaColor * sigmaColor)
+	spaceCoeff := -0.5 / (sigmaSpace * sigmaSpace)
+
+	var colorWeight [256 * 3]float32
+	for i := range colorWeight {
+		colorWeight[i] = float32(math.Exp(float64(i*i) * colorCoeff))
+	}
+
+	type tap struct {
+		dx, dy int
+		weight float32
+	}
+	var taps []tap
+	for dy := -radius; dy <= radius; dy++ {
+		for dx := -radius; dx <= radius; dx++ {
+			r := math.Sqrt(float64(dx*dx + dy*dy))
+			if r > float64(radius) {
+				continue
+			}
+			taps = append(taps, tap{dx, dy, float32(math.Exp(r * r * spaceCoeff))})
+		}
+	}
+
+	dst := image.NewRGBA(src.Bounds())
+	for y := 0; y < h; y++ {
+		for x := 0; x < w; x++ {
+			i := y*src.Stride + x*4
+			r0, g0, b0 := int(src.Pix[i]), int(src.Pix[i+1]), int(src.Pix[i+2])
+
+			var sumR, sumG, sumB, sumW float32
+			for _, t := range taps {
+				j := reflect101(y+t.dy, h)*src.Stride + reflect101(x+t.dx, w)*4
+				r, g, b := int(src.Pix[j]), int(src.Pix[j+1]), int(src.Pix[j+2])
+				wt := t.weight * colorWeight[abs(r-r0)+abs(g-g0)+abs(b-b0)]
+				sumR += float32(r) * wt
+				sumG += float32(g) * wt
+				sumB += float32(b) * wt
+				sumW += wt
+			}
+
+			sumW = 1 / sumW
+			dst.Pix[i] = saturate(float64(sumR * sumW))
+			dst.Pix[i+1] = saturate(float64(sumG * sumW))
+			dst.Pix[i+2] = saturate(float64(sumB * sumW))
+			dst.Pix[i+3] = 255
+		}
+	}
+	return dst
+}
+
+// mask is cv2.bitwise_and(img, img, mask=m): black wherever m is 0
+func mask(src *image.RGBA, m *image.Gray) *image.RGBA {
+	dst := image.NewRGBA(src.Bounds())
+	copy(dst.Pix, src.Pix)
+	for j, v := range m.Pix {
+		if v == 0 {
+			i := j * 4
+			dst.Pix[i], dst.Pix[i+1], dst.Pix[i+2] = 0, 0, 0
+		}
+	}
+	return dst
+}
+
+// saturate rounds half to even and clamps to a byte, like cv::saturate_cast
+func saturate(v float64) uint8 {
+	v = math.RoundToEven(v)
+	switch {
+	case v < 0:
+		return 0
+	case v > 255:
+		return 255
+	}
+	return uint8(v)
+}
+
+func clamp(v, lo, hi int) int {
+	if v < lo {
+		return lo
+	}
+	if v > hi {
+		return hi
+	}
+	return v
+}
+
+// reflect101 maps an out-of-range index like BORDER_REFLECT_101 (gfedcb|abcdefgh|gfedcba)
+func reflect101(i, n int) int {
+	if n == 1 {
+		return 0
+	}
+	for i < 0 || i >= n {
+		if i < 0 {
+			i = -i
+		}
+		if i >= n {
+			i = 2*n - 2 - i
+		}
+	}
+	return i
+}
+
+func abs(v int) int {
+	if v < 0 {
+		return -v
+	}
+	return v
+}
+
+// gaussianBlur is cv2.GaussianBlur with a (2r+1)² kernel and sigma 0, which
+// OpenCV derives from the kernel size. Borders reflect without repeating.
+func gaussianBlur(src *image.Gray, radius int) *image.Gray {
+	if radius <= 0 {
+		return src
+	}
+	w, h := src.Bounds().Dx(), src.Bounds().Dy()
+	ksize := 2*radius + 1
+	sigma := 0.3*(float64(ksize-1)*0.5-1) + 0.8
+
+	kernel := make([]float64, ksize)
+	sum := 0.0
+	for i := range kernel {
+		x := float64(i - radius)
+		kernel[i] = math.Exp(-x * x / (2 * sigma * sigma))
+		sum += kernel[i]
+	}
+	for i := range kernel {
+		kernel[i] /= sum
+	}
+
+	rows := make([]float64, w*h)
+	for y := 0; y < h; y++ {
+		for x := 0; x < w; x++ {
+			v := 0.0
+			for k, kv := range kernel {
+				v += kv * float64(src.Pix[y*src.Stride+reflect101(x+k-radius, w)])
+			}
+			rows[y*w+x] = v
+		}
+	}
+
+	dst := image.NewGray(src.Bounds())
+	for y := 0; y < h; y++ {
+		for x := 0; x < w; x++ {
+			v := 0.0
+			for k, kv := range kernel {
+				v += kv * rows[reflect101(y+k-radius, h)*w+x]
+			}
+			dst.Pix[y*dst.Stride+x] = saturate(v)
+		}
+	}
+	return dst
+}
+
+// splitChannels separates R, G and B
+func splitChannels(src *image.RGBA) [3]*image.Gray {
+	var out [3]*image.Gray
+	for c := range out {
+		out[c] = image.NewGray(src.Bounds())
+	}
+	for j := range out[0].Pix {
+		i := j * 4
+		out[0].Pix[j], out[1].Pix[j], out[2].Pix[j] = src.Pix[i], src.Pix[i+1], src.Pix[i+2]
+	}
+	return out
+}
+
+// grayToRGBA is cv2.cvtColor(..., COLOR_GRAY2BGR)
+func grayToRGBA(src *image.Gray) *image.RGBA {
+	dst := image.NewRGBA(src.Bounds())
+	for j, v := range src.Pix {
+		i := j * 4
+		dst.Pix[i], dst.Pix[i+1], dst.Pix[i+2], dst.Pix[i+3] = v, v, v, 255
+	}
+	return dst
+}
@@ -0,0 +1,106 @@
+package imaging
+
+import (
+	"image"
+	"testing"
+)
+
+func grayOf(w int, pix ...uint8) *image.Gray {
+	img := image.NewGray(image.Rect(0, 0, w, len(pix)/w))
+	copy(img.Pix, pix)
+	return img
+}
+
+func TestSaturate(t *testing.T) {
+	tests := []struct {
+		in   float64
+		want uint8
+	}{
+		{-3, 0},
+		{0.5, 0},
+		{1.5, 2},
+		{2.5, 2},
+		{254.6, 255},
+		{300, 255},
+	}
+	for _, tt := range tests {
+		if got := saturate(tt.in); got != tt.want {
+			t.Errorf("saturate(%v) = %d, want %d", tt.in, got, tt.want)
+		}
+	}
+}
+
+func TestReflect101(t *testing.T) {
+	// gfedcb|abcdefgh|gfedcba
+	tests := []struct{ i, want int }{
+		{-2, 2}, {-1, 1}, {0, 0}, {7, 7}, {8, 6}, {9, 5},
+	}
+	for _, tt := range tests {
+		if got := reflect101(tt.i, 8); got != tt.want {
+			t.Errorf("reflect101(%d, 8) = %d, want %d", tt.i, got, tt.want)
+		}
+	}
+	if got := reflect101(5, 1); got != 0 {
+		t.Errorf("reflect101(5, 1) = %d, want 0", got)
+	}
+}
+
+func TestGrayscaleWeights(t *testing.T) {
+	img := image.NewRGBA(image.Rect(0, 0, 3, 1))
+	copy(img.Pix, []uint8{255, 0, 0, 255, 0, 255, 0, 255, 0, 0, 255, 255})
+	// cv2's fixed-point BGR2GRAY: R 0.299, G 0.587, B 0.114
+	want := []uint8{76, 150, 29}
+	if got := grayscale(img).Pix; string(got) != string(want) {
+		t.Errorf("grayscale = %v, want %v", got, want)
+	}
+}
+
+func TestMedianBlurRemovesSpeck(t *testing.T) {
+	src := grayOf(3,
+		10, 10, 10,
+		10, 250, 10,
+		10, 10, 10,
+	)
+	if got := medianBlur(src, 3).Pix[4]; got != 10 {
+		t.Errorf("centre = %d, want 10", got)
+	}
+}
+
+func TestAdaptiveThresholdMean(t *testing.T) {
+	// A dark line across a flat field is the only thing kept
+	src := grayOf(5,
+		200, 200, 200, 200, 200,
+		200, 200, 200, 200, 200,
+		20, 20, 20, 20, 20,
+		200, 200, 200, 200, 200,
+		200, 200, 200, 200, 200,
+	)
+	out := adaptiveThresholdMean(src, 3, 5)
+	for y := 0; y < 5; y++ {
+		want := uint8(255)
+		if y == 2 {
+			want = 0
+		}
+		for x := 0; x < 5; x++ {
+			if got := out.GrayAt(x, y).Y; got != want {
+				t.Errorf("(%d,%d) = %d, want %d", x, y, got, want)
+			}
+		}
+	}
+}
+
+func TestEqualizeHistStretches(t *testing.T) {
+	out := equalizeHist(grayOf(4, 100, 101, 102, 103))
+	if out.Pix[0] != 0 || out.Pix[3] != 255 {
+		t.Errorf("equalizeHist = %v, want the range stretched to 0..255", out.Pix)
+	}
+}
+
+func TestGaussianBlurFlat(t *testing.T) {
+	src := grayOf(4, 90, 90, 90, 90, 90, 90, 90, 90)
+	for _, v := range gaussianBlur(src, 2).Pix {
+		if v != 90 {
+			t.Fatalf("blurred flat image = %v, want unchanged", v)
+		}
+	}
+}
@@ -0,0 +1,134 @@
+// Package jobs runs slow work (image conversion and the like) outside the
+// request that asked for it. Jobs live in Postgres so they survive restarts
+// and can be picked up by any server instance.
+package jobs
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"time"
+)
+
+// Statuses
+const (
+	Queued    = "queued"
+	Running   = "running"
+	Succeeded = "succeeded"
+	Failed    = "failed"
+	Cancelled = "cancelled"
+)
+
+var (
+	ErrNotFound = errors.New("job not found")
+	// ErrUnknownKind means no task is registered for the job's kind
+	ErrUnknownKind = errors.New("unknown job kind")
+	// ErrTooManyQueued means the user already has the maximum waiting
+	ErrTooManyQueued = errors.New("too many queued jobs")
+)
+
+type Job struct {
+	ID              int64           `json:"id"`
+	UserID          int             `json:"-"`
+	Kind            string          `json:"kind"`
+	Status          string          `json:"status"`
+	Payload         json.RawMessage `json:"-"`
+	Result          json.RawMessage `json:"result,omitempty"`
+	Error           string          `json:"error,omitempty"`
+	Attempts        int             `json:"attempts"`
+	MaxAttempts     int             `json:"maxAttempts"`
+	CancelRequested bool            `json:"cancelRequested,omitempty"`
+	CreatedAt       time.Time       `json:"createdAt"`
+	StartedAt       *time.Time      `json:"startedAt,omitempty"`
+	FinishedAt      *time.Time      `json:"finishedAt,omitempty"`
+	UpdatedAt       time.Time       `json:"updatedAt"`
+}
+
+// Done reports whether the job has reached a final status
+func (j *Job) Done() bool {
+	return j.Status == Succeeded || j.Status == Failed || j.Status == Cancelled
+}
+
+// Task does the work for one kind of job. The result is stored as JSON and
+// returned to the client. ctx is cancelled if the user cancels the job.
+type Task interface {
+	Run(ctx context.Context, job *Job) (interface{}, error)
+}
+
+// Finisher is implemented by tasks that clean up once a job is over for
+// good, whether it succeeded, failed its last attempt or was cancelled.
+type Finisher interface {
+	Finish(ctx context.Context, job *Job)
+}
+
+// permanentError marks failures retrying won't fix
+type permanentError struct{ err error }
+
+func (e permanentError) Error() string { return e.err.Error() }
+func (e permanentError) Unwrap() error { return e.err }
+
+// Permanent wraps err so the job fails without further attempts
+func Permanent(err error) error {
+	return permanentError{err}
+}
+
+// FailedMessage is what the job's owner sees when it fails without a
+// message of its own
+const FailedMessage = "The job failed"
+
+// userError carries a message that is safe to show the job's owner
+type userError struct {
+	message string
+	err     error
+}
+
+func (e userError) Error() string { return e.message + ": " + e.err.Error() }
+func (e userError) Unwrap() error { return e.err }
+
+// Fail wraps err with a message for the job's owner. Job.Error only ever
+// holds such a message or FailedMessage; the cause is logged.
+func Fail(message string, err error) error {
+	return userError{message, err}
+}
+
+// publicMessage is what Job.Error records for a failed attempt
+func publicMessage(err error) string {
+	var e userError
+	if errors.As(err, &e) {
+		return e.message
+	}
+	return FailedMessage
+}
+
+const jobColumns = `id, user_id, kind, status, payload, result, error, attempts, max_attempts,
+	cancel_requested, created_at, started_at, finished_at, updated_at`
+
+type scanner interface {
+	Scan(dest ...interface{}) error
+}
+
+func scanJob(row scanner) (*Job, error) {
+	var job Job
+	var result []byte
+	var errMsg sql.NullString
+	var startedAt, finishedAt sql.NullTime
+
+	err := row.Scan(&job.ID, &job.UserID, &job.Kind, &job.Status, &job.Payload, &result, &errMsg,
+		&job.Attempts, &job.MaxAttempts, &job.CancelRequested, &job.CreatedAt, &startedAt, &finishedAt, &job.UpdatedAt)
+	if err != nil {
+		return nil, err
+	}
+
+	if result != nil {
+		job.Result = result
+	}
+	job.Error = errMsg.String
+	if startedAt.Valid {
+		job.StartedAt = &startedAt.Time
+	}
+	if finishedAt.Valid {
+		job.FinishedAt = &finishedAt.Time
+	}
+	return &job, nil
+}
@@ -0,0 +1,35 @@
+package jobs
+
+import (
+	"errors"
+	"fmt"
+	"testing"
+)
+
+func TestPublicMessage(t *testing.T) {
+	cause := errors.New(`open /var/data/URPaint_Jobs/user_7/abc.png: permission denied`)
+
+	tests := []struct {
+		name string
+		err  error
+		want string
+	}{
+		{"plain", cause, FailedMessage},
+		{"permanent", Permanent(cause), FailedMessage},
+		{"panic", Permanent(fmt.Errorf("panic: %v", "index out of range")), FailedMessage},
+		{"fail", Fail("The upload is no longer available", cause), "The upload is no longer available"},
+		{"permanent fail", Permanent(Fail("The image could not be converted", cause)), "The image could not be converted"},
+		{"wrapped fail", fmt.Errorf("run: %w", Fail("Nope", cause)), "Nope"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := publicMessage(tt.err); got != tt.want {
+				t.Errorf("publicMessage = %q, want %q", got, tt.want)
+			}
+		})
+	}
+
+	if err := Permanent(Fail("Nope", cause)); !errors.Is(err, cause) {
+		t.Error("the cause isn't reachable for logging")
+	}
+}
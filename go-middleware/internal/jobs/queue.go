@@ -0,0 +1,490 @@
+package jobs
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"sync"
+	"time"
+)
+
+// Arbitrary class for pg_advisory_xact_lock(class, user_id), so one user's
+// submissions and claims are checked against their limits one at a time
+const userLockClass = 72_617_004
+
+// Queue stores jobs and runs them on a pool of workers.
+type Queue struct {
+	DB *sql.DB
+	// Workers is how many jobs this process runs at once
+	Workers int
+	// PerUser caps how many of one user's jobs run at once, across instances
+	PerUser int
+	// MaxQueued caps how many jobs of one kind a user may have waiting
+	MaxQueued int
+	// MaxAttempts is how often a failing job is tried before it fails for good
+	MaxAttempts int
+	// PollInterval is how often idle workers look for new jobs
+	PollInterval time.Duration
+	// Lease is how long a claimed job stays ours without a heartbeat
+	Lease time.Duration
+
+	once  sync.Once
+	mu    sync.RWMutex
+	tasks map[string]Task
+	wake  chan struct{}
+}
+
+func (q *Queue) init() {
+	q.once.Do(func() {
+		q.tasks = map[string]Task{}
+		q.wake = make(chan struct{}, 1)
+		if q.Workers <= 0 {
+			q.Workers = 4
+		}
+		if q.PerUser <= 0 {
+			q.PerUser = 2
+		}
+		if q.MaxQueued <= 0 {
+			q.MaxQueued = 20
+		}
+		if q.MaxAttempts <= 0 {
+			q.MaxAttempts = 3
+		}
+		if q.PollInterval <= 0 {
+			q.PollInterval = time.Second
+		}
+		if q.Lease <= 0 {
+			q.Lease = time.Minute
+		}
+	})
+}
+
+// Register makes a kind of job runnable
+func (q *Queue) Register(kind string, task Task) {
+	q.init()
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	q.tasks[kind] = task
+}
+
+func (q *Queue) task(kind string) (Task, bool) {
+	q.mu.RLock()
+	defer q.mu.RUnlock()
+	task, ok := q.tasks[kind]
+	return task, ok
+}
+
+// Submit queues a job for the user. payload is stored as JSON.
+func (q *Queue) Submit(ctx context.Context, userID int, kind string, payload interface{}) (*Job, error) {
+	q.init()
+	if _, ok := q.task(kind); !ok {
+		return nil, ErrUnknownKind
+	}
+
+	data, err := json.Marshal(payload)
+	if err != nil {
+		return nil, err
+	}
+
+	tx, err := q.DB.BeginTx(ctx, nil)
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback()
+
+	// Under the user's lock so a burst can't all pass the count
+	if _, err := tx.ExecContext(ctx, "SELECT pg_advisory_xact_lock($1, $2)", userLockClass, userID); err != nil {
+		return nil, err
+	}
+	var queued int
+	err = tx.QueryRowContext(ctx,
+		"SELECT count(*) FROM jobs WHERE user_id = $1 AND kind = $2 AND status IN ('queued', 'running')",
+		userID, kind,
+	).Scan(&queued)
+	if err != nil {
+		return nil, err
+	}
+	if queued >= q.MaxQueued {
+		return nil, ErrTooManyQueued
+	}
+
+	job, err := scanJob(tx.QueryRowContext(ctx,
+		`INSERT INTO jobs (user_id, kind, payload, max_attempts) VALUES ($1, $2, $3, $4)
+		 RETURNING `+jobColumns,
+		userID, kind, string(data), q.MaxAttempts,
+	))
+	if err != nil {
+		return nil, err
+	}
+	if err := tx.Commit(); err != nil {
+		return nil, err
+	}
+
+	select {
+	case q.wake <- struct{}{}:
+	default:
+	}
+	return job, nil
+}
+
+// Get returns one of the user's jobs
+func (q *Queue) Get(ctx context.Context, id int64, userID int) (*Job, error) {
+	job, err := scanJob(q.DB.QueryRowContext(ctx,
+		"SELECT "+jobColumns+" FROM jobs WHERE id = $1 AND user_id = $2", id, userID,
+	))
+	if errors.Is(err, sql.ErrNoRows) {
+		return nil, ErrNotFound
+	}
+	return job, err
+}
+
+// List returns the user's most recent jobs, newest first
+func (q *Queue) List(ctx context.Context, userID, limit int) ([]*Job, error) {
+	rows, err := q.DB.QueryContext(ctx,
+		"SELECT "+jobColumns+" FROM jobs WHERE user_id = $1 ORDER BY created_at DESC, id DESC LIMIT $2",
+		userID, limit,
+	)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	list := []*Job{}
+	for rows.Next() {
+		job, err := scanJob(rows)
+		if err != nil {
+			return nil, err
+		}
+		list = append(list, job)
+	}
+	return list, rows.Err()
+}
+
+// Cancel stops one of the user's jobs. A queued job is cancelled at once; a
+// running one is flagged and its worker cancels it at the next heartbeat.
+// Cancelling a finished job is a no-op.
+func (q *Queue) Cancel(ctx context.Context, id int64, userID int) (*Job, error) {
+	q.init()
+
+	job, err := scanJob(q.DB.QueryRowContext(ctx,
+		`UPDATE jobs SET
+		     status = CASE WHEN status = 'queued' THEN 'cancelled' ELSE status END,
+		     finished_at = CASE WHEN status = 'queued' THEN now() ELSE finished_at END,
+		     cancel_requested = true,
+		     updated_at = now()
+		 WHERE id = $1 AND user_id = $2 AND status IN ('queued', 'running')
+		 RETURNING `+jobColumns,
+		id, userID,
+	))
+	if errors.Is(err, sql.ErrNoRows) {
+		return q.Get(ctx, id, userID)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	if job.Status == Cancelled {
+		q.finish(job)
+	}
+	return job, nil
+}
+
+// Run works through the queue until ctx is cancelled, then waits for the
+// jobs in flight. Jobs interrupted by shutdown go back on the queue.
+func (q *Queue) Run(ctx context.Context) {
+	q.init()
+
+	var wg sync.WaitGroup
+	for i := 0; i < q.Workers; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			q.work(ctx)
+		}()
+	}
+	wg.Wait()
+}
+
+func (q *Queue) work(ctx context.Context) {
+	ticker := time.NewTicker(q.PollInterval)
+	defer ticker.Stop()
+
+	for {
+		job, err := q.claim(ctx)
+		if err != nil && ctx.Err() == nil {
+			slog.ErrorContext(ctx, "job claim failed", "err", err)
+		}
+
+		if job != nil {
+			q.execute(ctx, job)
+			continue
+		}
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-q.wake:
+		case <-ticker.C:
+		}
+	}
+}
+
+// claim takes the oldest runnable job whose owner is under their
+// concurrency limit. Jobs whose lease ran out (a worker died) are put back
+// first.
+func (q *Queue) claim(ctx context.Context) (*Job, error) {
+	if err := q.reclaim(ctx); err != nil {
+		return nil, err
+	}
+
+	tx, err := q.DB.BeginTx(ctx, nil)
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback()
+
+	var id int64
+	var userID int
+	err = tx.QueryRowContext(ctx,
+		`SELECT j.id, j.user_id FROM jobs j
+		 WHERE j.status = 'queued' AND j.run_after <= now() AND NOT j.cancel_requested
+		   AND (SELECT count(*) FROM jobs r WHERE r.user_id = j.user_id AND r.status = 'running') < $1
+		 ORDER BY j.run_after, j.id
+		 FOR UPDATE SKIP LOCKED
+		 LIMIT 1`,
+		q.PerUser,
+	).Scan(&id, &userID)
+	if errors.Is(err, sql.ErrNoRows) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	// Workers claiming for the same user take turns, and the count is
+	// taken again under the lock, so they can't both start a job the
+	// limit only has room for once
+	if _, err := tx.ExecContext(ctx, "SELECT pg_advisory_xact_lock($1, $2)", userLockClass, userID); err != nil {
+		return nil, err
+	}
+	var running int
+	err = tx.QueryRowContext(ctx,
+		"SELECT count(*) FROM jobs WHERE user_id = $1 AND status = 'running'", userID,
+	).Scan(&running)
+	if err != nil {
+		return nil, err
+	}
+	if running >= q.PerUser {
+		return nil, nil
+	}
+
+	job, err := scanJob(tx.QueryRowContext(ctx,
+		`UPDATE jobs SET status = 'running', attempts = attempts + 1, started_at = now(),
+		     locked_until = now() + $2::bigint * interval '1 millisecond', updated_at = now()
+		 WHERE id = $1
+		 RETURNING `+jobColumns,
+		id, q.Lease.Milliseconds(),
+	))
+	if err != nil {
+		return nil, err
+	}
+	if err := tx.Commit(); err != nil {
+		return nil, err
+	}
+	return job, nil
+}
+
+// reclaim requeues jobs whose worker stopped heartbeating, or fails them
+// if that was their last attempt. Jobs cancelled meanwhile stay cancelled.
+func (q *Queue) reclaim(ctx context.Context) error {
+	rows, err := q.DB.QueryContext(ctx,
+		`UPDATE jobs SET
+		     status = CASE WHEN cancel_requested THEN 'cancelled'
+		                   WHEN attempts >= max_attempts THEN 'failed' ELSE 'queued' END,
+		     error = CASE WHEN cancel_requested THEN 'cancelled'
+		                  WHEN attempts >= max_attempts THEN 'worker stopped responding' ELSE error END,
+		     finished_at = CASE WHEN cancel_requested OR attempts >= max_attempts THEN now() ELSE finished_at END,
+		     run_after = now(), locked_until = NULL, updated_at = now()
+		 WHERE status = 'running' AND locked_until < now()
+		 RETURNING `+jobColumns,
+	)
+	if err != nil {
+		return err
+	}
+
+	var over []*Job
+	for rows.Next() {
+		job, err := scanJob(rows)
+		if err != nil {
+			rows.Close()
+			return err
+		}
+		if job.Status == Failed || job.Status == Cancelled {
+			over = append(over, job)
+		}
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return err
+	}
+
+	for _, job := range over {
+		q.finish(job)
+	}
+	return nil
+}
+
+func (q *Queue) execute(ctx context.Context, job *Job) {
+	jobCtx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	// Keep the lease alive and watch for cancellation
+	stop := make(chan struct{})
+	var cancelled bool
+	var heartbeat sync.WaitGroup
+	heartbeat.Add(1)
+	go func() {
+		defer heartbeat.Done()
+		ticker := time.NewTicker(q.Lease / 3)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-stop:
+				return
+			case <-ticker.C:
+				var requested bool
+				err := q.DB.QueryRowContext(ctx,
+					`UPDATE jobs SET locked_until = now() + $2::bigint * interval '1 millisecond'
+					 WHERE id = $1 RETURNING cancel_requested`,
+					job.ID, q.Lease.Milliseconds(),
+				).Scan(&requested)
+				if err != nil {
+					if ctx.Err() == nil {
+						slog.WarnContext(ctx, "job heartbeat failed", "job_id", job.ID, "err", err)
+					}
+					continue
+				}
+				if requested {
+					cancelled = true
+					cancel()
+					return
+				}
+			}
+		}
+	}()
+
+	result, runErr := q.run(jobCtx, job)
+	close(stop)
+	heartbeat.Wait()
+
+	// Recording the outcome must not be cut short by shutdown
+	saveCtx, done := context.WithTimeout(context.Background(), 10*time.Second)
+	defer done()
+
+	var err error
+	switch {
+	case cancelled:
+		err = q.complete(saveCtx, job, Cancelled, nil, "cancelled")
+	case ctx.Err() != nil:
+		// Shutting down: hand the job back without spending an attempt
+		err = q.requeue(saveCtx, job, true, "", 0)
+	case runErr == nil:
+		err = q.complete(saveCtx, job, Succeeded, result, "")
+	case errors.As(runErr, new(permanentError)) || job.Attempts >= job.MaxAttempts:
+		err = q.complete(saveCtx, job, Failed, nil, publicMessage(runErr))
+	default:
+		// Back off 5s, 20s, 45s...
+		backoff := time.Duration(job.Attempts*job.Attempts) * 5 * time.Second
+		err = q.requeue(saveCtx, job, false, publicMessage(runErr), backoff)
+	}
+	if err != nil {
+		slog.ErrorContext(ctx, "job status update failed", "job_id", job.ID, "err", err)
+	}
+	if runErr != nil && !cancelled && ctx.Err() == nil {
+		slog.WarnContext(ctx, "job attempt failed", "job_id", job.ID, "kind", job.Kind, "attempt", job.Attempts, "err", runErr)
+	}
+}
+
+// requeue puts a job back on the queue after delay, optionally giving back
+// the attempt, and records errMsg if there is one. A job whose cancel came
+// in after the last heartbeat is finished as cancelled instead.
+func (q *Queue) requeue(ctx context.Context, job *Job, refund bool, errMsg string, delay time.Duration) error {
+	var status string
+	err := q.DB.QueryRowContext(ctx,
+		`UPDATE jobs SET
+		     status = CASE WHEN cancel_requested THEN 'cancelled' ELSE 'queued' END,
+		     attempts = CASE WHEN $2 AND NOT cancel_requested THEN attempts - 1 ELSE attempts END,
+		     error = CASE WHEN cancel_requested THEN 'cancelled' ELSE COALESCE(NULLIF($3::text, ''), error) END,
+		     finished_at = CASE WHEN cancel_requested THEN now() ELSE finished_at END,
+		     run_after = now() + $4::bigint * interval '1 millisecond',
+		     locked_until = NULL, updated_at = now()
+		 WHERE id = $1
+		 RETURNING status`,
+		job.ID, refund, errMsg, delay.Milliseconds(),
+	).Scan(&status)
+	if err != nil {
+		return err
+	}
+
+	if status == Cancelled {
+		job.Status = status
+		q.finish(job)
+	}
+	return nil
+}
+
+// run calls the task, turning a panic into a permanent failure
+func (q *Queue) run(ctx context.Context, job *Job) (result interface{}, err error) {
+	task, ok := q.task(job.Kind)
+	if !ok {
+		return nil, Permanent(ErrUnknownKind)
+	}
+
+	defer func() {
+		if p := recover(); p != nil {
+			err = Permanent(fmt.Errorf("panic: %v", p))
+		}
+	}()
+	return task.Run(ctx, job)
+}
+
+func (q *Queue) complete(ctx context.Context, job *Job, status string, result interface{}, errMsg string) error {
+	var data interface{}
+	if result != nil {
+		encoded, err := json.Marshal(result)
+		if err != nil {
+			return err
+		}
+		data = string(encoded)
+	}
+
+	_, err := q.DB.ExecContext(ctx,
+		`UPDATE jobs SET status = $2, result = $3, error = NULLIF($4, ''), finished_at = now(),
+		     locked_until = NULL, updated_at = now()
+		 WHERE id = $1`,
+		job.ID, status, data, errMsg,
+	)
+	if err != nil {
+		return err
+	}
+
+	job.Status = status
+	q.finish(job)
+	return nil
+}
+
+// finish lets the task clean up after a job that is over for good
+func (q *Queue) finish(job *Job) {
+	task, ok := q.task(job.Kind)
+	if !ok {
+		return
+	}
+	if f, ok := task.(Finisher); ok {
+		ctx, cancel := context.WithTimeout(context.Background(), time.Minute)
+		defer cancel()
+		f.Finish(ctx, job)
+	}
+}
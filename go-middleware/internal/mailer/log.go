@@ -0,0 +1,40 @@
+package mailer
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"regexp"
+	"time"
+)
+
+// Log is the development mailer. Messages go to the server log with their
+// tokens redacted, and are written in full to Dir as .eml files when it
+// is set.
+type Log struct {
+	Dir string
+}
+
+// Verification and reset links carry their token as a query parameter
+var tokenParam = regexp.MustCompile(`(token=)[^\s&]+`)
+
+func redact(body string) string {
+	return tokenParam.ReplaceAllString(body, "${1}[redacted]")
+}
+
+func (l *Log) Send(ctx context.Context, msg Message) error {
+	slog.InfoContext(ctx, "mail", "to", msg.To, "subject", msg.Subject, "body", redact(msg.Body))
+
+	if l.Dir == "" {
+		return nil
+	}
+	if err := os.MkdirAll(l.Dir, 0o755); err != nil {
+		return err
+	}
+
+	name := fmt.Sprintf("%d.eml", time.Now().UnixNano())
+	content := fmt.Sprintf("To: %s\nSubject: %s\n\n%s\n", msg.To, msg.Subject, msg.Body)
+	return os.WriteFile(filepath.Join(l.Dir, name), []byte(content), 0o644)
+}
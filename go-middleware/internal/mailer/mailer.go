@@ -0,0 +1,14 @@
+package mailer
+
+import "context"
+
+type Message struct {
+	To      string
+	Subject string
+	Body    string
+}
+
+// Mailer delivers plain-text emails such as verification and reset links.
+type Mailer interface {
+	Send(ctx context.Context, msg Message) error
+}
@@ -0,0 +1,100 @@
+// Package metrics holds the server's Prometheus collectors and the
+// /metrics handler that exposes them.
+package metrics
+
+import (
+	"database/sql"
+	"net/http"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/collectors"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+)
+
+const namespace = "urpaint"
+
+// Registry has only our collectors plus the Go and process ones, not
+// whatever a dependency registers globally
+var Registry = prometheus.NewRegistry()
+
+var (
+	// HTTPDuration is labelled with the mux pattern, never the raw path,
+	// so IDs in URLs don't explode the series count
+	HTTPDuration = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: namespace,
+		Subsystem: "http",
+		Name:      "request_duration_seconds",
+		Help:      "HTTP request latency by route, method and status.",
+		Buckets:   []float64{.005, .01, .025, .05, .1, .25, .5, 1, 2.5, 5, 10, 30},
+	}, []string{"route", "method", "status"})
+
+	HTTPInFlight = prometheus.NewGauge(prometheus.GaugeOpts{
+		Namespace: namespace,
+		Subsystem: "http",
+		Name:      "requests_in_flight",
+		Help:      "Requests currently being served, open sockets and streams included.",
+	})
+
+	StorageDuration = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: namespace,
+		Subsystem: "storage",
+		Name:      "operation_duration_seconds",
+		Help:      "Storage backend call latency by operation.",
+		Buckets:   []float64{.01, .025, .05, .1, .25, .5, 1, 2.5, 5, 10, 30},
+	}, []string{"backend", "operation"})
+
+	StorageFailures = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Subsystem: "storage",
+		Name:      "operation_failures_total",
+		Help:      "Storage backend calls that failed, not counting missing objects.",
+	}, []string{"backend", "operation"})
+
+	// AuthFailures reasons: missing, invalid, revoked, error
+	AuthFailures = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Subsystem: "auth",
+		Name:      "failures_total",
+		Help:      "Rejected JWTs by reason.",
+	}, []string{"reason"})
+
+	// UploadBytes counts what is stored, after metadata is stripped
+	UploadBytes = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Subsystem: "uploads",
+		Name:      "bytes_total",
+		Help:      "Bytes of image uploads that passed validation, by form field.",
+	}, []string{"field"})
+
+	UploadsRejected = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Subsystem: "uploads",
+		Name:      "rejected_total",
+		Help:      "Image uploads refused by validation, by error code.",
+	}, []string{"field", "code"})
+)
+
+func init() {
+	Registry.MustRegister(
+		collectors.NewGoCollector(),
+		collectors.NewProcessCollector(collectors.ProcessCollectorOpts{}),
+		HTTPDuration,
+		HTTPInFlight,
+		StorageDuration,
+		StorageFailures,
+		AuthFailures,
+		UploadBytes,
+		UploadsRejected,
+	)
+}
+
+// RegisterDB exposes the pool stats from db.Stats(): open, idle and in-use
+// connections, waits and closes
+func RegisterDB(db *sql.DB, name string) {
+	Registry.MustRegister(collectors.NewDBStatsCollector(db, name))
+}
+
+// Handler serves every metric in Registry
+func Handler() http.Handler {
+	return promhttp.HandlerFor(Registry, promhttp.HandlerOpts{Registry: Registry})
+}
@@ -0,0 +1,70 @@
+package metrics
+
+import (
+	"context"
+	"errors"
+	"io"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+
+	"urpaint/internal/storage"
+)
+
+// instrumented times every call that goes to the backend. PublicURL and
+// KeyFromURL only build strings and pass straight through.
+type instrumented struct {
+	storage.Storage
+	backend string
+}
+
+// Storage wraps s so each backend call is timed and failures counted
+// under backend
+func Storage(s storage.Storage, backend string) storage.Storage {
+	return &instrumented{Storage: s, backend: backend}
+}
+
+func (s *instrumented) observe(operation string, start time.Time, err error) {
+	labels := prometheus.Labels{"backend": s.backend, "operation": operation}
+	StorageDuration.With(labels).Observe(time.Since(start).Seconds())
+	if err != nil && !errors.Is(err, storage.ErrNotFound) {
+		StorageFailures.With(labels).Inc()
+	}
+}
+
+func (s *instrumented) Put(ctx context.Context, folder string, r io.Reader) (obj storage.Object, err error) {
+	start := time.Now()
+	defer func() { s.observe("put", start, err) }()
+	return s.Storage.Put(ctx, folder, r)
+}
+
+func (s *instrumented) Overwrite(ctx context.Context, key string, r io.Reader) (obj storage.Object, err error) {
+	start := time.Now()
+	defer func() { s.observe("overwrite", start, err) }()
+	return s.Storage.Overwrite(ctx, key, r)
+}
+
+// Open is timed until the object is open, not while it's read
+func (s *instrumented) Open(ctx context.Context, key string) (rc io.ReadCloser, err error) {
+	start := time.Now()
+	defer func() { s.observe("open", start, err) }()
+	return s.Storage.Open(ctx, key)
+}
+
+// Ping is passed through when the backend has one, so wrapping doesn't
+// hide it from readiness checks
+func (s *instrumented) Ping(ctx context.Context) (err error) {
+	pinger, ok := s.Storage.(storage.Pinger)
+	if !ok {
+		return nil
+	}
+	start := time.Now()
+	defer func() { s.observe("ping", start, err) }()
+	return pinger.Ping(ctx)
+}
+
+func (s *instrumented) Delete(ctx context.Context, key string) (err error) {
+	start := time.Now()
+	defer func() { s.observe("delete", start, err) }()
+	return s.Storage.Delete(ctx, key)
+}
@@ -0,0 +1,15 @@
+package middleware
+
+import (
+    "net/http"
+)
+
+// Deprecated serves an old route unchanged but tells clients where it
+// moved, with a Deprecation header and a successor-version Link
+func Deprecated(successor string, next http.Handler) http.Handler {
+    return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+        w.Header().Set("Deprecation", "true")
+        w.Header().Set("Link", "<"+successor+`>; rel="successor-version"`)
+        next.ServeHTTP(w, r)
+    })
+}
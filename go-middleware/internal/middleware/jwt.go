@@ -2,37 +2,86 @@ package middleware
 
 import (
     "context"
+    "errors"
     "net/http"
     "strings"
 
     "github.com/golang-jwt/jwt/v5"
+
+    "urpaint/internal/httperr"
+    "urpaint/internal/metrics"
+)
+
+var (
+    ErrInvalidToken = errors.New("invalid token")
+    ErrTokenRevoked = errors.New("token revoked")
 )
 
-func JWTAuth(secret []byte, next http.Handler) http.Handler {
+// Revoker reports whether a correctly signed token was revoked server-side
+type Revoker interface {
+    Revoked(ctx context.Context, claims jwt.MapClaims) (bool, error)
+}
+
+// Authenticate checks a raw token exactly like JWTAuth does. Other errors
+// mean the revocation check itself failed. Every failure is counted in
+// metrics.AuthFailures.
+func Authenticate(ctx context.Context, secret []byte, revoker Revoker, tokenString string) (jwt.MapClaims, error) {
+    token, err := jwt.Parse(tokenString, func(token *jwt.Token) (interface{}, error) {
+        return secret, nil
+    }, jwt.WithValidMethods([]string{"HS256"}))
+    if err != nil || !token.Valid {
+        metrics.AuthFailures.WithLabelValues("invalid").Inc()
+        return nil, ErrInvalidToken
+    }
+
+    claims, ok := token.Claims.(jwt.MapClaims)
+    if !ok {
+        metrics.AuthFailures.WithLabelValues("invalid").Inc()
+        return nil, ErrInvalidToken
+    }
+
+    if revoker != nil {
+        revoked, err := revoker.Revoked(ctx, claims)
+        if err != nil {
+            metrics.AuthFailures.WithLabelValues("error").Inc()
+            return nil, err
+        }
+        if revoked {
+            metrics.AuthFailures.WithLabelValues("revoked").Inc()
+            return nil, ErrTokenRevoked
+        }
+    }
+
+    return claims, nil
+}
+
+func JWTAuth(secret []byte, revoker Revoker, next http.Handler) http.Handler {
     return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
         authHeader := r.Header.Get("Authorization")
         if authHeader == "" {
-            http.Error(w, "Missing Authorization header", http.StatusUnauthorized)
+            metrics.AuthFailures.WithLabelValues("missing").Inc()
+            httperr.Write(w, r, httperr.New(http.StatusUnauthorized, "Missing Authorization header").WithCode("missing_token"))
             return
         }
 
         tokenString := strings.TrimPrefix(authHeader, "Bearer ")
         tokenString = strings.TrimSpace(tokenString)
-        token, err := jwt.Parse(tokenString, func(token *jwt.Token) (interface{}, error) {
-            return secret, nil
-        }, jwt.WithValidMethods([]string{"HS256"}))
-        if err != nil || !token.Valid {
-            http.Error(w, "Invalid token", http.StatusUnauthorized)
-            return
-        }
 
-        claims, ok := token.Claims.(jwt.MapClaims)
-        if !ok {
-            http.Error(w, "Invalid token claims", http.StatusUnauthorized)
+        claims, err := Authenticate(r.Context(), secret, revoker, tokenString)
+        switch {
+        case err == ErrInvalidToken:
+            httperr.Write(w, r, httperr.New(http.StatusUnauthorized, "Invalid token").WithCode("invalid_token"))
+            return
+        case err == ErrTokenRevoked:
+            httperr.Write(w, r, httperr.New(http.StatusUnauthorized, "Token revoked").WithCode("token_revoked"))
+            return
+        case err != nil:
+            httperr.Write(w, r, httperr.Internal("Could not validate token", err))
             return
         }
 
+        setUser(r.Context(), claims)
         ctx := context.WithValue(r.Context(), "claims", claims)
         next.ServeHTTP(w, r.WithContext(ctx))
     })
-}
\ No newline at end of file
+}
@@ -0,0 +1,250 @@
+package middleware
+
+import (
+    "bufio"
+    "context"
+    "crypto/rand"
+    "encoding/hex"
+    "errors"
+    "fmt"
+    "log/slog"
+    "net"
+    "net/http"
+    "runtime/debug"
+    "time"
+
+    "github.com/golang-jwt/jwt/v5"
+
+    "urpaint/internal/httperr"
+)
+
+type requestInfoKey struct{}
+
+// requestInfo follows a request down the chain. Handlers further in get
+// derived requests, so it's a pointer they fill rather than a value.
+type requestInfo struct {
+    id     string
+    userID int
+}
+
+func infoFrom(ctx context.Context) *requestInfo {
+    info, _ := ctx.Value(requestInfoKey{}).(*requestInfo)
+    return info
+}
+
+// setUser records who a request is from once JWTAuth has checked the token
+func setUser(ctx context.Context, claims jwt.MapClaims) {
+    info := infoFrom(ctx)
+    if info == nil {
+        return
+    }
+    if id, ok := claims["id"].(float64); ok {
+        info.userID = int(id)
+    }
+}
+
+// RequestIDFromContext is the ID RequestID gave the request, or ""
+func RequestIDFromContext(ctx context.Context) string {
+    if info := infoFrom(ctx); info != nil {
+        return info.id
+    }
+    return ""
+}
+
+// validRequestID accepts a caller's ID only when it's short and plain
+// enough to put in logs as is
+func validRequestID(id string) bool {
+    if id == "" || len(id) > 128 {
+        return false
+    }
+    for _, c := range id {
+        switch {
+        case c >= 'a' && c <= 'z', c >= 'A' && c <= 'Z', c >= '0' && c <= '9':
+        case c == '-', c == '_', c == '.', c == ':':
+        default:
+            return false
+        }
+    }
+    return true
+}
+
+func newRequestID() string {
+    b := make([]byte, 16)
+    rand.Read(b)
+    return hex.EncodeToString(b)
+}
+
+// RequestID keeps the caller's X-Request-ID or assigns one, and sends it
+// back. It goes outermost so everything after it, error bodies included,
+// sees the same ID.
+func RequestID(next http.Handler) http.Handler {
+    return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+        id := r.Header.Get("X-Request-ID")
+        if !validRequestID(id) {
+            id = newRequestID()
+        }
+        r = r.WithContext(context.WithValue(r.Context(), requestInfoKey{}, &requestInfo{id: id}))
+        r.Header.Set("X-Request-ID", id)
+        w.Header().Set("X-Request-ID", id)
+        next.ServeHTTP(w, r)
+    })
+}
+
+// responseRecorder notes the status and size of a response. It passes
+// Flush and Hijack through so event streams and sockets still work.
+type responseRecorder struct {
+    http.ResponseWriter
+    status int
+    bytes  int64
+}
+
+// record reuses the recorder further out in the chain, if there is one
+func record(w http.ResponseWriter) *responseRecorder {
+    if rec, ok := w.(*responseRecorder); ok {
+        return rec
+    }
+    return &responseRecorder{ResponseWriter: w}
+}
+
+func (rec *responseRecorder) WriteHeader(status int) {
+    if rec.status == 0 {
+        rec.status = status
+    }
+    rec.ResponseWriter.WriteHeader(status)
+}
+
+func (rec *responseRecorder) Write(b []byte) (int, error) {
+    if rec.status == 0 {
+        rec.status = http.StatusOK
+    }
+    n, err := rec.ResponseWriter.Write(b)
+    rec.bytes += int64(n)
+    return n, err
+}
+
+func (rec *responseRecorder) Flush() {
+    if rec.status == 0 {
+        rec.status = http.StatusOK
+    }
+    if f, ok := rec.ResponseWriter.(http.Flusher); ok {
+        f.Flush()
+    }
+}
+
+func (rec *responseRecorder) Hijack() (net.Conn, *bufio.ReadWriter, error) {
+    h, ok := rec.ResponseWriter.(http.Hijacker)
+    if !ok {
+        return nil, nil, errors.New("response does not support hijacking")
+    }
+    conn, rw, err := h.Hijack()
+    if err == nil && rec.status == 0 {
+        rec.status = http.StatusSwitchingProtocols
+    }
+    return conn, rw, err
+}
+
+// Unwrap lets http.ResponseController reach the real writer
+func (rec *responseRecorder) Unwrap() http.ResponseWriter {
+    return rec.ResponseWriter
+}
+
+// Logger writes one log line per request once it's done: method, route
+// pattern, status, latency, bytes written, request ID and user.
+func Logger(logger *slog.Logger, next http.Handler) http.Handler {
+    return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+        start := time.Now()
+        rec := record(w)
+
+        next.ServeHTTP(rec, r)
+
+        status := rec.status
+        if status == 0 {
+            status = http.StatusOK
+        }
+        level := slog.LevelInfo
+        if status >= 500 {
+            level = slog.LevelError
+        }
+
+        attrs := []slog.Attr{
+            slog.String("method", r.Method),
+            // Set by the mux on this same request; empty when nothing matched
+            slog.String("route", r.Pattern),
+            slog.String("path", r.URL.Path),
+            slog.Int("status", status),
+            slog.Float64("latency_ms", float64(time.Since(start).Microseconds())/1000),
+            slog.Int64("bytes", rec.bytes),
+        }
+        attrs = append(attrs, infoAttrs(r.Context())...)
+        // The attrs are explicit so any logger gets them; no context keeps
+        // LogHandler from adding them twice
+        logger.LogAttrs(context.Background(), level, "request", attrs...)
+    })
+}
+
+// Recover turns a panic in a handler into a logged 500 instead of a
+// dropped connection. If the response had already started, all it can
+// do is log.
+func Recover(logger *slog.Logger, next http.Handler) http.Handler {
+    return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+        rec := record(w)
+        defer func() {
+            v := recover()
+            if v == nil {
+                return
+            }
+            // The server's own signal to abort a response quietly
+            if v == http.ErrAbortHandler {
+                panic(v)
+            }
+
+            attrs := []slog.Attr{
+                slog.String("method", r.Method),
+                slog.String("path", r.URL.Path),
+                slog.Any("panic", v),
+                slog.String("stack", string(debug.Stack())),
+            }
+            logger.LogAttrs(context.Background(), slog.LevelError, "panic", append(attrs, infoAttrs(r.Context())...)...)
+            if rec.status == 0 {
+                httperr.Write(rec, r, httperr.Internal("Something went wrong", fmt.Errorf("panic: %v", v)))
+            }
+        }()
+        next.ServeHTTP(rec, r)
+    })
+}
+
+// LogHandler adds the request ID and user to anything logged with a
+// request's context, so handler logs line up with the request log
+func LogHandler(h slog.Handler) slog.Handler {
+    return contextHandler{h}
+}
+
+type contextHandler struct {
+    slog.Handler
+}
+
+func (h contextHandler) Handle(ctx context.Context, record slog.Record) error {
+    record.AddAttrs(infoAttrs(ctx)...)
+    return h.Handler.Handle(ctx, record)
+}
+
+// infoAttrs are the request ID and user for a request's context
+func infoAttrs(ctx context.Context) []slog.Attr {
+    info := infoFrom(ctx)
+    if info == nil {
+        return nil
+    }
+    attrs := []slog.Attr{slog.String("request_id", info.id)}
+    if info.userID != 0 {
+        attrs = append(attrs, slog.Int("user_id", info.userID))
+    }
+    return attrs
+}
+
+func (h contextHandler) WithAttrs(attrs []slog.Attr) slog.Handler {
+    return contextHandler{h.Handler.WithAttrs(attrs)}
+}
+
+func (h contextHandler) WithGroup(name string) slog.Handler {
+    return contextHandler{h.Handler.WithGroup(name)}
+}
@@ -0,0 +1,33 @@
+package middleware
+
+import (
+    "net/http"
+    "strconv"
+    "time"
+
+    "urpaint/internal/metrics"
+)
+
+// Metrics times each request by route, method and status. Sockets are
+// timed until they close and show up under status 101.
+func Metrics(next http.Handler) http.Handler {
+    return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+        start := time.Now()
+        rec := record(w)
+        metrics.HTTPInFlight.Inc()
+        defer metrics.HTTPInFlight.Dec()
+
+        next.ServeHTTP(rec, r)
+
+        status := rec.status
+        if status == 0 {
+            status = http.StatusOK
+        }
+        route := r.Pattern
+        if route == "" {
+            route = "unmatched"
+        }
+        metrics.HTTPDuration.WithLabelValues(route, r.Method, strconv.Itoa(status)).
+            Observe(time.Since(start).Seconds())
+    })
+}
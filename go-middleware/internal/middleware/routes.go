@@ -0,0 +1,56 @@
+package middleware
+
+import (
+    "net/http"
+
+    "urpaint/internal/httperr"
+)
+
+// Routes serves mux, but answers requests no route matches with the same
+// JSON error envelope as everything else instead of the mux's plain text.
+// A 405 keeps the Allow header the mux set; redirects pass through.
+func Routes(mux *http.ServeMux) http.Handler {
+    return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+        if _, pattern := mux.Handler(r); pattern != "" {
+            mux.ServeHTTP(w, r)
+            return
+        }
+
+        u := &unmatched{ResponseWriter: w}
+        mux.ServeHTTP(u, r)
+        switch u.status {
+        case http.StatusNotFound:
+            httperr.Write(w, r, httperr.New(http.StatusNotFound, "Not found"))
+        case http.StatusMethodNotAllowed:
+            httperr.Write(w, r, httperr.New(http.StatusMethodNotAllowed, "Method not allowed"))
+        }
+    })
+}
+
+// unmatched holds back the mux's own 404 and 405 so Routes can answer in
+// their place. Any other response is written through.
+type unmatched struct {
+    http.ResponseWriter
+    status int
+}
+
+func (u *unmatched) WriteHeader(status int) {
+    u.status = status
+    if !u.replaced() {
+        u.ResponseWriter.WriteHeader(status)
+    }
+}
+
+func (u *unmatched) Write(b []byte) (int, error) {
+    if u.status == 0 {
+        u.WriteHeader(http.StatusOK)
+    }
+    if u.replaced() {
+        return len(b), nil
+    }
+    return u.ResponseWriter.Write(b)
+}
+
+func (u *unmatched) replaced() bool {
+    return u.status == http.StatusNotFound || u.status == http.StatusMethodNotAllowed
+}
@@ -0,0 +1,76 @@
+package middleware
+
+import (
+    "encoding/json"
+    "net/http"
+    "net/http/httptest"
+    "testing"
+)
+
+func TestRoutes(t *testing.T) {
+    mux := http.NewServeMux()
+    mux.HandleFunc("GET /drawings/{id}", func(w http.ResponseWriter, r *http.Request) {
+        w.Write([]byte("drawing " + r.PathValue("id")))
+    })
+    mux.HandleFunc("DELETE /drawings/{id}", func(w http.ResponseWriter, r *http.Request) {
+        w.WriteHeader(http.StatusNoContent)
+    })
+    mux.HandleFunc("GET /files/", func(w http.ResponseWriter, r *http.Request) {})
+    // A handler's own 404 is left alone
+    mux.HandleFunc("GET /missing", func(w http.ResponseWriter, r *http.Request) {
+        http.NotFound(w, r)
+    })
+    h := Routes(mux)
+
+    tests := []struct {
+        name   string
+        method string
+        path   string
+        status int
+        code   string
+        allow  string
+    }{
+        {"matched", http.MethodGet, "/drawings/7", http.StatusOK, "", ""},
+        {"no route", http.MethodGet, "/nowhere", http.StatusNotFound, "not_found", ""},
+        {"wrong method", http.MethodPost, "/drawings/7", http.StatusMethodNotAllowed, "method_not_allowed", "DELETE, GET, HEAD"},
+        {"redirect", http.MethodGet, "/files", http.StatusTemporaryRedirect, "", ""},
+        {"handler 404", http.MethodGet, "/missing", http.StatusNotFound, "", ""},
+    }
+    for _, tt := range tests {
+        t.Run(tt.name, func(t *testing.T) {
+            w := httptest.NewRecorder()
+            h.ServeHTTP(w, httptest.NewRequest(tt.method, tt.path, nil))
+
+            if w.Code != tt.status {
+                t.Fatalf("status = %d, want %d", w.Code, tt.status)
+            }
+            if allow := w.Header().Get("Allow"); allow != tt.allow {
+                t.Errorf("Allow = %q, want %q", allow, tt.allow)
+            }
+            if tt.code == "" {
+                if ct := w.Header().Get("Content-Type"); ct == "application/json" {
+                    t.Errorf("unexpected JSON body %q", w.Body)
+                }
+                return
+            }
+
+            var env struct {
+                Error struct {
+                    Code string `json:"code"`
+                } `json:"error"`
+            }
+            if err := json.Unmarshal(w.Body.Bytes(), &env); err != nil {
+                t.Fatalf("body %q: %v", w.Body, err)
+            }
+            if env.Error.Code != tt.code {
+                t.Errorf("code = %q, want %q", env.Error.Code, tt.code)
+            }
+        })
+    }
+
+    w := httptest.NewRecorder()
+    h.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/drawings/7", nil))
+    if w.Body.String() != "drawing 7" {
+        t.Errorf("matched body = %q", w.Body)
+    }
+}
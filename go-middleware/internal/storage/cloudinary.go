@@ -0,0 +1,160 @@
+package storage
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strings"
+
+	"github.com/cloudinary/cloudinary-go/v2"
+	"github.com/cloudinary/cloudinary-go/v2/api/uploader"
+)
+
+// Cloudinary stores images in a Cloudinary account.
+type Cloudinary struct {
+	cld *cloudinary.Cloudinary
+}
+
+func NewCloudinary(cloudinaryURL string) (*Cloudinary, error) {
+	cld, err := cloudinary.NewFromURL(cloudinaryURL)
+	if err != nil {
+		return nil, err
+	}
+	cld.Config.URL.Secure = true
+
+	return &Cloudinary{cld: cld}, nil
+}
+
+// Ping calls the Admin API's ping endpoint, which also checks the
+// credentials.
+func (c *Cloudinary) Ping(ctx context.Context) error {
+	res, err := c.cld.Admin.Ping(ctx)
+	if err != nil {
+		return err
+	}
+	if res.Error.Message != "" {
+		return errors.New("cloudinary: " + res.Error.Message)
+	}
+	return nil
+}
+
+func (c *Cloudinary) Put(ctx context.Context, folder string, r io.Reader) (Object, error) {
+	return c.upload(ctx, r, uploader.UploadParams{
+		Folder:       folder,
+		ResourceType: "image",
+	})
+}
+
+func (c *Cloudinary) Overwrite(ctx context.Context, key string, r io.Reader) (Object, error) {
+	overwrite := true
+	return c.upload(ctx, r, uploader.UploadParams{
+		PublicID:     key,
+		Overwrite:    &overwrite,
+		ResourceType: "image",
+	})
+}
+
+func (c *Cloudinary) upload(ctx context.Context, r io.Reader, params uploader.UploadParams) (Object, error) {
+	res, err := c.cld.Upload.Upload(ctx, r, params)
+	if err != nil {
+		return Object{}, err
+	}
+	if res.Error.Message != "" {
+		return Object{}, errors.New(res.Error.Message)
+	}
+
+	return Object{Key: res.PublicID, URL: res.SecureURL, Bytes: int64(res.Bytes)}, nil
+}
+
+// Open downloads the image from its delivery URL.
+func (c *Cloudinary) Open(ctx context.Context, key string) (io.ReadCloser, error) {
+	publicURL := c.PublicURL(key)
+	if publicURL == "" {
+		return nil, fmt.Errorf("invalid storage key %q", key)
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, publicURL, nil)
+	if err != nil {
+		return nil, err
+	}
+	res, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return nil, err
+	}
+
+	switch {
+	case res.StatusCode == http.StatusNotFound:
+		res.Body.Close()
+		return nil, ErrNotFound
+	case res.StatusCode != http.StatusOK:
+		res.Body.Close()
+		return nil, fmt.Errorf("cloudinary: fetching %s: %s", key, res.Status)
+	}
+	return res.Body, nil
+}
+
+func (c *Cloudinary) Delete(ctx context.Context, key string) error {
+	res, err := c.cld.Upload.Destroy(ctx, uploader.DestroyParams{
+		PublicID:     key,
+		ResourceType: "image",
+	})
+	if err != nil {
+		return err
+	}
+	if res.Error.Message != "" {
+		return errors.New(res.Error.Message)
+	}
+	if res.Result == "not found" {
+		return ErrNotFound
+	}
+	return nil
+}
+
+func (c *Cloudinary) PublicURL(key string) string {
+	img, err := c.cld.Image(key)
+	if err != nil {
+		return ""
+	}
+	publicURL, err := img.String()
+	if err != nil {
+		return ""
+	}
+	return publicURL
+}
+
+// KeyFromURL turns .../image/upload/v1712345/folder/name.png into folder/name.
+func (c *Cloudinary) KeyFromURL(rawURL string) string {
+	uploadIndex := strings.Index(rawURL, "/upload/")
+	if uploadIndex == -1 {
+		return ""
+	}
+	publicID := rawURL[uploadIndex+len("/upload/"):]
+	if unescaped, err := url.PathUnescape(publicID); err == nil {
+		publicID = unescaped
+	}
+
+	if slashIndex := strings.Index(publicID, "/"); slashIndex != -1 && isVersion(publicID[:slashIndex]) {
+		publicID = publicID[slashIndex+1:]
+	}
+
+	if dotIndex := strings.LastIndex(publicID, "."); dotIndex != -1 {
+		publicID = publicID[:dotIndex]
+	}
+
+	return publicID
+}
+
+func isVersion(segment string) bool {
+	if len(segment) < 2 || segment[0] != 'v' {
+		return false
+	}
+	for _, c := range segment[1:] {
+		if c < '0' || c > '9' {
+			return false
+		}
+	}
+	return true
+}
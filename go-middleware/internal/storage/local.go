@@ -0,0 +1,238 @@
+package storage
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"path"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+
+	"urpaint/internal/httperr"
+)
+
+// Local stores images on disk and serves them from the Go server itself.
+type Local struct {
+	root    string
+	baseURL string
+	prefix  string
+}
+
+// NewLocal stores files under dir and builds URLs from baseURL,
+// e.g. "http://localhost:8080/files".
+func NewLocal(dir, baseURL string) (*Local, error) {
+	root, err := filepath.Abs(dir)
+	if err != nil {
+		return nil, err
+	}
+	if err := os.MkdirAll(root, 0o755); err != nil {
+		return nil, err
+	}
+
+	u, err := url.Parse(baseURL)
+	if err != nil {
+		return nil, fmt.Errorf("invalid local storage URL: %w", err)
+	}
+
+	return &Local{
+		root:    root,
+		baseURL: strings.TrimSuffix(baseURL, "/"),
+		prefix:  strings.TrimSuffix(u.Path, "/") + "/",
+	}, nil
+}
+
+// Ping checks the storage directory is still there.
+func (l *Local) Ping(ctx context.Context) error {
+	info, err := os.Stat(l.root)
+	if err != nil {
+		return err
+	}
+	if !info.IsDir() {
+		return fmt.Errorf("%s is not a directory", l.root)
+	}
+	return nil
+}
+
+// Prefix is the path the server has to mount the Local handler on.
+func (l *Local) Prefix() string {
+	return l.prefix
+}
+
+func (l *Local) Put(ctx context.Context, folder string, r io.Reader) (Object, error) {
+	name, err := randomName()
+	if err != nil {
+		return Object{}, err
+	}
+
+	// Sniff the type so the file gets a sensible extension
+	head := make([]byte, 512)
+	n, err := io.ReadFull(r, head)
+	if err != nil && err != io.ErrUnexpectedEOF && err != io.EOF {
+		return Object{}, err
+	}
+	head = head[:n]
+
+	key := path.Join(folder, name+extensionFor(http.DetectContentType(head)))
+	return l.write(key, io.MultiReader(bytes.NewReader(head), r), false)
+}
+
+func (l *Local) Overwrite(ctx context.Context, key string, r io.Reader) (Object, error) {
+	obj, err := l.write(key, r, true)
+	if err != nil {
+		return Object{}, err
+	}
+	// Bust browser caches, the path itself does not change
+	obj.URL += "?v=" + strconv.FormatInt(time.Now().UnixNano(), 36)
+	return obj, nil
+}
+
+func (l *Local) write(key string, r io.Reader, mustExist bool) (Object, error) {
+	full, err := l.path(key)
+	if err != nil {
+		return Object{}, err
+	}
+	if mustExist {
+		if _, err := os.Stat(full); errors.Is(err, os.ErrNotExist) {
+			return Object{}, ErrNotFound
+		}
+	}
+
+	if err := os.MkdirAll(filepath.Dir(full), 0o755); err != nil {
+		return Object{}, err
+	}
+
+	tmp, err := os.CreateTemp(filepath.Dir(full), ".upload-*")
+	if err != nil {
+		return Object{}, err
+	}
+	defer os.Remove(tmp.Name())
+
+	n, err := io.Copy(tmp, r)
+	if closeErr := tmp.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		return Object{}, err
+	}
+
+	if err := os.Rename(tmp.Name(), full); err != nil {
+		return Object{}, err
+	}
+
+	return Object{Key: key, URL: l.PublicURL(key), Bytes: n}, nil
+}
+
+func (l *Local) Open(ctx context.Context, key string) (io.ReadCloser, error) {
+	full, err := l.path(key)
+	if err != nil {
+		return nil, err
+	}
+	f, err := os.Open(full)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil, ErrNotFound
+	}
+	return f, err
+}
+
+func (l *Local) Delete(ctx context.Context, key string) error {
+	full, err := l.path(key)
+	if err != nil {
+		return err
+	}
+	if err := os.Remove(full); err != nil {
+		if errors.Is(err, os.ErrNotExist) {
+			return ErrNotFound
+		}
+		return err
+	}
+	return nil
+}
+
+func (l *Local) PublicURL(key string) string {
+	segments := strings.Split(key, "/")
+	for i, s := range segments {
+		segments[i] = url.PathEscape(s)
+	}
+	return l.baseURL + "/" + strings.Join(segments, "/")
+}
+
+func (l *Local) KeyFromURL(rawURL string) string {
+	if !strings.HasPrefix(rawURL, l.baseURL+"/") {
+		return ""
+	}
+	key := strings.TrimPrefix(rawURL, l.baseURL+"/")
+	if i := strings.IndexAny(key, "?#"); i != -1 {
+		key = key[:i]
+	}
+	key, err := url.PathUnescape(key)
+	if err != nil {
+		return ""
+	}
+	return key
+}
+
+// ServeHTTP serves stored files. Directory listings are never exposed.
+func (l *Local) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet && r.Method != http.MethodHead {
+		w.Header().Set("Allow", "GET, HEAD")
+		httperr.Write(w, r, httperr.New(http.StatusMethodNotAllowed, "Method not allowed"))
+		return
+	}
+
+	key := strings.TrimPrefix(r.URL.Path, l.prefix)
+	full, err := l.path(key)
+	if err != nil {
+		httperr.Write(w, r, httperr.New(http.StatusNotFound, "File not found"))
+		return
+	}
+
+	info, err := os.Stat(full)
+	if err != nil || info.IsDir() {
+		httperr.Write(w, r, httperr.New(http.StatusNotFound, "File not found"))
+		return
+	}
+
+	w.Header().Set("X-Content-Type-Options", "nosniff")
+	http.ServeFile(w, r, full)
+}
+
+// path maps a key onto the disk, refusing anything that escapes the root.
+func (l *Local) path(key string) (string, error) {
+	clean := path.Clean("/" + key)
+	if clean == "/" {
+		return "", fmt.Errorf("invalid storage key %q", key)
+	}
+	return filepath.Join(l.root, filepath.FromSlash(clean)), nil
+}
+
+func randomName() (string, error) {
+	b := make([]byte, 16)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(b), nil
+}
+
+func extensionFor(contentType string) string {
+	switch contentType {
+	case "image/png":
+		return ".png"
+	case "image/jpeg":
+		return ".jpg"
+	case "image/gif":
+		return ".gif"
+	case "image/webp":
+		return ".webp"
+	default:
+		return ".bin"
+	}
+}
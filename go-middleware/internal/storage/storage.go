@@ -0,0 +1,41 @@
+package storage
+
+import (
+	"context"
+	"errors"
+	"io"
+)
+
+var ErrNotFound = errors.New("storage: object not found")
+
+// Object describes a stored image.
+type Object struct {
+	Key   string
+	URL   string
+	Bytes int64
+}
+
+// Storage is the backend the handlers push images to.
+// Keys are backend specific; handlers only ever persist the URL and
+// recover the key with KeyFromURL.
+type Storage interface {
+	// Put stores r as a new object inside folder.
+	Put(ctx context.Context, folder string, r io.Reader) (Object, error)
+	// Overwrite replaces the object stored under key.
+	Overwrite(ctx context.Context, key string, r io.Reader) (Object, error)
+	// Open reads back the object stored under key.
+	Open(ctx context.Context, key string) (io.ReadCloser, error)
+	// Delete removes the object stored under key.
+	Delete(ctx context.Context, key string) error
+	// PublicURL returns the URL clients load the object from.
+	PublicURL(key string) string
+	// KeyFromURL returns the key for a URL produced by this backend,
+	// or "" if the URL belongs somewhere else.
+	KeyFromURL(url string) string
+}
+
+// Pinger is a backend that can check it is reachable without touching
+// any object, for readiness probes.
+type Pinger interface {
+	Ping(ctx context.Context) error
+}
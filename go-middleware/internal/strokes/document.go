@@ -0,0 +1,284 @@
+// Package strokes defines the vector drawing format: what DrawingCanvas
+// does, recorded as data so a drawing can be re-rendered, diffed and
+// replayed instead of only kept as pixels.
+package strokes
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"math"
+	"net/url"
+	"regexp"
+)
+
+// Version is the format version this server reads and writes.
+const Version = 1
+
+// Limits keep a single document renderable in bounded time and memory.
+const (
+	MaxSize      = 8192
+	MaxLayers    = 32
+	MaxOps       = 100_000
+	MaxPoints    = 2_000_000
+	MaxLineWidth = 500
+	MaxTolerance = 255
+
+	// MaxWork caps the pixels a render may visit, see Work. The other
+	// limits alone still allow 2M points of a 500px brush, which is
+	// minutes of rendering; this is a few seconds at most.
+	MaxWork = 1 << 29
+
+	// DefaultTolerance matches the canvas flood fill
+	DefaultTolerance = 10
+)
+
+// Op types
+const (
+	OpStroke = "stroke"
+	OpErase  = "erase"
+	OpFill   = "fill"
+)
+
+// Document is a whole drawing.
+//
+//	{
+//	  "version": 1,
+//	  "width": 800, "height": 600,
+//	  "background": "#ffffff",
+//	  "layers": [{
+//	    "name": "Layer 1",
+//	    "ops": [
+//	      {"type": "stroke", "color": "#000000", "width": 5, "points": [[10,10],[20,15]]},
+//	      {"type": "erase", "width": 12, "points": [[15,12]]},
+//	      {"type": "fill", "color": "#ff0000", "x": 40, "y": 40}
+//	    ]
+//	  }]
+//	}
+//
+// Layers are composited bottom to top over the background and the optional
+// base image, which is stretched to the canvas like the Studio does with an
+// uploaded photo. Within a layer ops apply in order.
+type Document struct {
+	Version    int     `json:"version"`
+	Width      int     `json:"width"`
+	Height     int     `json:"height"`
+	Background string  `json:"background,omitempty"`
+	BaseImage  string  `json:"baseImage,omitempty"`
+	Layers     []Layer `json:"layers"`
+}
+
+type Layer struct {
+	Name   string `json:"name,omitempty"`
+	Hidden bool   `json:"hidden,omitempty"`
+	Ops    []Op   `json:"ops"`
+}
+
+// Op is one canvas action.
+//
+// A stroke is a round-capped, round-joined polyline in Color. An erase is
+// the same with the background color, the way the canvas eraser paints
+// white rather than clearing. A fill is a flood fill from (X, Y) of the
+// region matching that pixel within Tolerance on every channel.
+type Op struct {
+	Type      string  `json:"type"`
+	Color     string  `json:"color,omitempty"`
+	Width     float64 `json:"width,omitempty"`
+	Points    []Point `json:"points,omitempty"`
+	X         int     `json:"x,omitempty"`
+	Y         int     `json:"y,omitempty"`
+	Tolerance *int    `json:"tolerance,omitempty"`
+}
+
+// Point is [x, y] in canvas pixels
+type Point [2]float64
+
+// FillTolerance is the op's tolerance or the canvas default
+func (op Op) FillTolerance() int {
+	if op.Tolerance == nil {
+		return DefaultTolerance
+	}
+	return *op.Tolerance
+}
+
+// BackgroundColor is the document background, white when unset
+func (d *Document) BackgroundColor() string {
+	if d.Background == "" {
+		return "#ffffff"
+	}
+	return d.Background
+}
+
+// ValidationError names the offending field, e.g. "layers[0].ops[3].color".
+type ValidationError struct {
+	Field   string
+	Message string
+}
+
+func (e *ValidationError) Error() string {
+	if e.Field == "" {
+		return e.Message
+	}
+	return e.Field + ": " + e.Message
+}
+
+func invalid(field, format string, args ...interface{}) error {
+	return &ValidationError{Field: field, Message: fmt.Sprintf(format, args...)}
+}
+
+var hexColor = regexp.MustCompile(`^#[0-9a-fA-F]{6}$`)
+
+// Parse decodes and validates a document. Unknown fields are rejected so
+// typos don't silently drop data.
+func Parse(data []byte) (*Document, error) {
+	dec := json.NewDecoder(bytes.NewReader(data))
+	dec.DisallowUnknownFields()
+
+	var doc Document
+	if err := dec.Decode(&doc); err != nil {
+		return nil, &ValidationError{Message: "invalid JSON: " + err.Error()}
+	}
+	if dec.More() {
+		return nil, &ValidationError{Message: "invalid JSON: trailing data"}
+	}
+	if err := doc.Validate(); err != nil {
+		return nil, err
+	}
+	return &doc, nil
+}
+
+// Validate checks the document is something the renderer can draw.
+func (d *Document) Validate() error {
+	if d.Version != Version {
+		return invalid("version", "unsupported version %d, expected %d", d.Version, Version)
+	}
+	if d.Width < 1 || d.Width > MaxSize {
+		return invalid("width", "must be between 1 and %d", MaxSize)
+	}
+	if d.Height < 1 || d.Height > MaxSize {
+		return invalid("height", "must be between 1 and %d", MaxSize)
+	}
+	if d.Background != "" && !hexColor.MatchString(d.Background) {
+		return invalid("background", "must be a #rrggbb color")
+	}
+	if d.BaseImage != "" {
+		u, err := url.Parse(d.BaseImage)
+		if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" || len(d.BaseImage) > 2048 {
+			return invalid("baseImage", "must be an http(s) URL")
+		}
+	}
+	if len(d.Layers) > MaxLayers {
+		return invalid("layers", "at most %d layers", MaxLayers)
+	}
+
+	ops, points := 0, 0
+	for i, layer := range d.Layers {
+		for j, op := range layer.Ops {
+			field := fmt.Sprintf("layers[%d].ops[%d]", i, j)
+			if err := d.validateOp(field, op); err != nil {
+				return err
+			}
+			ops++
+			points += len(op.Points)
+		}
+	}
+	if ops > MaxOps {
+		return invalid("layers", "at most %d ops in total", MaxOps)
+	}
+	if points > MaxPoints {
+		return invalid("layers", "at most %d points in total", MaxPoints)
+	}
+	if d.Work() > MaxWork {
+		return invalid("layers", "too much to render: use fewer or thinner strokes, or fewer fills")
+	}
+	return nil
+}
+
+// Work estimates what Render costs in pixels visited: the canvas for the
+// background and base image, the bounding box of every stroke segment plus
+// the stroke's own box when it's blended, and the whole canvas for each
+// fill. Hidden layers aren't rendered and don't count.
+func (d *Document) Work() int64 {
+	canvas := int64(d.Width) * int64(d.Height)
+	work := 2 * canvas
+
+	for _, layer := range d.Layers {
+		if layer.Hidden {
+			continue
+		}
+		for _, op := range layer.Ops {
+			if op.Type == OpFill {
+				work += canvas
+				continue
+			}
+			pad := op.Width + 2
+			minX, minY := math.Inf(1), math.Inf(1)
+			maxX, maxY := math.Inf(-1), math.Inf(-1)
+			for k, a := range op.Points {
+				b := a
+				if k+1 < len(op.Points) {
+					b = op.Points[k+1]
+				} else if k > 0 {
+					break
+				}
+				work += d.boxArea(math.Abs(b[0]-a[0])+pad, math.Abs(b[1]-a[1])+pad)
+				minX, maxX = math.Min(minX, math.Min(a[0], b[0])), math.Max(maxX, math.Max(a[0], b[0]))
+				minY, maxY = math.Min(minY, math.Min(a[1], b[1])), math.Max(maxY, math.Max(a[1], b[1]))
+			}
+			work += d.boxArea(maxX-minX+pad, maxY-minY+pad)
+		}
+	}
+	return work
+}
+
+// boxArea is the area of a w by h box, clipped to the canvas size
+func (d *Document) boxArea(w, h float64) int64 {
+	return int64(math.Ceil(math.Min(w, float64(d.Width)))) * int64(math.Ceil(math.Min(h, float64(d.Height))))
+}
+
+func (d *Document) validateOp(field string, op Op) error {
+	switch op.Type {
+	case OpStroke, OpErase:
+		if op.Type == OpStroke && !hexColor.MatchString(op.Color) {
+			return invalid(field+".color", "must be a #rrggbb color")
+		}
+		if op.Type == OpErase && op.Color != "" {
+			return invalid(field+".color", "erase uses the background color")
+		}
+		if !(op.Width > 0 && op.Width <= MaxLineWidth) {
+			return invalid(field+".width", "must be greater than 0 and at most %d", MaxLineWidth)
+		}
+		if len(op.Points) == 0 {
+			return invalid(field+".points", "at least one point is required")
+		}
+		// Strokes may run off the canvas, but not absurdly far
+		for k, p := range op.Points {
+			for _, v := range p {
+				if math.IsNaN(v) || math.IsInf(v, 0) || math.Abs(v) > 4*MaxSize {
+					return invalid(fmt.Sprintf("%s.points[%d]", field, k), "coordinate out of range")
+				}
+			}
+		}
+		if op.Tolerance != nil {
+			return invalid(field+".tolerance", "only applies to fills")
+		}
+
+	case OpFill:
+		if !hexColor.MatchString(op.Color) {
+			return invalid(field+".color", "must be a #rrggbb color")
+		}
+		if op.X < 0 || op.X >= d.Width || op.Y < 0 || op.Y >= d.Height {
+			return invalid(field, "fill point (%d, %d) is outside the canvas", op.X, op.Y)
+		}
+		if op.Tolerance != nil && (*op.Tolerance < 0 || *op.Tolerance > MaxTolerance) {
+			return invalid(field+".tolerance", "must be between 0 and %d", MaxTolerance)
+		}
+		if len(op.Points) > 0 || op.Width != 0 {
+			return invalid(field, "fills take x and y, not points or width")
+		}
+
+	default:
+		return invalid(field+".type", "must be stroke, erase or fill")
+	}
+	return nil
+}
@@ -0,0 +1,147 @@
+package strokes
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+	"testing"
+)
+
+const validDoc = `{
+	"version": 1,
+	"width": 100, "height": 80,
+	"background": "#ffffff",
+	"layers": [{
+		"name": "Layer 1",
+		"ops": [
+			{"type": "stroke", "color": "#000000", "width": 5, "points": [[10,10],[20,15]]},
+			{"type": "erase", "width": 12, "points": [[15,12]]},
+			{"type": "fill", "color": "#ff0000", "x": 40, "y": 40, "tolerance": 0}
+		]
+	}]
+}`
+
+func TestParseValid(t *testing.T) {
+	doc, err := Parse([]byte(validDoc))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if doc.Width != 100 || doc.Height != 80 || len(doc.Layers) != 1 || len(doc.Layers[0].Ops) != 3 {
+		t.Errorf("unexpected document %+v", doc)
+	}
+	if got := doc.Layers[0].Ops[2].FillTolerance(); got != 0 {
+		t.Errorf("FillTolerance = %d, want 0", got)
+	}
+	if got := (Op{}).FillTolerance(); got != DefaultTolerance {
+		t.Errorf("default FillTolerance = %d, want %d", got, DefaultTolerance)
+	}
+	if got := (&Document{}).BackgroundColor(); got != "#ffffff" {
+		t.Errorf("default BackgroundColor = %q", got)
+	}
+}
+
+func TestParseRejects(t *testing.T) {
+	doc := func(ops string) string {
+		return `{"version":1,"width":100,"height":80,"layers":[{"ops":[` + ops + `]}]}`
+	}
+
+	tests := []struct {
+		name  string
+		json  string
+		field string
+	}{
+		{"bad json", `{`, ""},
+		{"trailing data", doc(``) + `{}`, ""},
+		{"unknown field", `{"version":1,"width":1,"height":1,"layers":[],"extra":1}`, ""},
+		{"version", `{"version":2,"width":1,"height":1,"layers":[]}`, "version"},
+		{"width", `{"version":1,"width":0,"height":1,"layers":[]}`, "width"},
+		{"height", fmt.Sprintf(`{"version":1,"width":1,"height":%d,"layers":[]}`, MaxSize+1), "height"},
+		{"background", `{"version":1,"width":1,"height":1,"background":"red","layers":[]}`, "background"},
+		{"base image", `{"version":1,"width":1,"height":1,"baseImage":"file:///etc/passwd","layers":[]}`, "baseImage"},
+		{"stroke color", doc(`{"type":"stroke","color":"black","width":1,"points":[[1,1]]}`), "layers[0].ops[0].color"},
+		{"erase color", doc(`{"type":"erase","color":"#000000","width":1,"points":[[1,1]]}`), "layers[0].ops[0].color"},
+		{"zero width", doc(`{"type":"stroke","color":"#000000","width":0,"points":[[1,1]]}`), "layers[0].ops[0].width"},
+		{"wide", doc(`{"type":"stroke","color":"#000000","width":501,"points":[[1,1]]}`), "layers[0].ops[0].width"},
+		{"no points", doc(`{"type":"stroke","color":"#000000","width":1}`), "layers[0].ops[0].points"},
+		{"far point", doc(`{"type":"stroke","color":"#000000","width":1,"points":[[1,1],[1e9,1]]}`), "layers[0].ops[0].points[1]"},
+		{"stroke tolerance", doc(`{"type":"stroke","color":"#000000","width":1,"points":[[1,1]],"tolerance":3}`), "layers[0].ops[0].tolerance"},
+		{"fill outside", doc(`{"type":"fill","color":"#000000","x":100,"y":0}`), "layers[0].ops[0]"},
+		{"fill tolerance", doc(`{"type":"fill","color":"#000000","x":1,"y":1,"tolerance":256}`), "layers[0].ops[0].tolerance"},
+		{"fill points", doc(`{"type":"fill","color":"#000000","x":1,"y":1,"points":[[1,1]]}`), "layers[0].ops[0]"},
+		{"unknown op", doc(`{"type":"smudge"}`), "layers[0].ops[0].type"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := Parse([]byte(tt.json))
+			var invalid *ValidationError
+			if !errors.As(err, &invalid) {
+				t.Fatalf("err = %v, want *ValidationError", err)
+			}
+			if invalid.Field != tt.field {
+				t.Errorf("field = %q, want %q (%v)", invalid.Field, tt.field, err)
+			}
+		})
+	}
+}
+
+func TestValidateLimits(t *testing.T) {
+	layers := make([]Layer, MaxLayers+1)
+	doc := &Document{Version: Version, Width: 10, Height: 10, Layers: layers}
+	if err := doc.Validate(); err == nil || !strings.Contains(err.Error(), "layers") {
+		t.Errorf("too many layers: err = %v", err)
+	}
+
+	ops := make([]Op, MaxOps+1)
+	for i := range ops {
+		ops[i] = Op{Type: OpStroke, Color: "#000000", Width: 1, Points: []Point{{1, 1}}}
+	}
+	doc = &Document{Version: Version, Width: 10, Height: 10, Layers: []Layer{{Ops: ops}}}
+	if err := doc.Validate(); err == nil || !strings.Contains(err.Error(), "ops") {
+		t.Errorf("too many ops: err = %v", err)
+	}
+}
+
+func TestWork(t *testing.T) {
+	doc := &Document{Version: Version, Width: 100, Height: 50}
+	if got, want := doc.Work(), int64(2*100*50); got != want {
+		t.Errorf("empty Work = %d, want %d", got, want)
+	}
+
+	// Fills cost the canvas; hidden layers nothing
+	doc.Layers = []Layer{
+		{Ops: []Op{{Type: OpFill, Color: "#000000"}}},
+		{Hidden: true, Ops: []Op{{Type: OpFill, Color: "#000000"}}},
+	}
+	if got, want := doc.Work(), int64(3*100*50); got != want {
+		t.Errorf("fill Work = %d, want %d", got, want)
+	}
+
+	// One 10px segment of a 4px brush: its box padded by width+2, twice
+	doc.Layers = []Layer{{Ops: []Op{{Type: OpStroke, Width: 4, Points: []Point{{0, 0}, {10, 0}}}}}}
+	if got, want := doc.Work(), int64(2*100*50+2*16*6); got != want {
+		t.Errorf("stroke Work = %d, want %d", got, want)
+	}
+}
+
+func TestValidateWorkBudget(t *testing.T) {
+	// Within MaxPoints and MaxLineWidth, but each segment covers most of
+	// a large canvas
+	points := make([]Point, 10_000)
+	for i := range points {
+		points[i] = Point{float64(i % 2 * 4000), float64(i % 2 * 4000)}
+	}
+	doc := &Document{
+		Version: Version, Width: 4096, Height: 4096,
+		Layers: []Layer{{Ops: []Op{{Type: OpStroke, Color: "#000000", Width: MaxLineWidth, Points: points}}}},
+	}
+	err := doc.Validate()
+	var invalid *ValidationError
+	if !errors.As(err, &invalid) || invalid.Field != "layers" {
+		t.Fatalf("err = %v, want a layers ValidationError", err)
+	}
+
+	doc.Layers[0].Ops[0].Points = points[:2]
+	if err := doc.Validate(); err != nil {
+		t.Errorf("a single long stroke should pass: %v", err)
+	}
+}
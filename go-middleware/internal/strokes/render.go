@@ -0,0 +1,210 @@
+package strokes
+
+import (
+	"image"
+	"image/color"
+	"math"
+	"strconv"
+
+	"golang.org/x/image/draw"
+)
+
+// Render draws the document the way DrawingCanvas would have: background,
+// then base (stretched to the canvas) if given, then every visible layer's
+// ops in order on one surface. The document must already be valid.
+func Render(doc *Document, base image.Image) *image.RGBA {
+	dst := image.NewRGBA(image.Rect(0, 0, doc.Width, doc.Height))
+	bg := parseColor(doc.BackgroundColor())
+	draw.Draw(dst, dst.Bounds(), image.NewUniform(bg), image.Point{}, draw.Src)
+
+	if base != nil {
+		draw.BiLinear.Scale(dst, dst.Bounds(), base, base.Bounds(), draw.Over, nil)
+	}
+
+	r := &rasterizer{dst: dst, coverage: make([]uint8, doc.Width*doc.Height)}
+	for _, layer := range doc.Layers {
+		if layer.Hidden {
+			continue
+		}
+		for _, op := range layer.Ops {
+			switch op.Type {
+			case OpStroke:
+				r.stroke(op.Points, op.Width, parseColor(op.Color))
+			case OpErase:
+				// The canvas eraser paints the background back in
+				r.stroke(op.Points, op.Width, bg)
+			case OpFill:
+				floodFill(dst, op.X, op.Y, parseColor(op.Color), op.FillTolerance())
+			}
+		}
+	}
+	return dst
+}
+
+// parseColor reads a validated #rrggbb color
+func parseColor(hex string) color.RGBA {
+	v, _ := strconv.ParseUint(hex[1:], 16, 32)
+	return color.RGBA{R: uint8(v >> 16), G: uint8(v >> 8), B: uint8(v), A: 255}
+}
+
+type rasterizer struct {
+	dst *image.RGBA
+	// Per-pixel antialiased coverage of the stroke being drawn, so a
+	// stroke crossing itself blends once like a single canvas path does
+	coverage []uint8
+}
+
+// stroke paints a round-capped, round-joined polyline. A pixel's coverage
+// is how far its center lies inside the nearest segment, smoothed over one
+// pixel for antialiasing.
+func (r *rasterizer) stroke(points []Point, width float64, c color.RGBA) {
+	bounds := r.dst.Bounds()
+	radius := width / 2
+	dirty := image.Rectangle{}
+
+	for i := range points {
+		a := points[i]
+		b := a
+		if i+1 < len(points) {
+			b = points[i+1]
+		} else if i > 0 {
+			// The last point was already covered by the previous segment
+			break
+		}
+
+		box := image.Rect(
+			int(math.Floor(math.Min(a[0], b[0])-radius-1)),
+			int(math.Floor(math.Min(a[1], b[1])-radius-1)),
+			int(math.Ceil(math.Max(a[0], b[0])+radius+1)),
+			int(math.Ceil(math.Max(a[1], b[1])+radius+1)),
+		).Intersect(bounds)
+		if box.Empty() {
+			continue
+		}
+		dirty = dirty.Union(box)
+
+		for y := box.Min.Y; y < box.Max.Y; y++ {
+			row := y * bounds.Dx()
+			for x := box.Min.X; x < box.Max.X; x++ {
+				d := segmentDistance(float64(x)+0.5, float64(y)+0.5, a, b)
+				cov := radius - d + 0.5
+				if cov <= 0 {
+					continue
+				}
+				v := uint8(255)
+				if cov < 1 {
+					v = uint8(cov * 255)
+				}
+				if v > r.coverage[row+x] {
+					r.coverage[row+x] = v
+				}
+			}
+		}
+	}
+
+	for y := dirty.Min.Y; y < dirty.Max.Y; y++ {
+		row := y * bounds.Dx()
+		for x := dirty.Min.X; x < dirty.Max.X; x++ {
+			cov := r.coverage[row+x]
+			if cov == 0 {
+				continue
+			}
+			r.coverage[row+x] = 0
+			blend(r.dst, x, y, c, cov)
+		}
+	}
+}
+
+// segmentDistance is the distance from (px, py) to the segment a-b
+func segmentDistance(px, py float64, a, b Point) float64 {
+	dx, dy := b[0]-a[0], b[1]-a[1]
+	t := 0.0
+	if l := dx*dx + dy*dy; l > 0 {
+		t = ((px-a[0])*dx + (py-a[1])*dy) / l
+		t = math.Max(0, math.Min(1, t))
+	}
+	return math.Hypot(px-(a[0]+t*dx), py-(a[1]+t*dy))
+}
+
+// blend draws an opaque color over the pixel with the given coverage
+func blend(dst *image.RGBA, x, y int, c color.RGBA, cov uint8) {
+	i := dst.PixOffset(x, y)
+	p := dst.Pix[i : i+4 : i+4]
+	a := uint32(cov)
+	p[0] = uint8((uint32(c.R)*a + uint32(p[0])*(255-a) + 127) / 255)
+	p[1] = uint8((uint32(c.G)*a + uint32(p[1])*(255-a) + 127) / 255)
+	p[2] = uint8((uint32(c.B)*a + uint32(p[2])*(255-a) + 127) / 255)
+	p[3] = uint8((255*a + uint32(p[3])*(255-a) + 127) / 255)
+}
+
+// floodFill is the canvas tool's scanline fill: every pixel connected to
+// (x, y) within tolerance of its color on all four channels becomes c.
+func floodFill(dst *image.RGBA, x, y int, c color.RGBA, tolerance int) {
+	bounds := dst.Bounds()
+	width, height := bounds.Dx(), bounds.Dy()
+
+	at := func(x, y int) [4]uint8 {
+		i := dst.PixOffset(x, y)
+		return [4]uint8{dst.Pix[i], dst.Pix[i+1], dst.Pix[i+2], dst.Pix[i+3]}
+	}
+	replacement := [4]uint8{c.R, c.G, c.B, 255}
+	target := at(x, y)
+
+	matches := func(a, b [4]uint8) bool {
+		for k := range a {
+			d := int(a[k]) - int(b[k])
+			if d < -tolerance || d > tolerance {
+				return false
+			}
+		}
+		return true
+	}
+	if matches(target, replacement) {
+		return
+	}
+
+	set := func(x, y int) {
+		i := dst.PixOffset(x, y)
+		copy(dst.Pix[i:i+4], replacement[:])
+	}
+
+	stack := []image.Point{{X: x, Y: y}}
+	for len(stack) > 0 {
+		p := stack[len(stack)-1]
+		stack = stack[:len(stack)-1]
+
+		cy := p.Y
+		for cy >= 0 && matches(at(p.X, cy), target) {
+			cy--
+		}
+		cy++
+
+		reachLeft, reachRight := false, false
+		for cy < height && matches(at(p.X, cy), target) {
+			set(p.X, cy)
+
+			if p.X > 0 {
+				if matches(at(p.X-1, cy), target) {
+					if !reachLeft {
+						stack = append(stack, image.Point{X: p.X - 1, Y: cy})
+						reachLeft = true
+					}
+				} else {
+					reachLeft = false
+				}
+			}
+
+			if p.X < width-1 {
+				if matches(at(p.X+1, cy), target) {
+					if !reachRight {
+						stack = append(stack, image.Point{X: p.X + 1, Y: cy})
+						reachRight = true
+					}
+				} else {
+					reachRight = false
+				}
+			}
+			cy++
+		}
+	}
+}
@@ -0,0 +1,158 @@
+package strokes
+
+import (
+	"image"
+	"image/color"
+	"math"
+	"testing"
+)
+
+func rgba(img *image.RGBA, x, y int) color.RGBA {
+	return img.RGBAAt(x, y)
+}
+
+func TestRenderBackground(t *testing.T) {
+	img := Render(&Document{Version: Version, Width: 4, Height: 3, Background: "#102030"}, nil)
+	if img.Bounds() != image.Rect(0, 0, 4, 3) {
+		t.Fatalf("bounds = %v", img.Bounds())
+	}
+	want := color.RGBA{0x10, 0x20, 0x30, 0xff}
+	for y := 0; y < 3; y++ {
+		for x := 0; x < 4; x++ {
+			if got := rgba(img, x, y); got != want {
+				t.Fatalf("(%d,%d) = %v, want %v", x, y, got, want)
+			}
+		}
+	}
+}
+
+func TestRenderBaseImage(t *testing.T) {
+	src := image.NewRGBA(image.Rect(0, 0, 2, 2))
+	for i := 0; i < len(src.Pix); i += 4 {
+		copy(src.Pix[i:i+4], []uint8{0, 0, 255, 255})
+	}
+	img := Render(&Document{Version: Version, Width: 8, Height: 8}, src)
+	if got := rgba(img, 4, 4); got != (color.RGBA{0, 0, 255, 255}) {
+		t.Errorf("stretched base = %v, want blue", got)
+	}
+}
+
+func TestRenderStroke(t *testing.T) {
+	doc := &Document{Version: Version, Width: 40, Height: 20, Layers: []Layer{{Ops: []Op{
+		{Type: OpStroke, Color: "#ff0000", Width: 7, Points: []Point{{5, 10}, {35, 10}}},
+	}}}}
+	img := Render(doc, nil)
+
+	red := color.RGBA{255, 0, 0, 255}
+	white := color.RGBA{255, 255, 255, 255}
+	tests := []struct {
+		x, y int
+		want color.RGBA
+	}{
+		{20, 10, red},   // on the line
+		{5, 10, red},    // round cap start
+		{20, 12, red},   // inside the width
+		{20, 2, white},  // above
+		{0, 10, white},  // before the cap
+		{39, 10, white}, // after the cap
+	}
+	for _, tt := range tests {
+		if got := rgba(img, tt.x, tt.y); got != tt.want {
+			t.Errorf("(%d,%d) = %v, want %v", tt.x, tt.y, got, tt.want)
+		}
+	}
+
+	// The edge is antialiased, not hard
+	edge := rgba(img, 20, 13)
+	if edge == red || edge == white {
+		t.Errorf("edge (20,13) = %v, want a blend", edge)
+	}
+}
+
+func TestRenderSelfCrossingStrokeBlendsOnce(t *testing.T) {
+	// A stroke doubling back over itself must not darken where it overlaps
+	doc := &Document{Version: Version, Width: 30, Height: 10, Layers: []Layer{{Ops: []Op{
+		{Type: OpStroke, Color: "#000000", Width: 3, Points: []Point{{2, 5}, {28, 5}, {2, 5}}},
+	}}}}
+	once := &Document{Version: Version, Width: 30, Height: 10, Layers: []Layer{{Ops: []Op{
+		{Type: OpStroke, Color: "#000000", Width: 3, Points: []Point{{2, 5}, {28, 5}}},
+	}}}}
+	a, b := Render(doc, nil), Render(once, nil)
+	for i := range a.Pix {
+		if a.Pix[i] != b.Pix[i] {
+			t.Fatalf("pixel byte %d differs: %d vs %d", i, a.Pix[i], b.Pix[i])
+		}
+	}
+}
+
+func TestRenderErase(t *testing.T) {
+	doc := &Document{Version: Version, Width: 20, Height: 20, Background: "#00ff00", Layers: []Layer{{Ops: []Op{
+		{Type: OpFill, Color: "#000000", X: 0, Y: 0},
+		{Type: OpErase, Width: 6, Points: []Point{{10, 10}}},
+	}}}}
+	img := Render(doc, nil)
+	if got := rgba(img, 10, 10); got != (color.RGBA{0, 255, 0, 255}) {
+		t.Errorf("erased pixel = %v, want the background", got)
+	}
+	if got := rgba(img, 1, 1); got != (color.RGBA{0, 0, 0, 255}) {
+		t.Errorf("untouched pixel = %v, want black", got)
+	}
+}
+
+func TestRenderFill(t *testing.T) {
+	// A vertical wall splits the canvas; the fill stays on its side
+	doc := &Document{Version: Version, Width: 20, Height: 10, Layers: []Layer{{Ops: []Op{
+		{Type: OpStroke, Color: "#000000", Width: 2, Points: []Point{{10, -5}, {10, 15}}},
+		{Type: OpFill, Color: "#0000ff", X: 2, Y: 2},
+	}}}}
+	img := Render(doc, nil)
+	if got := rgba(img, 2, 8); got != (color.RGBA{0, 0, 255, 255}) {
+		t.Errorf("filled side = %v, want blue", got)
+	}
+	if got := rgba(img, 18, 2); got != (color.RGBA{255, 255, 255, 255}) {
+		t.Errorf("other side = %v, want white", got)
+	}
+}
+
+func TestFloodFillTolerance(t *testing.T) {
+	img := image.NewRGBA(image.Rect(0, 0, 3, 1))
+	for x, v := range []uint8{100, 105, 130} {
+		img.SetRGBA(x, 0, color.RGBA{v, v, v, 255})
+	}
+	floodFill(img, 0, 0, color.RGBA{255, 0, 0, 255}, 10)
+
+	red := color.RGBA{255, 0, 0, 255}
+	if rgba(img, 0, 0) != red || rgba(img, 1, 0) != red {
+		t.Errorf("pixels within tolerance weren't filled: %v %v", rgba(img, 0, 0), rgba(img, 1, 0))
+	}
+	if got := rgba(img, 2, 0); got == red {
+		t.Error("pixel outside tolerance was filled")
+	}
+}
+
+func TestRenderHiddenLayer(t *testing.T) {
+	doc := &Document{Version: Version, Width: 5, Height: 5, Layers: []Layer{
+		{Hidden: true, Ops: []Op{{Type: OpFill, Color: "#000000"}}},
+	}}
+	if got := rgba(Render(doc, nil), 2, 2); got != (color.RGBA{255, 255, 255, 255}) {
+		t.Errorf("hidden layer drew: %v", got)
+	}
+}
+
+func TestSegmentDistance(t *testing.T) {
+	tests := []struct {
+		px, py float64
+		a, b   Point
+		want   float64
+	}{
+		{5, 3, Point{0, 0}, Point{10, 0}, 3},
+		{-4, 3, Point{0, 0}, Point{10, 0}, 5},
+		{13, 4, Point{0, 0}, Point{10, 0}, 5},
+		{1, 1, Point{1, 1}, Point{1, 1}, 0},
+	}
+	for _, tt := range tests {
+		if got := segmentDistance(tt.px, tt.py, tt.a, tt.b); math.Abs(got-tt.want) > 1e-9 {
+			t.Errorf("segmentDistance(%v,%v,%v,%v) = %v, want %v", tt.px, tt.py, tt.a, tt.b, got, tt.want)
+		}
+	}
+}
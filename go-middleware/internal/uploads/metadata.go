@@ -0,0 +1,244 @@
+package uploads
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"image"
+	"image/draw"
+	"image/jpeg"
+)
+
+var errMalformed = errors.New("uploads: malformed image")
+
+// pngKeep lists the chunks that affect how a PNG looks. Text, EXIF,
+// timestamps and the rest are dropped, as are APNG frames.
+var pngKeep = map[string]bool{
+	"IHDR": true, "PLTE": true, "IDAT": true, "IEND": true,
+	"tRNS": true, "gAMA": true, "cHRM": true, "sRGB": true, "iCCP": true, "sBIT": true,
+}
+
+// stripPNG copies the chunks in pngKeep, leaving the pixels untouched
+func stripPNG(data []byte, img image.Image) ([]byte, image.Image, error) {
+	out := make([]byte, 8, len(data))
+	copy(out, data[:8])
+
+	for pos := 8; pos < len(data); {
+		if pos+8 > len(data) {
+			return nil, nil, errMalformed
+		}
+		length := int(binary.BigEndian.Uint32(data[pos:]))
+		end := pos + 12 + length
+		if length < 0 || end > len(data) {
+			return nil, nil, errMalformed
+		}
+		if pngKeep[string(data[pos+4:pos+8])] {
+			out = append(out, data[pos:end]...)
+		}
+		if string(data[pos+4:pos+8]) == "IEND" {
+			break
+		}
+		pos = end
+	}
+	return out, img, nil
+}
+
+// JPEG markers
+const (
+	markerSOS   = 0xda
+	markerEOI   = 0xd9
+	markerAPP0  = 0xe0
+	markerAPP1  = 0xe1
+	markerAPP2  = 0xe2
+	markerAPP14 = 0xee
+	markerAPP15 = 0xef
+	markerCOM   = 0xfe
+)
+
+// stripJPEG drops the APPn and comment segments that carry EXIF, XMP,
+// IPTC and the like. JFIF, the ICC profile and the Adobe segment stay
+// because decoders need them for color. A photo relying on its EXIF
+// orientation is rotated upright and re-encoded, since it would
+// otherwise turn sideways once the tag is gone.
+func stripJPEG(data []byte, img image.Image) ([]byte, image.Image, error) {
+	out := make([]byte, 2, len(data))
+	copy(out, data[:2])
+	orientation := 1
+
+	pos := 2
+	for {
+		if pos+4 > len(data) || data[pos] != 0xff {
+			return nil, nil, errMalformed
+		}
+		marker := data[pos+1]
+		// Fill bytes before a marker
+		if marker == 0xff {
+			pos++
+			continue
+		}
+		if marker == markerEOI {
+			out = append(out, data[pos:pos+2]...)
+			break
+		}
+
+		length := int(binary.BigEndian.Uint16(data[pos+2:]))
+		end := pos + 2 + length
+		if length < 2 || end > len(data) {
+			return nil, nil, errMalformed
+		}
+		segment := data[pos:end]
+		payload := segment[4:]
+
+		if marker == markerSOS {
+			// Entropy-coded data follows; everything from here is image
+			out = append(out, data[pos:]...)
+			break
+		}
+
+		keep := true
+		switch {
+		case marker == markerAPP1:
+			if o, ok := exifOrientation(payload); ok {
+				orientation = o
+			}
+			keep = false
+		case marker == markerAPP2:
+			keep = bytes.HasPrefix(payload, []byte("ICC_PROFILE\x00"))
+		case marker == markerAPP14:
+			keep = bytes.HasPrefix(payload, []byte("Adobe"))
+		case marker > markerAPP0 && marker <= markerAPP15, marker == markerCOM:
+			keep = false
+		}
+		if keep {
+			out = append(out, segment...)
+		}
+		pos = end
+	}
+
+	if orientation < 2 || orientation > 8 {
+		return out, img, nil
+	}
+	upright := orient(img, orientation)
+	var buf bytes.Buffer
+	if err := jpeg.Encode(&buf, upright, &jpeg.Options{Quality: 92}); err != nil {
+		return nil, nil, err
+	}
+	return buf.Bytes(), upright, nil
+}
+
+// exifOrientation reads tag 0x0112 from IFD0 of an APP1 Exif payload
+func exifOrientation(payload []byte) (int, bool) {
+	if !bytes.HasPrefix(payload, []byte("Exif\x00\x00")) {
+		return 0, false
+	}
+	tiff := payload[6:]
+	if len(tiff) < 8 {
+		return 0, false
+	}
+
+	var order binary.ByteOrder
+	switch string(tiff[:2]) {
+	case "II":
+		order = binary.LittleEndian
+	case "MM":
+		order = binary.BigEndian
+	default:
+		return 0, false
+	}
+
+	ifd := int(order.Uint32(tiff[4:]))
+	if ifd < 8 || ifd+2 > len(tiff) {
+		return 0, false
+	}
+	count := int(order.Uint16(tiff[ifd:]))
+	for i := 0; i < count; i++ {
+		entry := ifd + 2 + i*12
+		if entry+12 > len(tiff) {
+			return 0, false
+		}
+		if order.Uint16(tiff[entry:]) == 0x0112 {
+			return int(order.Uint16(tiff[entry+8:])), true
+		}
+	}
+	return 0, false
+}
+
+// orient applies an EXIF orientation (2-8) so the result displays upright
+func orient(img image.Image, orientation int) image.Image {
+	b := img.Bounds()
+	src := image.NewNRGBA(image.Rect(0, 0, b.Dx(), b.Dy()))
+	draw.Draw(src, src.Bounds(), img, b.Min, draw.Src)
+	w, h := b.Dx(), b.Dy()
+
+	// Orientations 5-8 swap the axes
+	dw, dh := w, h
+	if orientation >= 5 {
+		dw, dh = h, w
+	}
+	dst := image.NewNRGBA(image.Rect(0, 0, dw, dh))
+
+	for y := 0; y < h; y++ {
+		for x := 0; x < w; x++ {
+			var dx, dy int
+			switch orientation {
+			case 2: // mirrored
+				dx, dy = w-1-x, y
+			case 3: // upside down
+				dx, dy = w-1-x, h-1-y
+			case 4: // upside down, mirrored
+				dx, dy = x, h-1-y
+			case 5: // transposed
+				dx, dy = y, x
+			case 6: // rotated 90° clockwise to display
+				dx, dy = h-1-y, x
+			case 7: // transversed
+				dx, dy = h-1-y, w-1-x
+			case 8: // rotated 90° counter-clockwise to display
+				dx, dy = y, w-1-x
+			}
+			copy(dst.Pix[dst.PixOffset(dx, dy):][:4], src.Pix[src.PixOffset(x, y):][:4])
+		}
+	}
+	return dst
+}
+
+// stripWebP drops the EXIF and XMP chunks from an extended WebP and
+// clears their flags in the VP8X header
+func stripWebP(data []byte, img image.Image) ([]byte, image.Image, error) {
+	out := make([]byte, 12, len(data))
+	copy(out, data[:12])
+
+	for pos := 12; pos < len(data); {
+		if pos+8 > len(data) {
+			return nil, nil, errMalformed
+		}
+		fourCC := string(data[pos : pos+4])
+		size := int(binary.LittleEndian.Uint32(data[pos+4:]))
+		end := pos + 8 + size + size&1
+		if size < 0 || end > len(data) {
+			// The final chunk's padding byte is sometimes left off
+			if end == len(data)+1 {
+				end = len(data)
+			} else {
+				return nil, nil, errMalformed
+			}
+		}
+
+		switch fourCC {
+		case "EXIF", "XMP ":
+		case "VP8X":
+			start := len(out)
+			out = append(out, data[pos:end]...)
+			if size >= 1 {
+				// Bit 3 is EXIF, bit 2 XMP
+				out[start+8] &^= 0x08 | 0x04
+			}
+		default:
+			out = append(out, data[pos:end]...)
+		}
+		pos = end
+	}
+
+	binary.LittleEndian.PutUint32(out[4:], uint32(len(out)-8))
+	return out, img, nil
+}
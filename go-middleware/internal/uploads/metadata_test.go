@@ -0,0 +1,208 @@
+package uploads
+
+import (
+	"bytes"
+	"encoding/binary"
+	"hash/crc32"
+	"image"
+	"image/color"
+	"testing"
+)
+
+func pngChunk(kind string, data []byte) []byte {
+	chunk := binary.BigEndian.AppendUint32(nil, uint32(len(data)))
+	chunk = append(chunk, kind...)
+	chunk = append(chunk, data...)
+	return binary.BigEndian.AppendUint32(chunk, crc32.ChecksumIEEE(chunk[4:]))
+}
+
+// jpegSegment builds a marker segment; its length counts itself
+func jpegSegment(marker byte, payload []byte) []byte {
+	seg := []byte{0xff, marker}
+	seg = binary.BigEndian.AppendUint16(seg, uint16(len(payload)+2))
+	return append(seg, payload...)
+}
+
+// exifPayload is an APP1 Exif block whose IFD0 holds only an orientation
+func exifPayload(order binary.AppendByteOrder, orientation uint16) []byte {
+	tiff := []byte("II*\x00")
+	if order == binary.BigEndian {
+		tiff = []byte("MM\x00*")
+	}
+	tiff = order.AppendUint32(tiff, 8)
+	tiff = order.AppendUint16(tiff, 1)
+	tiff = order.AppendUint16(tiff, 0x0112)
+	tiff = order.AppendUint16(tiff, 3) // SHORT
+	tiff = order.AppendUint32(tiff, 1)
+	tiff = order.AppendUint16(tiff, orientation)
+	tiff = append(tiff, 0, 0)
+	tiff = order.AppendUint32(tiff, 0)
+	return append([]byte("Exif\x00\x00"), tiff...)
+}
+
+// withJPEGSegments inserts segments straight after SOI
+func withJPEGSegments(data []byte, segments ...[]byte) []byte {
+	out := append([]byte{}, data[:2]...)
+	for _, s := range segments {
+		out = append(out, s...)
+	}
+	return append(out, data[2:]...)
+}
+
+func TestStripPNG(t *testing.T) {
+	data := encodePNG(t, testImage(4, 3))
+	// Insert text chunks after IHDR (8-byte signature + 25-byte chunk)
+	const afterIHDR = 33
+	var withText []byte
+	withText = append(withText, data[:afterIHDR]...)
+	withText = append(withText, pngChunk("tEXt", []byte("Author\x00Jane Doe"))...)
+	withText = append(withText, pngChunk("eXIf", []byte("MM\x00*secret"))...)
+	withText = append(withText, data[afterIHDR:]...)
+
+	img, err := Check(withText, Limits{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if bytes.Contains(img.Data, []byte("Jane Doe")) || bytes.Contains(img.Data, []byte("eXIf")) {
+		t.Error("metadata chunks were kept")
+	}
+	if !bytes.Equal(img.Data, data) {
+		t.Error("stripping changed more than the metadata chunks")
+	}
+}
+
+func TestStripJPEG(t *testing.T) {
+	data := encodeJPEG(t, testImage(4, 3))
+	icc := jpegSegment(markerAPP2, []byte("ICC_PROFILE\x00\x01\x01profile"))
+	withMeta := withJPEGSegments(data,
+		jpegSegment(markerAPP1, []byte("http://ns.adobe.com/xap/1.0/\x00<x:xmpmeta>GPS</x:xmpmeta>")),
+		jpegSegment(markerCOM, []byte("shot on a secret phone")),
+		jpegSegment(0xed, []byte("Photoshop 3.0\x00IPTC")),
+		icc,
+	)
+
+	img, err := Check(withMeta, Limits{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, s := range []string{"xmpmeta", "secret phone", "IPTC"} {
+		if bytes.Contains(img.Data, []byte(s)) {
+			t.Errorf("%q was kept", s)
+		}
+	}
+	if !bytes.Contains(img.Data, icc) {
+		t.Error("the ICC profile was dropped")
+	}
+}
+
+func TestStripJPEGOrientation(t *testing.T) {
+	// 4x2 with a red left column, so rotation is visible
+	src := image.NewNRGBA(image.Rect(0, 0, 4, 2))
+	for y := 0; y < 2; y++ {
+		for x := 0; x < 4; x++ {
+			c := color.NRGBA{0, 0, 255, 255}
+			if x == 0 {
+				c = color.NRGBA{255, 0, 0, 255}
+			}
+			src.SetNRGBA(x, y, c)
+		}
+	}
+	data := encodeJPEG(t, src)
+
+	for _, order := range []binary.AppendByteOrder{binary.LittleEndian, binary.BigEndian} {
+		withExif := withJPEGSegments(data, jpegSegment(markerAPP1, exifPayload(order, 6)))
+		img, err := Check(withExif, Limits{})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if img.Width != 2 || img.Height != 4 {
+			t.Errorf("%v: rotated to %dx%d, want 2x4", order, img.Width, img.Height)
+		}
+		if bytes.Contains(img.Data, []byte("Exif")) {
+			t.Errorf("%v: EXIF was kept", order)
+		}
+	}
+
+	// Orientation 1 leaves the original bytes alone apart from the segment
+	withExif := withJPEGSegments(data, jpegSegment(markerAPP1, exifPayload(binary.BigEndian, 1)))
+	img, err := Check(withExif, Limits{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(img.Data, data) || img.Width != 4 {
+		t.Error("an upright photo was re-encoded")
+	}
+}
+
+func TestOrient(t *testing.T) {
+	// 2x1: A then B
+	src := image.NewNRGBA(image.Rect(0, 0, 2, 1))
+	a, b := color.NRGBA{1, 0, 0, 255}, color.NRGBA{2, 0, 0, 255}
+	src.SetNRGBA(0, 0, a)
+	src.SetNRGBA(1, 0, b)
+
+	tests := []struct {
+		orientation int
+		w, h        int
+		firstIsA    bool
+	}{
+		{2, 2, 1, false},
+		{3, 2, 1, false},
+		{4, 2, 1, true},
+		{5, 1, 2, true},
+		{6, 1, 2, true},
+		{7, 1, 2, false},
+		{8, 1, 2, false},
+	}
+	for _, tt := range tests {
+		out := orient(src, tt.orientation).(*image.NRGBA)
+		if b := out.Bounds(); b.Dx() != tt.w || b.Dy() != tt.h {
+			t.Errorf("orientation %d: %dx%d, want %dx%d", tt.orientation, b.Dx(), b.Dy(), tt.w, tt.h)
+			continue
+		}
+		if got := out.NRGBAAt(0, 0) == a; got != tt.firstIsA {
+			t.Errorf("orientation %d: first pixel is A = %v, want %v", tt.orientation, got, tt.firstIsA)
+		}
+	}
+}
+
+func TestStripWebP(t *testing.T) {
+	chunk := func(fourCC string, data []byte) []byte {
+		c := append([]byte(fourCC), binary.LittleEndian.AppendUint32(nil, uint32(len(data)))...)
+		c = append(c, data...)
+		if len(data)%2 == 1 {
+			c = append(c, 0)
+		}
+		return c
+	}
+	// VP8X flags EXIF and XMP; the image chunk's contents don't matter here
+	var body []byte
+	body = append(body, chunk("VP8X", []byte{0x08 | 0x04, 0, 0, 0, 0, 0, 0, 0, 0, 0})...)
+	body = append(body, chunk("VP8L", []byte("pixels"))...)
+	body = append(body, chunk("EXIF", []byte("gps!"))...)
+	body = append(body, chunk("XMP ", []byte("<x/>"))...)
+	data := append([]byte("RIFF"), binary.LittleEndian.AppendUint32(nil, uint32(len(body)+4))...)
+	data = append(data, "WEBP"...)
+	data = append(data, body...)
+
+	out, _, err := stripWebP(data, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if bytes.Contains(out, []byte("gps!")) || bytes.Contains(out, []byte("<x/>")) {
+		t.Error("metadata chunks were kept")
+	}
+	if !bytes.Contains(out, []byte("pixels")) {
+		t.Error("the image chunk was dropped")
+	}
+	if flags := out[20]; flags&(0x08|0x04) != 0 {
+		t.Errorf("VP8X flags = %#x, want EXIF and XMP cleared", flags)
+	}
+	if size := binary.LittleEndian.Uint32(out[4:]); int(size) != len(out)-8 {
+		t.Errorf("RIFF size = %d, want %d", size, len(out)-8)
+	}
+
+	if _, _, err := stripWebP(data[:len(data)-3], nil); err != errMalformed {
+		t.Errorf("truncated: err = %v, want errMalformed", err)
+	}
+}
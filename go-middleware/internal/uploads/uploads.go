@@ -0,0 +1,174 @@
+// Package uploads checks images users send us before anything is stored.
+// The type comes from the bytes rather than the filename or header, the
+// whole image is decoded, and metadata is stripped from what's kept.
+package uploads
+
+import (
+	"bytes"
+	"fmt"
+	"image"
+	"image/jpeg"
+	"image/png"
+	"io"
+
+	"golang.org/x/image/webp"
+)
+
+// Formats we accept, as reported in Image.Format
+const (
+	PNG  = "png"
+	JPEG = "jpeg"
+	WebP = "webp"
+)
+
+// Error codes
+const (
+	CodeEmpty           = "empty"
+	CodeTooLarge        = "too_large"
+	CodeUnsupportedType = "unsupported_type"
+	CodeDimensions      = "dimensions_too_large"
+	CodeCorrupt         = "corrupt"
+)
+
+// Error says why an upload was rejected. Code is one of the Code constants.
+type Error struct {
+	Code    string
+	Message string
+}
+
+func (e *Error) Error() string {
+	return e.Message
+}
+
+// Limits bounds what an upload may be. Zero fields use DefaultLimits.
+type Limits struct {
+	MaxBytes  int64
+	MaxWidth  int
+	MaxHeight int
+	// MaxPixels guards against small files that decode to huge images
+	MaxPixels int
+}
+
+// DefaultLimits fits anything the canvas produces with room to spare
+var DefaultLimits = Limits{
+	MaxBytes:  10 << 20,
+	MaxWidth:  8192,
+	MaxHeight: 8192,
+	MaxPixels: 40_000_000,
+}
+
+func (l Limits) withDefaults() Limits {
+	if l.MaxBytes <= 0 {
+		l.MaxBytes = DefaultLimits.MaxBytes
+	}
+	if l.MaxWidth <= 0 {
+		l.MaxWidth = DefaultLimits.MaxWidth
+	}
+	if l.MaxHeight <= 0 {
+		l.MaxHeight = DefaultLimits.MaxHeight
+	}
+	if l.MaxPixels <= 0 {
+		l.MaxPixels = DefaultLimits.MaxPixels
+	}
+	return l
+}
+
+// Bytes is the largest upload the limits allow
+func (l Limits) Bytes() int64 {
+	return l.withDefaults().MaxBytes
+}
+
+// Image is an upload that passed every check. Data is what should be
+// stored: the original encoding with its metadata removed.
+type Image struct {
+	Data   []byte
+	Format string
+	Width  int
+	Height int
+}
+
+type format struct {
+	name         string
+	decode       func(io.Reader) (image.Image, error)
+	decodeConfig func(io.Reader) (image.Config, error)
+	strip        func([]byte, image.Image) ([]byte, image.Image, error)
+}
+
+var formats = []format{
+	{PNG, png.Decode, png.DecodeConfig, stripPNG},
+	{JPEG, jpeg.Decode, jpeg.DecodeConfig, stripJPEG},
+	{WebP, webp.Decode, webp.DecodeConfig, stripWebP},
+}
+
+// sniff picks the format from the file's magic bytes
+func sniff(data []byte) (format, bool) {
+	switch {
+	case bytes.HasPrefix(data, []byte("\x89PNG\r\n\x1a\n")):
+		return formats[0], true
+	case bytes.HasPrefix(data, []byte("\xff\xd8\xff")):
+		return formats[1], true
+	case len(data) >= 12 && string(data[:4]) == "RIFF" && string(data[8:12]) == "WEBP":
+		return formats[2], true
+	}
+	return format{}, false
+}
+
+// Read reads an upload from r, stopping as soon as it's over the byte
+// limit, and checks it.
+func Read(r io.Reader, limits Limits) (Image, error) {
+	limits = limits.withDefaults()
+	data, err := io.ReadAll(io.LimitReader(r, limits.MaxBytes+1))
+	if err != nil {
+		return Image{}, err
+	}
+	return Check(data, limits)
+}
+
+// Check validates data against limits and strips its metadata. Rejections
+// are *Error; anything else is a failure on our side.
+func Check(data []byte, limits Limits) (Image, error) {
+	limits = limits.withDefaults()
+
+	if len(data) == 0 {
+		return Image{}, &Error{CodeEmpty, "file is empty"}
+	}
+	if int64(len(data)) > limits.MaxBytes {
+		return Image{}, &Error{CodeTooLarge, fmt.Sprintf("file is larger than %d bytes", limits.MaxBytes)}
+	}
+
+	f, ok := sniff(data)
+	if !ok {
+		return Image{}, &Error{CodeUnsupportedType, "file must be a PNG, JPEG or WebP image"}
+	}
+
+	// Dimensions come from the header so a bomb is refused before decoding
+	cfg, err := f.decodeConfig(bytes.NewReader(data))
+	if err != nil {
+		return Image{}, &Error{CodeCorrupt, "file is not a valid " + f.name + " image"}
+	}
+	if cfg.Width <= 0 || cfg.Height <= 0 {
+		return Image{}, &Error{CodeCorrupt, "image has no pixels"}
+	}
+	if cfg.Width > limits.MaxWidth || cfg.Height > limits.MaxHeight {
+		return Image{}, &Error{CodeDimensions, fmt.Sprintf("image is %dx%d, larger than %dx%d", cfg.Width, cfg.Height, limits.MaxWidth, limits.MaxHeight)}
+	}
+	if cfg.Width*cfg.Height > limits.MaxPixels {
+		return Image{}, &Error{CodeDimensions, fmt.Sprintf("image has more than %d pixels", limits.MaxPixels)}
+	}
+
+	img, err := f.decode(bytes.NewReader(data))
+	if err != nil {
+		return Image{}, &Error{CodeCorrupt, "file is not a valid " + f.name + " image"}
+	}
+	if b := img.Bounds(); b.Dx() != cfg.Width || b.Dy() != cfg.Height {
+		return Image{}, &Error{CodeCorrupt, "file is not a valid " + f.name + " image"}
+	}
+
+	stripped, img, err := f.strip(data, img)
+	if err != nil {
+		return Image{}, &Error{CodeCorrupt, "file is not a valid " + f.name + " image"}
+	}
+
+	b := img.Bounds()
+	return Image{Data: stripped, Format: f.name, Width: b.Dx(), Height: b.Dy()}, nil
+}
@@ -0,0 +1,121 @@
+package uploads
+
+import (
+	"bytes"
+	"errors"
+	"image"
+	"image/color"
+	"image/jpeg"
+	"image/png"
+	"strings"
+	"testing"
+)
+
+func testImage(w, h int) *image.NRGBA {
+	img := image.NewNRGBA(image.Rect(0, 0, w, h))
+	for y := 0; y < h; y++ {
+		for x := 0; x < w; x++ {
+			img.SetNRGBA(x, y, color.NRGBA{uint8(x * 10), uint8(y * 10), 100, 255})
+		}
+	}
+	return img
+}
+
+func encodePNG(t *testing.T, img image.Image) []byte {
+	t.Helper()
+	var buf bytes.Buffer
+	if err := png.Encode(&buf, img); err != nil {
+		t.Fatal(err)
+	}
+	return buf.Bytes()
+}
+
+func encodeJPEG(t *testing.T, img image.Image) []byte {
+	t.Helper()
+	var buf bytes.Buffer
+	if err := jpeg.Encode(&buf, img, nil); err != nil {
+		t.Fatal(err)
+	}
+	return buf.Bytes()
+}
+
+func TestCheckAccepts(t *testing.T) {
+	tests := []struct {
+		name   string
+		data   []byte
+		format string
+	}{
+		{"png", encodePNG(t, testImage(6, 4)), PNG},
+		{"jpeg", encodeJPEG(t, testImage(6, 4)), JPEG},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			img, err := Check(tt.data, Limits{})
+			if err != nil {
+				t.Fatal(err)
+			}
+			if img.Format != tt.format || img.Width != 6 || img.Height != 4 {
+				t.Errorf("got %s %dx%d, want %s 6x4", img.Format, img.Width, img.Height, tt.format)
+			}
+			if len(img.Data) == 0 {
+				t.Error("no data kept")
+			}
+		})
+	}
+}
+
+func TestCheckRejects(t *testing.T) {
+	valid := encodePNG(t, testImage(6, 4))
+
+	tests := []struct {
+		name   string
+		data   []byte
+		limits Limits
+		code   string
+	}{
+		{"empty", nil, Limits{}, CodeEmpty},
+		{"too large", valid, Limits{MaxBytes: int64(len(valid) - 1)}, CodeTooLarge},
+		{"gif", []byte("GIF89a\x01\x00\x01\x00"), Limits{}, CodeUnsupportedType},
+		{"svg", []byte(`<svg xmlns="http://www.w3.org/2000/svg"/>`), Limits{}, CodeUnsupportedType},
+		{"png named jpeg", append([]byte("\xff\xd8\xff"), valid[3:]...), Limits{}, CodeCorrupt},
+		{"truncated", valid[:len(valid)/2], Limits{}, CodeCorrupt},
+		{"header only", valid[:33], Limits{}, CodeCorrupt},
+		{"too wide", valid, Limits{MaxWidth: 5}, CodeDimensions},
+		{"too tall", valid, Limits{MaxHeight: 3}, CodeDimensions},
+		{"too many pixels", valid, Limits{MaxPixels: 23}, CodeDimensions},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := Check(tt.data, tt.limits)
+			var e *Error
+			if !errors.As(err, &e) {
+				t.Fatalf("err = %v, want *Error", err)
+			}
+			if e.Code != tt.code {
+				t.Errorf("code = %q, want %q (%v)", e.Code, tt.code, err)
+			}
+		})
+	}
+}
+
+func TestReadStopsAtLimit(t *testing.T) {
+	// Far more than the limit; Read must not buffer all of it
+	r := strings.NewReader("\x89PNG\r\n\x1a\n" + strings.Repeat("x", 1<<20))
+	_, err := Read(r, Limits{MaxBytes: 100})
+	var e *Error
+	if !errors.As(err, &e) || e.Code != CodeTooLarge {
+		t.Fatalf("err = %v, want %s", err, CodeTooLarge)
+	}
+	if read := int64(1<<20+8) - int64(r.Len()); read > 101 {
+		t.Errorf("read %d bytes, want at most 101", read)
+	}
+}
+
+func TestLimitsDefaults(t *testing.T) {
+	if got := (Limits{}).Bytes(); got != DefaultLimits.MaxBytes {
+		t.Errorf("Bytes() = %d, want %d", got, DefaultLimits.MaxBytes)
+	}
+	if got := (Limits{MaxBytes: 5}).Bytes(); got != 5 {
+		t.Errorf("Bytes() = %d, want 5", got)
+	}
+}
@@ -4,6 +4,7 @@ import Sidebar from "./components/Sidebar";
 import { rectSortingStrategy } from "@dnd-kit/sortable";
 import { GripVertical, Download, Share2 } from "lucide-react";
 import Toast from "./components/Toast";
+import { authFetch } from "./api.ts";
 import {
     DndContext,
     closestCenter,
@@ -22,6 +23,7 @@ import {
 interface Drawing {
     id: number;
     url: string;
+    thumbnailUrl: string;
     editUrl?: string | null;
     uploadedAt: string;
     title?: string;
@@ -64,7 +66,8 @@ function SortableItem({ drawing, onClick }: SortableItemProps) {
             className="relative group cursor-grab active:cursor-grabbing"
         >
             <img 
-                src={drawing.url}
+                src={drawing.thumbnailUrl}
+                loading="lazy"
                 alt="Drawing"
                 className={"w-full h-auto rounded-2xl shadow-md cursor-pointer image-hover"}
                 onClick={() => onClick(drawing)}
@@ -101,21 +104,30 @@ function Gallery() {
     useEffect(() => {
         const fetchGallery = async () => {
             try {
-                const token = localStorage.getItem("token");
-                const res = await fetch("http://localhost:8080/gallery", {
-                    headers: { Authorization: `Bearer ${token}` },
-                });
+                // Reordering needs every drawing, so walk all the pages
+                const items: any[] = [];
+                let cursor = "";
+                do {
+                    const params = new URLSearchParams({ limit: "200" });
+                    if (cursor) params.set("after", cursor);
 
-                if (!res.ok) throw new Error("Failed to fetch gallery");
+                    const res = await authFetch(`/drawings?${params}`);
 
-                const data = await res.json();
-                setDrawings(Array.isArray(data) ? data.map((d: any) => ({
+                    if (!res.ok) throw new Error("Failed to fetch gallery");
+
+                    const data = await res.json();
+                    items.push(...(data.items ?? []));
+                    cursor = data.nextCursor ?? "";
+                } while (cursor);
+
+                setDrawings(items.map((d: any) => ({
                     id: d.id,
                     url: d.image_url || d.url,
+                    thumbnailUrl: d.renditions?.medium?.url || d.image_url || d.url,
                     editUrl: d.edit_url || d.editUrl || null,
                     uploadedAt: d.uploadedAt || d.uploaded_at,
                     title: d.title,
-                })) : []);
+                })));
             } catch (err) {
                 console.error(err);
             } finally {
@@ -128,14 +140,7 @@ function Gallery() {
 
     const handleDelete = async (id: number) => {
         try {
-            const token = localStorage.getItem("token");
-            const res = await fetch(`http://localhost:8080/gallery/delete?id=${id}`, {
-                method: "DELETE",
-                headers: {
-                    "Content-Type": "application/json",
-                    Authorization: `Bearer ${token}`,
-                },
-            });
+            const res = await authFetch(`/drawings/${id}`, { method: "DELETE" });
 
             if (!res.ok) throw new Error("Failed to delete drawing");
 
@@ -157,15 +162,11 @@ function Gallery() {
             const newIndex = items.findIndex((i) => i.id === Number(over.id));
             const newItems = arrayMove(items, oldIndex, newIndex);
 
-            const token = localStorage.getItem("token");
             const newOrder = newItems.map((item) => item.id);
 
-            fetch("http://localhost:8080/gallery/reorder", {
-                method: "PATCH",
-                headers: {
-                    "Content-Type": "application/json",
-                    Authorization: `Bearer ${token}`,
-                },
+            authFetch("/drawings/order", {
+                method: "PUT",
+                headers: { "Content-Type": "application/json" },
                 body: JSON.stringify({ order: newOrder }),
             }).catch((err) => console.error("Failed to update order:", err));
 
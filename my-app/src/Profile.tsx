@@ -1,6 +1,6 @@
 import { useEffect, useState } from "react";
 import { useNavigate } from "react-router-dom";
-import { API_URL ,getProfile, updateProfile, type UserProfile } from "./api.ts";
+import { authFetch, getProfile, logout, updateProfile, type UserProfile } from "./api.ts";
 
 function Profile() {
     const [profile, setProfile] = useState<UserProfile | null>(null);
@@ -34,8 +34,8 @@ function Profile() {
     }, [navigate]);
 
     // Handle Logout
-    const handleLogout = () => {
-        localStorage.removeItem("token");
+    const handleLogout = async () => {
+        await logout();
         localStorage.removeItem("userProfile");
         navigate("/login");
     };
@@ -81,14 +81,8 @@ function Profile() {
         // formData.append("avatar", file);
 
         try {
-            const token = localStorage.getItem("token");
-            if (!token) throw new Error("No token");
-
-            const res = await fetch(`${API_URL}/profile/avatar`, {
+            const res = await authFetch("/profile/avatar", {
                 method: "POST",
-                headers: {
-                    Authorization: `Bearer ${token}`,
-                },
                 body: (() => {
                     const formData = new FormData();
                     formData.append("avatar", file);
@@ -3,6 +3,7 @@ import { useState, useEffect, useRef } from "react";
 import Sidebar from "./components/Sidebar";
 import DrawingBoard from "./components/DrawingBoard/DrawingBoard";
 import Toast from "./components/Toast";
+import { authFetch } from "./api.ts";
 
 function Studio() {
     const [sidebarOpen, setSidebarOpen] = useState(false);
@@ -53,7 +54,7 @@ function Studio() {
             const formData = new FormData();
             formData.append("file", blob, "image.png");
 
-            const response = await fetch("http://localhost:8000/convert", {
+            const response = await authFetch("/convert", {
                 method: "POST",
                 body: formData,
             });
@@ -150,19 +151,14 @@ function Studio() {
                 }, "image/png");
             });
 
-            const token = localStorage.getItem("token");
-
             if (editingId) {
                 const formData = new FormData();
                 formData.append("editImage", editBlob,"edit.png");
                 formData.append("galleryImage", galleryBlob, "gallery.png");
 
-                const res = await fetch(`http://localhost:8080/gallery/update?id=${editingId}`, {
+                const res = await authFetch(`/drawings/${editingId}`, {
                     method: "PUT",
                     body: formData,
-                    headers: {
-                        Authorization: `Bearer ${token}`,
-                    },
                 });
 
                 if (!res.ok) throw new Error("Failed to update drawing");
@@ -179,10 +175,9 @@ function Studio() {
             formData.append("galleryImage", galleryBlob, "gallery.png");
             formData.append("editImage", editBlob, "edit.png");
 
-            const res = await fetch("http://localhost:8080/gallery/upload", {
+            const res = await authFetch("/drawings", {
                 method: "POST",
                 body: formData,
-                headers: { Authorization: `Bearer ${token}` },
             });
 
             if (!res.ok) throw new Error("Failed to save drawing");
@@ -2,6 +2,26 @@ export const API_URL = "http://localhost:8080"; //change based on where backend
 
 export interface AuthResponse {
     token: string;
+    refreshToken: string;
+    expiresIn: number;
+}
+
+export interface ApiError {
+    code: string;
+    message: string;
+    details?: Record<string, unknown>;
+    requestId?: string;
+}
+
+// Reads the server's {"error": {...}} body, falling back when it has none
+export async function readError(res: Response, fallback: string): Promise<ApiError> {
+    try {
+        const body = await res.json();
+        if (body?.error?.message) return body.error;
+    } catch {
+        // Not JSON, e.g. a proxy error page
+    }
+    return { code: "unknown", message: fallback };
 }
 
 export interface UserProfile {
@@ -21,8 +41,8 @@ export async function signup(email: string, password: string): Promise<void> {
     });
 
     if (!res.ok) {
-        const text = await res.text();
-        throw { status: res.status, message: text };
+        const error = await readError(res, "Signup failed");
+        throw { status: res.status, code: error.code, message: error.message };
     }
 }
 
@@ -40,19 +60,102 @@ export async function login(email: string, password: string): Promise<AuthRespon
 
     const data: AuthResponse = await res.json();
     localStorage.setItem("token", data.token);
+    localStorage.setItem("refreshToken", data.refreshToken);
     return data;
 }
 
-// Get Profile Function
-export async function getProfile(): Promise<UserProfile> {
-    const token = localStorage.getItem("token");
-    console.log(token);
-    if (!token) throw new Error("No token");
+// Refresh Session Function
+export async function refreshSession(): Promise<AuthResponse> {
+    const refreshToken = localStorage.getItem("refreshToken");
+    if (!refreshToken) throw new Error("No refresh token");
 
-    const res = await fetch(`${API_URL}/profile`, {
-        headers: { Authorization: `Bearer ${token}` },
+    const res = await fetch(`${API_URL}/auth/refresh`, {
+        method: "POST",
+        headers: { "Content-Type": "application/json" },
+        body: JSON.stringify({ refreshToken }),
     });
 
+    if (!res.ok) {
+        localStorage.removeItem("token");
+        localStorage.removeItem("refreshToken");
+        throw new Error("Session expired");
+    }
+
+    const data: AuthResponse = await res.json();
+    localStorage.setItem("token", data.token);
+    localStorage.setItem("refreshToken", data.refreshToken);
+    return data;
+}
+
+// Refreshes running at the same time share one request, since the old
+// refresh token stops working as soon as it is used
+let refreshing: Promise<AuthResponse> | null = null;
+
+function refreshOnce(): Promise<AuthResponse> {
+    if (!refreshing) {
+        refreshing = refreshSession().finally(() => {
+            refreshing = null;
+        });
+    }
+    return refreshing;
+}
+
+// Sends the session to the login page once it can't be refreshed
+function endSession() {
+    localStorage.removeItem("token");
+    localStorage.removeItem("refreshToken");
+    localStorage.removeItem("userProfile");
+    if (window.location.pathname !== "/login") {
+        window.location.assign("/login");
+    }
+}
+
+// Authenticated fetch: adds the access token, and on a 401 refreshes the
+// session and retries once. If the refresh fails the user is logged out.
+export async function authFetch(path: string, init: RequestInit = {}): Promise<Response> {
+    const send = () => {
+        const headers = new Headers(init.headers);
+        const token = localStorage.getItem("token");
+        if (token) headers.set("Authorization", `Bearer ${token}`);
+        return fetch(`${API_URL}${path}`, { ...init, headers });
+    };
+
+    const res = await send();
+    if (res.status !== 401) return res;
+
+    try {
+        await refreshOnce();
+    } catch {
+        endSession();
+        throw new Error("Session expired");
+    }
+    return send();
+}
+
+// Logout Function
+export async function logout(allDevices = false): Promise<void> {
+    const token = localStorage.getItem("token");
+    const refreshToken = localStorage.getItem("refreshToken");
+
+    if (token) {
+        await fetch(`${API_URL}/auth/${allDevices ? "logout-all" : "logout"}`, {
+            method: "POST",
+            headers: {
+                "Authorization": `Bearer ${token}`,
+                "Content-Type": "application/json",
+            },
+            body: JSON.stringify({ refreshToken }),
+        }).catch(() => undefined);
+    }
+
+    localStorage.removeItem("token");
+    localStorage.removeItem("refreshToken");
+}
+
+// Get Profile Function
+export async function getProfile(): Promise<UserProfile> {
+    const res = await authFetch("/profile");
+
     if (!res.ok) {
         throw new Error("Unauthorized");
     }
@@ -62,38 +165,31 @@ export async function getProfile(): Promise<UserProfile> {
 
 // Update Profile Function
 export async function updateProfile(data: { bio: string }) {
-    const token = localStorage.getItem("token");
-    if (!token) throw new Error("No token");
-
-    const res = await fetch(`${API_URL}/profile`, {
+    const res = await authFetch("/profile", {
         method: "PATCH",
-        headers: {
-            "Authorization": `Bearer ${token}`,
-            "Content-Type": "application/json",
-        },
+        headers: { "Content-Type": "application/json" },
         body: JSON.stringify(data),
     });
 
     if (!res.ok) {
-        const text = await res.text();
-        throw new Error(text || "Failed to update profile");
+        const error = await readError(res, "Failed to update profile");
+        throw new Error(error.message);
     }
 }
 
 // Upload Avatar Function
 export async function uploadAvatar(file: File) {
-    const token = localStorage.getItem("token");
     const formData = new FormData();
     formData.append("avatar", file);
 
-    const res = await fetch(`${API_URL}/profile/avatar`, {
+    const res = await authFetch("/profile/avatar", {
         method: "POST",
-        headers: { "Authorization": `Bearer ${token}` },
         body: formData,
     });
 
     if (!res.ok) {
-        throw new Error("Failed to upload avatar");
+        const error = await readError(res, "Failed to upload avatar");
+        throw new Error(error.message);
     }
 
     return res.json();